@@ -0,0 +1,272 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"gallerio/configs"
+	"gallerio/migrations"
+	"gallerio/models"
+	"gallerio/utils/email"
+	"gallerio/utils/jobs"
+	"gallerio/utils/metrics"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// App is the whole site: the services, the background jobs and the
+// handler serving the routes
+type App struct {
+	cfg      configs.Config
+	services *models.Services
+	runner   *jobs.Runner
+	handler  http.Handler
+	// draining is set to 1 once shutting down starts
+	draining int32
+}
+
+// New connects to the database, applies pending migrations and starts the
+// background jobs
+func New(cfg configs.Config) (*App, error) {
+	policy, err := passwordPolicy(cfg.PasswordPolicy)
+	if err != nil {
+		return nil, err
+	}
+	dbCfg := cfg.Database
+	keys := models.Keys{
+		Peppers:    cfg.Peppers(),
+		HMACKeys:   cfg.HMACKeys(),
+		BcryptCost: cfg.BcryptCost,
+	}
+	services, err := models.NewServices(
+		models.WithGorm(dbCfg.Dialect(), dbCfg.ConnectionInfo()),
+		models.WithLogMode(false),
+		models.WithUser(keys, policy),
+		models.WithGallery(),
+		models.WithImage(),
+		models.WithWebhook(),
+		models.WithOAuth(),
+		models.WithRateLimitStore(cfg.RateLimit.Store),
+		models.WithAuditLog(),
+		models.WithAccountDeletion(cfg.DeletionGracePeriod()),
+		models.WithDataExport(keys),
+		models.WithInvitation(keys),
+		models.WithRegistration(cfg.Registration.Mode, cfg.Registration.AllowedDomains,
+			cfg.Registration.AdminInvitesOnly),
+		models.WithAPIToken(keys),
+		models.WithMetrics(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	applied, err := migrations.New(services.DB()).Up()
+	if err != nil {
+		services.Close()
+		return nil, err
+	}
+	for _, m := range applied {
+		slog.Info("applied migration", "migration", m.String())
+	}
+	
+	runner := jobs.NewRunner()
+	scheduleJobs(cfg, services, runner)
+	
+	mgCfg := cfg.Mailgun
+	emailer := email.NewClient(
+		email.WithSender("Gallerio Support",
+			"support@sandboxfa300beae3034442af3cdd253f03c0c1.mailgun.org"),
+		email.WithMailgun(mgCfg.Domain, mgCfg.PublicAPIKey),
+	)
+	a := &App{
+		cfg:      cfg,
+		services: services,
+		runner:   runner,
+	}
+	a.handler = NewRouter(cfg, services, emailer, runner, a.Draining)
+	return a, nil
+}
+
+func (a *App) Handler() http.Handler {
+	return a.handler
+}
+
+func (a *App) Services() *models.Services {
+	return a.services
+}
+
+// Draining reports whether the app is shutting down
+func (a *App) Draining() bool {
+	return atomic.LoadInt32(&a.draining) == 1
+}
+
+// AdminHandler serves the metrics on the admin port. It's nil when no
+// admin port is configured.
+func (a *App) AdminHandler() http.Handler {
+	if !a.cfg.Metrics.Enabled || a.cfg.Metrics.Port == 0 {
+		return nil
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	return mux
+}
+
+// Run serves on the configured port, and the admin port if there is one,
+// until the process receives SIGINT or SIGTERM
+func (a *App) Run() error {
+	l, err := net.Listen("tcp", fmt.Sprintf(":%v", a.cfg.Port))
+	if err != nil {
+		a.Shutdown(context.Background())
+		return err
+	}
+	var admin net.Listener
+	if a.AdminHandler() != nil {
+		admin, err = net.Listen("tcp", fmt.Sprintf(":%v", a.cfg.Metrics.Port))
+		if err != nil {
+			l.Close()
+			a.Shutdown(context.Background())
+			return err
+		}
+		slog.Info("serving metrics on the admin port", "port", a.cfg.Metrics.Port)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	
+	slog.Info("starting server", "port", a.cfg.Port)
+	return a.ServeWithAdmin(ctx, l, admin)
+}
+
+// Serve handles connections on l until ctx is done. It then stops
+// accepting connections, waits for in-flight requests and background jobs
+// to finish and closes the services. Waiting is cut short after the
+// configured shutdown timeout.
+func (a *App) Serve(ctx context.Context, l net.Listener) error {
+	return a.ServeWithAdmin(ctx, l, nil)
+}
+
+// ServeWithAdmin is Serve which also serves AdminHandler on admin, unless
+// admin is nil
+func (a *App) ServeWithAdmin(ctx context.Context, l, admin net.Listener) error {
+	serverCfg := a.cfg.Server
+	servers := []*http.Server{a.newServer(a.handler)}
+	listeners := []net.Listener{l}
+	if admin != nil {
+		servers = append(servers, a.newServer(a.AdminHandler()))
+		listeners = append(listeners, admin)
+	}
+	errs := make(chan error, len(servers))
+	for i := range servers {
+		server, l := servers[i], listeners[i]
+		go func() {
+			errs <- server.Serve(l)
+		}()
+	}
+	
+	var err error
+	select {
+	case err = <-errs:
+	case <-ctx.Done():
+		atomic.StoreInt32(&a.draining, 1)
+		// Keep serving while /readyz fails, so load balancers stop sending
+		// requests before the listeners close
+		if delay := serverCfg.DrainDelayDuration(); delay > 0 {
+			slog.Info("draining before shutting down", "delay", delay)
+			time.Sleep(delay)
+		}
+		slog.Info("shutting down, waiting for requests and jobs to finish")
+	}
+	
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), serverCfg.ShutdownTimeoutDuration())
+	defer cancel()
+	for _, server := range servers {
+		if shutdownErr := server.Shutdown(shutdownCtx); err == nil {
+			err = shutdownErr
+		}
+	}
+	if shutdownErr := a.Shutdown(shutdownCtx); err == nil {
+		err = shutdownErr
+	}
+	return err
+}
+
+// Shutdown stops the background jobs, waiting for them until ctx is done,
+// and closes the services
+func (a *App) Shutdown(ctx context.Context) error {
+	err := a.runner.Stop(ctx)
+	if closeErr := a.services.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (a *App) newServer(handler http.Handler) *http.Server {
+	serverCfg := a.cfg.Server
+	return &http.Server{
+		Handler:      handler,
+		ReadTimeout:  serverCfg.ReadTimeoutDuration(),
+		WriteTimeout: serverCfg.WriteTimeoutDuration(),
+		IdleTimeout:  serverCfg.IdleTimeoutDuration(),
+	}
+}
+
+func passwordPolicy(cfg configs.PasswordPolicyConfig) (models.PasswordPolicy, error) {
+	def := configs.DefaultPasswordPolicyConfig()
+	if cfg.MinLength <= 0 {
+		cfg.MinLength = def.MinLength
+	}
+	if cfg.MaxLength <= 0 {
+		cfg.MaxLength = def.MaxLength
+	}
+	rules := []models.PasswordRule{
+		models.MinLength(cfg.MinLength),
+		models.MaxLength(cfg.MaxLength),
+		models.NoPersonalInfo(),
+	}
+	if cfg.MinEntropy > 0 {
+		rules = append(rules, models.MinStrength(cfg.MinEntropy))
+	}
+	if cfg.BreachedList != "" {
+		list, err := models.LoadBreachedList(cfg.BreachedList)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, models.NotBreached(list))
+	}
+	return models.NewPasswordPolicy(rules...), nil
+}
+
+func scheduleJobs(cfg configs.Config, services *models.Services, runner *jobs.Runner) {
+	runner.Every(time.Hour, func(ctx context.Context) {
+		n, err := services.AccountDeletion.PurgeDue()
+		if err != nil {
+			slog.ErrorContext(ctx, "purging deleted accounts failed", "err", err)
+		}
+		if n > 0 {
+			slog.InfoContext(ctx, "deleted accounts after their grace period", "count", n)
+		}
+	})
+	runner.Every(time.Hour, func(ctx context.Context) {
+		if _, err := services.DataExport.Prune(); err != nil {
+			slog.ErrorContext(ctx, "pruning data exports failed", "err", err)
+		}
+	})
+	runner.Every(15*time.Second, func(ctx context.Context) {
+		if _, err := services.Webhook.DeliverDue(ctx); err != nil {
+			slog.ErrorContext(ctx, "delivering webhooks failed", "err", err)
+		}
+	})
+	runner.Every(time.Hour, func(ctx context.Context) {
+		if _, err := services.Webhook.Prune(); err != nil {
+			slog.ErrorContext(ctx, "pruning webhook deliveries failed", "err", err)
+		}
+	})
+	runner.Every(time.Hour, func(ctx context.Context) {
+		if _, err := services.AuditLog.Prune(cfg.AuditRetention()); err != nil {
+			slog.ErrorContext(ctx, "pruning the audit log failed", "err", err)
+		}
+	})
+}
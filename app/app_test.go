@@ -0,0 +1,169 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"gallerio/configs"
+	"net"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestApp applies the changes to the default config, which uses an
+// in-memory database
+func newTestApp(t *testing.T, changes ...func(cfg *configs.Config)) *App {
+	t.Helper()
+	// Templates are loaded relative to the root of the repository
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(".."); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	
+	cfg := configs.DefaultConfig()
+	cfg.Database = configs.DatabaseConfig{DBType: "sqlite", DBName: ":memory:"}
+	cfg.BcryptCost = 4
+	for _, change := range changes {
+		change(&cfg)
+	}
+	a, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestServeDrainsJobsOnShutdown(t *testing.T) {
+	a := newTestApp(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- a.Serve(ctx, l)
+	}()
+	
+	resp, err := http.Get("http://" + l.Addr().String() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", resp.StatusCode)
+	}
+	
+	var finished int32
+	a.runner.Go(func(ctx context.Context) {
+		time.Sleep(100 * time.Millisecond)
+		atomic.StoreInt32(&finished, 1)
+	})
+	cancel()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected Serve to return after the context was cancelled")
+	}
+	if atomic.LoadInt32(&finished) != 1 {
+		t.Fatal("expected Serve to wait for running jobs")
+	}
+	if err := a.Services().DB().DB().Ping(); err == nil {
+		t.Fatal("expected the database to be closed")
+	}
+	if _, err := http.Get("http://" + l.Addr().String() + "/"); err == nil {
+		t.Fatal("expected the server to stop accepting connections")
+	}
+}
+
+func TestServeMetricsOnAdminPort(t *testing.T) {
+	a := newTestApp(t, func(cfg *configs.Config) {
+		// Only has to be set, the test passes its own listener
+		cfg.Metrics.Port = 9100
+	})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- a.ServeWithAdmin(ctx, l, admin)
+	}()
+	defer func() {
+		cancel()
+		<-served
+	}()
+	
+	resp, err := http.Get("http://" + admin.Addr().String() + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the admin port to serve the metrics, got status %d", resp.StatusCode)
+	}
+	resp, err = http.Get("http://" + l.Addr().String() + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected the site not to serve the metrics, got status %d", resp.StatusCode)
+	}
+}
+
+func TestReadyzFailsWhileDraining(t *testing.T) {
+	a := newTestApp(t, func(cfg *configs.Config) {
+		cfg.Server.DrainDelay = 1
+	})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- a.Serve(ctx, l)
+	}()
+	
+	shutdownCheck := func() string {
+		t.Helper()
+		resp, err := http.Get("http://" + l.Addr().String() + "/readyz")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var ready struct {
+			Checks map[string]string
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&ready); err != nil {
+			t.Fatal(err)
+		}
+		return ready.Checks["shutdown"]
+	}
+	if check := shutdownCheck(); check != "" {
+		t.Fatalf("expected no shutdown in progress, got %q", check)
+	}
+	cancel()
+	time.Sleep(100 * time.Millisecond)
+	if check := shutdownCheck(); check != "draining" {
+		t.Fatalf("expected readiness to fail while draining, got %q", check)
+	}
+	if err := <-served; err != nil {
+		t.Fatal(err)
+	}
+}
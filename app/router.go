@@ -0,0 +1,269 @@
+// Package app wires the services, controllers and middlewares into the
+// handler serving the site
+package app
+
+import (
+	"gallerio/configs"
+	"gallerio/controllers"
+	"gallerio/middlewares"
+	"gallerio/models"
+	"gallerio/utils/email"
+	"gallerio/utils/errors"
+	"gallerio/utils/ip"
+	"gallerio/utils/jobs"
+	"gallerio/utils/metrics"
+	"gallerio/utils/rand"
+	"gallerio/utils/ratelimit"
+	"github.com/gorilla/csrf"
+	"github.com/gorilla/mux"
+	"golang.org/x/oauth2"
+	"log/slog"
+	"net/http"
+)
+
+func getDropboxConfig(id, secret, autUrl, tokenUrl string) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID: id,
+		ClientSecret: secret,
+		Endpoint: oauth2.Endpoint{
+			AuthURL: autUrl,
+			TokenURL: tokenUrl,
+		},
+		RedirectURL: "http://localhost:8000/oauth/dropbox/callback",
+		Scopes: []string{"files.metadata.read"},
+	}
+}
+
+// NewRouter builds every route of the site along with the middlewares
+// wrapping all of them. Jobs started by requests, e.g. data exports, run
+// on runner. Draining makes /readyz fail once it returns true, it can be
+// nil.
+func NewRouter(cfg configs.Config, services *models.Services, emailer email.Client, runner *jobs.Runner,
+	draining func() bool) http.Handler {
+	ip.TrustProxy = cfg.TrustProxy
+	cookies := cfg.CookiePolicy()
+	limiter := ratelimit.NewLimiter(services.RateLimit, cfg.RateLimit.Policy())
+
+	router := mux.NewRouter()
+	usersController := controllers.NewUsersController(services.User, services.AccountDeletion,
+		services.Registration, services.AuditLog, emailer, limiter, runner, cookies)
+	galleriesController := controllers.NewGalleriesController(services.Gallery, services.Image,
+		services.Webhook, services.RateLimit, router)
+	invitationsController := controllers.NewInvitationsController(services.Invitation,
+		services.Registration, emailer, cfg.Registration.InviteTTL())
+	apiController := controllers.NewAPIController(services.Gallery, services.Image,
+		cfg.Server.MaxUploadBytes())
+	apiTokensController := controllers.NewAPITokensController(services.APIToken, services.AuditLog)
+	webhooksController := controllers.NewWebhooksController(services.Webhook, services.AuditLog)
+	dataExportsController := controllers.NewDataExportsController(services.DataExport, emailer, runner)
+	adminController := controllers.NewAdminController(services.User, services.Gallery,
+		services.Image, services.AuditLog, emailer)
+	coreController := controllers.NewStaticController()
+	healthController := controllers.NewHealthController(services, emailer, draining)
+	oauthConfigs := make(map[string]*oauth2.Config)
+	oauthConfigs[models.OAuthDropbox] = getDropboxConfig(
+		cfg.Dropbox.ID,
+		cfg.Dropbox.Secret,
+		cfg.Dropbox.AuthURL,
+		cfg.Dropbox.TokenURL,
+	)
+	oauthController := controllers.NewOAuthsController(services.OAuth, services.AuditLog, oauthConfigs, cookies)
+	
+	csrfKey, err := cfg.CSRFKeyBytes()
+	errors.Must(err)
+	if csrfKey == nil {
+		// Only allowed outside production, forms break on every restart
+		slog.Warn("no csrf_key configured, using a random one")
+		csrfKey, err = rand.Bytes(32)
+		errors.Must(err)
+	}
+	csrfMw := csrf.Protect(csrfKey, cookies.CSRFOptions()...)
+	assignUserMw := middlewares.AssignUser{
+		UserService: services.User,
+	}
+	loginRequiredMw := middlewares.LoginRequired{
+		UserService: services.User,
+	}
+	alreadyLoggedInMw := middlewares.AlreadyLoggedIn{
+		UserService: services.User,
+	}
+	moderatorMw := middlewares.RequireRole{Role: models.RoleModerator}
+	adminMw := middlewares.RequireRole{Role: models.RoleAdmin}
+	bearerTokenMw := middlewares.BearerToken{
+		APITokenService: services.APIToken,
+	}
+	requestIDMw := middlewares.RequestID{}
+	accessLogMw := middlewares.AccessLog{}
+	metricsMw := middlewares.Metrics{}
+	securityMw := middlewares.SecurityHeaders{
+		Policy: cfg.SecurityPolicy(),
+	}
+	cookiesMw := middlewares.CookiePolicy{
+		Policy: cookies,
+	}
+	router.Use(metricsMw.Middleware)
+	galleriesReadMw := middlewares.RequireScope{
+		UserService: services.User,
+		Scope:       models.ScopeGalleriesRead,
+	}
+	galleriesWriteMw := middlewares.RequireScope{
+		UserService: services.User,
+		Scope:       models.ScopeGalleriesWrite,
+	}
+	imagesWriteMw := middlewares.RequireScope{
+		UserService: services.User,
+		Scope:       models.ScopeImagesWrite,
+	}
+
+	// Health Routes
+	router.HandleFunc("/healthz", healthController.Healthz).Methods("GET")
+	router.HandleFunc("/readyz", healthController.Readyz).Methods("GET")
+	router.HandleFunc("/version", healthController.Version).Methods("GET")
+	
+	// Static Routes
+	router.Handle("/", coreController.HomeView).Methods("GET")
+	router.Handle("/contact", coreController.ContactView).Methods("GET")
+
+	// Accounts Routes
+	router.Handle("/signin",
+		alreadyLoggedInMw.Apply(usersController.SignInView)).Methods("GET")
+	router.HandleFunc("/signin",
+		alreadyLoggedInMw.ApplyFunc(usersController.SignIn)).Methods("POST")
+	router.HandleFunc("/signup",
+		alreadyLoggedInMw.ApplyFunc(usersController.New)).Methods("GET")
+	router.HandleFunc("/signup",
+		alreadyLoggedInMw.ApplyFunc(usersController.SignUp)).Methods("POST")
+	router.HandleFunc("/signout",
+		loginRequiredMw.ApplyFunc(usersController.SignOut)).Methods("POST")
+	router.HandleFunc("/forgot",
+		alreadyLoggedInMw.Apply(usersController.ForgotPwView)).Methods("GET")
+	router.HandleFunc("/forgot",
+		alreadyLoggedInMw.ApplyFunc(usersController.InitiateReset)).Methods("POST")
+	router.HandleFunc("/reset",
+		alreadyLoggedInMw.ApplyFunc(usersController.ResetPassword)).Methods("GET")
+	router.HandleFunc("/reset",
+		alreadyLoggedInMw.ApplyFunc(usersController.CompleteReset)).Methods("POST")
+	router.HandleFunc("/account",
+		loginRequiredMw.ApplyFunc(usersController.Account)).Methods("GET")
+	router.HandleFunc("/account/profile",
+		loginRequiredMw.ApplyFunc(usersController.UpdateProfile)).Methods("POST")
+	router.HandleFunc("/account/password",
+		loginRequiredMw.ApplyFunc(usersController.ChangePassword)).Methods("POST")
+	router.HandleFunc("/account/email",
+		loginRequiredMw.ApplyFunc(usersController.ChangeEmail)).Methods("POST")
+	router.HandleFunc("/account/activity",
+		loginRequiredMw.ApplyFunc(usersController.Activity)).Methods("GET")
+	router.HandleFunc("/account/sessions/revoke",
+		loginRequiredMw.ApplyFunc(usersController.RevokeSessions)).Methods("POST")
+	router.HandleFunc("/account/delete",
+		loginRequiredMw.ApplyFunc(usersController.DeleteAccount)).Methods("POST")
+	router.HandleFunc("/account/tokens",
+		loginRequiredMw.ApplyFunc(apiTokensController.Index)).Methods("GET")
+	router.HandleFunc("/account/tokens",
+		loginRequiredMw.ApplyFunc(apiTokensController.Create)).Methods("POST")
+	router.HandleFunc("/account/tokens/{id:[0-9]+}/delete",
+		loginRequiredMw.ApplyFunc(apiTokensController.Delete)).Methods("POST")
+	router.HandleFunc("/account/webhooks",
+		loginRequiredMw.ApplyFunc(webhooksController.Index)).Methods("GET")
+	router.HandleFunc("/account/webhooks",
+		loginRequiredMw.ApplyFunc(webhooksController.Create)).Methods("POST")
+	router.HandleFunc("/account/webhooks/{id:[0-9]+}",
+		loginRequiredMw.ApplyFunc(webhooksController.Show)).Methods("GET")
+	router.HandleFunc("/account/webhooks/{id:[0-9]+}/delete",
+		loginRequiredMw.ApplyFunc(webhooksController.Delete)).Methods("POST")
+	router.HandleFunc("/account/export",
+		loginRequiredMw.ApplyFunc(dataExportsController.Create)).Methods("POST")
+	router.HandleFunc("/account/export/download",
+		loginRequiredMw.ApplyFunc(dataExportsController.Download)).Methods("GET")
+	router.HandleFunc("/account/email/confirm",
+		usersController.ConfirmEmail).Methods("GET")
+
+	// Invitations Routes
+	router.HandleFunc("/invitations",
+		loginRequiredMw.ApplyFunc(invitationsController.Index)).Methods("GET")
+	router.HandleFunc("/invitations",
+		loginRequiredMw.ApplyFunc(invitationsController.Create)).Methods("POST")
+	router.HandleFunc("/invitations/{id:[0-9]+}/delete",
+		loginRequiredMw.ApplyFunc(invitationsController.Delete)).Methods("POST")
+
+	// Galleries Routes
+	router.Handle("/galleries/new",
+		loginRequiredMw.Apply(galleriesController.New)).Methods("GET")
+	router.HandleFunc("/galleries",
+		galleriesReadMw.ApplyFunc(galleriesController.Index)).Methods("GET")
+	router.HandleFunc("/galleries",
+		galleriesWriteMw.ApplyFunc(galleriesController.Create)).Methods("POST")
+	router.HandleFunc("/galleries/{id:[0-9]+}",
+		galleriesController.Show).Methods("GET").Name(controllers.ShowGalleryName)
+	router.HandleFunc("/galleries/{id:[0-9]+}/edit",
+		loginRequiredMw.ApplyFunc(galleriesController.Edit)).
+		Methods("GET").Name(controllers.EditGalleryName)
+	router.HandleFunc("/galleries/{id:[0-9]+}/update",
+		galleriesWriteMw.ApplyFunc(galleriesController.Update)).Methods("POST")
+	router.HandleFunc("/galleries/{id:[0-9]+}/delete",
+		galleriesWriteMw.ApplyFunc(galleriesController.Delete)).Methods("POST")
+	router.HandleFunc("/galleries/{id:[0-9]+}/images",
+		imagesWriteMw.ApplyFunc(galleriesController.UploadImage)).Methods("POST")
+	router.HandleFunc("/galleries/{id:[0-9]+}/images/{filename}/delete",
+		imagesWriteMw.ApplyFunc(galleriesController.DeleteImage)).Methods("POST")
+	
+	// Admin Routes
+	router.Handle("/admin", moderatorMw.Apply(
+		http.RedirectHandler("/admin/users", http.StatusSeeOther))).Methods("GET")
+	router.HandleFunc("/admin/users",
+		moderatorMw.ApplyFunc(adminController.Users)).Methods("GET")
+	router.HandleFunc("/admin/users/{id:[0-9]+}/suspend",
+		moderatorMw.ApplyFunc(adminController.Suspend)).Methods("POST")
+	router.HandleFunc("/admin/users/{id:[0-9]+}/unsuspend",
+		moderatorMw.ApplyFunc(adminController.Unsuspend)).Methods("POST")
+	router.HandleFunc("/admin/users/{id:[0-9]+}/reset",
+		adminMw.ApplyFunc(adminController.ForceReset)).Methods("POST")
+	router.HandleFunc("/admin/users/{id:[0-9]+}/role",
+		adminMw.ApplyFunc(adminController.ChangeRole)).Methods("POST")
+	router.HandleFunc("/admin/audit",
+		adminMw.ApplyFunc(adminController.Audit)).Methods("GET")
+	router.HandleFunc("/admin/galleries",
+		moderatorMw.ApplyFunc(adminController.Galleries)).Methods("GET")
+	router.HandleFunc("/admin/galleries/{id:[0-9]+}/delete",
+		moderatorMw.ApplyFunc(adminController.DeleteGallery)).Methods("POST")
+
+	// OAuth Controller
+	router.HandleFunc("/oauth/{provider:[a-z]+}/connect",
+		loginRequiredMw.ApplyFunc(oauthController.Connect)).Methods("GET")
+	router.HandleFunc("/oauth/{provider:[a-z]+}/callback",
+		loginRequiredMw.ApplyFunc(oauthController.Callback)).Methods("GET")
+	router.HandleFunc("/oauth/{provider:[a-z]+}/disconnect",
+		loginRequiredMw.ApplyFunc(oauthController.Disconnect)).Methods("POST")
+	router.HandleFunc("/oauth/{provider:[a-z]+}/test",
+		loginRequiredMw.ApplyFunc(oauthController.DropboxTest)).Methods("GET")
+	
+	// API Routes
+	router.HandleFunc("/api/openapi.json", apiController.Spec).Methods("GET")
+	apiRouter := router.PathPrefix(controllers.APIPrefix).Subrouter()
+	for _, route := range apiController.Routes() {
+		scopeMw := middlewares.RequireScope{
+			UserService: services.User,
+			Scope:       route.Scope,
+		}
+		apiRouter.HandleFunc(route.Path, scopeMw.ApplyFunc(route.Handler)).
+			Methods(route.Method).Name(route.Name)
+	}
+	apiRouter.NotFoundHandler = http.HandlerFunc(apiController.NotFound)
+	
+	// Media Routes
+	mediaHandler := http.FileServer(http.Dir("./media/"))
+	router.PathPrefix("/media/").Handler(http.StripPrefix("/media/", mediaHandler))
+	
+	// Static Routes
+	staticHandler := http.FileServer(http.Dir("./static/"))
+	router.PathPrefix("/static/").Handler(http.StripPrefix("/static/", staticHandler))
+	
+	// Metrics, unless they're served on the admin port. The site's port is
+	// public, so only admins may read them there.
+	if cfg.Metrics.Enabled && cfg.Metrics.Port == 0 {
+		router.Handle("/metrics", adminMw.Apply(metrics.Handler())).Methods("GET")
+	}
+	
+	return requestIDMw.Apply(accessLogMw.Apply(securityMw.Apply(cookiesMw.Apply(
+		bearerTokenMw.Apply(csrfMw(assignUserMw.Apply(router)))))))
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"gallerio/configs"
+	"os"
+)
+
+const configUsage = `usage: gallerio config <command>
+
+Commands:
+  print  show the effective config with secrets redacted`
+
+// runConfig implements "gallerio config"
+func runConfig(cfg configs.Config, args []string) error {
+	if len(args) == 0 || args[0] != "print" {
+		return fmt.Errorf(configUsage)
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(cfg.Redacted())
+}
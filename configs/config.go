@@ -1,13 +1,24 @@
 package configs
 
 import (
-	"encoding/json"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"os"
+	"gallerio/utils/cookie"
+	"gallerio/utils/ratelimit"
+	"gallerio/utils/security"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"strings"
+	"time"
 )
 
 // Database Configs
-type PostgresConfig struct {
+//
+// Type is "postgres" (the default), "mysql" or "sqlite3". SQLite only uses
+// Name, which is the path of the database file or ":memory:".
+type DatabaseConfig struct {
+	DBType     string `json:"type"`
 	DBHost     string `json:"host"`
 	DBPort     int    `json:"port"`
 	DBUser     string `json:"user"`
@@ -15,11 +26,31 @@ type PostgresConfig struct {
 	DBName     string `json:"name"`
 }
 
-func (c PostgresConfig) Dialect() string {
-	return "postgres"
+func (c DatabaseConfig) Dialect() string {
+	switch c.DBType {
+	case "", "postgresql":
+		return "postgres"
+	case "sqlite":
+		return "sqlite3"
+	default:
+		return c.DBType
+	}
 }
 
-func (c PostgresConfig) ConnectionInfo() string {
+func (c DatabaseConfig) ConnectionInfo() string {
+	switch c.Dialect() {
+	case "mysql":
+		// parseTime scans DATETIME columns into time.Time
+		return fmt.Sprintf("%s:%s@tcp(%s:%d)/%s?charset=utf8mb4&parseTime=True&loc=UTC",
+			c.DBUser, c.DBPassword, c.DBHost, c.DBPort, c.DBName,
+		)
+	case "sqlite3":
+		if c.DBName == ":memory:" {
+			return c.DBName
+		}
+		// Wait for other connections to finish writing instead of failing
+		return fmt.Sprintf("file:%s?_busy_timeout=5000", c.DBName)
+	}
 	if c.DBPassword == "" {
 		return fmt.Sprintf("host=%s port=%d user=%s dbname=%s sslmode=disable",
 			c.DBHost, c.DBPort, c.DBUser, c.DBName,
@@ -30,8 +61,9 @@ func (c PostgresConfig) ConnectionInfo() string {
 	)
 }
 
-func DefaultPostgresConfig() PostgresConfig {
-	return PostgresConfig{
+func DefaultDatabaseConfig() DatabaseConfig {
+	return DatabaseConfig{
+		DBType:     "postgres",
 		DBHost:     "localhost",
 		DBPort:     5432,
 		DBUser:     "robert",
@@ -63,15 +95,325 @@ func DefaultDropboxConfig() DropboxConfig {
 	return DropboxConfig{}
 }
 
+// Rate Limit Configs
+type RateLimitConfig struct {
+	Store       string `json:"store"`
+	MaxAttempts int    `json:"max_attempts"`
+	Window      int    `json:"window_seconds"`
+	Lockout     int    `json:"lockout_seconds"`
+	MaxLockout  int    `json:"max_lockout_seconds"`
+}
+
+func (c RateLimitConfig) Policy() ratelimit.Policy {
+	policy := ratelimit.DefaultPolicy()
+	if c.MaxAttempts > 0 {
+		policy.MaxAttempts = c.MaxAttempts
+	}
+	if c.Window > 0 {
+		policy.Window = time.Duration(c.Window) * time.Second
+	}
+	if c.Lockout > 0 {
+		policy.Lockout = time.Duration(c.Lockout) * time.Second
+	}
+	if c.MaxLockout > 0 {
+		policy.MaxLockout = time.Duration(c.MaxLockout) * time.Second
+	}
+	return policy
+}
+
+func DefaultRateLimitConfig() RateLimitConfig {
+	return RateLimitConfig{
+		Store: "memory",
+	}
+}
+
+// Password Policy Configs
+type PasswordPolicyConfig struct {
+	MinLength  int     `json:"min_length"`
+	MaxLength  int     `json:"max_length"`
+	MinEntropy float64 `json:"min_entropy_bits"`
+	// BreachedList is the path of a file with SHA-1 hashes of breached
+	// passwords, one per line. Checking is disabled when empty.
+	BreachedList string `json:"breached_list"`
+}
+
+func DefaultPasswordPolicyConfig() PasswordPolicyConfig {
+	return PasswordPolicyConfig{
+		MinLength:  8,
+		MaxLength:  72,
+		MinEntropy: 30,
+	}
+}
+
+// Registration Configs
+type RegistrationConfig struct {
+	// Mode is one of "open", "invite" or "domain"
+	Mode           string   `json:"mode"`
+	AllowedDomains []string `json:"allowed_domains"`
+	// AdminInvitesOnly keeps users without the admin role from inviting
+	AdminInvitesOnly bool `json:"admin_invites_only"`
+	InviteTTLDays    int  `json:"invite_ttl_days"`
+}
+
+func DefaultRegistrationConfig() RegistrationConfig {
+	return RegistrationConfig{
+		Mode:          "open",
+		InviteTTLDays: 7,
+	}
+}
+
+// InviteTTL is how long new invitations stay valid, zero meaning forever
+func (c RegistrationConfig) InviteTTL() time.Duration {
+	return time.Duration(c.InviteTTLDays) * 24 * time.Hour
+}
+
+// Cookie Configs
+type CookieConfig struct {
+	// Domain lets subdomains share the cookies, e.g. "example.com". Cookies
+	// are limited to the exact host when it's empty.
+	Domain string `json:"domain"`
+	// Secure only sends cookies over HTTPS. When it's not set it's on in
+	// production and off otherwise.
+	Secure *bool `json:"secure"`
+	// SameSite is "lax", "strict" or "none"
+	SameSite string `json:"same_site"`
+}
+
+func DefaultCookieConfig() CookieConfig {
+	return CookieConfig{
+		SameSite: "lax",
+	}
+}
+
+// Log Configs
+type LogConfig struct {
+	// Format is "text" or "json"
+	Format string `json:"format"`
+	// Level is "debug", "info", "warn" or "error"
+	Level string `json:"level"`
+}
+
+func DefaultLogConfig() LogConfig {
+	return LogConfig{
+		Format: "text",
+		Level:  "info",
+	}
+}
+
+// Metrics Configs
+type MetricsConfig struct {
+	// Enabled serves the metrics at /metrics in the Prometheus format
+	Enabled bool `json:"enabled"`
+	// Port serves the metrics on a separate admin port, which should be
+	// kept private. When it's zero they're served on the site's port
+	// instead, to signed in admins only.
+	Port int `json:"port"`
+}
+
+func DefaultMetricsConfig() MetricsConfig {
+	return MetricsConfig{
+		Enabled: true,
+		Port:    9100,
+	}
+}
+
+// Security Configs
+type SecurityConfig struct {
+	// CSP replaces the sources of the directives it lists, e.g.
+	// {"img-src": ["'self'", "https://images.example.com"]}. An empty list
+	// removes the directive.
+	CSP           map[string][]string `json:"csp"`
+	CSPReportOnly bool                `json:"csp_report_only"`
+	// FrameOptions, ReferrerPolicy and PermissionsPolicy replace the
+	// default values of their headers, "-" leaving the header out
+	FrameOptions      string `json:"frame_options"`
+	ReferrerPolicy    string `json:"referrer_policy"`
+	PermissionsPolicy string `json:"permissions_policy"`
+	// HSTSMaxAge is only used in production, for requests made over TLS
+	HSTSMaxAge int `json:"hsts_max_age_seconds"`
+}
+
+func DefaultSecurityConfig() SecurityConfig {
+	return SecurityConfig{
+		HSTSMaxAge: 180 * 24 * 60 * 60,
+	}
+}
+
+// Server Configs
+type ServerConfig struct {
+	ReadTimeout     int `json:"read_timeout_seconds"`
+	WriteTimeout    int `json:"write_timeout_seconds"`
+	IdleTimeout     int `json:"idle_timeout_seconds"`
+	ShutdownTimeout int `json:"shutdown_timeout_seconds"`
+	DrainDelay      int `json:"drain_delay_seconds"`
+	// MaxUploadMB caps the size of a single API upload request
+	MaxUploadMB int `json:"max_upload_mb"`
+}
+
+func (c ServerConfig) ReadTimeoutDuration() time.Duration {
+	return seconds(c.ReadTimeout, DefaultServerConfig().ReadTimeout)
+}
+
+func (c ServerConfig) WriteTimeoutDuration() time.Duration {
+	return seconds(c.WriteTimeout, DefaultServerConfig().WriteTimeout)
+}
+
+func (c ServerConfig) IdleTimeoutDuration() time.Duration {
+	return seconds(c.IdleTimeout, DefaultServerConfig().IdleTimeout)
+}
+
+// ShutdownTimeoutDuration is how long in-flight requests and background
+// jobs get to finish once the server is asked to stop
+func (c ServerConfig) ShutdownTimeoutDuration() time.Duration {
+	return seconds(c.ShutdownTimeout, DefaultServerConfig().ShutdownTimeout)
+}
+
+// DrainDelayDuration is how long the server keeps serving with /readyz
+// failing once it's asked to stop, zero meaning it stops right away
+func (c ServerConfig) DrainDelayDuration() time.Duration {
+	return time.Duration(c.DrainDelay) * time.Second
+}
+
+// MaxUploadBytes is the largest request body an upload may have
+func (c ServerConfig) MaxUploadBytes() int64 {
+	n := c.MaxUploadMB
+	if n <= 0 {
+		n = DefaultServerConfig().MaxUploadMB
+	}
+	return int64(n) << 20
+}
+
+func DefaultServerConfig() ServerConfig {
+	return ServerConfig{
+		ReadTimeout:     30,
+		WriteTimeout:    60,
+		IdleTimeout:     120,
+		ShutdownTimeout: 30,
+		MaxUploadMB:     100,
+	}
+}
+
+func seconds(n, def int) time.Duration {
+	if n <= 0 {
+		n = def
+	}
+	return time.Duration(n) * time.Second
+}
+
 // Base Configs
 type Config struct {
-	Port     int            `json:"port"`
-	Env      string         `json:"env"`
-	Pepper   string         `json:"pepper"`
-	HMACKey  string         `json:"hmac_key"`
-	Database PostgresConfig `json:"database"`
-	Mailgun  MailgunConfig  `json:"mailgun"`
-	Dropbox  DropboxConfig  `json:"dropbox"`
+	Port               int                  `json:"port"`
+	Env                string               `json:"env"`
+	Pepper             string               `json:"pepper"`
+	HMACKey            string               `json:"hmac_key"`
+	PreviousPeppers    []string             `json:"previous_peppers"`
+	PreviousHMACKeys   []string             `json:"previous_hmac_keys"`
+	BcryptCost         int                  `json:"bcrypt_cost"`
+	CSRFKey            string               `json:"csrf_key"`
+	TrustProxy         bool                 `json:"trust_proxy"`
+	DeletionGraceDays  int                  `json:"deletion_grace_days"`
+	AuditRetentionDays int                  `json:"audit_retention_days"`
+	Database           DatabaseConfig       `json:"database"`
+	Mailgun            MailgunConfig        `json:"mailgun"`
+	Dropbox            DropboxConfig        `json:"dropbox"`
+	RateLimit          RateLimitConfig      `json:"rate_limit"`
+	PasswordPolicy     PasswordPolicyConfig `json:"password_policy"`
+	Registration       RegistrationConfig   `json:"registration"`
+	Server             ServerConfig         `json:"server"`
+	Cookie             CookieConfig         `json:"cookie"`
+	Log                LogConfig            `json:"log"`
+	Metrics            MetricsConfig        `json:"metrics"`
+	Security           SecurityConfig       `json:"security"`
+}
+
+// DeletionGracePeriod is how long an account stays recoverable after its
+// owner deleted it.
+func (c Config) DeletionGracePeriod() time.Duration {
+	if c.DeletionGraceDays <= 0 {
+		return 14 * 24 * time.Hour
+	}
+	return time.Duration(c.DeletionGraceDays) * 24 * time.Hour
+}
+
+// AuditRetention is how long audit log entries are kept, zero meaning
+// forever.
+func (c Config) AuditRetention() time.Duration {
+	return time.Duration(c.AuditRetentionDays) * 24 * time.Hour
+}
+
+// Peppers returns the current pepper followed by the previous ones
+func (c Config) Peppers() []string {
+	return append([]string{c.Pepper}, c.PreviousPeppers...)
+}
+
+// HMACKeys returns the current HMAC key followed by the previous ones
+func (c Config) HMACKeys() []string {
+	return append([]string{c.HMACKey}, c.PreviousHMACKeys...)
+}
+
+// CSRFKeyBytes decodes CSRFKey, which is 32 bytes encoded as hex. It
+// returns nil when no key is set.
+func (c Config) CSRFKeyBytes() ([]byte, error) {
+	if c.CSRFKey == "" {
+		return nil, nil
+	}
+	key, err := hex.DecodeString(c.CSRFKey)
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("configs: csrf_key must be 32 bytes encoded as 64 hex characters")
+	}
+	return key, nil
+}
+
+// CookiePolicy is applied to every cookie. Cookies are secure in production
+// unless cookie.secure is turned off.
+func (c Config) CookiePolicy() cookie.Policy {
+	sameSite := http.SameSiteLaxMode
+	switch strings.ToLower(c.Cookie.SameSite) {
+	case "strict":
+		sameSite = http.SameSiteStrictMode
+	case "none":
+		sameSite = http.SameSiteNoneMode
+	}
+	secure := c.IsProduction()
+	if c.Cookie.Secure != nil {
+		secure = *c.Cookie.Secure
+	}
+	return cookie.Policy{
+		Domain:   c.Cookie.Domain,
+		Secure:   secure,
+		SameSite: sameSite,
+	}
+}
+
+// SecurityPolicy is the default policy with the configured changes. HSTS is
+// only sent in production.
+func (c Config) SecurityPolicy() security.Policy {
+	policy := security.DefaultPolicy()
+	sc := c.Security
+	for directive, sources := range sc.CSP {
+		if len(sources) == 0 {
+			delete(policy.CSP, directive)
+			continue
+		}
+		policy.CSP[directive] = sources
+	}
+	policy.CSPReportOnly = sc.CSPReportOnly
+	override := func(value *string, with string) {
+		switch with {
+		case "":
+		case "-":
+			*value = ""
+		default:
+			*value = with
+		}
+	}
+	override(&policy.FrameOptions, sc.FrameOptions)
+	override(&policy.ReferrerPolicy, sc.ReferrerPolicy)
+	override(&policy.PermissionsPolicy, sc.PermissionsPolicy)
+	if c.IsProduction() {
+		policy.HSTSMaxAge = time.Duration(sc.HSTSMaxAge) * time.Second
+	}
+	return policy
 }
 
 func (c Config) IsProduction() bool {
@@ -84,32 +426,23 @@ func (c Config) IsDevelopment() bool {
 
 func DefaultConfig() Config {
 	return Config{
-		Port:     8000,
-		Env:      "DEVELOPMENT",
-		Pepper:   "secret-random-string",
-		HMACKey:  "secret-hmac-key",
-		Database: DefaultPostgresConfig(),
-		Mailgun:  DefaultMailgunConfig(),
-		Dropbox:  DefaultDropboxConfig(),
-	}
-}
-
-// Load Config
-func LoadConfig(configReq bool) Config {
-	f, err := os.Open("configs/.config.json")
-	if err != nil {
-		if configReq {
-			panic(err)
-		}
-		fmt.Println("Loaded default configs......")
-		return DefaultConfig()
-	}
-	
-	var cfg Config
-	err = json.NewDecoder(f).Decode(&cfg)
-	if err != nil {
-		panic(err)
+		Port:               8000,
+		Env:                "DEVELOPMENT",
+		Pepper:             "secret-random-string",
+		HMACKey:            "secret-hmac-key",
+		BcryptCost:         bcrypt.DefaultCost,
+		DeletionGraceDays:  14,
+		AuditRetentionDays: 365,
+		Database:           DefaultDatabaseConfig(),
+		Mailgun:            DefaultMailgunConfig(),
+		Dropbox:            DefaultDropboxConfig(),
+		RateLimit:          DefaultRateLimitConfig(),
+		PasswordPolicy:     DefaultPasswordPolicyConfig(),
+		Registration:       DefaultRegistrationConfig(),
+		Server:             DefaultServerConfig(),
+		Cookie:             DefaultCookieConfig(),
+		Log:                DefaultLogConfig(),
+		Metrics:            DefaultMetricsConfig(),
+		Security:           DefaultSecurityConfig(),
 	}
-	fmt.Println("Successfully loaded configs......")
-	return cfg
 }
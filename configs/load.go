@@ -0,0 +1,386 @@
+package configs
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"gallerio/utils/logging"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const (
+	// EnvPrefix starts the name of every environment variable read by Load,
+	// e.g. GALLERIO_DATABASE_HOST sets database.host
+	EnvPrefix = "GALLERIO_"
+
+	// DefaultPath is read when no config file is given and it exists
+	DefaultPath = "configs/.config.json"
+
+	redacted = "REDACTED"
+)
+
+// Load builds the config in layers, each overriding the previous one:
+//
+//  1. DefaultConfig
+//  2. the JSON or YAML file given by -config or GALLERIO_CONFIG, or
+//     DefaultPath if it exists
+//  3. GALLERIO_* environment variables
+//  4. command line flags
+//
+// The remaining command line arguments are returned along with the config,
+// which is validated before it's returned.
+func Load(args []string, environ []string) (Config, []string, error) {
+	fs := flag.NewFlagSet("gallerio", flag.ContinueOnError)
+	path := fs.String("config", "", "Path of the JSON or YAML config file. Defaults to "+
+		"$"+EnvPrefix+"CONFIG, then "+DefaultPath+" if it exists.")
+	prod := fs.Bool("prod", false, "Run in production, same as -env PRODUCTION.")
+	env := fs.String("env", "", "Environment, DEVELOPMENT or PRODUCTION.")
+	port := fs.Int("port", 0, "Port to listen on.")
+	var sets setFlags
+	fs.Var(&sets, "set", "Set any option by its key, e.g. -set database.host=db. "+
+		"Can be repeated.")
+	if err := fs.Parse(args); err != nil {
+		return Config{}, nil, err
+	}
+
+	cfg := DefaultConfig()
+	envVars := parseEnviron(environ)
+	if *path == "" {
+		*path = envVars["CONFIG"]
+	}
+	if err := loadFile(&cfg, *path); err != nil {
+		return Config{}, nil, err
+	}
+
+	for name, value := range envVars {
+		if name == "CONFIG" {
+			continue
+		}
+		key := strings.ToLower(name)
+		if err := setEnv(&cfg, key, value); err != nil {
+			return Config{}, nil, fmt.Errorf("configs: %s%s: %v", EnvPrefix, name, err)
+		}
+	}
+
+	for _, set := range sets {
+		parts := strings.SplitN(set, "=", 2)
+		if len(parts) != 2 {
+			return Config{}, nil, fmt.Errorf("configs: -set %s: expected key=value", set)
+		}
+		if err := Set(&cfg, parts[0], parts[1]); err != nil {
+			return Config{}, nil, fmt.Errorf("configs: -set %s: %v", set, err)
+		}
+	}
+	if *env != "" {
+		cfg.Env = strings.ToUpper(*env)
+	}
+	if *prod {
+		cfg.Env = "PRODUCTION"
+	}
+	if *port != 0 {
+		cfg.Port = *port
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return Config{}, nil, err
+	}
+	return cfg, fs.Args(), nil
+}
+
+// loadFile decodes the file over cfg. A missing file is only an error when
+// the path was given explicitly.
+func loadFile(cfg *Config, path string) error {
+	explicit := path != ""
+	if !explicit {
+		path = DefaultPath
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) && !explicit {
+			slog.Debug("no config file, using the defaults", "path", path)
+			return nil
+		}
+		return err
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		// The YAML is converted to JSON so both formats use the json tags
+		var doc interface{}
+		if err := yaml.Unmarshal(b, &doc); err != nil {
+			return fmt.Errorf("configs: %s: %v", path, err)
+		}
+		if b, err = json.Marshal(doc); err != nil {
+			return fmt.Errorf("configs: %s: %v", path, err)
+		}
+	}
+	if err := json.Unmarshal(b, cfg); err != nil {
+		return fmt.Errorf("configs: %s: %v", path, err)
+	}
+	slog.Debug("loaded config file", "path", path)
+	return nil
+}
+
+// parseEnviron returns the GALLERIO_* variables without the prefix
+func parseEnviron(environ []string) map[string]string {
+	vars := make(map[string]string)
+	for _, kv := range environ {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[0], EnvPrefix) {
+			continue
+		}
+		vars[strings.TrimPrefix(parts[0], EnvPrefix)] = parts[1]
+	}
+	return vars
+}
+
+// setEnv sets the option named by an environment variable. Variable names
+// can't tell the underscores separating sections apart from those within
+// keys, so every split is tried, e.g. rate_limit_max_attempts matches
+// rate_limit.max_attempts.
+func setEnv(cfg *Config, name, value string) error {
+	v := reflect.ValueOf(cfg).Elem()
+	field, ok := lookupEnv(v, name)
+	if !ok {
+		return errUnknownKey
+	}
+	return setValue(field, value)
+}
+
+func lookupEnv(v reflect.Value, name string) (reflect.Value, bool) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		key := jsonKey(t.Field(i))
+		if key == "" {
+			continue
+		}
+		field := v.Field(i)
+		if name == key && field.Kind() != reflect.Struct {
+			return field, true
+		}
+		if field.Kind() == reflect.Struct && strings.HasPrefix(name, key+"_") {
+			if found, ok := lookupEnv(field, strings.TrimPrefix(name, key+"_")); ok {
+				return found, true
+			}
+		}
+	}
+	return reflect.Value{}, false
+}
+
+var errUnknownKey = errors.New("unknown config key")
+
+// Set changes the option with the dotted key, e.g. "database.host", to the
+// value parsed for the option's type. Lists are comma separated.
+func Set(cfg *Config, key, value string) error {
+	v := reflect.ValueOf(cfg).Elem()
+	for _, part := range strings.Split(key, ".") {
+		if v.Kind() != reflect.Struct {
+			return errUnknownKey
+		}
+		field, ok := fieldByKey(v, part)
+		if !ok {
+			return errUnknownKey
+		}
+		v = field
+	}
+	if v.Kind() == reflect.Struct {
+		return errUnknownKey
+	}
+	return setValue(v, value)
+}
+
+func fieldByKey(v reflect.Value, key string) (reflect.Value, bool) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if jsonKey(t.Field(i)) == key {
+			return v.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+func jsonKey(f reflect.StructField) string {
+	tag := strings.Split(f.Tag.Get("json"), ",")[0]
+	if tag == "-" {
+		return ""
+	}
+	return tag
+}
+
+func setValue(v reflect.Value, value string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(n))
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Ptr:
+		p := reflect.New(v.Type().Elem())
+		if err := setValue(p.Elem(), value); err != nil {
+			return err
+		}
+		v.Set(p)
+	case reflect.Slice:
+		var items []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		v.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("options of type %s can't be set", v.Type())
+	}
+	return nil
+}
+
+type setFlags []string
+
+func (s *setFlags) String() string {
+	return strings.Join(*s, " ")
+}
+
+func (s *setFlags) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// Validate checks the options which would otherwise only fail once they
+// are used. In production it also refuses the example secrets.
+func (c Config) Validate() error {
+	var problems []string
+	if c.Env != "DEVELOPMENT" && c.Env != "PRODUCTION" {
+		problems = append(problems, fmt.Sprintf("env must be DEVELOPMENT or PRODUCTION, not %q", c.Env))
+	}
+	if c.Port <= 0 || c.Port > 65535 {
+		problems = append(problems, fmt.Sprintf("port %d is out of range", c.Port))
+	}
+	if c.Security.HSTSMaxAge < 0 {
+		problems = append(problems, "security.hsts_max_age_seconds must not be negative")
+	}
+	for directive, sources := range c.Security.CSP {
+		if directive == "" || strings.ContainsAny(directive, " ;,") {
+			problems = append(problems, fmt.Sprintf("security.csp directive %q is invalid", directive))
+		}
+		for _, source := range sources {
+			if source == "" || strings.ContainsAny(source, " ;,") {
+				problems = append(problems, fmt.Sprintf("security.csp source %q of %s is invalid", source, directive))
+			}
+		}
+	}
+	if c.Server.DrainDelay < 0 {
+		problems = append(problems, "server.drain_delay_seconds must not be negative")
+	}
+	if c.Server.MaxUploadMB < 0 {
+		problems = append(problems, "server.max_upload_mb must not be negative")
+	}
+	if c.Metrics.Port < 0 || c.Metrics.Port > 65535 {
+		problems = append(problems, fmt.Sprintf("metrics.port %d is out of range", c.Metrics.Port))
+	} else if c.Metrics.Port != 0 && c.Metrics.Port == c.Port {
+		problems = append(problems, "metrics.port must differ from port")
+	}
+	switch c.Database.Dialect() {
+	case "postgres", "mysql", "sqlite3":
+	default:
+		problems = append(problems, fmt.Sprintf("database.type %q is not supported", c.Database.DBType))
+	}
+	switch c.Registration.Mode {
+	case "open", "invite", "domain":
+	default:
+		problems = append(problems, fmt.Sprintf("registration.mode %q is not supported", c.Registration.Mode))
+	}
+	switch c.RateLimit.Store {
+	case "memory", "database":
+	default:
+		problems = append(problems, fmt.Sprintf("rate_limit.store %q is not supported", c.RateLimit.Store))
+	}
+
+	switch strings.ToLower(c.Cookie.SameSite) {
+	case "", "lax", "strict":
+	case "none":
+		if !c.CookiePolicy().Secure {
+			problems = append(problems, "cookie.same_site none requires cookie.secure")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("cookie.same_site %q is not supported", c.Cookie.SameSite))
+	}
+	switch strings.ToLower(c.Log.Format) {
+	case "", "text", "json":
+	default:
+		problems = append(problems, fmt.Sprintf("log.format %q is not supported", c.Log.Format))
+	}
+	if _, err := logging.ParseLevel(c.Log.Level); err != nil {
+		problems = append(problems, fmt.Sprintf("log.level %q is not supported", c.Log.Level))
+	}
+	if _, err := c.CSRFKeyBytes(); err != nil {
+		problems = append(problems, strings.TrimPrefix(err.Error(), "configs: "))
+	}
+
+	if c.IsProduction() {
+		def := DefaultConfig()
+		if c.Pepper == "" || c.Pepper == def.Pepper {
+			problems = append(problems, "pepper must be set to a secret value in production")
+		}
+		if c.HMACKey == "" || c.HMACKey == def.HMACKey {
+			problems = append(problems, "hmac_key must be set to a secret value in production")
+		}
+		if c.CSRFKey == "" {
+			problems = append(problems, "csrf_key must be set in production so forms survive restarts")
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("configs: invalid config:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// Redacted returns a copy of the config with every secret which is set
+// replaced, so it can be shown
+func (c Config) Redacted() Config {
+	redact := func(s *string) {
+		if *s != "" {
+			*s = redacted
+		}
+	}
+	redactAll := func(list []string) []string {
+		out := make([]string, len(list))
+		for i := range list {
+			out[i] = redacted
+		}
+		return out
+	}
+	redact(&c.Pepper)
+	redact(&c.HMACKey)
+	redact(&c.CSRFKey)
+	c.PreviousPeppers = redactAll(c.PreviousPeppers)
+	c.PreviousHMACKeys = redactAll(c.PreviousHMACKeys)
+	redact(&c.Database.DBPassword)
+	redact(&c.Mailgun.APIKey)
+	redact(&c.Mailgun.PublicAPIKey)
+	redact(&c.Dropbox.Secret)
+	return c
+}
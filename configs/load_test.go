@@ -0,0 +1,232 @@
+package configs
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadLayers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	yaml := `
+port: 9000
+database:
+  type: sqlite
+  name: gallerio.db
+rate_limit:
+  store: memory
+  max_attempts: 10
+`
+	if err := ioutil.WriteFile(path, []byte(yaml), 0600); err != nil {
+		t.Fatal(err)
+	}
+	environ := []string{
+		"GALLERIO_CONFIG=" + path,
+		"GALLERIO_RATE_LIMIT_MAX_ATTEMPTS=3",
+		"GALLERIO_REGISTRATION_ALLOWED_DOMAINS=example.com, example.org",
+		"GALLERIO_PORT=9001",
+		"HOME=/root",
+	}
+	cfg, args, err := Load([]string{"-port", "9002", "-set", "database.name=other.db", "migrate", "up"}, environ)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Database.Dialect() != "sqlite3" {
+		t.Errorf("expected the file to set the database type, got %q", cfg.Database.DBType)
+	}
+	if cfg.Database.DBName != "other.db" {
+		t.Errorf("expected -set to override the file, got %q", cfg.Database.DBName)
+	}
+	if cfg.RateLimit.MaxAttempts != 3 {
+		t.Errorf("expected the environment to override the file, got %d", cfg.RateLimit.MaxAttempts)
+	}
+	if got := strings.Join(cfg.Registration.AllowedDomains, " "); got != "example.com example.org" {
+		t.Errorf("expected a list from the environment, got %q", got)
+	}
+	if cfg.Port != 9002 {
+		t.Errorf("expected -port to override the environment and file, got %d", cfg.Port)
+	}
+	if cfg.Registration.Mode != "open" || cfg.BcryptCost == 0 {
+		t.Error("expected options which aren't set anywhere to keep their defaults")
+	}
+	if strings.Join(args, " ") != "migrate up" {
+		t.Errorf("expected the command to be returned, got %q", args)
+	}
+}
+
+// Commands such as "config print" write to stdout, which loading the
+// config must keep clean
+func TestLoadKeepsStdoutClean(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := ioutil.WriteFile(path, []byte(`{"port": 9000}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := os.CreateTemp(t.TempDir(), "stdout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdout.Close()
+	orig := os.Stdout
+	os.Stdout = stdout
+	defer func() { os.Stdout = orig }()
+	
+	for _, environ := range [][]string{{"GALLERIO_CONFIG=" + path}, nil} {
+		if _, _, err := Load(nil, environ); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.Stdout = orig
+	if b, _ := ioutil.ReadFile(stdout.Name()); len(b) > 0 {
+		t.Fatalf("expected nothing on stdout, got %q", b)
+	}
+}
+
+func TestLoadRejectsUnknownKeys(t *testing.T) {
+	if _, _, err := Load(nil, []string{"GALLERIO_DATABASE_HOTS=db"}); err == nil {
+		t.Error("expected an unknown environment variable to be rejected")
+	}
+	if _, _, err := Load([]string{"-set", "database=db"}, nil); err == nil {
+		t.Error("expected setting a section to be rejected")
+	}
+	if _, _, err := Load([]string{"-config", filepath.Join(t.TempDir(), "missing.json")}, nil); err == nil {
+		t.Error("expected a missing config file to be an error when it's given")
+	}
+}
+
+func TestValidateProductionSecrets(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Env = "PRODUCTION"
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("expected the default pepper and HMAC key to be refused in production")
+	}
+	cfg.Pepper = "a real secret pepper"
+	cfg.HMACKey = "a real secret key"
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("expected a missing CSRF key to be refused in production")
+	}
+	cfg.CSRFKey = strings.Repeat("ab", 32)
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.Database.DBType = "oracle"
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("expected an unsupported database type to be refused")
+	}
+}
+
+func TestRedacted(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PreviousPeppers = []string{"old pepper"}
+	cfg.Dropbox.Secret = "dropbox secret"
+	redacted := cfg.Redacted()
+	for _, secret := range []string{redacted.Pepper, redacted.HMACKey, redacted.PreviousPeppers[0],
+		redacted.Database.DBPassword, redacted.Dropbox.Secret} {
+		if secret != "REDACTED" {
+			t.Errorf("expected the secret to be redacted, got %q", secret)
+		}
+	}
+	if redacted.Mailgun.APIKey != "" {
+		t.Error("expected unset secrets to stay empty")
+	}
+	if cfg.Pepper == "REDACTED" {
+		t.Error("expected the original config to be unchanged")
+	}
+}
+
+func TestCookiePolicy(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Cookie.Domain = "example.com"
+	policy := cfg.CookiePolicy()
+	if policy.Secure || policy.SameSite != http.SameSiteLaxMode || policy.Domain != "example.com" {
+		t.Fatalf("expected lax cookies which aren't secure in development, got %+v", policy)
+	}
+	cfg.Env = "PRODUCTION"
+	if !cfg.CookiePolicy().Secure {
+		t.Fatal("expected cookies to be secure in production by default")
+	}
+	// E.g. behind a proxy which doesn't tell the app about HTTPS
+	if err := Set(&cfg, "cookie.secure", "false"); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.CookiePolicy().Secure {
+		t.Fatal("expected cookie.secure false to be honored in production")
+	}
+
+	cfg = DefaultConfig()
+	cfg.Cookie.SameSite = "none"
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("expected same_site none without secure to be refused")
+	}
+	if err := Set(&cfg, "cookie.secure", "true"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	cfg.Env = "PRODUCTION"
+	cfg.Cookie.Secure = nil
+	cfg.Cookie.SameSite = "strict"
+	if !cfg.CookiePolicy().Secure || cfg.CookiePolicy().SameSite != http.SameSiteStrictMode {
+		t.Fatalf("expected strict secure cookies, got %+v", cfg.CookiePolicy())
+	}
+
+	cfg.CSRFKey = "too short"
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("expected an invalid CSRF key to be refused")
+	}
+}
+
+func TestValidateLog(t *testing.T) {
+	cfg, _, err := Load([]string{"-set", "log.format=json", "-set", "log.level=debug"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Log.Format != "json" || cfg.Log.Level != "debug" {
+		t.Errorf("expected the log options to be set, got %+v", cfg.Log)
+	}
+	if _, _, err := Load([]string{"-set", "log.format=xml"}, nil); err == nil {
+		t.Error("expected an unknown log format to be refused")
+	}
+	if _, _, err := Load(nil, []string{"GALLERIO_LOG_LEVEL=verbose"}); err == nil {
+		t.Error("expected an unknown log level to be refused")
+	}
+}
+
+func TestSecurityPolicy(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Security.CSP = map[string][]string{
+		"img-src":     {"'self'", "https://images.example.com"},
+		"form-action": {},
+	}
+	cfg.Security.FrameOptions = "-"
+	policy := cfg.SecurityPolicy()
+	if got := policy.CSP["img-src"]; len(got) != 2 || got[1] != "https://images.example.com" {
+		t.Errorf("expected img-src to be replaced, got %v", got)
+	}
+	if _, ok := policy.CSP["form-action"]; ok {
+		t.Error("expected an empty list to remove form-action")
+	}
+	if policy.FrameOptions != "" || policy.ReferrerPolicy == "" {
+		t.Errorf("expected only X-Frame-Options to be left out, got %+v", policy)
+	}
+	if policy.HSTSMaxAge != 0 {
+		t.Error("expected no HSTS outside production")
+	}
+
+	cfg.Env = "PRODUCTION"
+	if policy := cfg.SecurityPolicy(); policy.HSTSMaxAge != 180*24*time.Hour {
+		t.Errorf("expected HSTS in production, got %v", policy.HSTSMaxAge)
+	}
+
+	cfg.Security.CSP = map[string][]string{"script-src": {"'self'; object-src *"}}
+	cfg.Env = "DEVELOPMENT"
+	if err := cfg.Validate(); err == nil {
+		t.Error("expected a source with a semicolon to be refused")
+	}
+}
@@ -0,0 +1,468 @@
+package controllers
+
+import (
+	"fmt"
+	"gallerio/forms"
+	"gallerio/models"
+	"gallerio/utils/context"
+	"gallerio/utils/email"
+	"gallerio/utils/rand"
+	"gallerio/views"
+	"github.com/gorilla/mux"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+func NewAdminController(us models.UserService, gs models.GalleryService, is models.ImageService,
+	al models.AuditLogService, mg email.Client) *AdminController {
+	return &AdminController{
+		UsersView:     views.NewView("base", "admin/users"),
+		GalleriesView: views.NewView("base", "admin/galleries"),
+		AuditView:     views.NewView("base", "admin/audit"),
+		us:            us,
+		gs:            gs,
+		is:            is,
+		al:            al,
+		mg:            mg,
+	}
+}
+
+type AdminController struct {
+	UsersView     *views.View
+	GalleriesView *views.View
+	AuditView     *views.View
+	us            models.UserService
+	gs            models.GalleryService
+	is            models.ImageService
+	al            models.AuditLogService
+	mg            email.Client
+}
+
+type AdminUser struct {
+	models.User
+	Galleries int
+	Images    int
+	Storage   string
+}
+
+type AdminUsers struct {
+	ListPage
+	Users   []AdminUser
+	IsAdmin bool
+	Roles   []string
+}
+
+type AdminAuditEntry struct {
+	models.AuditLog
+	User  string
+	Actor string
+}
+
+type AdminAudit struct {
+	ListPage
+	User    string
+	Action  string
+	IP      string
+	Entries []AdminAuditEntry
+}
+
+type AdminGallery struct {
+	models.Gallery
+	Owner   string
+	Images  int
+	Storage string
+}
+
+type AdminGalleries struct {
+	ListPage
+	Galleries []AdminGallery
+	IsAdmin   bool
+}
+
+func (au AdminUsers) JSONContent() interface{} {
+	type user struct {
+		models.PublicUser
+		Suspended   bool       `json:"suspended"`
+		DeleteAfter *time.Time `json:"delete_after"`
+		Galleries   int        `json:"galleries"`
+		Images      int        `json:"images"`
+		Storage     string     `json:"storage"`
+	}
+	users := make([]user, len(au.Users))
+	for i, u := range au.Users {
+		users[i] = user{u.Public(), u.Suspended(), u.DeleteAfter, u.Galleries, u.Images, u.Storage}
+	}
+	return struct {
+		Pagination ListPage `json:"pagination"`
+		Users      []user   `json:"users"`
+		Roles      []string `json:"roles"`
+	}{au.ListPage, users, au.Roles}
+}
+
+func (aa AdminAudit) JSONContent() interface{} {
+	type entry struct {
+		models.PublicAuditLog
+		User  string `json:"user"`
+		Actor string `json:"actor"`
+	}
+	entries := make([]entry, len(aa.Entries))
+	for i, e := range aa.Entries {
+		entries[i] = entry{e.Public(), e.User, e.Actor}
+	}
+	return struct {
+		Pagination ListPage `json:"pagination"`
+		User       string   `json:"user"`
+		Action     string   `json:"action"`
+		IP         string   `json:"ip"`
+		Entries    []entry  `json:"entries"`
+	}{aa.ListPage, aa.User, aa.Action, aa.IP, entries}
+}
+
+func (ag AdminGalleries) JSONContent() interface{} {
+	type gallery struct {
+		models.PublicGallery
+		Owner      string `json:"owner"`
+		ImageCount int    `json:"image_count"`
+		Storage    string `json:"storage"`
+	}
+	galleries := make([]gallery, len(ag.Galleries))
+	for i, g := range ag.Galleries {
+		galleries[i] = gallery{g.Public(), g.Owner, g.Images, g.Storage}
+	}
+	return struct {
+		Pagination ListPage  `json:"pagination"`
+		Galleries  []gallery `json:"galleries"`
+	}{ag.ListPage, galleries}
+}
+
+// GET /admin/users
+func (ac *AdminController) Users(w http.ResponseWriter, req *http.Request) {
+	var data views.Data
+	var form forms.SearchForm
+	if err := forms.ParseURLParams(req, &form); err != nil {
+		data.SetAlert(req.Context(), err)
+		ac.UsersView.Render(w, req, data)
+		return
+	}
+	
+	p := models.NewPagination(form.Page, models.DefaultPerPage)
+	users, total, err := ac.us.Search(form.Query, p)
+	if err != nil {
+		data.SetAlert(req.Context(), err)
+		ac.UsersView.Render(w, req, data)
+		return
+	}
+	content := AdminUsers{
+		ListPage: newListPage(req, form.Query, p, total),
+		Users:    make([]AdminUser, len(users)),
+		IsAdmin:  context.User(req.Context()).HasRole(models.RoleAdmin),
+		Roles:    []string{models.RoleUser, models.RoleModerator, models.RoleAdmin},
+	}
+	for i, user := range users {
+		content.Users[i] = AdminUser{User: user}
+		galleries, err := ac.gs.ByUserID(user.ID)
+		if err != nil {
+			slog.ErrorContext(req.Context(), "loading galleries failed", "owner_id", user.ID, "err", err)
+			continue
+		}
+		var size int64
+		for _, gallery := range galleries {
+			n, bytes, err := ac.is.Usage(gallery.ID)
+			if err != nil {
+				slog.ErrorContext(req.Context(), "measuring gallery usage failed", "gallery_id", gallery.ID, "err", err)
+				continue
+			}
+			content.Users[i].Images += n
+			size += bytes
+		}
+		content.Users[i].Galleries = len(galleries)
+		content.Users[i].Storage = formatBytes(size)
+	}
+	data.Content = content
+	ac.UsersView.Render(w, req, data)
+}
+
+// GET /admin/galleries
+func (ac *AdminController) Galleries(w http.ResponseWriter, req *http.Request) {
+	var data views.Data
+	var form forms.SearchForm
+	if err := forms.ParseURLParams(req, &form); err != nil {
+		data.SetAlert(req.Context(), err)
+		ac.GalleriesView.Render(w, req, data)
+		return
+	}
+	
+	p := models.NewPagination(form.Page, models.DefaultPerPage)
+	galleries, total, err := ac.gs.Search(form.Query, p)
+	if err != nil {
+		data.SetAlert(req.Context(), err)
+		ac.GalleriesView.Render(w, req, data)
+		return
+	}
+	content := AdminGalleries{
+		ListPage:  newListPage(req, form.Query, p, total),
+		Galleries: make([]AdminGallery, len(galleries)),
+		IsAdmin:   context.User(req.Context()).HasRole(models.RoleAdmin),
+	}
+	for i, gallery := range galleries {
+		content.Galleries[i] = AdminGallery{Gallery: gallery}
+		if owner, err := ac.us.ByID(gallery.UserID); err == nil {
+			content.Galleries[i].Owner = owner.Username
+		}
+		n, size, err := ac.is.Usage(gallery.ID)
+		if err != nil {
+			slog.ErrorContext(req.Context(), "measuring gallery usage failed", "gallery_id", gallery.ID, "err", err)
+			continue
+		}
+		content.Galleries[i].Images = n
+		content.Galleries[i].Storage = formatBytes(size)
+	}
+	data.Content = content
+	ac.GalleriesView.Render(w, req, data)
+}
+
+// GET /admin/audit
+func (ac *AdminController) Audit(w http.ResponseWriter, req *http.Request) {
+	var data views.Data
+	var form forms.AuditSearchForm
+	if err := forms.ParseURLParams(req, &form); err != nil {
+		data.SetAlert(req.Context(), err)
+		ac.AuditView.Render(w, req, data)
+		return
+	}
+	
+	content := AdminAudit{
+		User:   form.User,
+		Action: form.Action,
+		IP:     form.IP,
+	}
+	data.Content = &content
+	filter := models.AuditFilter{
+		Action: form.Action,
+		IP:     form.IP,
+	}
+	if form.User != "" {
+		user, err := ac.lookupUser(form.User)
+		if err != nil {
+			data.SetAlert(req.Context(), err)
+			ac.AuditView.Render(w, req, data)
+			return
+		}
+		filter.UserID = user.ID
+	}
+	
+	p := models.NewPagination(form.Page, models.DefaultPerPage)
+	entries, total, err := ac.al.Search(filter, p)
+	if err != nil {
+		data.SetAlert(req.Context(), err)
+		ac.AuditView.Render(w, req, data)
+		return
+	}
+	content.ListPage = newListPage(req, "", p, total)
+	content.Entries = make([]AdminAuditEntry, len(entries))
+	usernames := map[uint]string{}
+	username := func(id uint) string {
+		if id == 0 {
+			return ""
+		}
+		if name, ok := usernames[id]; ok {
+			return name
+		}
+		name := fmt.Sprintf("#%d", id)
+		if user, err := ac.us.ByID(id); err == nil {
+			name = user.Username
+		}
+		usernames[id] = name
+		return name
+	}
+	for i, entry := range entries {
+		content.Entries[i] = AdminAuditEntry{
+			AuditLog: entry,
+			User:     username(entry.UserID),
+			Actor:    username(entry.ActorID),
+		}
+	}
+	ac.AuditView.Render(w, req, data)
+}
+
+// POST /admin/users/{id}/suspend
+func (ac *AdminController) Suspend(w http.ResponseWriter, req *http.Request) {
+	actor, user, ok := ac.manageableUser(w, req)
+	if !ok {
+		return
+	}
+	token, err := rand.RememberToken()
+	if err != nil {
+		ac.redirectAlert(w, req, "/admin/users", err)
+		return
+	}
+	now := time.Now()
+	user.SuspendedAt = &now
+	// Rotating the token signs the user out everywhere
+	user.RememberToken = token
+	if err := ac.us.Update(user); err != nil {
+		ac.redirectAlert(w, req, "/admin/users", err)
+		return
+	}
+	ac.record(req, actor, user.ID, models.AuditAdminUserSuspended, "")
+	ac.redirectSuccess(w, req, "/admin/users", fmt.Sprintf("%s was suspended", user.Username))
+}
+
+// POST /admin/users/{id}/unsuspend
+func (ac *AdminController) Unsuspend(w http.ResponseWriter, req *http.Request) {
+	actor, user, ok := ac.manageableUser(w, req)
+	if !ok {
+		return
+	}
+	user.SuspendedAt = nil
+	if err := ac.us.Update(user); err != nil {
+		ac.redirectAlert(w, req, "/admin/users", err)
+		return
+	}
+	ac.record(req, actor, user.ID, models.AuditAdminUserUnsuspended, "")
+	ac.redirectSuccess(w, req, "/admin/users", fmt.Sprintf("%s is no longer suspended", user.Username))
+}
+
+// POST /admin/users/{id}/reset
+func (ac *AdminController) ForceReset(w http.ResponseWriter, req *http.Request) {
+	actor, user, ok := ac.manageableUser(w, req)
+	if !ok {
+		return
+	}
+	token, err := ac.us.ForceReset(user)
+	if err != nil {
+		ac.redirectAlert(w, req, "/admin/users", err)
+		return
+	}
+	if err := ac.mg.ResetPassword(req.Context(), user.Email, token); err != nil {
+		ac.redirectAlert(w, req, "/admin/users", err)
+		return
+	}
+	ac.record(req, actor, user.ID, models.AuditAdminPasswordReset, "")
+	ac.redirectSuccess(w, req, "/admin/users",
+		fmt.Sprintf("%s was signed out and sent a password reset email", user.Username))
+}
+
+// POST /admin/users/{id}/role
+func (ac *AdminController) ChangeRole(w http.ResponseWriter, req *http.Request) {
+	actor, user, ok := ac.manageableUser(w, req)
+	if !ok {
+		return
+	}
+	var form forms.RoleForm
+	if err := forms.ParseForm(req, &form); err != nil {
+		ac.redirectAlert(w, req, "/admin/users", err)
+		return
+	}
+	previous := user.Role
+	user.Role = form.Role
+	if err := ac.us.Update(user); err != nil {
+		ac.redirectAlert(w, req, "/admin/users", err)
+		return
+	}
+	ac.record(req, actor, user.ID, models.AuditAdminRoleChanged,
+		fmt.Sprintf("role changed from %s to %s", previous, user.Role))
+	ac.redirectSuccess(w, req, "/admin/users", fmt.Sprintf("%s is now %s", user.Username, user.Role))
+}
+
+// POST /admin/galleries/{id}/delete
+func (ac *AdminController) DeleteGallery(w http.ResponseWriter, req *http.Request) {
+	actor := context.User(req.Context())
+	id, err := strconv.Atoi(mux.Vars(req)["id"])
+	if err != nil {
+		views.Error(w, req, "Invalid Gallery ID", http.StatusBadRequest)
+		return
+	}
+	gallery, err := ac.gs.ByID(uint(id))
+	if err != nil {
+		ac.redirectAlert(w, req, "/admin/galleries", err)
+		return
+	}
+	if err := ac.is.DeleteAll(gallery.ID); err != nil {
+		ac.redirectAlert(w, req, "/admin/galleries", err)
+		return
+	}
+	if err := ac.gs.Delete(req.Context(), gallery.ID); err != nil {
+		ac.redirectAlert(w, req, "/admin/galleries", err)
+		return
+	}
+	ac.record(req, actor, gallery.UserID, models.AuditAdminGalleryDeleted,
+		fmt.Sprintf("gallery #%d %q", gallery.ID, gallery.Title))
+	ac.redirectSuccess(w, req, "/admin/galleries", fmt.Sprintf("Gallery %q was deleted", gallery.Title))
+}
+
+// manageableUser looks up the user in the URL and makes sure the signed in
+// staff member may act on them: nobody can act on themselves and only
+// admins can act on staff members.
+func (ac *AdminController) manageableUser(w http.ResponseWriter, req *http.Request) (*models.User, *models.User, bool) {
+	actor := context.User(req.Context())
+	id, err := strconv.Atoi(mux.Vars(req)["id"])
+	if err != nil {
+		views.Error(w, req, "Invalid User ID", http.StatusBadRequest)
+		return nil, nil, false
+	}
+	user, err := ac.us.ByID(uint(id))
+	if err != nil {
+		ac.redirectAlert(w, req, "/admin/users", err)
+		return nil, nil, false
+	}
+	if user.ID == actor.ID {
+		ac.redirectError(w, req, "/admin/users", "You can't manage your own account from here")
+		return nil, nil, false
+	}
+	if user.HasRole(models.RoleModerator) && !actor.HasRole(models.RoleAdmin) {
+		ac.redirectError(w, req, "/admin/users", "Only admins can manage staff accounts")
+		return nil, nil, false
+	}
+	return actor, user, true
+}
+
+// lookupUser accepts a user ID, a username or an email address
+func (ac *AdminController) lookupUser(login string) (*models.User, error) {
+	if id, err := strconv.Atoi(login); err == nil {
+		return ac.us.ByID(uint(id))
+	}
+	return ac.us.ByLogin(login)
+}
+
+func (ac *AdminController) record(req *http.Request, actor *models.User, userID uint, action, detail string) {
+	recordEvent(ac.al, req, models.AuditLog{
+		UserID:  userID,
+		ActorID: actor.ID,
+		Action:  action,
+		Detail:  detail,
+	})
+}
+
+func (ac *AdminController) redirectAlert(w http.ResponseWriter, req *http.Request, urlStr string, err error) {
+	var data views.Data
+	data.SetAlert(req.Context(), err)
+	views.RedirectAlert(w, req, urlStr, http.StatusSeeOther, *data.Alert)
+}
+
+func (ac *AdminController) redirectError(w http.ResponseWriter, req *http.Request, urlStr, message string) {
+	var data views.Data
+	data.AlertError(message)
+	views.RedirectAlert(w, req, urlStr, http.StatusSeeOther, *data.Alert)
+}
+
+func (ac *AdminController) redirectSuccess(w http.ResponseWriter, req *http.Request, urlStr, message string) {
+	var data views.Data
+	data.AlertSuccess(message)
+	views.RedirectAlert(w, req, urlStr, http.StatusSeeOther, *data.Alert)
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,450 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"gallerio/forms"
+	"gallerio/models"
+	"gallerio/utils/context"
+	"gallerio/views"
+	"github.com/gorilla/mux"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// APIPrefix is where the current version of the API is mounted
+const APIPrefix = "/api/v1"
+
+// maxUploadMemory is how much of a multipart upload is kept in memory, the
+// rest is buffered on disk
+const maxUploadMemory int64 = 10 << 20 // 10MB
+
+func NewAPIController(gs models.GalleryService, is models.ImageService, maxUpload int64) *APIController {
+	return &APIController{
+		gs:        gs,
+		is:        is,
+		maxUpload: maxUpload,
+	}
+}
+
+// APIController serves the versioned JSON API under /api/v1. Users only
+// ever see their own galleries, anything else is reported as not found.
+type APIController struct {
+	gs models.GalleryService
+	is models.ImageService
+	// maxUpload is the largest request body UploadImages accepts
+	maxUpload int64
+}
+
+// APIRoute is an entry of the API route table, which is used both to
+// register the routes and to generate the OpenAPI document. Path is relative
+// to APIPrefix.
+type APIRoute struct {
+	Name    string
+	Method  string
+	Path    string
+	Scope   string
+	Summary string
+	// Paginated routes accept the page and per_page query parameters
+	Paginated bool
+	// Request is a value of the type of the JSON request body, if any
+	Request interface{}
+	// Upload is the multipart field files are uploaded in, if any
+	Upload string
+	// Status and Response describe the successful response. Response is
+	// nil when it has no body.
+	Status   int
+	Response interface{}
+	Handler  http.HandlerFunc
+}
+
+// Routes returns the API route table
+func (ac *APIController) Routes() []APIRoute {
+	return []APIRoute{
+		{
+			Name: "listGalleries", Method: http.MethodGet, Path: "/galleries",
+			Scope: models.ScopeGalleriesRead, Summary: "List your galleries",
+			Paginated: true,
+			Status:    http.StatusOK, Response: APIGalleryList{},
+			Handler: ac.ListGalleries,
+		},
+		{
+			Name: "createGallery", Method: http.MethodPost, Path: "/galleries",
+			Scope: models.ScopeGalleriesWrite, Summary: "Create a gallery",
+			Request: forms.GalleryForm{},
+			Status:  http.StatusCreated, Response: APIGallery{},
+			Handler: ac.CreateGallery,
+		},
+		{
+			Name: "showGallery", Method: http.MethodGet, Path: "/galleries/{id:[0-9]+}",
+			Scope: models.ScopeGalleriesRead, Summary: "Get a gallery",
+			Status: http.StatusOK, Response: APIGallery{},
+			Handler: ac.ShowGallery,
+		},
+		{
+			Name: "updateGallery", Method: http.MethodPatch, Path: "/galleries/{id:[0-9]+}",
+			Scope: models.ScopeGalleriesWrite, Summary: "Rename a gallery",
+			Request: forms.GalleryForm{},
+			Status:  http.StatusOK, Response: APIGallery{},
+			Handler: ac.UpdateGallery,
+		},
+		{
+			Name: "deleteGallery", Method: http.MethodDelete, Path: "/galleries/{id:[0-9]+}",
+			Scope: models.ScopeGalleriesWrite, Summary: "Delete a gallery and its images",
+			Status:  http.StatusNoContent,
+			Handler: ac.DeleteGallery,
+		},
+		{
+			Name: "listImages", Method: http.MethodGet, Path: "/galleries/{id:[0-9]+}/images",
+			Scope: models.ScopeImagesRead, Summary: "List the images of a gallery",
+			Paginated: true,
+			Status:    http.StatusOK, Response: APIImageList{},
+			Handler: ac.ListImages,
+		},
+		{
+			Name: "uploadImages", Method: http.MethodPost, Path: "/galleries/{id:[0-9]+}/images",
+			Scope: models.ScopeImagesWrite, Summary: "Upload images to a gallery",
+			Upload: "images",
+			Status: http.StatusCreated, Response: []APIImage{},
+			Handler: ac.UploadImages,
+		},
+		{
+			Name: "updateImage", Method: http.MethodPatch, Path: "/galleries/{id:[0-9]+}/images/{filename}",
+			Scope: models.ScopeImagesWrite, Summary: "Rename an image",
+			Request: forms.ImageForm{},
+			Status:  http.StatusOK, Response: APIImage{},
+			Handler: ac.UpdateImage,
+		},
+		{
+			Name: "deleteImage", Method: http.MethodDelete, Path: "/galleries/{id:[0-9]+}/images/{filename}",
+			Scope: models.ScopeImagesWrite, Summary: "Delete an image",
+			Status:  http.StatusNoContent,
+			Handler: ac.DeleteImage,
+		},
+	}
+}
+
+type APIGallery struct {
+	ID        uint      `json:"id"`
+	Title     string    `json:"title"`
+	URL       string    `json:"url"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type APIImage struct {
+	GalleryID uint   `json:"gallery_id"`
+	Filename  string `json:"filename"`
+	URL       string `json:"url"`
+}
+
+type APIPagination struct {
+	Page       int `json:"page"`
+	PerPage    int `json:"per_page"`
+	Total      int `json:"total"`
+	TotalPages int `json:"total_pages"`
+}
+
+type APIGalleryList struct {
+	Data       []APIGallery  `json:"data"`
+	Pagination APIPagination `json:"pagination"`
+}
+
+type APIImageList struct {
+	Data       []APIImage    `json:"data"`
+	Pagination APIPagination `json:"pagination"`
+}
+
+// GET /api/v1/galleries
+func (ac *APIController) ListGalleries(w http.ResponseWriter, req *http.Request) {
+	user := context.User(req.Context())
+	p, ok := ac.pagination(w, req)
+	if !ok {
+		return
+	}
+	galleries, total, err := ac.gs.PageByUserID(user.ID, p)
+	if err != nil {
+		ac.renderError(w, req, err)
+		return
+	}
+	list := APIGalleryList{
+		Data:       make([]APIGallery, len(galleries)),
+		Pagination: newAPIPagination(p, total),
+	}
+	for i := range galleries {
+		list.Data[i] = newAPIGallery(&galleries[i])
+	}
+	views.RenderJSON(w, http.StatusOK, list)
+}
+
+// POST /api/v1/galleries
+func (ac *APIController) CreateGallery(w http.ResponseWriter, req *http.Request) {
+	user := context.User(req.Context())
+	var form forms.GalleryForm
+	if err := forms.ParseJSON(req, &form); err != nil {
+		ac.renderBadRequest(w, err)
+		return
+	}
+	gallery := models.Gallery{
+		UserID: user.ID,
+		Title:  form.Title,
+	}
+	if err := ac.gs.Create(req.Context(), &gallery); err != nil {
+		ac.renderError(w, req, err)
+		return
+	}
+	w.Header().Set("Location", fmt.Sprintf("/api/v1/galleries/%d", gallery.ID))
+	views.RenderJSON(w, http.StatusCreated, newAPIGallery(&gallery))
+}
+
+// GET /api/v1/galleries/{id}
+func (ac *APIController) ShowGallery(w http.ResponseWriter, req *http.Request) {
+	gallery, ok := ac.gallery(w, req)
+	if !ok {
+		return
+	}
+	views.RenderJSON(w, http.StatusOK, newAPIGallery(gallery))
+}
+
+// PATCH /api/v1/galleries/{id}
+func (ac *APIController) UpdateGallery(w http.ResponseWriter, req *http.Request) {
+	gallery, ok := ac.gallery(w, req)
+	if !ok {
+		return
+	}
+	var form forms.GalleryForm
+	if err := forms.ParseJSON(req, &form); err != nil {
+		ac.renderBadRequest(w, err)
+		return
+	}
+	gallery.Title = form.Title
+	if err := ac.gs.Update(req.Context(), gallery); err != nil {
+		ac.renderError(w, req, err)
+		return
+	}
+	views.RenderJSON(w, http.StatusOK, newAPIGallery(gallery))
+}
+
+// DELETE /api/v1/galleries/{id}
+func (ac *APIController) DeleteGallery(w http.ResponseWriter, req *http.Request) {
+	gallery, ok := ac.gallery(w, req)
+	if !ok {
+		return
+	}
+	if err := ac.is.DeleteAll(gallery.ID); err != nil {
+		ac.renderError(w, req, err)
+		return
+	}
+	if err := ac.gs.Delete(req.Context(), gallery.ID); err != nil {
+		ac.renderError(w, req, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GET /api/v1/galleries/{id}/images
+func (ac *APIController) ListImages(w http.ResponseWriter, req *http.Request) {
+	gallery, ok := ac.gallery(w, req)
+	if !ok {
+		return
+	}
+	p, ok := ac.pagination(w, req)
+	if !ok {
+		return
+	}
+	images, err := ac.is.ByGalleryID(gallery.ID)
+	if err != nil {
+		ac.renderError(w, req, err)
+		return
+	}
+	list := APIImageList{
+		Data:       []APIImage{},
+		Pagination: newAPIPagination(p, len(images)),
+	}
+	start, end := p.Offset(), p.Offset()+p.Limit()
+	if start > len(images) {
+		start = len(images)
+	}
+	if end > len(images) {
+		end = len(images)
+	}
+	for i := start; i < end; i++ {
+		list.Data = append(list.Data, newAPIImage(&images[i]))
+	}
+	views.RenderJSON(w, http.StatusOK, list)
+}
+
+// POST /api/v1/galleries/{id}/images
+func (ac *APIController) UploadImages(w http.ResponseWriter, req *http.Request) {
+	gallery, ok := ac.gallery(w, req)
+	if !ok {
+		return
+	}
+	req.Body = http.MaxBytesReader(w, req.Body, ac.maxUpload)
+	if err := req.ParseMultipartForm(maxUploadMemory); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			views.RenderJSONError(w, http.StatusRequestEntityTooLarge, "too_large",
+				fmt.Sprintf("Uploads are limited to %s", formatBytes(tooLarge.Limit)))
+			return
+		}
+		ac.renderBadRequest(w, err)
+		return
+	}
+	files := req.MultipartForm.File["images"]
+	if len(files) == 0 {
+		views.RenderJSONError(w, http.StatusBadRequest, "bad_request",
+			"Upload at least one file in the images field")
+		return
+	}
+	
+	uploaded := make([]APIImage, 0, len(files))
+	for _, f := range files {
+		file, err := f.Open()
+		if err != nil {
+			ac.renderError(w, req, err)
+			return
+		}
+		if err := ac.is.Create(req.Context(), gallery.ID, f.Filename, file); err != nil {
+			ac.renderError(w, req, err)
+			return
+		}
+		uploaded = append(uploaded, newAPIImage(&models.Image{
+			GalleryID: gallery.ID,
+			Filename:  f.Filename,
+		}))
+	}
+	views.RenderJSON(w, http.StatusCreated, uploaded)
+}
+
+// PATCH /api/v1/galleries/{id}/images/{filename}
+func (ac *APIController) UpdateImage(w http.ResponseWriter, req *http.Request) {
+	image, ok := ac.image(w, req)
+	if !ok {
+		return
+	}
+	var form forms.ImageForm
+	if err := forms.ParseJSON(req, &form); err != nil {
+		ac.renderBadRequest(w, err)
+		return
+	}
+	if err := ac.is.Rename(image, form.Filename); err != nil {
+		ac.renderError(w, req, err)
+		return
+	}
+	views.RenderJSON(w, http.StatusOK, newAPIImage(image))
+}
+
+// DELETE /api/v1/galleries/{id}/images/{filename}
+func (ac *APIController) DeleteImage(w http.ResponseWriter, req *http.Request) {
+	image, ok := ac.image(w, req)
+	if !ok {
+		return
+	}
+	if err := ac.is.Delete(req.Context(), image); err != nil {
+		ac.renderError(w, req, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// NotFound answers requests to unknown API routes
+func (ac *APIController) NotFound(w http.ResponseWriter, req *http.Request) {
+	views.RenderJSONError(w, http.StatusNotFound, "not_found", "Resource not found")
+}
+
+// gallery looks up the gallery in the URL and makes sure it belongs to the
+// current user
+func (ac *APIController) gallery(w http.ResponseWriter, req *http.Request) (*models.Gallery, bool) {
+	id, err := strconv.Atoi(mux.Vars(req)["id"])
+	if err != nil || id <= 0 {
+		ac.renderError(w, req, models.ErrIDInvalid)
+		return nil, false
+	}
+	gallery, err := ac.gs.ByID(uint(id))
+	if err != nil {
+		ac.renderError(w, req, err)
+		return nil, false
+	}
+	if gallery.UserID != context.User(req.Context()).ID {
+		ac.renderError(w, req, models.ErrNotFound)
+		return nil, false
+	}
+	return gallery, true
+}
+
+func (ac *APIController) image(w http.ResponseWriter, req *http.Request) (*models.Image, bool) {
+	gallery, ok := ac.gallery(w, req)
+	if !ok {
+		return nil, false
+	}
+	image, err := ac.is.ByFilename(gallery.ID, mux.Vars(req)["filename"])
+	if err != nil {
+		ac.renderError(w, req, err)
+		return nil, false
+	}
+	return image, true
+}
+
+func (ac *APIController) pagination(w http.ResponseWriter, req *http.Request) (models.Pagination, bool) {
+	var form forms.PageForm
+	if err := forms.ParseURLParams(req, &form); err != nil {
+		ac.renderBadRequest(w, err)
+		return models.Pagination{}, false
+	}
+	return models.NewPagination(form.Page, form.PerPage), true
+}
+
+// renderError maps model errors to HTTP statuses. Errors which aren't
+// meant for the public are logged and reported as internal errors.
+func (ac *APIController) renderError(w http.ResponseWriter, req *http.Request, err error) {
+	switch err {
+	case models.ErrNotFound:
+		views.RenderJSONError(w, http.StatusNotFound, "not_found", "Resource not found")
+		return
+	case models.ErrIDInvalid:
+		views.RenderJSONError(w, http.StatusBadRequest, "invalid_id", "ID is invalid")
+		return
+	}
+	if pErr, ok := err.(views.PublicError); ok {
+		views.RenderJSONError(w, http.StatusUnprocessableEntity, "validation_failed", pErr.Public())
+		return
+	}
+	slog.ErrorContext(req.Context(), "API request failed", "err", err)
+	views.RenderJSONError(w, http.StatusInternalServerError, "internal_error", views.AlertMessageGeneric)
+}
+
+// renderBadRequest reports request bodies or parameters which couldn't be
+// parsed
+func (ac *APIController) renderBadRequest(w http.ResponseWriter, err error) {
+	views.RenderJSONError(w, http.StatusBadRequest, "bad_request", err.Error())
+}
+
+func newAPIGallery(gallery *models.Gallery) APIGallery {
+	return APIGallery{
+		ID:        gallery.ID,
+		Title:     gallery.Title,
+		URL:       fmt.Sprintf("/galleries/%d", gallery.ID),
+		CreatedAt: gallery.CreatedAt,
+		UpdatedAt: gallery.UpdatedAt,
+	}
+}
+
+func newAPIImage(image *models.Image) APIImage {
+	return APIImage{
+		GalleryID: image.GalleryID,
+		Filename:  image.Filename,
+		URL:       image.Path(),
+	}
+}
+
+func newAPIPagination(p models.Pagination, total int) APIPagination {
+	return APIPagination{
+		Page:       p.Page,
+		PerPage:    p.PerPage,
+		Total:      total,
+		TotalPages: p.TotalPages(total),
+	}
+}
@@ -0,0 +1,137 @@
+package controllers
+
+import (
+	"gallerio/utils/openapi"
+	"gallerio/views"
+	"net/http"
+	"strconv"
+)
+
+// APIVersion is the version of the API contract in the OpenAPI document
+const APIVersion = "1.0.0"
+
+// GET /api/openapi.json
+func (ac *APIController) Spec(w http.ResponseWriter, req *http.Request) {
+	views.RenderJSON(w, http.StatusOK, ac.OpenAPI())
+}
+
+// OpenAPI generates the OpenAPI document from the route table, so the
+// document can't describe routes or types the handlers don't use. Paths are
+// relative to the server URL, which is APIPrefix.
+func (ac *APIController) OpenAPI() *openapi.Document {
+	doc := openapi.New("Gallerio API", APIVersion)
+	doc.Servers = []openapi.Server{{URL: APIPrefix}}
+	doc.Components.SecuritySchemes = map[string]*openapi.SecurityScheme{
+		"bearer": {
+			Type:        "http",
+			Scheme:      "bearer",
+			Description: "A personal API token created under Account, API Tokens",
+		},
+	}
+	errorSchema := doc.SchemaOf(views.ErrorResponse{})
+	
+	for _, route := range ac.Routes() {
+		path, names, patterns := openapi.PathParams(route.Path)
+		op := &openapi.Operation{
+			OperationID: route.Name,
+			Summary:     route.Summary,
+			Security:    []map[string][]string{{"bearer": {route.Scope}}},
+			Responses:   map[string]*openapi.Response{},
+		}
+		
+		for i, name := range names {
+			schema := &openapi.Schema{Type: "string", Pattern: anchor(patterns[i])}
+			if name == "id" {
+				schema = &openapi.Schema{Type: "integer", Format: "int32"}
+			}
+			op.Parameters = append(op.Parameters, openapi.Parameter{
+				Name:     name,
+				In:       "path",
+				Required: true,
+				Schema:   schema,
+			})
+		}
+		if route.Paginated {
+			for _, name := range []string{"page", "per_page"} {
+				op.Parameters = append(op.Parameters, openapi.Parameter{
+					Name:   name,
+					In:     "query",
+					Schema: &openapi.Schema{Type: "integer", Format: "int32"},
+				})
+			}
+		}
+		
+		switch {
+		case route.Request != nil:
+			op.RequestBody = &openapi.RequestBody{
+				Required: true,
+				Content: map[string]*openapi.MediaType{
+					"application/json": {Schema: doc.SchemaOf(route.Request)},
+				},
+			}
+		case route.Upload != "":
+			closed := false
+			op.RequestBody = &openapi.RequestBody{
+				Required: true,
+				Content: map[string]*openapi.MediaType{
+					"multipart/form-data": {Schema: &openapi.Schema{
+						Type: "object",
+						Properties: map[string]*openapi.Schema{
+							route.Upload: {
+								Type:  "array",
+								Items: &openapi.Schema{Type: "string", Format: "binary"},
+							},
+						},
+						Required:             []string{route.Upload},
+						AdditionalProperties: &closed,
+					}},
+				},
+			}
+		}
+		
+		success := &openapi.Response{Description: http.StatusText(route.Status)}
+		if route.Response != nil {
+			success.Content = map[string]*openapi.MediaType{
+				"application/json": {Schema: doc.SchemaOf(route.Response)},
+			}
+		}
+		op.Responses[strconv.Itoa(route.Status)] = success
+		for _, status := range apiErrorStatuses(route, len(names) > 0) {
+			op.Responses[strconv.Itoa(status)] = &openapi.Response{
+				Description: http.StatusText(status),
+				Content: map[string]*openapi.MediaType{
+					"application/json": {Schema: errorSchema},
+				},
+			}
+		}
+		doc.AddOperation(path, route.Method, op)
+	}
+	return doc
+}
+
+// apiErrorStatuses lists the error statuses renderError and the middlewares
+// can respond to the route with
+func apiErrorStatuses(route APIRoute, hasParams bool) []int {
+	statuses := []int{http.StatusUnauthorized, http.StatusForbidden}
+	if hasParams || route.Paginated || route.Request != nil || route.Upload != "" {
+		statuses = append(statuses, http.StatusBadRequest)
+	}
+	if hasParams {
+		statuses = append(statuses, http.StatusNotFound)
+	}
+	if route.Upload != "" {
+		statuses = append(statuses, http.StatusRequestEntityTooLarge)
+	}
+	if route.Request != nil || route.Upload != "" {
+		statuses = append(statuses, http.StatusUnprocessableEntity)
+	}
+	return append(statuses, http.StatusInternalServerError)
+}
+
+// anchor turns a mux variable pattern into a full match pattern
+func anchor(pattern string) string {
+	if pattern == "" {
+		return ""
+	}
+	return "^" + pattern + "$"
+}
@@ -0,0 +1,344 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"gallerio/middlewares"
+	"gallerio/models"
+	"gallerio/utils/openapi"
+	"github.com/gorilla/mux"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+type apiTestGalleries struct {
+	galleries map[uint]*models.Gallery
+	nextID    uint
+}
+
+func (g *apiTestGalleries) ByUserID(userID uint) ([]models.Gallery, error) {
+	var galleries []models.Gallery
+	for id := uint(1); id < g.nextID; id++ {
+		if gallery, ok := g.galleries[id]; ok && gallery.UserID == userID {
+			galleries = append(galleries, *gallery)
+		}
+	}
+	return galleries, nil
+}
+
+func (g *apiTestGalleries) PageByUserID(userID uint, p models.Pagination) ([]models.Gallery, int, error) {
+	galleries, _ := g.ByUserID(userID)
+	total := len(galleries)
+	if p.Offset() >= total {
+		return nil, total, nil
+	}
+	end := p.Offset() + p.Limit()
+	if end > total {
+		end = total
+	}
+	return galleries[p.Offset():end], total, nil
+}
+
+func (g *apiTestGalleries) Search(query string, p models.Pagination) ([]models.Gallery, int, error) {
+	return nil, 0, nil
+}
+
+func (g *apiTestGalleries) ByID(id uint) (*models.Gallery, error) {
+	gallery, ok := g.galleries[id]
+	if !ok {
+		return nil, models.ErrNotFound
+	}
+	copied := *gallery
+	return &copied, nil
+}
+
+func (g *apiTestGalleries) Create(ctx context.Context, gallery *models.Gallery) error {
+	if gallery.Title == "" {
+		return models.ErrTitleRequired
+	}
+	gallery.ID = g.nextID
+	g.nextID++
+	copied := *gallery
+	g.galleries[gallery.ID] = &copied
+	return nil
+}
+
+func (g *apiTestGalleries) Update(ctx context.Context, gallery *models.Gallery) error {
+	if gallery.Title == "" {
+		return models.ErrTitleRequired
+	}
+	copied := *gallery
+	g.galleries[gallery.ID] = &copied
+	return nil
+}
+
+func (g *apiTestGalleries) Delete(ctx context.Context, id uint) error {
+	delete(g.galleries, id)
+	return nil
+}
+
+type apiTestUsers struct {
+	models.UserService
+}
+
+func (u *apiTestUsers) ByID(id uint) (*models.User, error) {
+	user := models.User{Username: fmt.Sprintf("user%d", id)}
+	user.ID = id
+	return &user, nil
+}
+
+type apiTestTokens struct {
+	models.APITokenService
+	tokens map[string]*models.APIToken
+}
+
+func (t *apiTestTokens) Authenticate(token string) (*models.APIToken, error) {
+	apiToken, ok := t.tokens[token]
+	if !ok {
+		return nil, models.ErrTokenInvalid
+	}
+	return apiToken, nil
+}
+
+// newAPITestServer builds the API routes the way main does, with
+// in-memory galleries and images stored in a temporary directory
+func newAPITestServer(t *testing.T) (*mux.Router, *APIController) {
+	dir, err := os.MkdirTemp("", "gallerio-api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.Chdir(wd)
+		os.RemoveAll(dir)
+	})
+	
+	galleries := &apiTestGalleries{galleries: map[uint]*models.Gallery{}, nextID: 1}
+	galleries.Create(context.Background(), &models.Gallery{UserID: 2, Title: "Someone else's"})
+	ac := NewAPIController(galleries, models.NewImageService(), 10<<20)
+	
+	tokens := &apiTestTokens{tokens: map[string]*models.APIToken{
+		"full":     {UserID: 1, Scopes: "galleries:read galleries:write images:read images:write"},
+		"readonly": {UserID: 1, Scopes: "galleries:read"},
+	}}
+	bearerMw := middlewares.BearerToken{APITokenService: tokens}
+	router := mux.NewRouter()
+	router.HandleFunc("/api/openapi.json", ac.Spec).Methods("GET")
+	apiRouter := router.PathPrefix(APIPrefix).Subrouter()
+	for _, route := range ac.Routes() {
+		scopeMw := middlewares.RequireScope{
+			UserService: &apiTestUsers{},
+			Scope:       route.Scope,
+		}
+		apiRouter.HandleFunc(route.Path, bearerMw.ApplyFunc(scopeMw.ApplyFunc(route.Handler))).
+			Methods(route.Method).Name(route.Name)
+	}
+	apiRouter.NotFoundHandler = http.HandlerFunc(ac.NotFound)
+	return router, ac
+}
+
+// serveAPI performs the request and fails the test unless the response
+// has the expected status and conforms to the OpenAPI document
+func serveAPI(t *testing.T, router *mux.Router, doc *openapi.Document, req *http.Request, status int) map[string]interface{} {
+	t.Helper()
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != status {
+		t.Fatalf("%s %s: expected status %d, got %d: %s", req.Method, req.URL, status, w.Code, w.Body)
+	}
+	
+	var match mux.RouteMatch
+	if !router.Match(req, &match) || match.Route == nil || match.Route.GetName() == "" {
+		t.Fatalf("%s %s: no named API route", req.Method, req.URL)
+	}
+	tpl, err := match.Route.GetPathTemplate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	path, _, _ := openapi.PathParams(tpl[len(APIPrefix):])
+	op := doc.Operation(path, req.Method)
+	if op == nil {
+		t.Fatalf("%s %s: operation is not documented", req.Method, path)
+	}
+	res, ok := op.Responses[strconv.Itoa(w.Code)]
+	if !ok {
+		t.Fatalf("%s %s: status %d is not documented", req.Method, path, w.Code)
+	}
+	if res.Content == nil {
+		if w.Body.Len() > 0 {
+			t.Fatalf("%s %s: documented without body, got %s", req.Method, path, w.Body)
+		}
+		return nil
+	}
+	
+	media, ok := res.Content[w.Header().Get("Content-Type")]
+	if !ok {
+		media, ok = res.Content["application/json"]
+		if !ok || w.Header().Get("Content-Type") != "application/json; charset=utf-8" {
+			t.Fatalf("%s %s: undocumented content type %q", req.Method, path, w.Header().Get("Content-Type"))
+		}
+	}
+	var body interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("%s %s: invalid JSON: %v", req.Method, path, err)
+	}
+	if err := doc.Validate(media.Schema, body); err != nil {
+		t.Fatalf("%s %s: response doesn't match the spec: %v\n%s", req.Method, path, err, w.Body)
+	}
+	obj, _ := body.(map[string]interface{})
+	return obj
+}
+
+func newAPIRequest(method, url, token, body string) *http.Request {
+	req := httptest.NewRequest(method, url, bytes.NewBufferString(body))
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return req
+}
+
+func newUploadRequest(t *testing.T, url, token string, files map[string]string) *http.Request {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for name, content := range files {
+		part, err := mw.CreateFormFile("images", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write([]byte(content))
+	}
+	mw.Close()
+	req := httptest.NewRequest(http.MethodPost, url, &buf)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer "+token)
+	return req
+}
+
+func TestAPIResponsesMatchSpec(t *testing.T) {
+	router, ac := newAPITestServer(t)
+	doc := ac.OpenAPI()
+	
+	serveAPI(t, router, doc, newAPIRequest("GET", "/api/v1/galleries", "", ""), http.StatusUnauthorized)
+	serveAPI(t, router, doc, newAPIRequest("GET", "/api/v1/galleries", "bogus", ""), http.StatusUnauthorized)
+	serveAPI(t, router, doc, newAPIRequest("POST", "/api/v1/galleries", "readonly", `{"title":"Trip"}`), http.StatusForbidden)
+	serveAPI(t, router, doc, newAPIRequest("POST", "/api/v1/galleries", "full", `{"title":`), http.StatusBadRequest)
+	serveAPI(t, router, doc, newAPIRequest("POST", "/api/v1/galleries", "full", `{"title":""}`), http.StatusUnprocessableEntity)
+	
+	created := serveAPI(t, router, doc, newAPIRequest("POST", "/api/v1/galleries", "full", `{"title":"Trip"}`), http.StatusCreated)
+	gallery := fmt.Sprintf("/api/v1/galleries/%v", created["id"])
+	
+	list := serveAPI(t, router, doc, newAPIRequest("GET", "/api/v1/galleries?per_page=1", "readonly", ""), http.StatusOK)
+	if data := list["data"].([]interface{}); len(data) != 1 {
+		t.Fatalf("expected only the user's own gallery, got %v", data)
+	}
+	serveAPI(t, router, doc, newAPIRequest("GET", gallery, "readonly", ""), http.StatusOK)
+	serveAPI(t, router, doc, newAPIRequest("GET", "/api/v1/galleries/1", "readonly", ""), http.StatusNotFound)
+	serveAPI(t, router, doc, newAPIRequest("PATCH", gallery, "full", `{"title":"Summer Trip"}`), http.StatusOK)
+	
+	serveAPI(t, router, doc, newUploadRequest(t, gallery+"/images", "full", map[string]string{
+		"beach.jpg": "not really a jpeg",
+		"dunes.jpg": "not really a jpeg either",
+	}), http.StatusCreated)
+	images := serveAPI(t, router, doc, newAPIRequest("GET", gallery+"/images?page=1&per_page=1", "full", ""), http.StatusOK)
+	if total := images["pagination"].(map[string]interface{})["total"]; total != float64(2) {
+		t.Fatalf("expected 2 images, got %v", total)
+	}
+	serveAPI(t, router, doc, newAPIRequest("PATCH", gallery+"/images/beach.jpg", "full", `{"filename":"../beach.jpg"}`), http.StatusUnprocessableEntity)
+	serveAPI(t, router, doc, newAPIRequest("PATCH", gallery+"/images/beach.jpg", "full", `{"filename":"sea.jpg"}`), http.StatusOK)
+	serveAPI(t, router, doc, newAPIRequest("DELETE", gallery+"/images/beach.jpg", "full", ""), http.StatusNotFound)
+	serveAPI(t, router, doc, newAPIRequest("DELETE", gallery+"/images/sea.jpg", "full", ""), http.StatusNoContent)
+	
+	serveAPI(t, router, doc, newAPIRequest("DELETE", gallery, "full", ""), http.StatusNoContent)
+	serveAPI(t, router, doc, newAPIRequest("GET", gallery, "full", ""), http.StatusNotFound)
+}
+
+func TestAPISpecCoversRouteTable(t *testing.T) {
+	router, ac := newAPITestServer(t)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/openapi.json", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+	var doc openapi.Document
+	if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.OpenAPI != openapi.Version {
+		t.Errorf("expected openapi %s, got %q", openapi.Version, doc.OpenAPI)
+	}
+	
+	for _, route := range ac.Routes() {
+		path, params, _ := openapi.PathParams(route.Path)
+		op := doc.Operation(path, route.Method)
+		if op == nil {
+			t.Errorf("%s %s is not documented", route.Method, path)
+			continue
+		}
+		if op.OperationID != route.Name {
+			t.Errorf("%s %s: expected operationId %q, got %q", route.Method, path, route.Name, op.OperationID)
+		}
+		if _, ok := op.Responses[strconv.Itoa(route.Status)]; !ok {
+			t.Errorf("%s %s: success status %d is not documented", route.Method, path, route.Status)
+		}
+		documented := map[string]bool{}
+		for _, param := range op.Parameters {
+			documented[param.Name] = true
+		}
+		for _, param := range params {
+			if !documented[param] {
+				t.Errorf("%s %s: path parameter %q is not documented", route.Method, path, param)
+			}
+		}
+		for _, res := range op.Responses {
+			for _, media := range res.Content {
+				if err := resolvable(&doc, media.Schema); err != nil {
+					t.Errorf("%s %s: %v", route.Method, path, err)
+				}
+			}
+		}
+	}
+}
+
+func resolvable(doc *openapi.Document, s *openapi.Schema) error {
+	if s.Ref != "" {
+		name := s.Ref[len("#/components/schemas/"):]
+		if _, ok := doc.Components.Schemas[name]; !ok {
+			return fmt.Errorf("unknown schema %s", s.Ref)
+		}
+	}
+	if s.Items != nil {
+		return resolvable(doc, s.Items)
+	}
+	return nil
+}
+
+func TestAPIUploadIsLimited(t *testing.T) {
+	router, ac := newAPITestServer(t)
+	doc := ac.OpenAPI()
+	ac.maxUpload = 1 << 10
+	
+	created := serveAPI(t, router, doc, newAPIRequest("POST", "/api/v1/galleries", "full", `{"title":"Trip"}`), http.StatusCreated)
+	images := fmt.Sprintf("/api/v1/galleries/%v/images", created["id"])
+	serveAPI(t, router, doc, newUploadRequest(t, images, "full", map[string]string{
+		"beach.jpg": strings.Repeat("x", 2<<10),
+	}), http.StatusRequestEntityTooLarge)
+	serveAPI(t, router, doc, newUploadRequest(t, images, "full", map[string]string{
+		"beach.jpg": "not really a jpeg",
+	}), http.StatusCreated)
+}
@@ -0,0 +1,137 @@
+package controllers
+
+import (
+	"fmt"
+	"gallerio/forms"
+	"gallerio/models"
+	"gallerio/utils/context"
+	"gallerio/views"
+	"github.com/gorilla/mux"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func NewAPITokensController(ats models.APITokenService, al models.AuditLogService) *APITokensController {
+	return &APITokensController{
+		IndexView: views.NewView("base", "user/tokens"),
+		ats:       ats,
+		al:        al,
+	}
+}
+
+type APITokensController struct {
+	IndexView *views.View
+	ats       models.APITokenService
+	al        models.AuditLogService
+}
+
+type APITokens struct {
+	Tokens []models.APIToken
+	Scopes []string
+	// Token is only set right after it was created, as it is stored hashed
+	Token string
+}
+
+func (at APITokens) JSONContent() interface{} {
+	tokens := make([]models.PublicAPIToken, len(at.Tokens))
+	for i := range at.Tokens {
+		tokens[i] = at.Tokens[i].Public()
+	}
+	return struct {
+		Tokens []models.PublicAPIToken `json:"tokens"`
+		Scopes []string                `json:"scopes"`
+		Token  string                  `json:"token,omitempty"`
+	}{tokens, at.Scopes, at.Token}
+}
+
+// GET /account/tokens
+func (atc *APITokensController) Index(w http.ResponseWriter, req *http.Request) {
+	atc.render(w, req, views.Data{}, "")
+}
+
+// POST /account/tokens
+func (atc *APITokensController) Create(w http.ResponseWriter, req *http.Request) {
+	user := context.User(req.Context())
+	var data views.Data
+	var form forms.APITokenForm
+	if err := forms.ParseForm(req, &form); err != nil {
+		data.SetAlert(req.Context(), err)
+		atc.render(w, req, data, "")
+		return
+	}
+	
+	token := models.APIToken{
+		UserID: user.ID,
+		Name:   form.Name,
+		Scopes: strings.Join(form.Scopes, " "),
+	}
+	if form.ExpiresInDays > 0 {
+		expiresAt := time.Now().AddDate(0, 0, form.ExpiresInDays)
+		token.ExpiresAt = &expiresAt
+	}
+	if err := atc.ats.Create(&token); err != nil {
+		data.SetAlert(req.Context(), err)
+		atc.render(w, req, data, "")
+		return
+	}
+	recordEvent(atc.al, req, models.AuditLog{
+		UserID: user.ID,
+		Action: models.AuditAPITokenCreated,
+		Detail: fmt.Sprintf("%q with scopes %s", token.Name, token.Scopes),
+	})
+	data.AlertSuccess("Token created. Copy it now, it won't be shown again")
+	atc.render(w, req, data, token.Token)
+}
+
+// POST /account/tokens/{id}/delete
+func (atc *APITokensController) Delete(w http.ResponseWriter, req *http.Request) {
+	user := context.User(req.Context())
+	id, err := strconv.Atoi(mux.Vars(req)["id"])
+	if err != nil {
+		views.Error(w, req, "Invalid Token ID", http.StatusBadRequest)
+		return
+	}
+	token, err := atc.ats.ByID(uint(id))
+	if err != nil || token.UserID != user.ID {
+		views.Error(w, req, "Token not found", http.StatusNotFound)
+		return
+	}
+	
+	alert := views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: fmt.Sprintf("Token %q was revoked", token.Name),
+	}
+	if err := atc.ats.Delete(token.ID); err != nil {
+		var data views.Data
+		data.SetAlert(req.Context(), err)
+		alert = *data.Alert
+	} else {
+		recordEvent(atc.al, req, models.AuditLog{
+			UserID: user.ID,
+			Action: models.AuditAPITokenRevoked,
+			Detail: fmt.Sprintf("%q", token.Name),
+		})
+	}
+	views.RedirectAlert(w, req, "/account/tokens", http.StatusSeeOther, alert)
+}
+
+func (atc *APITokensController) render(w http.ResponseWriter, req *http.Request, data views.Data, token string) {
+	user := context.User(req.Context())
+	tokens, err := atc.ats.ByUserID(user.ID)
+	if err != nil {
+		if data.Alert == nil {
+			data.SetAlert(req.Context(), err)
+		} else {
+			slog.ErrorContext(req.Context(), "loading API tokens failed", "err", err)
+		}
+	}
+	data.Content = APITokens{
+		Tokens: tokens,
+		Scopes: models.Scopes,
+		Token:  token,
+	}
+	atc.IndexView.Render(w, req, data)
+}
@@ -0,0 +1,19 @@
+package controllers
+
+import (
+	"gallerio/models"
+	"gallerio/utils/ip"
+	"log/slog"
+	"net/http"
+)
+
+// recordEvent writes the entry to the audit log along with the IP address
+// and user agent of the request. Failing to record must not fail the
+// request, so errors are only logged.
+func recordEvent(al models.AuditLogService, req *http.Request, entry models.AuditLog) {
+	entry.IP = ip.FromRequest(req)
+	entry.UserAgent = req.UserAgent()
+	if err := al.Create(&entry); err != nil {
+		slog.ErrorContext(req.Context(), "recording audit log entry failed", "action", entry.Action, "err", err)
+	}
+}
@@ -0,0 +1,85 @@
+package controllers
+
+import (
+	"fmt"
+	"gallerio/models"
+	"gallerio/utils/context"
+	"gallerio/utils/email"
+	"gallerio/utils/jobs"
+	"gallerio/utils/logging"
+	"gallerio/views"
+	"log/slog"
+	"net/http"
+)
+
+func NewDataExportsController(des models.DataExportService, mg email.Client, runner *jobs.Runner) *DataExportsController {
+	return &DataExportsController{
+		des:    des,
+		mg:     mg,
+		runner: runner,
+	}
+}
+
+type DataExportsController struct {
+	des    models.DataExportService
+	mg     email.Client
+	runner *jobs.Runner
+}
+
+// POST /account/export
+func (dc *DataExportsController) Create(w http.ResponseWriter, req *http.Request) {
+	user := context.User(req.Context())
+	var data views.Data
+	exports, err := dc.des.ByUserID(user.ID)
+	if err != nil {
+		data.SetAlert(req.Context(), err)
+		views.RedirectAlert(w, req, "/account", http.StatusSeeOther, *data.Alert)
+		return
+	}
+	for _, export := range exports {
+		if export.InProgress() {
+			data.AlertInfo("Your data is already being prepared. We will email you once it is ready")
+			views.RedirectAlert(w, req, "/account", http.StatusSeeOther, *data.Alert)
+			return
+		}
+	}
+	
+	export := &models.DataExport{UserID: user.ID}
+	if err := dc.des.Create(export); err != nil {
+		data.SetAlert(req.Context(), err)
+		views.RedirectAlert(w, req, "/account", http.StatusSeeOther, *data.Alert)
+		return
+	}
+	// The token is only known until the export is stored, so it has to be
+	// captured here for the email.
+	token, name, address := export.Token, user.Name, user.Email
+	reqCtx := req.Context()
+	dc.runner.Go(func(ctx context.Context) {
+		ctx = logging.Inherit(ctx, reqCtx)
+		if err := dc.des.Build(export); err != nil {
+			slog.ErrorContext(ctx, "building data export failed", "export_id", export.ID, "err", err)
+			return
+		}
+		// Failures are logged by the email client
+		dc.mg.DataExportReady(ctx, name, address, token, *export.ExpiresAt)
+	})
+	
+	data.AlertInfo("We are preparing a copy of your data. " +
+		"You will receive an email with a download link once it is ready")
+	views.RedirectAlert(w, req, "/account", http.StatusSeeOther, *data.Alert)
+}
+
+// GET /account/export/download
+func (dc *DataExportsController) Download(w http.ResponseWriter, req *http.Request) {
+	user := context.User(req.Context())
+	export, err := dc.des.ByToken(req.URL.Query().Get("token"))
+	if err != nil || export.UserID != user.ID ||
+		export.Status != models.DataExportReady || export.Expired() {
+		views.Error(w, req, "Export Not Found", http.StatusNotFound)
+		return
+	}
+	filename := fmt.Sprintf("gallerio-export-%s.zip", export.CreatedAt.Format("2006-01-02"))
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	http.ServeFile(w, req, export.Path)
+}
@@ -5,11 +5,14 @@ import (
 	"gallerio/forms"
 	"gallerio/models"
 	"gallerio/utils/context"
+	"gallerio/utils/ip"
+	"gallerio/utils/ratelimit"
 	"gallerio/views"
 	"github.com/gorilla/mux"
-	"log"
+	"log/slog"
 	"net/http"
 	"strconv"
+	"time"
 )
 
 var (
@@ -17,9 +20,15 @@ var (
 	EditGalleryName = "show_gallery"
 	
 	maxMemoryLimit int64 = 1 << 20 // 1MB
+	// shareViewInterval is how often the views of a gallery by the same
+	// viewer are sent to webhooks, views in between are not sent
+	shareViewInterval = 30 * time.Minute
 )
 
-func NewGalleriesController(gs models.GalleryService, is models.ImageService, router *mux.Router) *GalleriesController {
+// NewGalleriesController remembers recent views of shared galleries in
+// store, so reloading a page doesn't notify webhooks every time
+func NewGalleriesController(gs models.GalleryService, is models.ImageService, ws models.WebhookService,
+	store ratelimit.Store, router *mux.Router) *GalleriesController {
 	return &GalleriesController{
 		New:       views.NewView("base", "gallery/new"),
 		IndexView: views.NewView("base", "gallery/index"),
@@ -28,6 +37,13 @@ func NewGalleriesController(gs models.GalleryService, is models.ImageService, ro
 		router:    router,
 		gs:        gs,
 		is:        is,
+		ws:        ws,
+		views: ratelimit.NewLimiter(store, ratelimit.Policy{
+			MaxAttempts: 1,
+			Window:      shareViewInterval,
+			Lockout:     shareViewInterval,
+			MaxLockout:  shareViewInterval,
+		}),
 	}
 }
 
@@ -39,6 +55,8 @@ type GalleriesController struct {
 	router    *mux.Router
 	gs        models.GalleryService
 	is        models.ImageService
+	ws        models.WebhookService
+	views     *ratelimit.Limiter
 }
 
 // POST /galleries
@@ -46,7 +64,7 @@ func (gc *GalleriesController) Index(w http.ResponseWriter, req *http.Request) {
 	user := context.User(req.Context())
 	galleries, err := gc.gs.ByUserID(user.ID)
 	if err != nil {
-		http.Error(w, views.AlertMessageGeneric, http.StatusInternalServerError)
+		views.Error(w, req, views.AlertMessageGeneric, http.StatusInternalServerError)
 		return
 	}
 	data := views.Data{Content: galleries}
@@ -58,8 +76,7 @@ func (gc *GalleriesController) Create(w http.ResponseWriter, req *http.Request)
 	var data views.Data
 	var form forms.GalleryForm
 	if err := forms.ParseForm(req, &form); err != nil {
-		log.Println(err)
-		data.SetAlert(err)
+		data.SetAlert(req.Context(), err)
 		gc.New.Render(w, req, data)
 		return
 	}
@@ -70,9 +87,8 @@ func (gc *GalleriesController) Create(w http.ResponseWriter, req *http.Request)
 		Title:  form.Title,
 		UserID: user.ID,
 	}
-	if err := gc.gs.Create(&gallery); err != nil {
-		log.Println(err)
-		data.SetAlert(err)
+	if err := gc.gs.Create(req.Context(), &gallery); err != nil {
+		data.SetAlert(req.Context(), err)
 		gc.New.Render(w, req, data)
 		return
 	}
@@ -91,10 +107,42 @@ func (gc *GalleriesController) Show(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 	gallery.Images, _ = gc.is.ByGalleryID(gallery.ID)
+	// Owners looking at their own gallery don't count as a view of the link
+	user := context.User(req.Context())
+	if user == nil || user.ID != gallery.UserID {
+		gc.viewed(req, gallery)
+	}
 	data := views.Data{Content: gallery}
 	gc.ShowView.Render(w, req, data)
 }
 
+// viewed sends the view of a shared gallery to webhooks, unless the same
+// viewer was sent within shareViewInterval
+func (gc *GalleriesController) viewed(req *http.Request, gallery *models.Gallery) {
+	viewer := "ip:" + ip.FromRequest(req)
+	if user := context.User(req.Context()); user != nil {
+		viewer = "user:" + strconv.FormatUint(uint64(user.ID), 10)
+	}
+	bucket := fmt.Sprintf("view:gallery:%d:%s", gallery.ID, viewer)
+	wait, err := gc.views.Check(bucket)
+	if err != nil {
+		slog.ErrorContext(req.Context(), "checking gallery view failed", "err", err)
+		return
+	}
+	if wait > 0 {
+		return
+	}
+	if err := gc.views.Fail(bucket); err != nil {
+		slog.ErrorContext(req.Context(), "recording gallery view failed", "err", err)
+		return
+	}
+	err = gc.ws.Dispatch(gallery.UserID, models.EventShareLinkViewed, models.NewWebhookGallery(gallery))
+	if err != nil {
+		slog.ErrorContext(req.Context(), "queueing webhook failed",
+			"event", models.EventShareLinkViewed, "err", err)
+	}
+}
+
 // GET /galleries/{id}/edit
 func (gc *GalleriesController) Edit(w http.ResponseWriter, req *http.Request) {
 	gallery, err := gc.galleryByID(w, req)
@@ -103,7 +151,7 @@ func (gc *GalleriesController) Edit(w http.ResponseWriter, req *http.Request) {
 	}
 	user := context.User(req.Context())
 	if user.ID != gallery.UserID {
-		http.Error(w, "Gallery Not Found", http.StatusNotFound)
+		views.Error(w, req, "Gallery Not Found", http.StatusNotFound)
 		return
 	}
 	gallery.Images, _ = gc.is.ByGalleryID(gallery.ID)
@@ -119,23 +167,22 @@ func (gc *GalleriesController) Update(w http.ResponseWriter, req *http.Request)
 	}
 	user := context.User(req.Context())
 	if user.ID != gallery.UserID {
-		http.Error(w, "Gallery Not Found", http.StatusNotFound)
+		views.Error(w, req, "Gallery Not Found", http.StatusNotFound)
 		return
 	}
 	
 	data := views.Data{Content: gallery}
 	var form forms.GalleryForm
 	if err := forms.ParseForm(req, &form); err != nil {
-		log.Println(err)
-		data.SetAlert(err)
+		data.SetAlert(req.Context(), err)
 		gc.EditView.Render(w, req, data)
 		return
 	}
 	
 	gallery.Title = form.Title
-	err = gc.gs.Update(gallery)
+	err = gc.gs.Update(req.Context(), gallery)
 	if err != nil {
-		data.SetAlert(err)
+		data.SetAlert(req.Context(), err)
 		gc.EditView.Render(w, req, data)
 		return
 	}
@@ -151,14 +198,14 @@ func (gc *GalleriesController) UploadImage(w http.ResponseWriter, req *http.Requ
 	}
 	user := context.User(req.Context())
 	if user.ID != gallery.UserID {
-		http.Error(w, "Gallery Not Found", http.StatusNotFound)
+		views.Error(w, req, "Gallery Not Found", http.StatusNotFound)
 		return
 	}
 	
 	data := views.Data{Content: gallery}
 	err = req.ParseMultipartForm(maxMemoryLimit)
 	if err != nil {
-		data.SetAlert(err)
+		data.SetAlert(req.Context(), err)
 		gc.EditView.Render(w, req, data)
 		return
 	}
@@ -167,15 +214,15 @@ func (gc *GalleriesController) UploadImage(w http.ResponseWriter, req *http.Requ
 	for _, f := range files {
 		file, err := f.Open()
 		if err != nil {
-			data.SetAlert(err)
+			data.SetAlert(req.Context(), err)
 			gc.EditView.Render(w, req, data)
 			return
 		}
 		defer file.Close()
 		
-		err = gc.is.Create(gallery.ID, f.Filename, file)
+		err = gc.is.Create(req.Context(), gallery.ID, f.Filename, file)
 		if err != nil {
-			data.SetAlert(err)
+			data.SetAlert(req.Context(), err)
 			gc.EditView.Render(w, req, data)
 			return
 		}
@@ -197,7 +244,7 @@ func (gc *GalleriesController) DeleteImage(w http.ResponseWriter, req *http.Requ
 	}
 	user := context.User(req.Context())
 	if user.ID != gallery.UserID {
-		http.Error(w, "Gallery Not Found", http.StatusNotFound)
+		views.Error(w, req, "Gallery Not Found", http.StatusNotFound)
 		return
 	}
 	
@@ -205,11 +252,11 @@ func (gc *GalleriesController) DeleteImage(w http.ResponseWriter, req *http.Requ
 		Filename: mux.Vars(req)["filename"],
 		GalleryID: gallery.ID,
 	}
-	err = gc.is.Delete(image)
+	err = gc.is.Delete(req.Context(), image)
 	if err != nil {
 		gallery.Images, _ = gc.is.ByGalleryID(gallery.ID)
 		data := views.Data{Content: gallery}
-		data.SetAlert(err)
+		data.SetAlert(req.Context(), err)
 		gc.EditView.Render(w, req, data)
 		return
 	}
@@ -229,14 +276,14 @@ func (gc *GalleriesController) Delete(w http.ResponseWriter, req *http.Request)
 	}
 	user := context.User(req.Context())
 	if user.ID != gallery.UserID {
-		http.Error(w, "Gallery Not Found", http.StatusNotFound)
+		views.Error(w, req, "Gallery Not Found", http.StatusNotFound)
 		return
 	}
 	
 	data := views.Data{Content: gallery}
-	err = gc.gs.Delete(gallery.ID)
+	err = gc.gs.Delete(req.Context(), gallery.ID)
 	if err != nil {
-		data.SetAlert(err)
+		data.SetAlert(req.Context(), err)
 		gc.EditView.Render(w, req, data)
 		return
 	}
@@ -247,7 +294,7 @@ func (gc *GalleriesController) galleryByID(w http.ResponseWriter, req *http.Requ
 	params := mux.Vars(req)
 	id, err := strconv.Atoi(params["id"])
 	if err != nil {
-		http.Error(w, "Invalid Gallery ID", http.StatusBadRequest)
+		views.Error(w, req, "Invalid Gallery ID", http.StatusBadRequest)
 		return nil, err
 	}
 	
@@ -255,10 +302,10 @@ func (gc *GalleriesController) galleryByID(w http.ResponseWriter, req *http.Requ
 	if err != nil {
 		switch err {
 		case models.ErrNotFound:
-			http.Error(w, "Gallery Not Found", http.StatusNotFound)
+			views.Error(w, req, "Gallery Not Found", http.StatusNotFound)
 		default:
-			log.Println(err)
-			http.Error(w, "Server Error", http.StatusInternalServerError)
+			slog.ErrorContext(req.Context(), "loading gallery failed", "gallery_id", id, "err", err)
+			views.Error(w, req, "Server Error", http.StatusInternalServerError)
 		}
 		return nil, err
 	}
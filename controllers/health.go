@@ -0,0 +1,85 @@
+package controllers
+
+import (
+	"context"
+	"gallerio/models"
+	"gallerio/utils/buildinfo"
+	"gallerio/utils/email"
+	"gallerio/views"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// readyTimeout bounds each readiness check, so a hanging database fails
+// the probe instead of timing it out
+const readyTimeout = 2 * time.Second
+
+// NewHealthController serves the probes. Draining reports whether the
+// server is shutting down, it can be nil.
+func NewHealthController(services *models.Services, mg email.Client, draining func() bool) *HealthController {
+	return &HealthController{
+		services: services,
+		mg:       mg,
+		draining: draining,
+	}
+}
+
+type HealthController struct {
+	services *models.Services
+	mg       email.Client
+	draining func() bool
+}
+
+// Readiness is the body of /readyz. Checks only tell whether each check
+// passed, the cause of a failure is logged.
+type Readiness struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// GET /healthz
+//
+// The process is alive as long as it can answer
+func (hc *HealthController) Healthz(w http.ResponseWriter, req *http.Request) {
+	views.RenderJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// GET /readyz
+func (hc *HealthController) Readyz(w http.ResponseWriter, req *http.Request) {
+	ctx, cancel := context.WithTimeout(req.Context(), readyTimeout)
+	defer cancel()
+
+	ready := Readiness{
+		Status: "ok",
+		Checks: make(map[string]string),
+	}
+	check := func(name string, err error) {
+		if err == nil {
+			ready.Checks[name] = "ok"
+			return
+		}
+		slog.WarnContext(req.Context(), "readiness check failed", "check", name, "err", err)
+		ready.Status = "unavailable"
+		ready.Checks[name] = "failed"
+	}
+	check("database", hc.services.Ping(ctx))
+	check("media", hc.services.Image.Writable())
+	check("email", hc.mg.Check())
+	if hc.draining != nil && hc.draining() {
+		ready.Status = "unavailable"
+		ready.Checks["shutdown"] = "draining"
+	}
+
+	status := http.StatusOK
+	if ready.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	views.RenderJSON(w, status, ready)
+}
+
+// GET /version
+func (hc *HealthController) Version(w http.ResponseWriter, req *http.Request) {
+	views.RenderJSON(w, http.StatusOK, buildinfo.Get())
+}
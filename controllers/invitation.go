@@ -0,0 +1,172 @@
+package controllers
+
+import (
+	"fmt"
+	"gallerio/forms"
+	"gallerio/models"
+	"gallerio/utils/context"
+	"gallerio/utils/email"
+	"gallerio/views"
+	"github.com/gorilla/mux"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+func NewInvitationsController(is models.InvitationService, rs models.RegistrationService,
+	mg email.Client, ttl time.Duration) *InvitationsController {
+	return &InvitationsController{
+		IndexView: views.NewView("base", "invitation/index"),
+		is:        is,
+		rs:        rs,
+		mg:        mg,
+		ttl:       ttl,
+	}
+}
+
+type InvitationsController struct {
+	IndexView *views.View
+	is        models.InvitationService
+	rs        models.RegistrationService
+	mg        email.Client
+	ttl       time.Duration
+}
+
+type Invitations struct {
+	Invitations []models.Invitation
+	// Link is only set right after creating an invitation that wasn't
+	// emailed, as the token can't be recovered afterwards.
+	Link string
+}
+
+func (inv Invitations) JSONContent() interface{} {
+	invitations := make([]models.PublicInvitation, len(inv.Invitations))
+	for i := range inv.Invitations {
+		invitations[i] = inv.Invitations[i].Public()
+	}
+	return struct {
+		Invitations []models.PublicInvitation `json:"invitations"`
+		Link        string                    `json:"link,omitempty"`
+	}{invitations, inv.Link}
+}
+
+// GET /invitations
+func (ic *InvitationsController) Index(w http.ResponseWriter, req *http.Request) {
+	user := context.User(req.Context())
+	if !ic.allowed(w, req, user) {
+		return
+	}
+	ic.render(w, req, user, views.Data{}, "")
+}
+
+// POST /invitations
+func (ic *InvitationsController) Create(w http.ResponseWriter, req *http.Request) {
+	user := context.User(req.Context())
+	if !ic.allowed(w, req, user) {
+		return
+	}
+	var data views.Data
+	var form forms.InvitationForm
+	if err := forms.ParseForm(req, &form); err != nil {
+		data.SetAlert(req.Context(), err)
+		ic.render(w, req, user, data, "")
+		return
+	}
+	
+	inv := models.Invitation{
+		InviterID: user.ID,
+		Email:     form.Email,
+		MaxUses:   form.MaxUses,
+	}
+	if inv.Email != "" {
+		// An invitation sent to someone is meant for them alone
+		inv.MaxUses = 1
+	}
+	if ic.ttl > 0 {
+		expiresAt := time.Now().Add(ic.ttl)
+		inv.ExpiresAt = &expiresAt
+	}
+	if err := ic.is.Create(&inv); err != nil {
+		data.SetAlert(req.Context(), err)
+		ic.render(w, req, user, data, "")
+		return
+	}
+	
+	if inv.Email == "" {
+		data.AlertSuccess("Invitation created, share the link below. It won't be shown again")
+		ic.render(w, req, user, data, email.InviteURL(inv.Token))
+		return
+	}
+	// Failures are logged by the email client
+	if err := ic.mg.Invite(req.Context(), user.Name, inv.Email, inv.Token); err != nil {
+		data.AlertError("Invitation created but the email could not be sent, please try again")
+		if err := ic.is.Delete(inv.ID); err != nil {
+			slog.ErrorContext(req.Context(), "deleting unsent invitation failed", "invitation_id", inv.ID, "err", err)
+		}
+		ic.render(w, req, user, data, "")
+		return
+	}
+	alert := views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: fmt.Sprintf("Invitation sent to %s", inv.Email),
+	}
+	views.RedirectAlert(w, req, "/invitations", http.StatusSeeOther, alert)
+}
+
+// POST /invitations/{id}/delete
+func (ic *InvitationsController) Delete(w http.ResponseWriter, req *http.Request) {
+	user := context.User(req.Context())
+	if !ic.allowed(w, req, user) {
+		return
+	}
+	id, err := strconv.Atoi(mux.Vars(req)["id"])
+	if err != nil {
+		views.Error(w, req, "Invalid Invitation ID", http.StatusBadRequest)
+		return
+	}
+	inv, err := ic.is.ByID(uint(id))
+	if err != nil || inv.InviterID != user.ID {
+		views.Error(w, req, "Invitation not found", http.StatusNotFound)
+		return
+	}
+	
+	alert := views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: "Invitation revoked",
+	}
+	if err := ic.is.Delete(inv.ID); err != nil {
+		var data views.Data
+		data.SetAlert(req.Context(), err)
+		alert = *data.Alert
+	}
+	views.RedirectAlert(w, req, "/invitations", http.StatusSeeOther, alert)
+}
+
+func (ic *InvitationsController) allowed(w http.ResponseWriter, req *http.Request, user *models.User) bool {
+	if ic.rs.CanInvite(user) {
+		return true
+	}
+	alert := views.Alert{
+		Level:   views.AlertLevelError,
+		Message: "Only admins can invite people",
+	}
+	views.RedirectAlert(w, req, "/account", http.StatusSeeOther, alert)
+	return false
+}
+
+func (ic *InvitationsController) render(w http.ResponseWriter, req *http.Request, user *models.User, data views.Data, link string) {
+	invitations, err := ic.is.ByInviterID(user.ID)
+	if err != nil {
+		if data.Alert == nil {
+			data.SetAlert(req.Context(), err)
+		} else {
+			slog.ErrorContext(req.Context(), "loading invitations failed", "err", err)
+		}
+	}
+	data.Content = Invitations{
+		Invitations: invitations,
+		Link:        link,
+	}
+	ic.IndexView.Render(w, req, data)
+}
@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"gallerio/models"
 	"gallerio/utils/context"
+	"gallerio/utils/cookie"
+	"gallerio/views"
 	"github.com/gorilla/csrf"
 	"github.com/gorilla/mux"
 	"golang.org/x/oauth2"
@@ -14,32 +16,32 @@ import (
 	"time"
 )
 
-func NewOAuthsController(os models.OAuthService, configs map[string]*oauth2.Config) *OAuthsController {
+func NewOAuthsController(os models.OAuthService, al models.AuditLogService, configs map[string]*oauth2.Config,
+	cookies cookie.Policy) *OAuthsController {
 	return &OAuthsController{
 		os:      os,
+		al:      al,
 		configs: configs,
+		cookies: cookies,
 	}
 }
 
 type OAuthsController struct {
 	os      models.OAuthService
+	al      models.AuditLogService
 	configs map[string]*oauth2.Config
+	cookies cookie.Policy
 }
 
 func (oc *OAuthsController) Connect(w http.ResponseWriter, req *http.Request) {
 	provider := mux.Vars(req)["provider"]
 	state := csrf.Token(req)
 	if _, ok := oc.configs[provider]; !ok {
-		http.Error(w, "Unknown Provider", http.StatusBadRequest)
+		views.Error(w, req, "Unknown Provider", http.StatusBadRequest)
 		return
 	}
 	
-	cookie := &http.Cookie{
-		Name: "oauth_state",
-		Value: state,
-		HttpOnly: true,
-	}
-	http.SetCookie(w, cookie)
+	oc.cookies.Set(w, "oauth_state", state, time.Time{})
 	
 	url := oc.configs[provider].AuthCodeURL(state)
 	http.Redirect(w, req, url, http.StatusFound)
@@ -48,29 +50,27 @@ func (oc *OAuthsController) Connect(w http.ResponseWriter, req *http.Request) {
 func (oc *OAuthsController) Callback(w http.ResponseWriter, req *http.Request) {
 	provider := mux.Vars(req)["provider"]
 	if _, ok := oc.configs[provider]; !ok {
-		http.Error(w, "Unknown Provider", http.StatusBadRequest)
+		views.Error(w, req, "Unknown Provider", http.StatusBadRequest)
 		return
 	}
 	
 	req.ParseForm()
 	state := req.FormValue("state")
-	cookie, err := req.Cookie("oauth_state")
+	stateCookie, err := req.Cookie("oauth_state")
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		views.Error(w, req, err.Error(), http.StatusBadRequest)
 		return
-	} else if cookie == nil || cookie.Value != state {
-		http.Error(w, "Invalid State", http.StatusBadRequest)
+	} else if stateCookie == nil || stateCookie.Value != state {
+		views.Error(w, req, "Invalid State", http.StatusBadRequest)
 		return
 	}
 	
-	cookie.Value = ""
-	cookie.Expires = time.Now()
-	http.SetCookie(w, cookie)
+	oc.cookies.Clear(w, "oauth_state")
 	
 	code := req.FormValue("code")
 	token, err := oc.configs[provider].Exchange(context.TODO(), code)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		views.Error(w, req, err.Error(), http.StatusBadRequest)
 		return
 	}
 	
@@ -83,28 +83,64 @@ func (oc *OAuthsController) Callback(w http.ResponseWriter, req *http.Request) {
 	case nil:
 		oc.os.Delete(existing.ID)
 	default:
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		views.Error(w, req, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	
 	oauth := &models.OAuth{
 		UserID: user.ID,
 		Provider: provider,
-		Token: *token,
 	}
+	oauth.SetToken(token)
 	err = oc.os.Create(oauth)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		views.Error(w, req, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	recordEvent(oc.al, req, models.AuditLog{
+		UserID: user.ID,
+		Action: models.AuditOAuthConnected,
+		Detail: provider,
+	})
 	
 	fmt.Fprintln(w, token)
 }
 
+func (oc *OAuthsController) Disconnect(w http.ResponseWriter, req *http.Request) {
+	provider := mux.Vars(req)["provider"]
+	if _, ok := oc.configs[provider]; !ok {
+		views.Error(w, req, "Unknown Provider", http.StatusBadRequest)
+		return
+	}
+	
+	user := context.User(req.Context())
+	existing, err := oc.os.Find(user.ID, provider)
+	switch err {
+	case nil:
+		// pass
+	case models.ErrNotFound:
+		views.Error(w, req, "Not Connected", http.StatusNotFound)
+		return
+	default:
+		views.Error(w, req, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := oc.os.Delete(existing.ID); err != nil {
+		views.Error(w, req, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	recordEvent(oc.al, req, models.AuditLog{
+		UserID: user.ID,
+		Action: models.AuditOAuthDisconnected,
+		Detail: provider,
+	})
+	http.Redirect(w, req, "/account", http.StatusSeeOther)
+}
+
 func (oc *OAuthsController) DropboxTest(w http.ResponseWriter, req *http.Request) {
 	provider := mux.Vars(req)["provider"]
 	if provider != models.OAuthDropbox {
-		http.Error(w, "Unknown Provider", http.StatusBadRequest)
+		views.Error(w, req, "Unknown Provider", http.StatusBadRequest)
 		return
 	}
 	
@@ -117,7 +153,7 @@ func (oc *OAuthsController) DropboxTest(w http.ResponseWriter, req *http.Request
 		panic(err)
 	}
 	
-	token := oauth.Token
+	token := oauth.Token()
 	data := struct {
 		Path string `json:"path"`
 	}{Path: path}
@@ -126,7 +162,7 @@ func (oc *OAuthsController) DropboxTest(w http.ResponseWriter, req *http.Request
 		panic(err)
 	}
 	
-	client := oc.configs["provider"].Client(context.TODO(), &token)
+	client := oc.configs["provider"].Client(context.TODO(), token)
 	reqObj, err := http.NewRequest(
 		http.MethodPost,
 		"https://api.dropboxapi.com/2/files/list_folder",
@@ -0,0 +1,39 @@
+package controllers
+
+import (
+	"gallerio/models"
+	"net/http"
+	"strconv"
+)
+
+// ListPage holds the search and pagination state shared by paginated listings
+type ListPage struct {
+	Query      string `json:"query,omitempty"`
+	Page       int    `json:"page"`
+	TotalPages int    `json:"total_pages"`
+	Total      int    `json:"total"`
+	PrevURL    string `json:"prev_url,omitempty"`
+	NextURL    string `json:"next_url,omitempty"`
+}
+
+func newListPage(req *http.Request, query string, p models.Pagination, total int) ListPage {
+	page := ListPage{
+		Query:      query,
+		Page:       p.Page,
+		TotalPages: p.TotalPages(total),
+		Total:      total,
+	}
+	// Keep every filter of the current listing when paging
+	pageURL := func(n int) string {
+		v := req.URL.Query()
+		v.Set("page", strconv.Itoa(n))
+		return req.URL.Path + "?" + v.Encode()
+	}
+	if page.Page > 1 {
+		page.PrevURL = pageURL(page.Page - 1)
+	}
+	if page.Page < page.TotalPages {
+		page.NextURL = pageURL(page.Page + 1)
+	}
+	return page
+}
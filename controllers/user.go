@@ -1,42 +1,106 @@
 package controllers
 
 import (
+	"fmt"
 	"gallerio/forms"
 	"gallerio/models"
 	"gallerio/utils/context"
+	"gallerio/utils/cookie"
 	"gallerio/utils/email"
+	"gallerio/utils/ip"
+	"gallerio/utils/jobs"
+	"gallerio/utils/logging"
 	"gallerio/utils/rand"
+	"gallerio/utils/ratelimit"
 	"gallerio/views"
-	"log"
+	"log/slog"
+	"math"
 	"net/http"
+	"strings"
 	"time"
 )
 
-func NewUsersController(us models.UserService, mg email.Client) *UsersController {
+var (
+	// Shown for unknown accounts and wrong passwords alike so sign in
+	// can't be used to find out which email addresses are registered.
+	signInFailedMessage = "Invalid username, email address or password"
+	resetSentMessage    = "If an account exists for that email address, " +
+		"we have sent an email with the necessary information to reset your password"
+)
+
+func NewUsersController(us models.UserService, ads models.AccountDeletionService, rs models.RegistrationService,
+	al models.AuditLogService, mg email.Client, limiter *ratelimit.Limiter, runner *jobs.Runner,
+	cookies cookie.Policy) *UsersController {
 	return &UsersController{
 		SignUpView:   views.NewView("base", "user/signup"),
 		SignInView:   views.NewView("base", "user/signin"),
 		ResetPwView:  views.NewView("base", "user/reset_password"),
 		ForgotPwView: views.NewView("base", "user/forgot_password"),
+		AccountView:  views.NewView("base", "user/account"),
+		ActivityView: views.NewView("base", "user/activity"),
 		us:           us,
+		ads:          ads,
+		rs:           rs,
+		al:           al,
 		mg:           mg,
+		limiter:      limiter,
+		runner:       runner,
+		cookies:      cookies,
 	}
 }
 
+type Activity struct {
+	ListPage
+	Entries []models.AuditLog
+}
+
+func (a Activity) JSONContent() interface{} {
+	entries := make([]models.PublicAuditLog, len(a.Entries))
+	for i := range a.Entries {
+		entries[i] = a.Entries[i].Public()
+	}
+	return struct {
+		Pagination ListPage                `json:"pagination"`
+		Entries    []models.PublicAuditLog `json:"entries"`
+	}{a.ListPage, entries}
+}
+
 type UsersController struct {
 	SignUpView   *views.View
 	SignInView   *views.View
 	ForgotPwView *views.View
 	ResetPwView  *views.View
+	AccountView  *views.View
+	ActivityView *views.View
 	us           models.UserService
+	ads          models.AccountDeletionService
+	rs           models.RegistrationService
+	al           models.AuditLogService
 	mg           email.Client
+	limiter      *ratelimit.Limiter
+	runner       *jobs.Runner
+	cookies      cookie.Policy
 }
 
 // GET /signup
 func (uc *UsersController) New(w http.ResponseWriter, req *http.Request) {
+	var data views.Data
 	var form forms.SignUpForm
+	data.Content = &form
 	_ = forms.ParseURLParams(req, &form)
-	uc.SignUpView.Render(w, req, form)
+	if form.Invite != "" {
+		inv, err := uc.rs.Invitation(form.Invite)
+		if err != nil {
+			form.Invite = ""
+			data.SetAlert(req.Context(), err)
+		} else if inv.Email != "" {
+			form.Email = inv.Email
+		}
+	}
+	if data.Alert == nil && form.Invite == "" && uc.rs.Mode() == models.RegistrationInvite {
+		data.SetAlert(req.Context(), models.ErrInviteOnly)
+	}
+	uc.SignUpView.Render(w, req, data)
 }
 
 // POST /signup
@@ -45,8 +109,21 @@ func (uc *UsersController) SignUp(w http.ResponseWriter, req *http.Request) {
 	var form forms.SignUpForm
 	data.Content = &form
 	if err := forms.ParseForm(req, &form); err != nil {
-		log.Println(err)
-		data.SetAlert(err)
+		data.SetAlert(req.Context(), err)
+		uc.SignUpView.Render(w, req, data)
+		return
+	}
+	
+	buckets := []string{"signup:ip:" + ip.FromRequest(req)}
+	if !uc.allowAttempt(w, req, &data, buckets...) {
+		uc.SignUpView.Render(w, req, data)
+		return
+	}
+	uc.recordAttempt(req, buckets...)
+	
+	inv, err := uc.rs.Check(form.Email, form.Invite)
+	if err != nil {
+		data.SetAlert(req.Context(), err)
 		uc.SignUpView.Render(w, req, data)
 		return
 	}
@@ -57,9 +134,8 @@ func (uc *UsersController) SignUp(w http.ResponseWriter, req *http.Request) {
 		Email:    form.Email,
 		Password: form.Password,
 	}
-	if err := uc.us.Create(&user); err != nil {
-		log.Println(err)
-		data.SetAlert(err)
+	if err := uc.rs.SignUp(&user, inv); err != nil {
+		data.SetAlert(req.Context(), err)
 		uc.SignUpView.Render(w, req, data)
 		return
 	}
@@ -67,7 +143,11 @@ func (uc *UsersController) SignUp(w http.ResponseWriter, req *http.Request) {
 		http.Redirect(w, req, "/signin", http.StatusSeeOther)
 		return
 	}
-	go uc.mg.Welcome(user.Name, user.Email)
+	name, address := user.Name, user.Email
+	reqCtx := req.Context()
+	uc.runner.Go(func(ctx context.Context) {
+		uc.mg.Welcome(logging.Inherit(ctx, reqCtx), name, address)
+	})
 	alert := views.Alert{
 		Level:   views.AlertLevelSuccess,
 		Message: "Welcome to Gallerio",
@@ -80,47 +160,71 @@ func (uc *UsersController) SignIn(w http.ResponseWriter, req *http.Request) {
 	var data views.Data
 	var form forms.SignInForm
 	if err := forms.ParseForm(req, &form); err != nil {
-		log.Println(err)
-		data.SetAlert(err)
+		data.SetAlert(req.Context(), err)
+		uc.SignInView.Render(w, req, data)
+		return
+	}
+	
+	ipBucket := "signin:ip:" + ip.FromRequest(req)
+	accountBucket := "signin:account:" + strings.ToLower(strings.TrimSpace(form.Login))
+	if !uc.allowAttempt(w, req, &data, ipBucket, accountBucket) {
 		uc.SignInView.Render(w, req, data)
 		return
 	}
 	
-	user, err := uc.us.Authenticate(form.Email, form.Password)
+	user, err := uc.us.Authenticate(req.Context(), form.Login, form.Password)
 	if err != nil {
-		log.Println(err)
+		slog.InfoContext(req.Context(), "sign in failed", "err", err)
 		switch err {
-		case models.ErrNotFound:
-			data.AlertError("Email Address is incorrect")
+		case models.ErrNotFound, models.ErrPasswordIncorrect,
+			models.ErrEmailInvalid, models.ErrUsernameInvalid:
+			uc.recordAttempt(req, ipBucket, accountBucket)
+			uc.signInFailed(req, form.Login, err)
+			data.AlertError(signInFailedMessage)
+		case models.ErrAccountSuspended:
+			uc.signInFailed(req, form.Login, err)
+			data.SetAlert(req.Context(), err)
 		default:
-			data.SetAlert(err)
+			data.SetAlert(req.Context(), err)
 		}
 		uc.SignInView.Render(w, req, data)
 		return
 	}
+	if err := uc.limiter.Reset(accountBucket); err != nil {
+		slog.ErrorContext(req.Context(), "resetting rate limit failed", "err", err)
+	}
+	
+	if user.DeleteAfter != nil {
+		if err := uc.ads.Cancel(user); err != nil {
+			data.SetAlert(req.Context(), err)
+			uc.SignInView.Render(w, req, data)
+			return
+		}
+		data.AlertInfo("Welcome back! Your account is no longer scheduled for deletion")
+	}
 	
 	if err := uc.signInUser(w, user); err != nil {
-		log.Println(err)
+		slog.ErrorContext(req.Context(), "signing in failed", "user_id", user.ID, "err", err)
 		uc.SignInView.Render(w, req, data)
 		return
 	}
+	uc.record(req, user.ID, models.AuditSignIn, "")
+	if data.Alert != nil {
+		views.RedirectAlert(w, req, "/galleries", http.StatusSeeOther, *data.Alert)
+		return
+	}
 	http.Redirect(w, req, "/galleries", http.StatusSeeOther)
 }
 
 // POST /signout
 func (uc *UsersController) SignOut(w http.ResponseWriter, req *http.Request) {
-	cookie := &http.Cookie{
-		Name:     "remember_token",
-		Value:    "",
-		Expires:  time.Now(),
-		HttpOnly: true,
-	}
-	http.SetCookie(w, cookie)
+	uc.clearRememberToken(w)
 	
 	user := context.User(req.Context())
 	token, _ := rand.RememberToken()
 	user.RememberToken = token
 	_ = uc.us.Update(user)
+	uc.record(req, user.ID, models.AuditSignOut, "")
 	
 	http.Redirect(w, req, "/", http.StatusSeeOther)
 }
@@ -132,27 +236,62 @@ func (uc *UsersController) InitiateReset(w http.ResponseWriter, req *http.Reques
 	data.Content = &form
 	
 	if err := forms.ParseForm(req, &form); err != nil {
-		data.SetAlert(err)
+		data.SetAlert(req.Context(), err)
 		uc.ForgotPwView.Render(w, req, data)
 		return
 	}
 	
-	token, err := uc.us.InitiateReset(form.Email)
-	if err != nil {
-		data.SetAlert(err)
+	buckets := []string{
+		"reset:ip:" + ip.FromRequest(req),
+		"reset:account:" + strings.ToLower(strings.TrimSpace(form.Email)),
+	}
+	if !uc.allowAttempt(w, req, &data, buckets...) {
 		uc.ForgotPwView.Render(w, req, data)
 		return
 	}
+	uc.recordAttempt(req, buckets...)
 	
-	err = uc.mg.ResetPassword(form.Email, token)
+	// The email is sent in the background so that unknown addresses get
+	// the same response, just as fast
+	entry := models.AuditLog{
+		Action:    models.AuditPasswordResetRequested,
+		IP:        ip.FromRequest(req),
+		UserAgent: req.UserAgent(),
+	}
+	address := form.Email
+	reqCtx := req.Context()
+	uc.runner.Go(func(ctx context.Context) {
+		uc.sendReset(logging.Inherit(ctx, reqCtx), address, entry)
+	})
+	data.AlertSuccess(resetSentMessage)
+	views.RedirectAlert(w, req, "/reset", http.StatusSeeOther, *data.Alert)
+}
+
+// sendReset emails a password reset token to the user with the address,
+// if there is one, and records entry for them
+func (uc *UsersController) sendReset(ctx context.Context, address string, entry models.AuditLog) {
+	token, err := uc.us.InitiateReset(address)
+	switch err {
+	case nil:
+		// pass
+	case models.ErrNotFound, models.ErrEmailRequired, models.ErrEmailInvalid:
+		return
+	default:
+		slog.ErrorContext(ctx, "initiating password reset failed", "err", err)
+		return
+	}
+	// Failures are logged by the email client
+	if err := uc.mg.ResetPassword(ctx, address, token); err != nil {
+		return
+	}
+	user, err := uc.us.ByEmail(address)
 	if err != nil {
-		data.SetAlert(err)
-		uc.ForgotPwView.Render(w, req, data)
 		return
 	}
-	
-	data.AlertSuccess("An email was sent with necessary information to reset your password")
-	views.RedirectAlert(w, req, "/reset", http.StatusSeeOther, *data.Alert)
+	entry.UserID = user.ID
+	if err := uc.al.Create(&entry); err != nil {
+		slog.ErrorContext(ctx, "recording audit log entry failed", "action", entry.Action, "err", err)
+	}
 }
 
 // GET /reset
@@ -162,7 +301,7 @@ func (uc *UsersController) ResetPassword(w http.ResponseWriter, req *http.Reques
 	data.Content = &form
 	
 	if err := forms.ParseURLParams(req, &form); err != nil {
-		data.SetAlert(err)
+		data.SetAlert(req.Context(), err)
 	}
 	uc.ResetPwView.Render(w, req, data)
 }
@@ -174,29 +313,294 @@ func (uc *UsersController) CompleteReset(w http.ResponseWriter, req *http.Reques
 	data.Content = &form
 	
 	if err := forms.ParseForm(req, &form); err != nil {
-		data.SetAlert(err)
+		data.SetAlert(req.Context(), err)
 		uc.ResetPwView.Render(w, req, data)
 		return
 	}
 	
 	user, err := uc.us.CompleteReset(form.Token, form.Password)
 	if err != nil {
-		data.SetAlert(err)
+		data.SetAlert(req.Context(), err)
 		uc.ResetPwView.Render(w, req, data)
 		return
 	}
 	
+	uc.record(req, user.ID, models.AuditPasswordResetCompleted, "")
+	
+	// Like signing in, resetting the password keeps the account
+	message := "Password reset successful. You are now logged in"
+	if user.DeleteAfter != nil {
+		if err := uc.ads.Cancel(user); err != nil {
+			data.SetAlert(req.Context(), err)
+			uc.ResetPwView.Render(w, req, data)
+			return
+		}
+		message += ". Your account is no longer scheduled for deletion"
+	}
+	
 	err = uc.signInUser(w, user)
 	if err != nil {
-		data.SetAlert(err)
+		data.SetAlert(req.Context(), err)
 		uc.SignInView.Render(w, req, data)
 		return
 	}
 	
-	data.AlertSuccess("Password reset successful. You are now logged in")
+	data.AlertSuccess(message)
 	views.RedirectAlert(w, req, "/galleries", http.StatusSeeOther, *data.Alert)
 }
 
+// GET /account
+func (uc *UsersController) Account(w http.ResponseWriter, req *http.Request) {
+	user := context.User(req.Context())
+	uc.AccountView.Render(w, req, user)
+}
+
+// POST /account/profile
+func (uc *UsersController) UpdateProfile(w http.ResponseWriter, req *http.Request) {
+	user := context.User(req.Context())
+	profile := *user
+	data := views.Data{Content: &profile}
+	var form forms.ProfileForm
+	if err := forms.ParseForm(req, &form); err != nil {
+		data.SetAlert(req.Context(), err)
+		uc.AccountView.Render(w, req, data)
+		return
+	}
+	
+	profile.Name = form.Name
+	profile.Username = form.Username
+	if err := uc.us.Update(&profile); err != nil {
+		data.SetAlert(req.Context(), err)
+		uc.AccountView.Render(w, req, data)
+		return
+	}
+	alert := views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: "Your profile was updated",
+	}
+	views.RedirectAlert(w, req, "/account", http.StatusSeeOther, alert)
+}
+
+// POST /account/password
+func (uc *UsersController) ChangePassword(w http.ResponseWriter, req *http.Request) {
+	user := context.User(req.Context())
+	data := views.Data{Content: user}
+	var form forms.ChangePasswordForm
+	if err := forms.ParseForm(req, &form); err != nil {
+		data.SetAlert(req.Context(), err)
+		uc.AccountView.Render(w, req, data)
+		return
+	}
+	
+	err := uc.us.ChangePassword(user, form.CurrentPassword, form.NewPassword)
+	if err != nil {
+		data.SetAlert(req.Context(), err)
+		uc.AccountView.Render(w, req, data)
+		return
+	}
+	uc.record(req, user.ID, models.AuditPasswordChanged, "other sessions were signed out")
+	// The remember token was rotated, so only this session stays signed in
+	if err := uc.signInUser(w, user); err != nil {
+		http.Redirect(w, req, "/signin", http.StatusSeeOther)
+		return
+	}
+	alert := views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: "Your password was changed. All other sessions were signed out",
+	}
+	views.RedirectAlert(w, req, "/account", http.StatusSeeOther, alert)
+}
+
+// POST /account/email
+func (uc *UsersController) ChangeEmail(w http.ResponseWriter, req *http.Request) {
+	user := context.User(req.Context())
+	data := views.Data{Content: user}
+	var form forms.ChangeEmailForm
+	if err := forms.ParseForm(req, &form); err != nil {
+		data.SetAlert(req.Context(), err)
+		uc.AccountView.Render(w, req, data)
+		return
+	}
+	
+	token, err := uc.us.InitiateEmailChange(user, form.Password, form.Email)
+	if err != nil {
+		data.SetAlert(req.Context(), err)
+		uc.AccountView.Render(w, req, data)
+		return
+	}
+	if err := uc.mg.ConfirmEmailChange(req.Context(), form.Email, token); err != nil {
+		data.SetAlert(req.Context(), err)
+		uc.AccountView.Render(w, req, data)
+		return
+	}
+	alert := views.Alert{
+		Level:   views.AlertLevelInfo,
+		Message: "We sent a confirmation link to your new email address. Your email changes once you follow it",
+	}
+	views.RedirectAlert(w, req, "/account", http.StatusSeeOther, alert)
+}
+
+// GET /account/email/confirm
+func (uc *UsersController) ConfirmEmail(w http.ResponseWriter, req *http.Request) {
+	next := "/signin"
+	if context.User(req.Context()) != nil {
+		next = "/account"
+	}
+	user, oldEmail, err := uc.us.CompleteEmailChange(req.URL.Query().Get("token"))
+	if err != nil {
+		var data views.Data
+		data.SetAlert(req.Context(), err)
+		views.RedirectAlert(w, req, next, http.StatusSeeOther, *data.Alert)
+		return
+	}
+	uc.record(req, user.ID, models.AuditEmailChanged,
+		fmt.Sprintf("changed from %s to %s", oldEmail, user.Email))
+	newEmail := user.Email
+	reqCtx := req.Context()
+	uc.runner.Go(func(ctx context.Context) {
+		// Failures are logged by the email client
+		uc.mg.EmailChanged(logging.Inherit(ctx, reqCtx), oldEmail, newEmail)
+	})
+	alert := views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: "Your email address was changed to " + user.Email,
+	}
+	views.RedirectAlert(w, req, next, http.StatusSeeOther, alert)
+}
+
+// POST /account/sessions/revoke
+func (uc *UsersController) RevokeSessions(w http.ResponseWriter, req *http.Request) {
+	user := context.User(req.Context())
+	data := views.Data{Content: user}
+	token, err := rand.RememberToken()
+	if err != nil {
+		data.SetAlert(req.Context(), err)
+		uc.AccountView.Render(w, req, data)
+		return
+	}
+	user.RememberToken = token
+	if err := uc.us.Update(user); err != nil {
+		data.SetAlert(req.Context(), err)
+		uc.AccountView.Render(w, req, data)
+		return
+	}
+	uc.record(req, user.ID, models.AuditSessionsRevoked, "all other sessions were signed out")
+	// Keep this session signed in with the new token
+	if err := uc.signInUser(w, user); err != nil {
+		http.Redirect(w, req, "/signin", http.StatusSeeOther)
+		return
+	}
+	alert := views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: "All other sessions were signed out",
+	}
+	views.RedirectAlert(w, req, "/account", http.StatusSeeOther, alert)
+}
+
+// GET /account/activity
+func (uc *UsersController) Activity(w http.ResponseWriter, req *http.Request) {
+	user := context.User(req.Context())
+	var data views.Data
+	var form forms.SearchForm
+	if err := forms.ParseURLParams(req, &form); err != nil {
+		data.SetAlert(req.Context(), err)
+		uc.ActivityView.Render(w, req, data)
+		return
+	}
+	
+	p := models.NewPagination(form.Page, models.DefaultPerPage)
+	entries, total, err := uc.al.Search(models.AuditFilter{UserID: user.ID}, p)
+	if err != nil {
+		data.SetAlert(req.Context(), err)
+		uc.ActivityView.Render(w, req, data)
+		return
+	}
+	data.Content = Activity{
+		ListPage: newListPage(req, "", p, total),
+		Entries:  entries,
+	}
+	uc.ActivityView.Render(w, req, data)
+}
+
+// POST /account/delete
+func (uc *UsersController) DeleteAccount(w http.ResponseWriter, req *http.Request) {
+	user := context.User(req.Context())
+	data := views.Data{Content: user}
+	var form forms.DeleteAccountForm
+	if err := forms.ParseForm(req, &form); err != nil {
+		data.SetAlert(req.Context(), err)
+		uc.AccountView.Render(w, req, data)
+		return
+	}
+	
+	if err := uc.ads.Schedule(user, form.Password); err != nil {
+		data.SetAlert(req.Context(), err)
+		uc.AccountView.Render(w, req, data)
+		return
+	}
+	uc.clearRememberToken(w)
+	alert := views.Alert{
+		Level: views.AlertLevelInfo,
+		Message: fmt.Sprintf("Your account will be deleted on %s. "+
+			"Sign in before then if you change your mind", user.DeleteAfter.Format("January 2, 2006")),
+	}
+	views.RedirectAlert(w, req, "/", http.StatusSeeOther, alert)
+}
+
+// allowAttempt sets an alert and the 429 status when any of the buckets is
+// currently locked out.
+func (uc *UsersController) allowAttempt(w http.ResponseWriter, req *http.Request, data *views.Data, buckets ...string) bool {
+	wait, err := uc.limiter.Check(buckets...)
+	if err != nil {
+		// Don't lock everyone out when the store is unavailable
+		slog.ErrorContext(req.Context(), "checking rate limit failed", "err", err)
+		return true
+	}
+	if wait <= 0 {
+		return true
+	}
+	minutes := int(math.Ceil(wait.Minutes()))
+	w.Header().Set("Retry-After", fmt.Sprintf("%d", int(math.Ceil(wait.Seconds()))))
+	data.Status = http.StatusTooManyRequests
+	data.AlertError(fmt.Sprintf("Too many attempts. Please try again in %d minute(s)", minutes))
+	return false
+}
+
+func (uc *UsersController) recordAttempt(req *http.Request, buckets ...string) {
+	if err := uc.limiter.Fail(buckets...); err != nil {
+		slog.ErrorContext(req.Context(), "recording rate limited attempt failed", "err", err)
+	}
+}
+
+func (uc *UsersController) record(req *http.Request, userID uint, action, detail string) {
+	recordEvent(uc.al, req, models.AuditLog{
+		UserID: userID,
+		Action: action,
+		Detail: detail,
+	})
+}
+
+// signInFailed attributes the failed attempt to the account when the login
+// belongs to one
+func (uc *UsersController) signInFailed(req *http.Request, login string, err error) {
+	entry := models.AuditLog{
+		Action: models.AuditSignInFailed,
+		Detail: "unknown login",
+	}
+	if user, lookupErr := uc.us.ByLogin(login); lookupErr == nil {
+		entry.UserID = user.ID
+		entry.Detail = "incorrect password"
+		if err == models.ErrAccountSuspended {
+			entry.Detail = "account is suspended"
+		}
+	}
+	recordEvent(uc.al, req, entry)
+}
+
+func (uc *UsersController) clearRememberToken(w http.ResponseWriter) {
+	uc.cookies.Clear(w, "remember_token")
+}
+
 func (uc *UsersController) signInUser(w http.ResponseWriter, user *models.User) error {
 	if user.RememberToken == "" {
 		token, err := rand.RememberToken()
@@ -208,11 +612,6 @@ func (uc *UsersController) signInUser(w http.ResponseWriter, user *models.User)
 			return err
 		}
 	}
-	cookie := &http.Cookie{
-		Name:     "remember_token",
-		Value:    user.RememberToken,
-		HttpOnly: true,
-	}
-	http.SetCookie(w, cookie)
+	uc.cookies.Set(w, "remember_token", user.RememberToken, time.Time{})
 	return nil
 }
@@ -0,0 +1,193 @@
+package controllers
+
+import (
+	"fmt"
+	"gallerio/forms"
+	"gallerio/models"
+	"gallerio/utils/context"
+	"gallerio/views"
+	"github.com/gorilla/mux"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+func NewWebhooksController(ws models.WebhookService, al models.AuditLogService) *WebhooksController {
+	return &WebhooksController{
+		IndexView: views.NewView("base", "webhook/index"),
+		ShowView:  views.NewView("base", "webhook/show"),
+		ws:        ws,
+		al:        al,
+	}
+}
+
+type WebhooksController struct {
+	IndexView *views.View
+	ShowView  *views.View
+	ws        models.WebhookService
+	al        models.AuditLogService
+}
+
+type Webhooks struct {
+	Webhooks []models.Webhook
+	Events   []string
+}
+
+func (wh Webhooks) JSONContent() interface{} {
+	hooks := make([]models.PublicWebhook, len(wh.Webhooks))
+	for i := range wh.Webhooks {
+		hooks[i] = wh.Webhooks[i].Public()
+	}
+	return struct {
+		Webhooks []models.PublicWebhook `json:"webhooks"`
+		Events   []string               `json:"events"`
+	}{hooks, wh.Events}
+}
+
+type WebhookDeliveries struct {
+	ListPage
+	Webhook    *models.Webhook
+	Deliveries []models.WebhookDelivery
+}
+
+// JSONContent includes the secret of the webhook, which its page shows
+func (wd WebhookDeliveries) JSONContent() interface{} {
+	type webhook struct {
+		models.PublicWebhook
+		Secret string `json:"secret"`
+	}
+	deliveries := make([]models.PublicWebhookDelivery, len(wd.Deliveries))
+	for i := range wd.Deliveries {
+		deliveries[i] = wd.Deliveries[i].Public()
+	}
+	return struct {
+		Pagination ListPage                       `json:"pagination"`
+		Webhook    webhook                        `json:"webhook"`
+		Deliveries []models.PublicWebhookDelivery `json:"deliveries"`
+	}{wd.ListPage, webhook{wd.Webhook.Public(), wd.Webhook.Secret}, deliveries}
+}
+
+// GET /account/webhooks
+func (wc *WebhooksController) Index(w http.ResponseWriter, req *http.Request) {
+	wc.render(w, req, views.Data{})
+}
+
+// POST /account/webhooks
+func (wc *WebhooksController) Create(w http.ResponseWriter, req *http.Request) {
+	user := context.User(req.Context())
+	var data views.Data
+	var form forms.WebhookForm
+	if err := forms.ParseForm(req, &form); err != nil {
+		data.SetAlert(req.Context(), err)
+		wc.render(w, req, data)
+		return
+	}
+	
+	hook := models.Webhook{
+		UserID: user.ID,
+		URL:    form.URL,
+		Events: strings.Join(form.Events, " "),
+	}
+	if err := wc.ws.Create(&hook); err != nil {
+		data.SetAlert(req.Context(), err)
+		wc.render(w, req, data)
+		return
+	}
+	recordEvent(wc.al, req, models.AuditLog{
+		UserID: user.ID,
+		Action: models.AuditWebhookCreated,
+		Detail: fmt.Sprintf("%s for %s", hook.URL, hook.Events),
+	})
+	alert := views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: "Webhook created. Use its secret to verify the signature of deliveries",
+	}
+	views.RedirectAlert(w, req, fmt.Sprintf("/account/webhooks/%d", hook.ID), http.StatusSeeOther, alert)
+}
+
+// GET /account/webhooks/{id}
+func (wc *WebhooksController) Show(w http.ResponseWriter, req *http.Request) {
+	hook, err := wc.webhook(w, req)
+	if err != nil {
+		return
+	}
+	var data views.Data
+	var form forms.SearchForm
+	if err := forms.ParseURLParams(req, &form); err != nil {
+		data.SetAlert(req.Context(), err)
+	}
+	
+	p := models.NewPagination(form.Page, models.DefaultPerPage)
+	deliveries, total, err := wc.ws.Deliveries(hook.ID, p)
+	if err != nil {
+		data.SetAlert(req.Context(), err)
+	}
+	data.Content = WebhookDeliveries{
+		ListPage:   newListPage(req, "", p, total),
+		Webhook:    hook,
+		Deliveries: deliveries,
+	}
+	wc.ShowView.Render(w, req, data)
+}
+
+// POST /account/webhooks/{id}/delete
+func (wc *WebhooksController) Delete(w http.ResponseWriter, req *http.Request) {
+	hook, err := wc.webhook(w, req)
+	if err != nil {
+		return
+	}
+	
+	alert := views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: fmt.Sprintf("Webhook for %s was deleted", hook.URL),
+	}
+	if err := wc.ws.Delete(hook.ID); err != nil {
+		var data views.Data
+		data.SetAlert(req.Context(), err)
+		alert = *data.Alert
+	} else {
+		recordEvent(wc.al, req, models.AuditLog{
+			UserID: hook.UserID,
+			Action: models.AuditWebhookDeleted,
+			Detail: hook.URL,
+		})
+	}
+	views.RedirectAlert(w, req, "/account/webhooks", http.StatusSeeOther, alert)
+}
+
+// webhook looks up the webhook of the URL and only returns it to its owner
+func (wc *WebhooksController) webhook(w http.ResponseWriter, req *http.Request) (*models.Webhook, error) {
+	user := context.User(req.Context())
+	id, err := strconv.Atoi(mux.Vars(req)["id"])
+	if err != nil {
+		views.Error(w, req, "Invalid Webhook ID", http.StatusBadRequest)
+		return nil, err
+	}
+	hook, err := wc.ws.ByID(uint(id))
+	if err == nil && hook.UserID != user.ID {
+		err = models.ErrNotFound
+	}
+	if err != nil {
+		views.Error(w, req, "Webhook not found", http.StatusNotFound)
+		return nil, err
+	}
+	return hook, nil
+}
+
+func (wc *WebhooksController) render(w http.ResponseWriter, req *http.Request, data views.Data) {
+	user := context.User(req.Context())
+	hooks, err := wc.ws.ByUserID(user.ID)
+	if err != nil {
+		if data.Alert == nil {
+			data.SetAlert(req.Context(), err)
+		} else {
+			slog.ErrorContext(req.Context(), "loading webhooks failed", "err", err)
+		}
+	}
+	data.Content = Webhooks{
+		Webhooks: hooks,
+		Events:   models.Events,
+	}
+	wc.IndexView.Render(w, req, data)
+}
@@ -0,0 +1,18 @@
+package forms
+
+type SearchForm struct {
+	Query string `schema:"q"`
+	Page  int    `schema:"page"`
+}
+
+type RoleForm struct {
+	Role string `schema:"role"`
+}
+
+type AuditSearchForm struct {
+	// User is a user ID, username or email address
+	User   string `schema:"user"`
+	Action string `schema:"action"`
+	IP     string `schema:"ip"`
+	Page   int    `schema:"page"`
+}
@@ -0,0 +1,8 @@
+package forms
+
+type APITokenForm struct {
+	Name   string   `schema:"name"`
+	Scopes []string `schema:"scopes"`
+	// ExpiresInDays of 0 creates a token which doesn't expire
+	ExpiresInDays int `schema:"expires_in_days"`
+}
@@ -1,5 +1,14 @@
 package forms
 
 type GalleryForm struct {
-	Title string `schema:"title"`
+	Title string `schema:"title" json:"title"`
+}
+
+type ImageForm struct {
+	Filename string `json:"filename"`
+}
+
+type PageForm struct {
+	Page    int `schema:"page"`
+	PerPage int `schema:"per_page"`
 }
@@ -0,0 +1,7 @@
+package forms
+
+type InvitationForm struct {
+	// Email is optional, without it the invitation link is shown instead
+	Email   string `schema:"email"`
+	MaxUses int    `schema:"max_uses"`
+}
@@ -4,16 +4,37 @@ type SignUpForm struct {
 	Name     string `schema:"name"`
 	Username string `schema:"username"`
 	Email    string `schema:"email"`
-	Password string `schema:"password"`
+	Password string `schema:"password" json:"-"`
+	Invite   string `schema:"invite"`
 }
 
 type SignInForm struct {
-	Email    string `schema:"email"`
-	Password string `schema:"password"`
+	// Login is either the username or the email address
+	Login    string `schema:"login"`
+	Password string `schema:"password" json:"-"`
 }
 
 type ResetPasswordForm struct {
 	Email    string `schema:"email"`
-	Token    string `schema:"token"`
-	Password string `schema:"password"`
+	Token    string `schema:"token" json:"-"`
+	Password string `schema:"password" json:"-"`
+}
+
+type ProfileForm struct {
+	Name     string `schema:"name"`
+	Username string `schema:"username"`
+}
+
+type ChangePasswordForm struct {
+	CurrentPassword string `schema:"current_password" json:"-"`
+	NewPassword     string `schema:"new_password" json:"-"`
+}
+
+type ChangeEmailForm struct {
+	Email    string `schema:"email"`
+	Password string `schema:"password" json:"-"`
+}
+
+type DeleteAccountForm struct {
+	Password string `schema:"password" json:"-"`
 }
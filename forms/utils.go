@@ -1,7 +1,9 @@
 package forms
 
 import (
+	"encoding/json"
 	"github.com/gorilla/schema"
+	"io"
 	"net/http"
 	"net/url"
 )
@@ -28,3 +30,12 @@ func ParseValues(values url.Values, form interface{}) error {
 	}
 	return nil
 }
+
+// maxJSONBody limits the size of JSON request bodies
+const maxJSONBody = 1 << 20 // 1MB
+
+func ParseJSON(req *http.Request, form interface{}) error {
+	decoder := json.NewDecoder(io.LimitReader(req.Body, maxJSONBody))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(form)
+}
@@ -0,0 +1,6 @@
+package forms
+
+type WebhookForm struct {
+	URL    string   `schema:"url"`
+	Events []string `schema:"events"`
+}
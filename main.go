@@ -4,154 +4,73 @@ import (
 	"flag"
 	"fmt"
 	"gallerio/configs"
-	"gallerio/utils/email"
-	"gallerio/utils/errors"
-	"gallerio/utils/rand"
-	"github.com/gorilla/csrf"
-	"golang.org/x/oauth2"
+	"gallerio/utils/logging"
 	"log"
-	"net/http"
+	"log/slog"
+	"os"
 	
-	"gallerio/controllers"
-	"gallerio/middlewares"
-	"gallerio/models"
-	
-	"github.com/gorilla/mux"
+	"gallerio/app"
 )
 
-func getDropboxConfig(id, secret, autUrl, tokenUrl string) *oauth2.Config {
-	return &oauth2.Config{
-		ClientID: id,
-		ClientSecret: secret,
-		Endpoint: oauth2.Endpoint{
-			AuthURL: autUrl,
-			TokenURL: tokenUrl,
-		},
-		RedirectURL: "http://localhost:8000/oauth/dropbox/callback",
-		Scopes: []string{"files.metadata.read"},
-	}
-}
-
 func main() {
 	// To View list of flags
 	// run: go build . && ./gallerio --help
 	//
+	// Options are read from configs/.config.json, or the file given with
+	// --config, then from GALLERIO_* environment variables and then from
+	// flags, e.g. --set database.host=db
+	//
 	// To run with prod flag
 	// run: go build . && ./gallerio --prod
-	boolPtr := flag.Bool("prod", false, "Provide this flag in production." +
-		"This flag will ensure that a .config file is setup properly.")
-	flag.Parse()
-	
-	cfg := configs.LoadConfig(*boolPtr)
-	dbCfg := cfg.Database
-	services, err := models.NewServices(
-		models.WithGorm(dbCfg.Dialect(), dbCfg.ConnectionInfo()),
-		models.WithLogMode(false),
-		models.WithUser(cfg.Pepper, cfg.HMACKey),
-		models.WithGallery(),
-		models.WithImage(),
-		models.WithOAuth(),
-	)
-	if err != nil {
-		panic(err)
+	//
+	// To manage database migrations
+	// run: go build . && ./gallerio migrate up|down|status|create
+	//
+	// To show the effective config
+	// run: go build . && ./gallerio config print
+	//
+	// To make an existing user the first admin
+	// run: go build . && ./gallerio role jon@example.com admin
+	//
+	// To stamp the build served at /version
+	// run: go build -ldflags "-X gallerio/utils/buildinfo.Version=1.0.0 \
+	//   -X gallerio/utils/buildinfo.Commit=$(git rev-parse HEAD)" .
+	cfg, args, err := configs.Load(os.Args[1:], os.Environ())
+	if err == flag.ErrHelp {
+		return
 	}
-	defer services.Close()
-	services.AutoMigrate()
-
-	mgCfg := cfg.Mailgun
-	emailer := email.NewClient(
-		email.WithSender("Gallerio Support",
-		"support@sandboxfa300beae3034442af3cdd253f03c0c1.mailgun.org"),
-		email.WithMailgun(mgCfg.Domain, mgCfg.PublicAPIKey),
-	)
-
-	router := mux.NewRouter()
-	usersController := controllers.NewUsersController(services.User, emailer)
-	galleriesController := controllers.NewGalleriesController(services.Gallery, services.Image, router)
-	coreController := controllers.NewStaticController()
-	oauthConfigs := make(map[string]*oauth2.Config)
-	oauthConfigs[models.OAuthDropbox] = getDropboxConfig(
-		cfg.Dropbox.ID,
-		cfg.Dropbox.Secret,
-		cfg.Dropbox.AuthURL,
-		cfg.Dropbox.TokenURL,
-	)
-	oauthController := controllers.NewOAuthsController(services.OAuth, oauthConfigs)
-	
-	b, err := rand.Bytes(32)
-	errors.Must(err)
-	csrfMw := csrf.Protect(b, csrf.Secure(cfg.IsProduction()))
-	assignUserMw := middlewares.AssignUser{
-		UserService: services.User,
+	if err != nil {
+		log.Fatal(err)
 	}
-	loginRequiredMw := middlewares.LoginRequired{
-		UserService: services.User,
+	logger, err := logging.New(os.Stderr, cfg.Log.Format, cfg.Log.Level)
+	if err != nil {
+		log.Fatal(err)
 	}
-	alreadyLoggedInMw := middlewares.AlreadyLoggedIn{
-		UserService: services.User,
+	slog.SetDefault(logger)
+	if len(args) > 0 {
+		switch args[0] {
+		case "migrate":
+			err = runMigrate(cfg, args[1:])
+		case "config":
+			err = runConfig(cfg, args[1:])
+		case "role":
+			err = runRole(cfg, args[1:])
+		default:
+			err = fmt.Errorf("unknown command %q", args[0])
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
-
-	// Static Routes
-	router.Handle("/", coreController.HomeView).Methods("GET")
-	router.Handle("/contact", coreController.ContactView).Methods("GET")
-
-	// Accounts Routes
-	router.Handle("/signin",
-		alreadyLoggedInMw.Apply(usersController.SignInView)).Methods("GET")
-	router.HandleFunc("/signin",
-		alreadyLoggedInMw.ApplyFunc(usersController.SignIn)).Methods("POST")
-	router.HandleFunc("/signup",
-		alreadyLoggedInMw.ApplyFunc(usersController.New)).Methods("GET")
-	router.HandleFunc("/signup",
-		alreadyLoggedInMw.ApplyFunc(usersController.SignUp)).Methods("POST")
-	router.HandleFunc("/signout",
-		loginRequiredMw.ApplyFunc(usersController.SignOut)).Methods("POST")
-	router.HandleFunc("/forgot",
-		alreadyLoggedInMw.Apply(usersController.ForgotPwView)).Methods("GET")
-	router.HandleFunc("/forgot",
-		alreadyLoggedInMw.ApplyFunc(usersController.InitiateReset)).Methods("POST")
-	router.HandleFunc("/reset",
-		alreadyLoggedInMw.ApplyFunc(usersController.ResetPassword)).Methods("GET")
-	router.HandleFunc("/reset",
-		alreadyLoggedInMw.ApplyFunc(usersController.CompleteReset)).Methods("POST")
-
-	// Galleries Routes
-	router.Handle("/galleries/new",
-		loginRequiredMw.Apply(galleriesController.New)).Methods("GET")
-	router.HandleFunc("/galleries",
-		loginRequiredMw.ApplyFunc(galleriesController.Index)).Methods("GET")
-	router.HandleFunc("/galleries",
-		loginRequiredMw.ApplyFunc(galleriesController.Create)).Methods("POST")
-	router.HandleFunc("/galleries/{id:[0-9]+}",
-		galleriesController.Show).Methods("GET").Name(controllers.ShowGalleryName)
-	router.HandleFunc("/galleries/{id:[0-9]+}/edit",
-		loginRequiredMw.ApplyFunc(galleriesController.Edit)).
-		Methods("GET").Name(controllers.EditGalleryName)
-	router.HandleFunc("/galleries/{id:[0-9]+}/update",
-		loginRequiredMw.ApplyFunc(galleriesController.Update)).Methods("POST")
-	router.HandleFunc("/galleries/{id:[0-9]+}/delete",
-		loginRequiredMw.ApplyFunc(galleriesController.Delete)).Methods("POST")
-	router.HandleFunc("/galleries/{id:[0-9]+}/images",
-		loginRequiredMw.ApplyFunc(galleriesController.UploadImage)).Methods("POST")
-	router.HandleFunc("/galleries/{id:[0-9]+}/images/{filename}/delete",
-		loginRequiredMw.ApplyFunc(galleriesController.DeleteImage)).Methods("POST")
 	
-	// OAuth Controller
-	router.HandleFunc("/oauth/{provider:[a-z]+}/connect",
-		loginRequiredMw.ApplyFunc(oauthController.Connect)).Methods("GET")
-	router.HandleFunc("/oauth/{provider:[a-z]+}/callback",
-		loginRequiredMw.ApplyFunc(oauthController.Callback)).Methods("GET")
-	router.HandleFunc("/oauth/{provider:[a-z]+}/test",
-		loginRequiredMw.ApplyFunc(oauthController.DropboxTest)).Methods("GET")
-	
-	// Media Routes
-	mediaHandler := http.FileServer(http.Dir("./media/"))
-	router.PathPrefix("/media/").Handler(http.StripPrefix("/media/", mediaHandler))
-	
-	// Static Routes
-	staticHandler := http.FileServer(http.Dir("./static/"))
-	router.PathPrefix("/static/").Handler(http.StripPrefix("/static/", staticHandler))
-	
-	fmt.Printf("Starting server on Port : %v\n", cfg.Port)
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%v", cfg.Port), csrfMw(assignUserMw.Apply(router))))
+	a, err := app.New(cfg)
+	if err != nil {
+		slog.Error("starting failed", "err", err)
+		os.Exit(1)
+	}
+	if err := a.Run(); err != nil {
+		slog.Error("serving failed", "err", err)
+		os.Exit(1)
+	}
 }
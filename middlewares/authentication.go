@@ -3,7 +3,9 @@ package middlewares
 import (
 	"gallerio/models"
 	"gallerio/utils/context"
+	"gallerio/views"
 	"net/http"
+	"strconv"
 	"strings"
 )
 
@@ -23,6 +25,11 @@ func (mw *AssignUser) ApplyFunc(next http.HandlerFunc) http.HandlerFunc {
 			next(w, req)
 			return
 		}
+		// Requests with an API token never use the session cookie
+		if context.APIToken(req.Context()) != nil {
+			next(w, req)
+			return
+		}
 		cookie, err := req.Cookie("remember_token")
 		if err != nil {
 			next(w, req)
@@ -30,10 +37,11 @@ func (mw *AssignUser) ApplyFunc(next http.HandlerFunc) http.HandlerFunc {
 		}
 		
 		user, err := mw.UserService.ByRememberToken(cookie.Value)
-		if err != nil {
+		if err != nil || user.Suspended() {
 			next(w, req)
 			return
 		}
+		activeSessions.Touch(strconv.FormatUint(uint64(user.ID), 10))
 		ctx := req.Context()
 		ctx = context.WithUser(ctx, user)
 		req = req.WithContext(ctx)
@@ -54,7 +62,32 @@ func (mw *LoginRequired) ApplyFunc(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
 		user := context.User(req.Context())
 		if user == nil {
-			http.Redirect(w, req, "/signin", http.StatusSeeOther)
+			signInRequired(w, req)
+			return
+		}
+		next(w, req)
+	}
+}
+
+// RequireRole only lets signed in users with at least Role through. Everyone
+// else gets a 404 so the staff pages aren't advertised.
+type RequireRole struct {
+	Role string
+}
+
+func (mw *RequireRole) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFunc(next.ServeHTTP)
+}
+
+func (mw *RequireRole) ApplyFunc(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		user := context.User(req.Context())
+		if user == nil {
+			signInRequired(w, req)
+			return
+		}
+		if !user.HasRole(mw.Role) {
+			views.Error(w, req, "404 page not found", http.StatusNotFound)
 			return
 		}
 		next(w, req)
@@ -79,3 +112,13 @@ func (mw *AlreadyLoggedIn) ApplyFunc(next http.HandlerFunc) http.HandlerFunc {
 		next(w, req)
 	}
 }
+
+// signInRequired sends browsers to the sign in page, clients asking for
+// JSON get a 401 instead
+func signInRequired(w http.ResponseWriter, req *http.Request) {
+	if views.WantsJSON(req) {
+		views.Error(w, req, "Sign in required", http.StatusUnauthorized)
+		return
+	}
+	http.Redirect(w, req, "/signin", http.StatusSeeOther)
+}
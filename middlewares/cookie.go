@@ -0,0 +1,24 @@
+package middlewares
+
+import (
+	"gallerio/utils/context"
+	"gallerio/utils/cookie"
+	"net/http"
+)
+
+// CookiePolicy puts the policy in the context, where the views find it
+// when they set or clear the alert cookies
+type CookiePolicy struct {
+	Policy cookie.Policy
+}
+
+func (mw *CookiePolicy) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFunc(next.ServeHTTP)
+}
+
+func (mw *CookiePolicy) ApplyFunc(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		ctx := context.WithCookiePolicy(req.Context(), mw.Policy)
+		next(w, req.WithContext(ctx))
+	}
+}
@@ -0,0 +1,122 @@
+package middlewares
+
+import (
+	"encoding/hex"
+	"gallerio/utils/ip"
+	"gallerio/utils/logging"
+	"gallerio/utils/rand"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+const RequestIDHeader = "X-Request-ID"
+
+// requestIDPattern limits the IDs accepted from a proxy to ones which are
+// safe to log and echo back
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// RequestID tags the context of every request with an ID, which is also
+// sent back in the X-Request-ID header. The ID set by a trusted proxy is
+// kept so log lines can be matched across both.
+type RequestID struct{}
+
+func (mw *RequestID) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFunc(next.ServeHTTP)
+}
+
+func (mw *RequestID) ApplyFunc(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		id := req.Header.Get(RequestIDHeader)
+		if !ip.TrustProxy || !requestIDPattern.MatchString(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(RequestIDHeader, id)
+		ctx := logging.WithRequestID(req.Context(), id)
+		req = req.WithContext(ctx)
+		
+		next(w, req)
+	}
+}
+
+func newRequestID() string {
+	b, err := rand.Bytes(12)
+	if err != nil {
+		// Requests are still served, their log lines just can't be told apart
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
+
+// AccessLog logs every request once it's served. It has to be wrapped by
+// RequestID for the lines to carry the request ID.
+type AccessLog struct{}
+
+func (mw *AccessLog) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFunc(next.ServeHTTP)
+}
+
+func (mw *AccessLog) ApplyFunc(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		rec := &responseRecorder{ResponseWriter: w}
+		
+		next(rec, req)
+		
+		status := rec.Status()
+		level := slog.LevelInfo
+		if status >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+		slog.Log(req.Context(), level, "request",
+			"method", req.Method,
+			"path", req.URL.Path,
+			"status", status,
+			"bytes", rec.bytes,
+			"latency", time.Since(start),
+			"ip", ip.FromRequest(req),
+		)
+	}
+}
+
+// responseRecorder keeps the status and the size of the body written
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += n
+	return n, err
+}
+
+func (r *responseRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the original writer
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+func (r *responseRecorder) Status() int {
+	if r.status == 0 {
+		return http.StatusOK
+	}
+	return r.status
+}
@@ -0,0 +1,61 @@
+package middlewares
+
+import (
+	"gallerio/utils/metrics"
+	"github.com/gorilla/mux"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	httpRequests = metrics.NewCounter("gallerio_http_requests_total",
+		"Requests served, by route, method and status.", "route", "method", "status")
+	httpDuration = metrics.NewHistogram("gallerio_http_request_duration_seconds",
+		"Time taken to serve requests, by route and method.",
+		metrics.DefaultBuckets, "route", "method")
+	activeSessions = metrics.NewActive("gallerio_active_sessions",
+		"Signed in users who made a request in the last 15 minutes.", 15*time.Minute)
+)
+
+// Metrics counts and times the requests per route. The route is only known
+// once mux matched it, so it has to be added with the router's Use.
+type Metrics struct{}
+
+func (mw *Metrics) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFunc(next.ServeHTTP)
+}
+
+func (mw *Metrics) ApplyFunc(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		rec := &responseRecorder{ResponseWriter: w}
+		
+		next(rec, req)
+		
+		route := routeName(req)
+		httpRequests.Inc(route, req.Method, strconv.Itoa(rec.Status()))
+		httpDuration.Since(start, route, req.Method)
+	}
+}
+
+// Middleware lets the router's Use add the middleware
+func (mw *Metrics) Middleware(next http.Handler) http.Handler {
+	return mw.Apply(next)
+}
+
+// routeName is the name of the route or else its path template, so
+// requests for every gallery are counted together
+func routeName(req *http.Request) string {
+	route := mux.CurrentRoute(req)
+	if route == nil {
+		return "unmatched"
+	}
+	if name := route.GetName(); name != "" {
+		return name
+	}
+	if tpl, err := route.GetPathTemplate(); err == nil {
+		return tpl
+	}
+	return "unnamed"
+}
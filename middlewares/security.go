@@ -0,0 +1,79 @@
+package middlewares
+
+import (
+	"gallerio/utils/context"
+	"gallerio/utils/ip"
+	"gallerio/utils/security"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// SecurityHeaders sets the security headers of Policy on every response.
+// The nonce of the Content-Security-Policy is put in the context, where
+// views.View.Render finds it for the templates.
+type SecurityHeaders struct {
+	Policy security.Policy
+}
+
+func (mw *SecurityHeaders) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFunc(next.ServeHTTP)
+}
+
+func (mw *SecurityHeaders) ApplyFunc(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		nonce, err := security.NewNonce()
+		if err != nil {
+			// The headers are still sent, inline scripts just won't run
+			slog.ErrorContext(req.Context(), "generating CSP nonce failed", "err", err)
+		}
+		mw.Policy.SetHeaders(w.Header(), nonce, isTLS(req))
+		ctx := context.WithCSPNonce(req.Context(), nonce)
+		ctx = context.WithSecurityPolicy(ctx, mw.Policy)
+		req = req.WithContext(ctx)
+		
+		next(w, req)
+	}
+}
+
+// SecurityOverride changes the security headers of the routes it wraps,
+// which have to be wrapped by SecurityHeaders as well. For example to let
+// other sites frame an embed view:
+//
+//	embedMw := middlewares.SecurityOverride{Change: func(p *security.Policy) {
+//		p.FrameOptions = ""
+//		p.CSP["frame-ancestors"] = []string{"*"}
+//	}}
+type SecurityOverride struct {
+	Change func(p *security.Policy)
+}
+
+func (mw *SecurityOverride) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFunc(next.ServeHTTP)
+}
+
+func (mw *SecurityOverride) ApplyFunc(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		policy, ok := context.SecurityPolicy(req.Context())
+		if !ok {
+			next(w, req)
+			return
+		}
+		policy = policy.Clone()
+		mw.Change(&policy)
+		policy.SetHeaders(w.Header(), context.CSPNonce(req.Context()), isTLS(req))
+		ctx := context.WithSecurityPolicy(req.Context(), policy)
+		req = req.WithContext(ctx)
+		
+		next(w, req)
+	}
+}
+
+// isTLS tells whether the request was made over TLS, to the app or to a
+// trusted proxy in front of it
+func isTLS(req *http.Request) bool {
+	if req.TLS != nil {
+		return true
+	}
+	return ip.TrustProxy && strings.EqualFold(req.Header.Get("X-Forwarded-Proto"), "https")
+}
@@ -0,0 +1,45 @@
+package middlewares
+
+import (
+	"gallerio/utils/context"
+	"gallerio/utils/security"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSecurityOverride(t *testing.T) {
+	var nonce string
+	handler := func(w http.ResponseWriter, req *http.Request) {
+		nonce = context.CSPNonce(req.Context())
+	}
+	headersMw := SecurityHeaders{Policy: security.DefaultPolicy()}
+	embedMw := SecurityOverride{Change: func(p *security.Policy) {
+		p.FrameOptions = ""
+		p.CSP["frame-ancestors"] = []string{"*"}
+	}}
+	
+	w := httptest.NewRecorder()
+	headersMw.Apply(embedMw.ApplyFunc(handler)).ServeHTTP(w, httptest.NewRequest("GET", "/embed", nil))
+	if nonce == "" {
+		t.Fatal("expected the nonce in the context")
+	}
+	csp := w.Header().Get("Content-Security-Policy")
+	if !strings.Contains(csp, "frame-ancestors *") || !strings.Contains(csp, "'nonce-"+nonce+"'") {
+		t.Errorf("expected the changed CSP with the request's nonce, got %q", csp)
+	}
+	if w.Header().Get("X-Frame-Options") != "" {
+		t.Error("expected X-Frame-Options to be removed")
+	}
+	
+	// Other routes keep the policy
+	w = httptest.NewRecorder()
+	headersMw.ApplyFunc(handler).ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if csp := w.Header().Get("Content-Security-Policy"); !strings.Contains(csp, "frame-ancestors 'none'") {
+		t.Errorf("expected framing to be forbidden, got %q", csp)
+	}
+	if w.Header().Get("X-Frame-Options") != "DENY" {
+		t.Error("expected X-Frame-Options DENY")
+	}
+}
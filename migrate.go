@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"gallerio/configs"
+	"gallerio/migrations"
+	"gallerio/models"
+	"strconv"
+	"strings"
+)
+
+const migrateUsage = `usage: gallerio migrate <command>
+
+Commands:
+  up             apply every pending migration
+  down [n]       revert the latest n migrations, 1 by default
+  status         list migrations and when they were applied
+  create <name>  write a new empty migration to migrations/`
+
+// runMigrate implements "gallerio migrate"
+func runMigrate(cfg configs.Config, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf(migrateUsage)
+	}
+	if args[0] == "create" {
+		path, err := migrations.Create(strings.Join(args[1:], "_"))
+		if err != nil {
+			return err
+		}
+		fmt.Println("Created", path)
+		return nil
+	}
+	
+	dbCfg := cfg.Database
+	services, err := models.NewServices(
+		models.WithGorm(dbCfg.Dialect(), dbCfg.ConnectionInfo()),
+		models.WithLogMode(false),
+	)
+	if err != nil {
+		return err
+	}
+	defer services.Close()
+	migrator := migrations.New(services.DB())
+	
+	switch args[0] {
+	case "up":
+		applied, err := migrator.Up()
+		for _, m := range applied {
+			fmt.Println("Applied", m)
+		}
+		if err == nil && len(applied) == 0 {
+			fmt.Println("Database is up to date")
+		}
+		return err
+	case "down":
+		n := 1
+		if len(args) > 1 {
+			n, err = strconv.Atoi(args[1])
+			if err != nil || n < 1 {
+				return fmt.Errorf("migrate down: %q is not a positive number", args[1])
+			}
+		}
+		reverted, err := migrator.Down(n)
+		for _, m := range reverted {
+			fmt.Println("Reverted", m)
+		}
+		return err
+	case "status":
+		statuses, err := migrator.Status()
+		if err != nil {
+			return err
+		}
+		for _, s := range statuses {
+			state := "pending"
+			if s.AppliedAt != nil {
+				state = "applied " + s.AppliedAt.Format("2006-01-02 15:04:05 MST")
+			}
+			if s.Unknown {
+				state += " (not in this build)"
+			}
+			fmt.Printf("%-40s %s\n", s.Migration, state)
+		}
+		return nil
+	default:
+		return fmt.Errorf(migrateUsage)
+	}
+}
@@ -0,0 +1,179 @@
+package migrations
+
+import (
+	"github.com/jinzhu/gorm"
+	"time"
+)
+
+// The baseline creates the schema the models had when migrations were
+// introduced. The structs are frozen copies of the models; later changes to
+// the models need a migration of their own. Running it on a database which
+// was set up by AutoMigrate only adds what is missing.
+func init() {
+	Register(&Migration{
+		Version: 1,
+		Name:    "baseline",
+		Up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(baselineModels()...).Error
+		},
+		Down: func(tx *gorm.DB) error {
+			models := baselineModels()
+			for i := len(models) - 1; i >= 0; i-- {
+				if err := tx.DropTableIfExists(models[i]).Error; err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	})
+}
+
+func baselineModels() []interface{} {
+	return []interface{}{
+		&baselineUser{},
+		&baselineGallery{},
+		&baselinePasswordReset{},
+		&baselineOAuth{},
+		&baselineRateLimit{},
+		&baselineEmailChange{},
+		&baselineAuditLog{},
+		&baselineDataExport{},
+		&baselineInvitation{},
+		&baselineAPIToken{},
+		&baselineWebhook{},
+		&baselineWebhookDelivery{},
+	}
+}
+
+type baselineUser struct {
+	gorm.Model
+	Name              string
+	Username          string `gorm:"not null;unique_index"`
+	Email             string `gorm:"not null;unique_index"`
+	PasswordHash      string `gorm:"not null"`
+	RememberTokenHash string `gorm:"not null;unique_index"`
+	DeleteAfter       *time.Time `gorm:"index"`
+	Role              string     `gorm:"not null;default:'user'"`
+	SuspendedAt       *time.Time
+}
+
+func (baselineUser) TableName() string { return "users" }
+
+type baselineGallery struct {
+	gorm.Model
+	UserID uint   `gorm:"not null;index"`
+	Title  string `gorm:"not null"`
+}
+
+func (baselineGallery) TableName() string { return "galleries" }
+
+type baselinePasswordReset struct {
+	gorm.Model
+	UserID    uint
+	TokenHash string `gorm:"not null;unique_index"`
+}
+
+func (baselinePasswordReset) TableName() string { return "password_resets" }
+
+type baselineOAuth struct {
+	gorm.Model
+	UserID       uint   `gorm:"not null;unique_index:user_id_provider"`
+	Provider     string `gorm:"not null;unique_index:user_id_provider"`
+	AccessToken  string
+	TokenType    string
+	RefreshToken string
+	Expiry       time.Time
+}
+
+func (baselineOAuth) TableName() string { return "o_auths" }
+
+type baselineRateLimit struct {
+	gorm.Model
+	Bucket      string `gorm:"not null;unique_index"`
+	Failures    int
+	LastFailure time.Time
+	LockedUntil time.Time
+}
+
+func (baselineRateLimit) TableName() string { return "rate_limits" }
+
+type baselineEmailChange struct {
+	gorm.Model
+	UserID    uint   `gorm:"not null;index"`
+	Email     string `gorm:"not null"`
+	TokenHash string `gorm:"not null;unique_index"`
+}
+
+func (baselineEmailChange) TableName() string { return "email_changes" }
+
+type baselineAuditLog struct {
+	gorm.Model
+	UserID    uint   `gorm:"index"`
+	ActorID   uint   `gorm:"index"`
+	Action    string `gorm:"not null;index"`
+	Detail    string `gorm:"type:text"`
+	IP        string `gorm:"index"`
+	UserAgent string
+}
+
+func (baselineAuditLog) TableName() string { return "audit_logs" }
+
+type baselineDataExport struct {
+	gorm.Model
+	UserID    uint   `gorm:"not null;index"`
+	Status    string `gorm:"not null"`
+	Path      string
+	TokenHash string `gorm:"not null;unique_index"`
+	ExpiresAt *time.Time
+}
+
+func (baselineDataExport) TableName() string { return "data_exports" }
+
+type baselineInvitation struct {
+	gorm.Model
+	InviterID uint `gorm:"not null;index"`
+	Email     string
+	TokenHash string `gorm:"not null;unique_index"`
+	ExpiresAt *time.Time
+	MaxUses   int
+	Uses      int
+}
+
+func (baselineInvitation) TableName() string { return "invitations" }
+
+type baselineAPIToken struct {
+	gorm.Model
+	UserID     uint   `gorm:"not null;index"`
+	Name       string `gorm:"not null"`
+	Scopes     string `gorm:"not null"`
+	TokenHash  string `gorm:"not null;unique_index"`
+	ExpiresAt  *time.Time
+	LastUsedAt *time.Time
+}
+
+func (baselineAPIToken) TableName() string { return "api_tokens" }
+
+type baselineWebhook struct {
+	gorm.Model
+	UserID uint   `gorm:"not null;index"`
+	URL    string `gorm:"not null"`
+	Events string `gorm:"not null"`
+	Secret string `gorm:"not null"`
+}
+
+func (baselineWebhook) TableName() string { return "webhooks" }
+
+type baselineWebhookDelivery struct {
+	gorm.Model
+	WebhookID      uint   `gorm:"not null;index"`
+	Event          string `gorm:"not null"`
+	Payload        string `gorm:"type:text"`
+	Status         string `gorm:"not null;index"`
+	Attempts       int
+	NextAttemptAt  *time.Time `gorm:"index"`
+	ResponseStatus int
+	Error          string `gorm:"type:text"`
+	DeliveredAt    *time.Time
+}
+
+func (baselineWebhookDelivery) TableName() string { return "webhook_deliveries" }
@@ -0,0 +1,44 @@
+package migrations
+
+import (
+	"github.com/jinzhu/gorm"
+	"time"
+)
+
+// nullableTimes were stored as the zero time when unset. MySQL in strict
+// mode refuses zero dates, so the models store NULL instead. The columns
+// were created nullable already, only the rows need changing.
+var nullableTimes = []struct{ table, column string }{
+	{"o_auths", "expiry"},
+	{"rate_limits", "last_failure"},
+	{"rate_limits", "locked_until"},
+}
+
+func init() {
+	Register(&Migration{
+		Version: 2,
+		Name:    "nullable_times",
+		Up: func(tx *gorm.DB) error {
+			// Catches the zero time as well as MySQL's 0000-00-00
+			before := time.Date(1000, 1, 1, 0, 0, 0, 0, time.UTC)
+			for _, c := range nullableTimes {
+				err := tx.Table(c.table).Where(c.column+" < ?", before).
+					UpdateColumn(c.column, gorm.Expr("NULL")).Error
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Down: func(tx *gorm.DB) error {
+			for _, c := range nullableTimes {
+				err := tx.Table(c.table).Where(c.column + " IS NULL").
+					UpdateColumn(c.column, time.Time{}).Error
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	})
+}
@@ -0,0 +1,63 @@
+package migrations
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// Dir is where Create writes new migrations, relative to the working
+// directory like the views
+var Dir = "migrations/"
+
+var (
+	nameRegex = regexp.MustCompile(`[^a-z0-9]+`)
+	
+	migrationTemplate = template.Must(template.New("migration").Parse(`package migrations
+
+import (
+	"github.com/jinzhu/gorm"
+)
+
+func init() {
+	Register(&Migration{
+		Version: {{.Version}},
+		Name:    "{{.Name}}",
+		Up: func(tx *gorm.DB) error {
+			return nil
+		},
+		Down: func(tx *gorm.DB) error {
+			return nil
+		},
+	})
+}
+`))
+)
+
+// Create writes an empty migration numbered after the latest registered
+// one and returns the path of the new file
+func Create(name string) (string, error) {
+	name = strings.Trim(nameRegex.ReplaceAllString(strings.ToLower(name), "_"), "_")
+	if name == "" {
+		return "", fmt.Errorf("migrations: name is required")
+	}
+	version := 1
+	if all := All(); len(all) > 0 {
+		version = all[len(all)-1].Version + 1
+	}
+	migration := &Migration{Version: version, Name: name}
+	path := filepath.Join(Dir, migration.String()+".go")
+	
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if err := migrationTemplate.Execute(f, migration); err != nil {
+		return "", err
+	}
+	return path, nil
+}
@@ -0,0 +1,287 @@
+// Package migrations versions the database schema. Every migration is a
+// numbered Go file in this directory which registers itself from init.
+// Applied migrations are recorded in the schema_migrations table.
+package migrations
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"os"
+	"sort"
+	"time"
+)
+
+var (
+	// ErrLocked is returned when another instance kept the migration lock
+	// for longer than LockTimeout
+	ErrLocked = errors.New("migrations: another instance is migrating the database")
+	
+	// LockTimeout is how long to wait for another instance to finish
+	LockTimeout = 5 * time.Minute
+	// staleLockAge is when a lock is considered left over by an instance
+	// which died while migrating. The instance holding the lock refreshes
+	// it every lockRefresh, and waiting instances give up after
+	// LockTimeout, so both have to be well below and above it.
+	staleLockAge  = 2 * time.Minute
+	lockRefresh   = 30 * time.Second
+	lockRetryWait = time.Second
+	
+	registry = map[int]*Migration{}
+)
+
+// Migration changes the schema from the previous version to Version. Up and
+// Down run inside a transaction. MySQL commits every DDL statement on its
+// own though, so a migration failing there half way is not rolled back and
+// the schema has to be repaired by hand before running it again.
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(tx *gorm.DB) error
+	Down    func(tx *gorm.DB) error
+}
+
+func (m *Migration) String() string {
+	return fmt.Sprintf("%04d_%s", m.Version, m.Name)
+}
+
+// Register adds a migration, it panics when the version is taken
+func Register(m *Migration) {
+	if m.Version <= 0 {
+		panic(fmt.Sprintf("migrations: %s has an invalid version", m))
+	}
+	if existing, ok := registry[m.Version]; ok {
+		panic(fmt.Sprintf("migrations: %s and %s have the same version", existing, m))
+	}
+	registry[m.Version] = m
+}
+
+// All returns the registered migrations, oldest first
+func All() []*Migration {
+	all := make([]*Migration, 0, len(registry))
+	for _, m := range registry {
+		all = append(all, m)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Version < all[j].Version })
+	return all
+}
+
+// Status is a migration along with when it was applied. Unknown is set for
+// migrations recorded in the database which this build doesn't have.
+type Status struct {
+	*Migration
+	AppliedAt *time.Time
+	Unknown   bool
+}
+
+type schemaMigration struct {
+	Version   int    `gorm:"primary_key;auto_increment:false"`
+	Name      string `gorm:"not null"`
+	AppliedAt time.Time
+}
+
+func (schemaMigration) TableName() string {
+	return "schema_migrations"
+}
+
+// schemaMigrationLock has a row while an instance is migrating
+type schemaMigrationLock struct {
+	ID       int `gorm:"primary_key;auto_increment:false"`
+	Owner    string
+	LockedAt time.Time
+}
+
+func (schemaMigrationLock) TableName() string {
+	return "schema_migrations_lock"
+}
+
+func New(db *gorm.DB) *Migrator {
+	return &Migrator{
+		db:         db,
+		migrations: All(),
+	}
+}
+
+type Migrator struct {
+	db         *gorm.DB
+	migrations []*Migration
+}
+
+// Up applies every pending migration and returns the ones it applied
+func (m *Migrator) Up() ([]*Migration, error) {
+	unlock, err := m.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	
+	applied, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+	var done []*Migration
+	for _, migration := range m.migrations {
+		if _, ok := applied[migration.Version]; ok {
+			continue
+		}
+		err := m.run(migration, migration.Up, func(tx *gorm.DB) error {
+			return tx.Create(&schemaMigration{
+				Version:   migration.Version,
+				Name:      migration.Name,
+				AppliedAt: time.Now(),
+			}).Error
+		})
+		if err != nil {
+			return done, err
+		}
+		done = append(done, migration)
+	}
+	return done, nil
+}
+
+// Down reverts the latest n applied migrations and returns the ones it
+// reverted
+func (m *Migrator) Down(n int) ([]*Migration, error) {
+	unlock, err := m.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	
+	applied, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+	var done []*Migration
+	for i := len(m.migrations) - 1; i >= 0 && len(done) < n; i-- {
+		migration := m.migrations[i]
+		if _, ok := applied[migration.Version]; !ok {
+			continue
+		}
+		err := m.run(migration, migration.Down, func(tx *gorm.DB) error {
+			return tx.Where("version = ?", migration.Version).Delete(&schemaMigration{}).Error
+		})
+		if err != nil {
+			return done, err
+		}
+		done = append(done, migration)
+	}
+	return done, nil
+}
+
+// Status lists every migration, oldest first
+func (m *Migrator) Status() ([]Status, error) {
+	applied, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+	var statuses []Status
+	for _, migration := range m.migrations {
+		status := Status{Migration: migration}
+		if record, ok := applied[migration.Version]; ok {
+			status.AppliedAt = &record.AppliedAt
+			delete(applied, migration.Version)
+		}
+		statuses = append(statuses, status)
+	}
+	for _, record := range applied {
+		appliedAt := record.AppliedAt
+		statuses = append(statuses, Status{
+			Migration: &Migration{Version: record.Version, Name: record.Name},
+			AppliedAt: &appliedAt,
+			Unknown:   true,
+		})
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Version < statuses[j].Version })
+	return statuses, nil
+}
+
+// run calls fn and record in one transaction
+func (m *Migrator) run(migration *Migration, fn, record func(tx *gorm.DB) error) error {
+	tx := m.db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	if fn != nil {
+		if err := fn(tx); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migrations: %s: %v", migration, err)
+		}
+	}
+	if err := record(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+func (m *Migrator) applied() (map[int]schemaMigration, error) {
+	if err := m.db.AutoMigrate(&schemaMigration{}).Error; err != nil {
+		return nil, err
+	}
+	var records []schemaMigration
+	if err := m.db.Find(&records).Error; err != nil {
+		return nil, err
+	}
+	applied := make(map[int]schemaMigration, len(records))
+	for _, record := range records {
+		applied[record.Version] = record
+	}
+	return applied, nil
+}
+
+// lock takes the migration lock, waiting up to LockTimeout for another
+// instance to release it. The lock is refreshed until the returned func
+// releases it, so long migrations don't make it look stale.
+func (m *Migrator) lock() (func(), error) {
+	if err := m.db.AutoMigrate(&schemaMigrationLock{}).Error; err != nil {
+		return nil, err
+	}
+	hostname, _ := os.Hostname()
+	owner := fmt.Sprintf("%s:%d", hostname, os.Getpid())
+	
+	deadline := time.Now().Add(LockTimeout)
+	for {
+		err := m.db.Where("locked_at < ?", time.Now().Add(-staleLockAge)).
+			Delete(&schemaMigrationLock{}).Error
+		if err != nil {
+			return nil, err
+		}
+		err = m.db.Create(&schemaMigrationLock{ID: 1, Owner: owner, LockedAt: time.Now()}).Error
+		if err == nil {
+			break
+		}
+		// Creating the row only fails for other reasons when nobody holds
+		// the lock
+		var held schemaMigrationLock
+		if m.db.Where("id = ?", 1).First(&held).RecordNotFound() {
+			return nil, err
+		}
+		if time.Now().After(deadline) {
+			return nil, ErrLocked
+		}
+		time.Sleep(lockRetryWait)
+	}
+	
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(lockRefresh)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				m.db.Model(&schemaMigrationLock{}).Where("id = ? AND owner = ?", 1, owner).
+					Update("locked_at", time.Now())
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		<-stopped
+		m.db.Where("id = ? AND owner = ?", 1, owner).Delete(&schemaMigrationLock{})
+	}, nil
+}
@@ -0,0 +1,169 @@
+package migrations
+
+import (
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	"testing"
+	"time"
+)
+
+func openTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.DB().SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestUpDownStatus(t *testing.T) {
+	db := openTestDB(t)
+	m := New(db)
+	
+	applied, err := m.Up()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != len(All()) {
+		t.Fatalf("expected %d migrations to be applied, got %d", len(All()), len(applied))
+	}
+	if !db.HasTable("users") || !db.HasTable("webhook_deliveries") {
+		t.Fatal("expected the baseline tables to exist")
+	}
+	applied, err = m.Up()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != 0 {
+		t.Fatalf("expected nothing to apply the second time, got %d", len(applied))
+	}
+	
+	statuses, err := m.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, status := range statuses {
+		if status.AppliedAt == nil || status.Unknown {
+			t.Fatalf("expected %s to be applied", status.Migration)
+		}
+	}
+	
+	reverted, err := m.Down(len(All()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reverted) != len(All()) {
+		t.Fatalf("expected %d migrations to be reverted, got %d", len(All()), len(reverted))
+	}
+	if db.HasTable("users") {
+		t.Fatal("expected the baseline tables to be dropped")
+	}
+	statuses, err = m.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, status := range statuses {
+		if status.AppliedAt != nil {
+			t.Fatalf("expected %s to be pending", status.Migration)
+		}
+	}
+}
+
+func TestLockHeldByAnotherInstance(t *testing.T) {
+	db := openTestDB(t)
+	if err := db.AutoMigrate(&schemaMigrationLock{}).Error; err != nil {
+		t.Fatal(err)
+	}
+	held := schemaMigrationLock{ID: 1, Owner: "other:1", LockedAt: time.Now()}
+	if err := db.Create(&held).Error; err != nil {
+		t.Fatal(err)
+	}
+	
+	timeout, wait := LockTimeout, lockRetryWait
+	LockTimeout, lockRetryWait = 50*time.Millisecond, 10*time.Millisecond
+	defer func() { LockTimeout, lockRetryWait = timeout, wait }()
+	
+	if _, err := New(db).Up(); err != ErrLocked {
+		t.Fatalf("expected ErrLocked, got %v", err)
+	}
+	
+	// A lock left over by an instance which died is taken over
+	stale := time.Now().Add(-2 * staleLockAge)
+	if err := db.Model(&held).Update("locked_at", stale).Error; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(db).Up(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLockIsRefreshed(t *testing.T) {
+	db := openTestDB(t)
+	refresh := lockRefresh
+	lockRefresh = 10 * time.Millisecond
+	defer func() { lockRefresh = refresh }()
+	
+	m := New(db)
+	unlock, err := m.lock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var held schemaMigrationLock
+	if err := db.First(&held, 1).Error; err != nil {
+		t.Fatal(err)
+	}
+	lockedAt := held.LockedAt
+	time.Sleep(50 * time.Millisecond)
+	if err := db.First(&held, 1).Error; err != nil {
+		t.Fatal(err)
+	}
+	if !held.LockedAt.After(lockedAt) {
+		t.Fatal("expected the lock to be refreshed while it is held")
+	}
+	
+	unlock()
+	if !db.First(&held, 1).RecordNotFound() {
+		t.Fatal("expected the lock to be released")
+	}
+}
+
+func TestStaleLockAgeIsBelowLockTimeout(t *testing.T) {
+	// Otherwise an instance waiting for a lock left over by a crash gives
+	// up before it can take it over, and keeps failing to start
+	if staleLockAge >= LockTimeout || lockRefresh >= staleLockAge/2 {
+		t.Fatalf("expected lockRefresh (%s) < staleLockAge (%s) < LockTimeout (%s)",
+			lockRefresh, staleLockAge, LockTimeout)
+	}
+}
+
+func TestNullableTimes(t *testing.T) {
+	db := openTestDB(t)
+	baseline := &Migrator{db: db, migrations: All()[:1]}
+	if _, err := baseline.Up(); err != nil {
+		t.Fatal(err)
+	}
+	unlocked := baselineRateLimit{Bucket: "signin:ip:127.0.0.1", Failures: 1, LastFailure: time.Now()}
+	if err := db.Create(&unlocked).Error; err != nil {
+		t.Fatal(err)
+	}
+	
+	if _, err := New(db).Up(); err != nil {
+		t.Fatal(err)
+	}
+	var nulls, set int
+	db.Table("rate_limits").Where("locked_until IS NULL").Count(&nulls)
+	db.Table("rate_limits").Where("last_failure IS NOT NULL").Count(&set)
+	if nulls != 1 || set != 1 {
+		t.Fatal("expected only the zero time to be changed to NULL")
+	}
+	
+	if _, err := New(db).Down(1); err != nil {
+		t.Fatal(err)
+	}
+	db.Table("rate_limits").Where("locked_until IS NULL").Count(&nulls)
+	if nulls != 0 {
+		t.Fatal("expected NULL to be changed back to the zero time")
+	}
+}
@@ -0,0 +1,174 @@
+package models
+
+import (
+	"fmt"
+	"gallerio/utils/rand"
+	"github.com/jinzhu/gorm"
+	"os"
+	"time"
+)
+
+type AccountDeletionService interface {
+	// Schedule marks the account for deletion after the grace period,
+	// signs out every session and revokes the API tokens. Signing in again
+	// before then cancels it.
+	Schedule(user *User, password string) error
+	Cancel(user *User) error
+	
+	// PurgeDue permanently removes every account whose grace period is over
+	// and returns how many were removed.
+	PurgeDue() (int, error)
+	// Purge permanently removes the user along with everything they own
+	Purge(user *User) error
+}
+
+func NewAccountDeletionService(db *gorm.DB, us UserService, is ImageService, al AuditLogService, grace time.Duration) AccountDeletionService {
+	return &accountDeletionService{
+		db:    db,
+		us:    us,
+		is:    is,
+		al:    al,
+		grace: grace,
+	}
+}
+
+type accountDeletionService struct {
+	db    *gorm.DB
+	us    UserService
+	is    ImageService
+	al    AuditLogService
+	grace time.Duration
+}
+
+func (ads *accountDeletionService) Schedule(user *User, password string) error {
+	if err := ads.us.VerifyPassword(user, password); err != nil {
+		return err
+	}
+	token, err := rand.RememberToken()
+	if err != nil {
+		return err
+	}
+	deleteAfter := time.Now().Add(ads.grace)
+	user.DeleteAfter = &deleteAfter
+	user.RememberToken = token
+	if err := ads.us.Update(user); err != nil {
+		return err
+	}
+	err = ads.db.Unscoped().Where("user_id = ?", user.ID).Delete(&APIToken{}).Error
+	if err != nil {
+		return err
+	}
+	return ads.al.Record(user.ID, AuditAccountDeletionScheduled,
+		fmt.Sprintf("account will be deleted after %s", deleteAfter.Format(time.RFC3339)))
+}
+
+func (ads *accountDeletionService) Cancel(user *User) error {
+	if user.DeleteAfter == nil {
+		return nil
+	}
+	user.DeleteAfter = nil
+	if err := ads.us.Update(user); err != nil {
+		return err
+	}
+	return ads.al.Record(user.ID, AuditAccountDeletionCancelled, "")
+}
+
+func (ads *accountDeletionService) PurgeDue() (int, error) {
+	var users []User
+	err := ads.db.Where("delete_after IS NOT NULL AND delete_after <= ?", time.Now()).
+		Find(&users).Error
+	if err != nil {
+		return 0, err
+	}
+	for i := range users {
+		if err := ads.Purge(&users[i]); err != nil {
+			return i, err
+		}
+	}
+	return len(users), nil
+}
+
+// Purge is safe to run again after a failure; every step only removes
+// what is left over.
+func (ads *accountDeletionService) Purge(user *User) error {
+	var galleries []Gallery
+	err := ads.db.Unscoped().Where("user_id = ?", user.ID).Find(&galleries).Error
+	if err != nil {
+		return err
+	}
+	for _, gallery := range galleries {
+		if err := ads.is.DeleteAll(gallery.ID); err != nil {
+			return err
+		}
+	}
+	ads.step(user, fmt.Sprintf("removed images of %d galleries", len(galleries)))
+	
+	var exports []DataExport
+	err = ads.db.Unscoped().Where("user_id = ?", user.ID).Find(&exports).Error
+	if err != nil {
+		return err
+	}
+	for _, export := range exports {
+		if export.Path == "" {
+			continue
+		}
+		if err := os.Remove(export.Path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	ads.step(user, fmt.Sprintf("removed %d data export archives", len(exports)))
+	
+	var hooks []Webhook
+	err = ads.db.Unscoped().Where("user_id = ?", user.ID).Find(&hooks).Error
+	if err != nil {
+		return err
+	}
+	for _, hook := range hooks {
+		err := ads.db.Unscoped().Where("webhook_id = ?", hook.ID).Delete(&WebhookDelivery{}).Error
+		if err != nil {
+			return err
+		}
+	}
+	ads.step(user, fmt.Sprintf("removed delivery logs of %d webhooks", len(hooks)))
+	
+	steps := []struct {
+		name  string
+		model interface{}
+	}{
+		{"galleries", &Gallery{}},
+		{"oauth connections", &OAuth{}},
+		{"password reset tokens", &passwordReset{}},
+		{"pending email changes", &emailChange{}},
+		{"data exports", &DataExport{}},
+		{"api tokens", &APIToken{}},
+		{"webhooks", &Webhook{}},
+	}
+	for _, s := range steps {
+		db := ads.db.Unscoped().Where("user_id = ?", user.ID).Delete(s.model)
+		if db.Error != nil {
+			return db.Error
+		}
+		ads.step(user, fmt.Sprintf("removed %d %s", db.RowsAffected, s.name))
+	}
+	
+	db := ads.db.Unscoped().Where("inviter_id = ?", user.ID).Delete(&Invitation{})
+	if db.Error != nil {
+		return db.Error
+	}
+	ads.step(user, fmt.Sprintf("removed %d invitations", db.RowsAffected))
+	
+	// Sessions are tied to the remember token stored on the user, so they
+	// are gone with the user row.
+	err = ads.db.Unscoped().Delete(&User{Model: gorm.Model{ID: user.ID}}).Error
+	if err != nil {
+		return err
+	}
+	ads.step(user, "revoked sessions and removed user")
+	return ads.al.Record(user.ID, AuditAccountPurged,
+		fmt.Sprintf("account %s (%s) was permanently deleted", user.Username, user.Email))
+}
+
+func (ads *accountDeletionService) step(user *User, detail string) {
+	// The audit trail must not stop a purge which is already under way
+	_ = ads.al.Record(user.ID, AuditAccountPurgeStep, detail)
+}
@@ -0,0 +1,325 @@
+package models
+
+import (
+	"gallerio/utils/hash"
+	"gallerio/utils/rand"
+	"github.com/jinzhu/gorm"
+	"strings"
+	"time"
+)
+
+const (
+	ScopeGalleriesRead  = "galleries:read"
+	ScopeGalleriesWrite = "galleries:write"
+	ScopeImagesRead     = "images:read"
+	ScopeImagesWrite    = "images:write"
+	
+	// APITokenPrefix makes tokens easy to recognize, e.g. by secret scanners
+	APITokenPrefix = "glr_"
+	
+	// lastUsedPrecision limits how often LastUsedAt is written for a token
+	// which is used for many requests in a row
+	lastUsedPrecision = time.Minute
+)
+
+// Scopes lists every scope a token can be granted
+var Scopes = []string{
+	ScopeGalleriesRead,
+	ScopeGalleriesWrite,
+	ScopeImagesRead,
+	ScopeImagesWrite,
+}
+
+// APIToken is a personal access token for programmatic access. Token is
+// only set right after the token was created, it can't be recovered later.
+// Scopes are stored space separated.
+type APIToken struct {
+	gorm.Model
+	UserID     uint   `gorm:"not null;index"`
+	Name       string `gorm:"not null"`
+	Scopes     string `gorm:"not null"`
+	Token      string `gorm:"-"`
+	TokenHash  string `gorm:"not null;unique_index" json:"-"`
+	ExpiresAt  *time.Time
+	LastUsedAt *time.Time
+}
+
+// PublicAPIToken holds the fields of an API token which are safe to send
+// to its owner. The token itself is only known right after it was created.
+type PublicAPIToken struct {
+	ID         uint       `json:"id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+func (t APIToken) Public() PublicAPIToken {
+	return PublicAPIToken{
+		ID:         t.ID,
+		Name:       t.Name,
+		Scopes:     t.ScopeList(),
+		ExpiresAt:  t.ExpiresAt,
+		LastUsedAt: t.LastUsedAt,
+		CreatedAt:  t.CreatedAt,
+	}
+}
+
+func (t APIToken) ScopeList() []string {
+	return strings.Fields(t.Scopes)
+}
+
+func (t APIToken) HasScope(scope string) bool {
+	for _, s := range t.ScopeList() {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func (t APIToken) Expired() bool {
+	return t.ExpiresAt != nil && time.Now().After(*t.ExpiresAt)
+}
+
+type APITokenDB interface {
+	// Methods for single api token queries
+	ByID(id uint) (*APIToken, error)
+	ByToken(token string) (*APIToken, error)
+	
+	// Methods for multiple api token queries
+	ByUserID(userID uint) ([]APIToken, error)
+	
+	// Methods for modifying api token
+	Create(token *APIToken) error
+	Update(token *APIToken) error
+	Delete(id uint) error
+}
+
+type APITokenService interface {
+	// Authenticate returns the token if it exists and hasn't expired and
+	// records that it was used
+	Authenticate(token string) (*APIToken, error)
+	APITokenDB
+}
+
+func NewAPITokenService(db *gorm.DB, keys Keys) APITokenService {
+	return &apiTokenService{
+		APITokenDB: newAPITokenValidator(&apiTokenGorm{db}, keys.Keyring()),
+	}
+}
+
+type apiTokenService struct {
+	APITokenDB
+}
+
+func (ats *apiTokenService) Authenticate(token string) (*APIToken, error) {
+	apiToken, err := ats.ByToken(token)
+	if err != nil {
+		if err == ErrNotFound {
+			return nil, ErrTokenInvalid
+		}
+		return nil, err
+	}
+	if apiToken.Expired() {
+		return nil, ErrTokenInvalid
+	}
+	
+	now := time.Now()
+	if apiToken.LastUsedAt == nil || now.Sub(*apiToken.LastUsedAt) >= lastUsedPrecision {
+		apiToken.LastUsedAt = &now
+		if err := ats.Update(apiToken); err != nil {
+			return nil, err
+		}
+	}
+	return apiToken, nil
+}
+
+type apiTokenValFunc func(token *APIToken) error
+
+func runAPITokenValFuncs(token *APIToken, fns ...apiTokenValFunc) error {
+	for _, fn := range fns {
+		if err := fn(token); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newAPITokenValidator(db APITokenDB, hmac hash.Keyring) *apiTokenValidator {
+	return &apiTokenValidator{
+		APITokenDB: db,
+		hmac:       hmac,
+	}
+}
+
+type apiTokenValidator struct {
+	APITokenDB
+	hmac hash.Keyring
+}
+
+// ByToken also finds tokens hashed with a previous HMAC key
+func (atv *apiTokenValidator) ByToken(token string) (*APIToken, error) {
+	if !strings.HasPrefix(token, APITokenPrefix) {
+		return nil, ErrNotFound
+	}
+	for i, tokenHash := range atv.hmac.Hashes(token) {
+		apiToken, err := atv.APITokenDB.ByToken(tokenHash)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if i > 0 {
+			apiToken.TokenHash = atv.hmac.Hash(token)
+			if err := atv.APITokenDB.Update(apiToken); err != nil {
+				return nil, err
+			}
+		}
+		return apiToken, nil
+	}
+	return nil, ErrNotFound
+}
+
+func (atv *apiTokenValidator) Create(token *APIToken) error {
+	err := runAPITokenValFuncs(token,
+		atv.userIDRequired,
+		atv.nameRequired,
+		atv.scopesNormalize,
+		atv.scopesValid,
+		atv.defaultToken,
+		atv.hashToken,
+	)
+	if err != nil {
+		return err
+	}
+	return atv.APITokenDB.Create(token)
+}
+
+func (atv *apiTokenValidator) Update(token *APIToken) error {
+	err := runAPITokenValFuncs(token,
+		atv.userIDRequired,
+		atv.nameRequired,
+		atv.scopesNormalize,
+		atv.scopesValid,
+		atv.hashToken,
+	)
+	if err != nil {
+		return err
+	}
+	return atv.APITokenDB.Update(token)
+}
+
+func (atv *apiTokenValidator) Delete(id uint) error {
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+	return atv.APITokenDB.Delete(id)
+}
+
+func (atv *apiTokenValidator) userIDRequired(token *APIToken) error {
+	if token.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+	return nil
+}
+
+func (atv *apiTokenValidator) nameRequired(token *APIToken) error {
+	token.Name = strings.TrimSpace(token.Name)
+	if token.Name == "" {
+		return ErrTokenNameRequired
+	}
+	return nil
+}
+
+// scopesNormalize sorts scopes in the order of Scopes and drops duplicates
+func (atv *apiTokenValidator) scopesNormalize(token *APIToken) error {
+	requested := map[string]bool{}
+	for _, scope := range token.ScopeList() {
+		requested[scope] = true
+	}
+	var scopes []string
+	for _, scope := range Scopes {
+		if requested[scope] {
+			scopes = append(scopes, scope)
+			delete(requested, scope)
+		}
+	}
+	if len(requested) > 0 {
+		return ErrScopeInvalid
+	}
+	token.Scopes = strings.Join(scopes, " ")
+	return nil
+}
+
+func (atv *apiTokenValidator) scopesValid(token *APIToken) error {
+	if token.Scopes == "" {
+		return ErrScopesRequired
+	}
+	return nil
+}
+
+func (atv *apiTokenValidator) defaultToken(token *APIToken) error {
+	if token.Token != "" {
+		return nil
+	}
+	value, err := rand.RememberToken()
+	if err != nil {
+		return err
+	}
+	token.Token = APITokenPrefix + value
+	return nil
+}
+
+func (atv *apiTokenValidator) hashToken(token *APIToken) error {
+	if token.Token == "" {
+		return nil
+	}
+	token.TokenHash = atv.hmac.Hash(token.Token)
+	return nil
+}
+
+var _ APITokenDB = &apiTokenGorm{}
+
+type apiTokenGorm struct {
+	db *gorm.DB
+}
+
+func (atg *apiTokenGorm) ByID(id uint) (*APIToken, error) {
+	var token APIToken
+	err := First(atg.db.Where("id = ?", id), &token)
+	return &token, err
+}
+
+func (atg *apiTokenGorm) ByToken(tokenHash string) (*APIToken, error) {
+	var token APIToken
+	err := First(atg.db.Where("token_hash = ?", tokenHash), &token)
+	if err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+func (atg *apiTokenGorm) ByUserID(userID uint) ([]APIToken, error) {
+	var tokens []APIToken
+	err := atg.db.Where("user_id = ?", userID).Order("created_at desc").Find(&tokens).Error
+	if err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+func (atg *apiTokenGorm) Create(token *APIToken) error {
+	return atg.db.Create(token).Error
+}
+
+func (atg *apiTokenGorm) Update(token *APIToken) error {
+	return atg.db.Save(token).Error
+}
+
+func (atg *apiTokenGorm) Delete(id uint) error {
+	token := APIToken{Model: gorm.Model{ID: id}}
+	return atg.db.Unscoped().Delete(&token).Error
+}
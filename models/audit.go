@@ -0,0 +1,235 @@
+package models
+
+import (
+	"github.com/jinzhu/gorm"
+	"strings"
+	"time"
+)
+
+// userAgentMaxLength keeps user agents within a default varchar column
+const userAgentMaxLength = 255
+
+const (
+	AuditSignIn                 = "auth.signin"
+	AuditSignInFailed           = "auth.signin_failed"
+	AuditSignOut                = "auth.signout"
+	AuditSessionsRevoked        = "auth.sessions_revoked"
+	AuditPasswordResetRequested = "auth.password_reset_requested"
+	AuditPasswordResetCompleted = "auth.password_reset_completed"
+	AuditPasswordChanged        = "account.password_changed"
+	AuditEmailChanged           = "account.email_changed"
+	AuditOAuthConnected         = "oauth.connected"
+	AuditOAuthDisconnected      = "oauth.disconnected"
+	AuditAPITokenCreated        = "api_token.created"
+	AuditAPITokenRevoked        = "api_token.revoked"
+	AuditWebhookCreated         = "webhook.created"
+	AuditWebhookDeleted         = "webhook.deleted"
+	
+
+	AuditAccountDeletionScheduled = "account.deletion_scheduled"
+	AuditAccountDeletionCancelled = "account.deletion_cancelled"
+	AuditAccountPurgeStep         = "account.purge_step"
+	AuditAccountPurged            = "account.purged"
+	
+	AuditAdminUserSuspended   = "admin.user_suspended"
+	AuditAdminUserUnsuspended = "admin.user_unsuspended"
+	AuditAdminPasswordReset   = "admin.password_reset_forced"
+	AuditAdminRoleChanged     = "admin.role_changed"
+	AuditAdminGalleryDeleted  = "admin.gallery_deleted"
+)
+
+// AuditLog is a single entry of the audit trail. Entries outlive the user
+// they belong to, so UserID is not a foreign key. ActorID is the staff
+// member who acted on the user, or 0 when the user acted themselves.
+// UserID is 0 for failed sign ins with an unknown login. IP and UserAgent
+// are empty for entries recorded by background jobs.
+type AuditLog struct {
+	gorm.Model
+	UserID    uint   `gorm:"index"`
+	ActorID   uint   `gorm:"index"`
+	Action    string `gorm:"not null;index"`
+	Detail    string `gorm:"type:text"`
+	IP        string `gorm:"index"`
+	UserAgent string
+}
+
+// PublicAuditLog holds the fields of an audit log entry which are safe to
+// send to the clients allowed to see the entry
+type PublicAuditLog struct {
+	ID        uint      `json:"id"`
+	Action    string    `json:"action"`
+	Detail    string    `json:"detail"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (l AuditLog) Public() PublicAuditLog {
+	return PublicAuditLog{
+		ID:        l.ID,
+		Action:    l.Action,
+		Detail:    l.Detail,
+		IP:        l.IP,
+		UserAgent: l.UserAgent,
+		CreatedAt: l.CreatedAt,
+	}
+}
+
+// AuditFilter narrows down audit log queries, zero values match anything
+type AuditFilter struct {
+	UserID uint
+	Action string
+	IP     string
+	Since  time.Time
+	Until  time.Time
+}
+
+type AuditLogDB interface {
+	// Methods for multiple audit log queries
+	ByUserID(userID uint) ([]AuditLog, error)
+	// Search returns the newest entries matching the filter first along
+	// with the total number of matches
+	Search(filter AuditFilter, p Pagination) ([]AuditLog, int, error)
+	
+	// Methods for modifying audit log
+	Create(entry *AuditLog) error
+	DeleteBefore(t time.Time) (int64, error)
+}
+
+type AuditLogService interface {
+	// Record is a shorthand for creating an entry
+	Record(userID uint, action, detail string) error
+	// RecordBy records an action taken by a staff member on a user
+	RecordBy(actorID, userID uint, action, detail string) error
+	// Prune removes entries older than the retention period and returns
+	// how many were removed. A retention of 0 keeps everything.
+	Prune(retention time.Duration) (int64, error)
+	AuditLogDB
+}
+
+func NewAuditLogService(db *gorm.DB) AuditLogService {
+	return &auditLogService{
+		AuditLogDB: &auditLogValidator{&auditLogGorm{db}},
+	}
+}
+
+type auditLogService struct {
+	AuditLogDB
+}
+
+func (als *auditLogService) Record(userID uint, action, detail string) error {
+	return als.Create(&AuditLog{
+		UserID: userID,
+		Action: action,
+		Detail: detail,
+	})
+}
+
+func (als *auditLogService) RecordBy(actorID, userID uint, action, detail string) error {
+	return als.Create(&AuditLog{
+		UserID:  userID,
+		ActorID: actorID,
+		Action:  action,
+		Detail:  detail,
+	})
+}
+
+func (als *auditLogService) Prune(retention time.Duration) (int64, error) {
+	if retention <= 0 {
+		return 0, nil
+	}
+	return als.DeleteBefore(time.Now().Add(-retention))
+}
+
+type auditLogValFunc func(entry *AuditLog) error
+
+func runAuditLogValFuncs(entry *AuditLog, fns ...auditLogValFunc) error {
+	for _, fn := range fns {
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type auditLogValidator struct {
+	AuditLogDB
+}
+
+func (alv *auditLogValidator) Create(entry *AuditLog) error {
+	err := runAuditLogValFuncs(entry,
+		alv.actionRequired,
+		alv.userAgentTruncate,
+	)
+	if err != nil {
+		return err
+	}
+	return alv.AuditLogDB.Create(entry)
+}
+
+func (alv *auditLogValidator) actionRequired(entry *AuditLog) error {
+	if entry.Action == "" {
+		return ErrActionRequired
+	}
+	return nil
+}
+
+func (alv *auditLogValidator) userAgentTruncate(entry *AuditLog) error {
+	entry.UserAgent = strings.TrimSpace(entry.UserAgent)
+	if len(entry.UserAgent) > userAgentMaxLength {
+		entry.UserAgent = entry.UserAgent[:userAgentMaxLength]
+	}
+	return nil
+}
+
+type auditLogGorm struct {
+	db *gorm.DB
+}
+
+func (alg *auditLogGorm) ByUserID(userID uint) ([]AuditLog, error) {
+	var entries []AuditLog
+	err := alg.db.Where("user_id = ?", userID).Order("created_at desc").Find(&entries).Error
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func (alg *auditLogGorm) Create(entry *AuditLog) error {
+	return alg.db.Create(entry).Error
+}
+
+func (alg *auditLogGorm) Search(filter AuditFilter, p Pagination) ([]AuditLog, int, error) {
+	db := alg.db.Model(&AuditLog{})
+	if filter.UserID > 0 {
+		db = db.Where("user_id = ?", filter.UserID)
+	}
+	if filter.Action != "" {
+		db = db.Where("action = ?", filter.Action)
+	}
+	if filter.IP != "" {
+		db = db.Where("ip = ?", filter.IP)
+	}
+	if !filter.Since.IsZero() {
+		db = db.Where("created_at >= ?", filter.Since)
+	}
+	if !filter.Until.IsZero() {
+		db = db.Where("created_at < ?", filter.Until)
+	}
+	
+	var total int
+	if err := db.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	var entries []AuditLog
+	err := db.Order("created_at desc").Offset(p.Offset()).Limit(p.Limit()).Find(&entries).Error
+	if err != nil {
+		return nil, 0, err
+	}
+	return entries, total, nil
+}
+
+func (alg *auditLogGorm) DeleteBefore(t time.Time) (int64, error) {
+	db := alg.db.Unscoped().Where("created_at < ?", t).Delete(&AuditLog{})
+	return db.RowsAffected, db.Error
+}
@@ -0,0 +1,436 @@
+package models
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"gallerio/utils/hash"
+	"gallerio/utils/rand"
+	"github.com/jinzhu/gorm"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	DataExportPending = "pending"
+	DataExportReady   = "ready"
+	DataExportFailed  = "failed"
+)
+
+var (
+	exportDir = "exports/"
+	// exportTTL is how long the download link of a finished export works
+	exportTTL = 48 * time.Hour
+	// exportTimeout is longer than any export takes to build. Exports still
+	// pending after it were abandoned, e.g. by a crash, and count as failed.
+	exportTimeout = time.Hour
+	
+	slugRegex = regexp.MustCompile(`[^a-z0-9]+`)
+)
+
+type DataExport struct {
+	gorm.Model
+	UserID    uint   `gorm:"not null;index"`
+	Status    string `gorm:"not null"`
+	Path      string `json:"-"`
+	Token     string `gorm:"-" json:"-"`
+	TokenHash string `gorm:"not null;unique_index" json:"-"`
+	ExpiresAt *time.Time
+}
+
+func (de *DataExport) Expired() bool {
+	return de.ExpiresAt != nil && time.Now().After(*de.ExpiresAt)
+}
+
+// InProgress tells whether the export is pending and not abandoned
+func (de *DataExport) InProgress() bool {
+	return de.Status == DataExportPending && time.Since(de.CreatedAt) < exportTimeout
+}
+
+type DataExportDB interface {
+	// Methods for single data export queries
+	ByID(id uint) (*DataExport, error)
+	ByToken(token string) (*DataExport, error)
+	
+	// Methods for multiple data export queries
+	ByUserID(userID uint) ([]DataExport, error)
+	ExpiredBefore(t time.Time) ([]DataExport, error)
+	PendingBefore(t time.Time) ([]DataExport, error)
+	
+	// Methods for modifying data export
+	Create(export *DataExport) error
+	Update(export *DataExport) error
+	Delete(id uint) error
+}
+
+type DataExportService interface {
+	// Build writes the archive of a pending export and marks it as ready.
+	// The export is marked as failed when the archive can't be written.
+	Build(export *DataExport) error
+	// Prune removes expired, failed and abandoned exports along with their
+	// archives
+	Prune() (int, error)
+	DataExportDB
+}
+
+func NewDataExportService(db *gorm.DB, keys Keys, us UserService, gs GalleryService, is ImageService, oas OAuthService) DataExportService {
+	return &dataExportService{
+		DataExportDB: newDataExportValidator(&dataExportGorm{db}, keys.Keyring()),
+		us:           us,
+		gs:           gs,
+		is:           is,
+		oas:          oas,
+	}
+}
+
+type dataExportService struct {
+	DataExportDB
+	us  UserService
+	gs  GalleryService
+	is  ImageService
+	oas OAuthService
+}
+
+type exportProfile struct {
+	ID        uint      `json:"id"`
+	Name      string    `json:"name"`
+	Username  string    `json:"username"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type exportGallery struct {
+	ID        uint      `json:"id"`
+	Title     string    `json:"title"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Images    []string  `json:"images"`
+}
+
+type exportConnection struct {
+	Provider    string     `json:"provider"`
+	ConnectedAt time.Time  `json:"connected_at"`
+	Expiry      *time.Time `json:"expiry,omitempty"`
+}
+
+func (des *dataExportService) Build(export *DataExport) error {
+	err := des.build(export)
+	if err != nil {
+		// There is nothing to download, the next Prune removes it
+		now := time.Now()
+		export.Status = DataExportFailed
+		export.ExpiresAt = &now
+		if export.Path != "" {
+			os.Remove(export.Path)
+			export.Path = ""
+		}
+		des.Update(export)
+		return err
+	}
+	expiresAt := time.Now().Add(exportTTL)
+	export.Status = DataExportReady
+	export.ExpiresAt = &expiresAt
+	return des.Update(export)
+}
+
+func (des *dataExportService) build(export *DataExport) error {
+	user, err := des.us.ByID(export.UserID)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(exportDir, 0700); err != nil {
+		return err
+	}
+	name, err := rand.String(16)
+	if err != nil {
+		return err
+	}
+	export.Path = filepath.Join(exportDir, fmt.Sprintf("%d-%s.zip", user.ID, name))
+	f, err := os.OpenFile(export.Path, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	
+	zw := zip.NewWriter(f)
+	profile := exportProfile{
+		ID:        user.ID,
+		Name:      user.Name,
+		Username:  user.Username,
+		Email:     user.Email,
+		CreatedAt: user.CreatedAt,
+		UpdatedAt: user.UpdatedAt,
+	}
+	if err := writeZipJSON(zw, "profile.json", profile); err != nil {
+		return err
+	}
+	
+	galleries, err := des.gs.ByUserID(user.ID)
+	if err != nil {
+		return err
+	}
+	for _, gallery := range galleries {
+		if err := des.writeGallery(zw, gallery); err != nil {
+			return err
+		}
+	}
+	
+	oauths, err := des.oas.ByUserID(user.ID)
+	if err != nil {
+		return err
+	}
+	connections := make([]exportConnection, len(oauths))
+	for i, oauth := range oauths {
+		// Access and refresh tokens are secrets and never exported
+		connections[i] = exportConnection{
+			Provider:    oauth.Provider,
+			ConnectedAt: oauth.CreatedAt,
+			Expiry:      oauth.Expiry,
+		}
+	}
+	if err := writeZipJSON(zw, "connections.json", connections); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+func (des *dataExportService) writeGallery(zw *zip.Writer, gallery Gallery) error {
+	images, err := des.is.ByGalleryID(gallery.ID)
+	if err != nil {
+		return err
+	}
+	dir := fmt.Sprintf("galleries/%d-%s/", gallery.ID, slugify(gallery.Title))
+	meta := exportGallery{
+		ID:        gallery.ID,
+		Title:     gallery.Title,
+		CreatedAt: gallery.CreatedAt,
+		UpdatedAt: gallery.UpdatedAt,
+		Images:    make([]string, len(images)),
+	}
+	for i, image := range images {
+		meta.Images[i] = image.Filename
+		if err := writeZipFile(zw, dir+"images/"+image.Filename, image.RelativePath()); err != nil {
+			return err
+		}
+	}
+	return writeZipJSON(zw, dir+"gallery.json", meta)
+}
+
+func (des *dataExportService) Prune() (int, error) {
+	now := time.Now()
+	exports, err := des.ExpiredBefore(now)
+	if err != nil {
+		return 0, err
+	}
+	abandoned, err := des.PendingBefore(now.Add(-exportTimeout))
+	if err != nil {
+		return 0, err
+	}
+	exports = append(exports, abandoned...)
+	for i, export := range exports {
+		if export.Path != "" {
+			if err := os.Remove(export.Path); err != nil && !os.IsNotExist(err) {
+				return i, err
+			}
+		}
+		if err := des.Delete(export.ID); err != nil {
+			return i, err
+		}
+	}
+	return len(exports), nil
+}
+
+func writeZipJSON(zw *zip.Writer, name string, v interface{}) error {
+	w, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func writeZipFile(zw *zip.Writer, name, path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	w, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, src)
+	return err
+}
+
+func slugify(s string) string {
+	s = slugRegex.ReplaceAllString(strings.ToLower(s), "-")
+	s = strings.Trim(s, "-")
+	if s == "" {
+		return "untitled"
+	}
+	return s
+}
+
+type dataExportValFunc func(export *DataExport) error
+
+func runDataExportValFuncs(export *DataExport, fns ...dataExportValFunc) error {
+	for _, fn := range fns {
+		if err := fn(export); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newDataExportValidator(db DataExportDB, hmac hash.Keyring) *dataExportValidator {
+	return &dataExportValidator{
+		DataExportDB: db,
+		hmac:         hmac,
+	}
+}
+
+type dataExportValidator struct {
+	DataExportDB
+	hmac hash.Keyring
+}
+
+// ByToken also finds tokens hashed with a previous HMAC key
+func (dev *dataExportValidator) ByToken(token string) (*DataExport, error) {
+	for _, tokenHash := range dev.hmac.Hashes(token) {
+		export, err := dev.DataExportDB.ByToken(tokenHash)
+		if err != ErrNotFound {
+			return export, err
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (dev *dataExportValidator) Create(export *DataExport) error {
+	err := runDataExportValFuncs(export,
+		dev.userIDRequired,
+		dev.defaultStatus,
+		dev.defaultToken,
+		dev.hashToken,
+	)
+	if err != nil {
+		return err
+	}
+	return dev.DataExportDB.Create(export)
+}
+
+func (dev *dataExportValidator) Update(export *DataExport) error {
+	err := runDataExportValFuncs(export, dev.userIDRequired, dev.hashToken)
+	if err != nil {
+		return err
+	}
+	return dev.DataExportDB.Update(export)
+}
+
+func (dev *dataExportValidator) Delete(id uint) error {
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+	return dev.DataExportDB.Delete(id)
+}
+
+func (dev *dataExportValidator) userIDRequired(export *DataExport) error {
+	if export.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+	return nil
+}
+
+func (dev *dataExportValidator) defaultStatus(export *DataExport) error {
+	if export.Status == "" {
+		export.Status = DataExportPending
+	}
+	return nil
+}
+
+func (dev *dataExportValidator) defaultToken(export *DataExport) error {
+	if export.Token != "" {
+		return nil
+	}
+	token, err := rand.RememberToken()
+	if err != nil {
+		return err
+	}
+	export.Token = token
+	return nil
+}
+
+func (dev *dataExportValidator) hashToken(export *DataExport) error {
+	if export.Token == "" {
+		return nil
+	}
+	export.TokenHash = dev.hmac.Hash(export.Token)
+	return nil
+}
+
+var _ DataExportDB = &dataExportGorm{}
+
+type dataExportGorm struct {
+	db *gorm.DB
+}
+
+func (deg *dataExportGorm) ByID(id uint) (*DataExport, error) {
+	var export DataExport
+	err := First(deg.db.Where("id = ?", id), &export)
+	return &export, err
+}
+
+func (deg *dataExportGorm) ByToken(tokenHash string) (*DataExport, error) {
+	var export DataExport
+	err := First(deg.db.Where("token_hash = ?", tokenHash), &export)
+	if err != nil {
+		return nil, err
+	}
+	return &export, nil
+}
+
+func (deg *dataExportGorm) ByUserID(userID uint) ([]DataExport, error) {
+	var exports []DataExport
+	err := deg.db.Where("user_id = ?", userID).Order("created_at desc").Find(&exports).Error
+	if err != nil {
+		return nil, err
+	}
+	return exports, nil
+}
+
+func (deg *dataExportGorm) ExpiredBefore(t time.Time) ([]DataExport, error) {
+	var exports []DataExport
+	err := deg.db.Where("expires_at IS NOT NULL AND expires_at < ?", t).Find(&exports).Error
+	if err != nil {
+		return nil, err
+	}
+	return exports, nil
+}
+
+func (deg *dataExportGorm) PendingBefore(t time.Time) ([]DataExport, error) {
+	var exports []DataExport
+	err := deg.db.Where("status = ? AND created_at < ?", DataExportPending, t).Find(&exports).Error
+	if err != nil {
+		return nil, err
+	}
+	return exports, nil
+}
+
+func (deg *dataExportGorm) Create(export *DataExport) error {
+	return deg.db.Create(export).Error
+}
+
+func (deg *dataExportGorm) Update(export *DataExport) error {
+	return deg.db.Save(export).Error
+}
+
+func (deg *dataExportGorm) Delete(id uint) error {
+	export := DataExport{Model: gorm.Model{ID: id}}
+	return deg.db.Unscoped().Delete(&export).Error
+}
@@ -0,0 +1,65 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDataExportPrune(t *testing.T) {
+	services := newTestServices(t)
+	des := services.DataExport
+	alice := createTestUser(t, services.User, "alice")
+	
+	// Left pending by a crash in the middle of building it
+	abandoned := &DataExport{UserID: alice.ID}
+	if err := des.Create(abandoned); err != nil {
+		t.Fatal(err)
+	}
+	err := services.DB().Model(&DataExport{}).Where("id = ?", abandoned.ID).
+		UpdateColumn("created_at", time.Now().Add(-2*exportTimeout)).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	abandoned, err = des.ByID(abandoned.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if abandoned.InProgress() {
+		t.Fatal("expected an export pending for so long to be abandoned")
+	}
+	
+	// The user is gone, so building fails
+	failed := &DataExport{UserID: alice.ID + 1}
+	if err := des.Create(failed); err != nil {
+		t.Fatal(err)
+	}
+	if !failed.InProgress() {
+		t.Fatal("expected a new export to be in progress")
+	}
+	if err := des.Build(failed); err == nil {
+		t.Fatal("expected building the export of an unknown user to fail")
+	}
+	if failed.Status != DataExportFailed {
+		t.Fatalf("expected the export to be failed, got %s", failed.Status)
+	}
+	
+	pending := &DataExport{UserID: alice.ID}
+	if err := des.Create(pending); err != nil {
+		t.Fatal(err)
+	}
+	
+	n, err := des.Prune()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("expected the abandoned and failed exports to be pruned, got %d", n)
+	}
+	exports, err := des.ByUserID(alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(exports) != 1 || exports[0].ID != pending.ID {
+		t.Fatalf("expected only the pending export to be left, got %d", len(exports))
+	}
+}
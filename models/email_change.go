@@ -0,0 +1,155 @@
+package models
+
+import (
+	"gallerio/utils/hash"
+	"gallerio/utils/rand"
+	"github.com/jinzhu/gorm"
+)
+
+// emailChange holds a new email address until the user proves they own it
+// by following the link sent to that address.
+type emailChange struct {
+	gorm.Model
+	UserID    uint   `gorm:"not null;index"`
+	Email     string `gorm:"not null"`
+	Token     string `gorm:"-" json:"-"`
+	TokenHash string `gorm:"not null;unique_index" json:"-"`
+}
+
+type emailChangeDB interface {
+	ByToken(token string) (*emailChange, error)
+	
+	Create(ec *emailChange) error
+	Delete(id uint) error
+	DeleteByUserID(userID uint) error
+}
+
+type emailChangeValFunc func(*emailChange) error
+
+func runEmailChangeValFuncs(ec *emailChange, fns ...emailChangeValFunc) error {
+	for _, fn := range fns {
+		if err := fn(ec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newEmailChangeValidator(db emailChangeDB, hmac hash.Keyring) *emailChangeValidator {
+	return &emailChangeValidator{
+		emailChangeDB: db,
+		hmac:          hmac,
+	}
+}
+
+type emailChangeValidator struct {
+	emailChangeDB
+	hmac hash.Keyring
+}
+
+// ByToken also finds tokens hashed with a previous HMAC key
+func (ecv *emailChangeValidator) ByToken(token string) (*emailChange, error) {
+	for _, tokenHash := range ecv.hmac.Hashes(token) {
+		ec, err := ecv.emailChangeDB.ByToken(tokenHash)
+		if err != ErrNotFound {
+			return ec, err
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (ecv *emailChangeValidator) Create(ec *emailChange) error {
+	err := runEmailChangeValFuncs(ec,
+		ecv.userIDRequired,
+		ecv.emailNormalize,
+		ecv.emailRequired,
+		ecv.emailFormat,
+		ecv.defaultToken,
+		ecv.hashToken,
+	)
+	if err != nil {
+		return err
+	}
+	return ecv.emailChangeDB.Create(ec)
+}
+
+func (ecv *emailChangeValidator) Delete(id uint) error {
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+	return ecv.emailChangeDB.Delete(id)
+}
+
+func (ecv *emailChangeValidator) userIDRequired(ec *emailChange) error {
+	if ec.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+	return nil
+}
+
+func (ecv *emailChangeValidator) emailNormalize(ec *emailChange) error {
+	user := &User{Email: ec.Email}
+	normalizeEmail(user)
+	ec.Email = user.Email
+	return nil
+}
+
+func (ecv *emailChangeValidator) emailRequired(ec *emailChange) error {
+	if ec.Email == "" {
+		return ErrEmailRequired
+	}
+	return nil
+}
+
+func (ecv *emailChangeValidator) emailFormat(ec *emailChange) error {
+	if !EmailRegex.MatchString(ec.Email) {
+		return ErrEmailInvalid
+	}
+	return nil
+}
+
+func (ecv *emailChangeValidator) defaultToken(ec *emailChange) error {
+	if ec.Token != "" {
+		return nil
+	}
+	token, err := rand.RememberToken()
+	if err != nil {
+		return err
+	}
+	ec.Token = token
+	return nil
+}
+
+func (ecv *emailChangeValidator) hashToken(ec *emailChange) error {
+	if ec.Token == "" {
+		return nil
+	}
+	ec.TokenHash = ecv.hmac.Hash(ec.Token)
+	return nil
+}
+
+type emailChangeGorm struct {
+	db *gorm.DB
+}
+
+func (ecg *emailChangeGorm) ByToken(tokenHash string) (*emailChange, error) {
+	var ec emailChange
+	err := First(ecg.db.Where("token_hash = ?", tokenHash), &ec)
+	if err != nil {
+		return nil, err
+	}
+	return &ec, nil
+}
+
+func (ecg *emailChangeGorm) Create(ec *emailChange) error {
+	return ecg.db.Create(ec).Error
+}
+
+func (ecg *emailChangeGorm) Delete(id uint) error {
+	ec := emailChange{Model: gorm.Model{ID: id}}
+	return ecg.db.Unscoped().Delete(&ec).Error
+}
+
+func (ecg *emailChangeGorm) DeleteByUserID(userID uint) error {
+	return ecg.db.Unscoped().Where("user_id = ?", userID).Delete(&emailChange{}).Error
+}
@@ -6,10 +6,33 @@ const (
 	ErrNotFound          modelError = "models: resource not found"
 	ErrPasswordIncorrect modelError = "models: incorrect password provided"
 	ErrPasswordRequired  modelError = "models: password is required"
-	ErrPasswordTooShort  modelError = "models: password must be at least 8 characters"
+	ErrPasswordTooWeak   modelError = "models: password is too easy to guess, try a longer one mixing letters, numbers and symbols"
+	ErrPasswordPersonal  modelError = "models: password must not contain your username or email address"
+	ErrPasswordBreached  modelError = "models: password has appeared in a data breach, please choose a different one"
 	ErrEmailRequired     modelError = "models: email address is required"
 	ErrEmailInvalid      modelError = "models: email address is invalid"
 	ErrEmailTaken        modelError = "models: email address is taken"
+	ErrEmailUnchanged    modelError = "models: new email address is the same as the current one"
+	ErrUsernameRequired  modelError = "models: username is required"
+	ErrUsernameInvalid   modelError = "models: username must be 3 to 30 letters, numbers, dots, dashes or underscores"
+	ErrUsernameReserved  modelError = "models: username is reserved"
+	ErrUsernameTaken     modelError = "models: username is taken"
+	ErrRoleInvalid       modelError = "models: role is invalid"
+	ErrAccountSuspended  modelError = "models: your account has been suspended, please contact support"
+	ErrInviteOnly        modelError = "models: registration is by invitation only"
+	ErrInviteInvalid     modelError = "models: invitation is invalid or has expired"
+	ErrInviteEmail       modelError = "models: invitation was sent to a different email address"
+	ErrDomainNotAllowed  modelError = "models: email addresses of this domain can't sign up"
+	ErrMaxUsesInvalid    modelError = "models: number of uses can't be negative"
+	ErrTokenNameRequired modelError = "models: token name is required"
+	ErrScopesRequired    modelError = "models: select at least one scope"
+	ErrScopeInvalid      modelError = "models: scope is invalid"
+	ErrFilenameInvalid   modelError = "models: filename is invalid"
+	ErrFilenameTaken     modelError = "models: an image with this filename already exists"
+	ErrWebhookURLInvalid modelError = "models: webhook URL must be an absolute http or https URL"
+	ErrWebhookURLPrivate modelError = "models: webhook URL must not point at a local or private address"
+	ErrEventsRequired    modelError = "models: select at least one event"
+	ErrEventInvalid      modelError = "models: event is invalid"
 	ErrTitleRequired     modelError = "models: title is required"
 	ErrTokenInvalid      modelError = "models: token is invalid"
 	ErrProviderRequired  modelError = "models: provider is required"
@@ -18,6 +41,7 @@ const (
 	ErrRememberTokenTooShort privateError = "models: remember token must be at least 32 bytes"
 	ErrRememberTokenRequired privateError = "models: remember token is required"
 	ErrUserIDRequired        privateError = "models: user ID was not provided"
+	ErrActionRequired        privateError = "models: audit action is required"
 )
 
 type modelError string
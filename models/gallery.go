@@ -1,7 +1,10 @@
 package models
 
 import (
+	"context"
 	"github.com/jinzhu/gorm"
+	"strings"
+	"time"
 )
 
 type Gallery struct {
@@ -11,6 +14,30 @@ type Gallery struct {
 	Images []Image `gorm:"-"`
 }
 
+// PublicGallery holds the fields of a gallery which are safe to send to
+// clients
+type PublicGallery struct {
+	ID        uint          `json:"id"`
+	Title     string        `json:"title"`
+	Images    []PublicImage `json:"images"`
+	CreatedAt time.Time     `json:"created_at"`
+	UpdatedAt time.Time     `json:"updated_at"`
+}
+
+func (g *Gallery) Public() PublicGallery {
+	images := make([]PublicImage, len(g.Images))
+	for i := range g.Images {
+		images[i] = g.Images[i].Public()
+	}
+	return PublicGallery{
+		ID:        g.ID,
+		Title:     g.Title,
+		Images:    images,
+		CreatedAt: g.CreatedAt,
+		UpdatedAt: g.UpdatedAt,
+	}
+}
+
 func (g *Gallery) ImageSplitN(n int) [][]Image {
 	ret := make([][]Image, n)
 	for i:=0; i<n; i++ {
@@ -24,13 +51,28 @@ func (g *Gallery) ImageSplitN(n int) [][]Image {
 	return ret
 }
 
+// GalleryService is GalleryDB with a context for the changes, whose
+// request ID tags the log lines of sending them to webhooks
 type GalleryService interface {
-	GalleryDB
+	ByUserID(id uint) ([]Gallery, error)
+	PageByUserID(id uint, p Pagination) ([]Gallery, int, error)
+	Search(query string, p Pagination) ([]Gallery, int, error)
+	ByID(id uint) (*Gallery, error)
+	
+	Create(ctx context.Context, gallery *Gallery) error
+	Update(ctx context.Context, gallery *Gallery) error
+	Delete(ctx context.Context, id uint) error
 }
 
 type GalleryDB interface {
 	// Methods for multiple gallery queries
 	ByUserID(id uint) ([]Gallery, error)
+	// PageByUserID returns one page of the user's galleries and the total
+	// number of galleries the user has
+	PageByUserID(id uint, p Pagination) ([]Gallery, int, error)
+	// Search matches the query against the title and also returns the
+	// total number of matches
+	Search(query string, p Pagination) ([]Gallery, int, error)
 	
 	// Methods for single gallery queries
 	ByID(id uint) (*Gallery, error)
@@ -51,6 +93,18 @@ type galleryService struct {
 	GalleryDB
 }
 
+func (gs *galleryService) Create(ctx context.Context, gallery *Gallery) error {
+	return gs.GalleryDB.Create(gallery)
+}
+
+func (gs *galleryService) Update(ctx context.Context, gallery *Gallery) error {
+	return gs.GalleryDB.Update(gallery)
+}
+
+func (gs *galleryService) Delete(ctx context.Context, id uint) error {
+	return gs.GalleryDB.Delete(id)
+}
+
 type galleryValFunc func(gallery *Gallery) error
 
 func runGalleryValFuncs(user *Gallery, fns ...galleryValFunc) error {
@@ -124,6 +178,37 @@ func (gg *galleryGorm) ByUserID(userId uint) ([]Gallery, error) {
 	return galleries, nil
 }
 
+func (gg *galleryGorm) PageByUserID(userId uint, p Pagination) ([]Gallery, int, error) {
+	db := gg.db.Model(&Gallery{}).Where("user_id = ?", userId)
+	var total int
+	if err := db.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	var galleries []Gallery
+	err := db.Order("id").Offset(p.Offset()).Limit(p.Limit()).Find(&galleries).Error
+	if err != nil {
+		return nil, 0, err
+	}
+	return galleries, total, nil
+}
+
+func (gg *galleryGorm) Search(query string, p Pagination) ([]Gallery, int, error) {
+	db := gg.db.Model(&Gallery{})
+	if query != "" {
+		db = db.Where("LOWER(title) LIKE ?", "%"+strings.ToLower(query)+"%")
+	}
+	var total int
+	if err := db.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	var galleries []Gallery
+	err := db.Order("id").Offset(p.Offset()).Limit(p.Limit()).Find(&galleries).Error
+	if err != nil {
+		return nil, 0, err
+	}
+	return galleries, total, nil
+}
+
 func (gg *galleryGorm) ByID(id uint) (*Gallery, error) {
 	var gallery Gallery
 	db := gg.db.Where("id = ?", id)
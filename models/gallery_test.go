@@ -0,0 +1,56 @@
+package models
+
+import (
+	"context"
+	"testing"
+)
+
+func TestGalleryQueries(t *testing.T) {
+	services := newTestServices(t)
+	gs := services.Gallery
+	alice := createTestUser(t, services.User, "alice")
+	bob := createTestUser(t, services.User, "bob")
+	
+	for _, gallery := range []Gallery{
+		{UserID: alice.ID, Title: "Summer Trip"},
+		{UserID: alice.ID, Title: "Winter Trip"},
+		{UserID: alice.ID, Title: "Birthday"},
+		{UserID: bob.ID, Title: "Road Trip"},
+	} {
+		if err := gs.Create(context.Background(), &gallery); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := gs.Create(context.Background(), &Gallery{UserID: alice.ID}); err != ErrTitleRequired {
+		t.Fatalf("expected ErrTitleRequired, got %v", err)
+	}
+	
+	galleries, err := gs.ByUserID(alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(galleries) != 3 {
+		t.Fatalf("expected 3 galleries, got %d", len(galleries))
+	}
+	page, total, err := gs.PageByUserID(alice.ID, NewPagination(2, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 3 || len(page) != 1 {
+		t.Fatalf("expected the second page to hold 1 of 3 galleries, got %d of %d", len(page), total)
+	}
+	matches, total, err := gs.Search("trip", NewPagination(1, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 3 || len(matches) != 3 {
+		t.Fatalf("expected 3 trips, got %d of %d", len(matches), total)
+	}
+	
+	if err := gs.Delete(context.Background(), galleries[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gs.ByID(galleries[0].ID); err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
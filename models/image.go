@@ -1,8 +1,10 @@
 package models
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/url"
 	"os"
 	"path/filepath"
@@ -15,6 +17,20 @@ type Image struct {
 	Filename string
 }
 
+// PublicImage holds the fields of an image which are safe to send to
+// clients
+type PublicImage struct {
+	Filename string `json:"filename"`
+	URL      string `json:"url"`
+}
+
+func (i *Image) Public() PublicImage {
+	return PublicImage{
+		Filename: i.Filename,
+		URL:      i.Path(),
+	}
+}
+
 func (i *Image) Path() string {
 	temp := url.URL{
 		Path: "/" + i.RelativePath(),
@@ -34,12 +50,26 @@ func (i *Image) DeletePath() string {
 }
 
 type ImageService interface {
-	// Mutations
-	Create(galleryID uint, filename string, reader io.ReadCloser) error
-	Delete(img *Image) error
+	// Mutations, ctx tags the log lines of sending them to webhooks
+	Create(ctx context.Context, galleryID uint, filename string, reader io.ReadCloser) error
+	// Rename changes the filename of the image and updates img
+	Rename(img *Image, filename string) error
+	Delete(ctx context.Context, img *Image) error
+	// DeleteAll removes every image of the gallery from disk
+	DeleteAll(galleryID uint) error
+	
+	// Single queries
+	ByFilename(galleryID uint, filename string) (*Image, error)
 	
 	// Multiple queries
 	ByGalleryID(galleryID uint) ([]Image, error)
+	
+	// Usage returns the number of images of the gallery and the bytes they
+	// take up on disk
+	Usage(galleryID uint) (int, int64, error)
+	
+	// Writable checks that new images can be stored
+	Writable() error
 }
 
 func NewImageService() ImageService {
@@ -50,8 +80,11 @@ type imageService struct {
 
 }
 
-func (is *imageService) Create(galleryID uint, filename string, reader io.ReadCloser) error {
+func (is *imageService) Create(ctx context.Context, galleryID uint, filename string, reader io.ReadCloser) error {
 	defer reader.Close()
+	if err := is.filenameValid(filename); err != nil {
+		return err
+	}
 	// Create Directory if does not exists
 	path, err := is.mkImagePath(galleryID)
 	if err != nil {
@@ -73,10 +106,65 @@ func (is *imageService) Create(galleryID uint, filename string, reader io.ReadCl
 	return nil
 }
 
-func (is *imageService) Delete(img *Image) error {
+func (is *imageService) Rename(img *Image, filename string) error {
+	if err := is.filenameValid(img.Filename); err != nil {
+		return err
+	}
+	if err := is.filenameValid(filename); err != nil {
+		return err
+	}
+	if filename == img.Filename {
+		return nil
+	}
+	renamed := Image{
+		GalleryID: img.GalleryID,
+		Filename:  filename,
+	}
+	if _, err := os.Stat(renamed.RelativePath()); err == nil {
+		return ErrFilenameTaken
+	}
+	if err := os.Rename(img.RelativePath(), renamed.RelativePath()); err != nil {
+		if os.IsNotExist(err) {
+			return ErrNotFound
+		}
+		return err
+	}
+	img.Filename = filename
+	return nil
+}
+
+func (is *imageService) Delete(ctx context.Context, img *Image) error {
+	if err := is.filenameValid(img.Filename); err != nil {
+		return err
+	}
 	return os.Remove(img.RelativePath())
 }
 
+func (is *imageService) ByFilename(galleryID uint, filename string) (*Image, error) {
+	if err := is.filenameValid(filename); err != nil {
+		return nil, err
+	}
+	img := Image{
+		GalleryID: galleryID,
+		Filename:  filename,
+	}
+	info, err := os.Stat(img.RelativePath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, ErrNotFound
+	}
+	return &img, nil
+}
+
+func (is *imageService) DeleteAll(galleryID uint) error {
+	return os.RemoveAll(is.galleryImagePath(galleryID))
+}
+
 func (is *imageService) ByGalleryID(galleryID uint) ([]Image, error) {
 	galleryImagePath := is.galleryImagePath(galleryID)
 	files, err := filepath.Glob(galleryImagePath + "*")
@@ -94,6 +182,44 @@ func (is *imageService) ByGalleryID(galleryID uint) ([]Image, error) {
 	return images, nil
 }
 
+func (is *imageService) Usage(galleryID uint) (int, int64, error) {
+	images, err := is.ByGalleryID(galleryID)
+	if err != nil {
+		return 0, 0, err
+	}
+	var size int64
+	for _, img := range images {
+		info, err := os.Stat(img.RelativePath())
+		if err != nil {
+			return 0, 0, err
+		}
+		size += info.Size()
+	}
+	return len(images), size, nil
+}
+
+func (is *imageService) Writable() error {
+	dir := "media/galleries/"
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, ".writable-")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// filenameValid keeps filenames from reaching outside the gallery directory
+func (is *imageService) filenameValid(filename string) error {
+	if filename == "" || filename == "." || filename == ".." ||
+		strings.ContainsAny(filename, `/\`) {
+		return ErrFilenameInvalid
+	}
+	return nil
+}
+
 func (is *imageService) mkImagePath(galleryID uint) (string, error) {
 	galleryImagePath := is.galleryImagePath(galleryID)
 	err := os.MkdirAll(galleryImagePath, 0755)
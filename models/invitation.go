@@ -0,0 +1,267 @@
+package models
+
+import (
+	"gallerio/utils/hash"
+	"gallerio/utils/rand"
+	"github.com/jinzhu/gorm"
+	"strings"
+	"time"
+)
+
+// Invitation lets people sign up while registration is invite-only. An
+// invitation can be bound to one email address, expire and be limited in
+// how often it can be used. MaxUses of 0 means it can be used any number
+// of times.
+type Invitation struct {
+	gorm.Model
+	InviterID uint `gorm:"not null;index"`
+	Email     string
+	Token     string `gorm:"-"`
+	TokenHash string `gorm:"not null;unique_index" json:"-"`
+	ExpiresAt *time.Time
+	MaxUses   int
+	Uses      int
+}
+
+// PublicInvitation holds the fields of an invitation which are safe to send
+// to its inviter. The token itself is only known right after it was
+// created.
+type PublicInvitation struct {
+	ID        uint       `json:"id"`
+	Email     string     `json:"email"`
+	ExpiresAt *time.Time `json:"expires_at"`
+	MaxUses   int        `json:"max_uses"`
+	Uses      int        `json:"uses"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+func (inv Invitation) Public() PublicInvitation {
+	return PublicInvitation{
+		ID:        inv.ID,
+		Email:     inv.Email,
+		ExpiresAt: inv.ExpiresAt,
+		MaxUses:   inv.MaxUses,
+		Uses:      inv.Uses,
+		CreatedAt: inv.CreatedAt,
+	}
+}
+
+// Usable reports whether the invitation has neither expired nor been used up
+func (inv Invitation) Usable() bool {
+	if inv.ExpiresAt != nil && time.Now().After(*inv.ExpiresAt) {
+		return false
+	}
+	return inv.MaxUses == 0 || inv.Uses < inv.MaxUses
+}
+
+type InvitationDB interface {
+	// Methods for single invitation queries
+	ByID(id uint) (*Invitation, error)
+	ByToken(token string) (*Invitation, error)
+	
+	// Methods for multiple invitation queries
+	ByInviterID(inviterID uint) ([]Invitation, error)
+	
+	// Methods for modifying invitation
+	Create(inv *Invitation) error
+	Update(inv *Invitation) error
+	Delete(id uint) error
+}
+
+type InvitationService interface {
+	// Redeem counts one more use of the invitation within tx. It fails with
+	// ErrInviteInvalid when the invitation expired or was used up since it
+	// was looked up.
+	Redeem(tx *gorm.DB, inv *Invitation) error
+	InvitationDB
+}
+
+func NewInvitationService(db *gorm.DB, keys Keys) InvitationService {
+	return &invitationService{
+		InvitationDB: newInvitationValidator(&invitationGorm{db}, keys.Keyring()),
+	}
+}
+
+type invitationService struct {
+	InvitationDB
+}
+
+func (is *invitationService) Redeem(tx *gorm.DB, inv *Invitation) error {
+	// Checked and counted in one statement, so concurrent sign ups can't
+	// use the invitation more often than allowed
+	result := tx.Model(&Invitation{}).
+		Where("id = ? AND (max_uses = 0 OR uses < max_uses)", inv.ID).
+		Where("expires_at IS NULL OR expires_at > ?", time.Now()).
+		UpdateColumn("uses", gorm.Expr("uses + 1"))
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrInviteInvalid
+	}
+	inv.Uses++
+	return nil
+}
+
+type invitationValFunc func(inv *Invitation) error
+
+func runInvitationValFuncs(inv *Invitation, fns ...invitationValFunc) error {
+	for _, fn := range fns {
+		if err := fn(inv); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newInvitationValidator(db InvitationDB, hmac hash.Keyring) *invitationValidator {
+	return &invitationValidator{
+		InvitationDB: db,
+		hmac:         hmac,
+	}
+}
+
+type invitationValidator struct {
+	InvitationDB
+	hmac hash.Keyring
+}
+
+// ByToken also finds tokens hashed with a previous HMAC key
+func (iv *invitationValidator) ByToken(token string) (*Invitation, error) {
+	if token == "" {
+		return nil, ErrNotFound
+	}
+	for _, tokenHash := range iv.hmac.Hashes(token) {
+		inv, err := iv.InvitationDB.ByToken(tokenHash)
+		if err != ErrNotFound {
+			return inv, err
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (iv *invitationValidator) Create(inv *Invitation) error {
+	err := runInvitationValFuncs(inv,
+		iv.inviterIDRequired,
+		iv.emailNormalize,
+		iv.emailFormat,
+		iv.maxUsesNotNegative,
+		iv.defaultToken,
+		iv.hashToken,
+	)
+	if err != nil {
+		return err
+	}
+	return iv.InvitationDB.Create(inv)
+}
+
+func (iv *invitationValidator) Update(inv *Invitation) error {
+	err := runInvitationValFuncs(inv,
+		iv.inviterIDRequired,
+		iv.emailNormalize,
+		iv.emailFormat,
+		iv.maxUsesNotNegative,
+		iv.hashToken,
+	)
+	if err != nil {
+		return err
+	}
+	return iv.InvitationDB.Update(inv)
+}
+
+func (iv *invitationValidator) Delete(id uint) error {
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+	return iv.InvitationDB.Delete(id)
+}
+
+func (iv *invitationValidator) inviterIDRequired(inv *Invitation) error {
+	if inv.InviterID <= 0 {
+		return ErrUserIDRequired
+	}
+	return nil
+}
+
+func (iv *invitationValidator) emailNormalize(inv *Invitation) error {
+	inv.Email = strings.ToLower(strings.TrimSpace(inv.Email))
+	return nil
+}
+
+// emailFormat only applies to invitations bound to an email address
+func (iv *invitationValidator) emailFormat(inv *Invitation) error {
+	if inv.Email != "" && !EmailRegex.MatchString(inv.Email) {
+		return ErrEmailInvalid
+	}
+	return nil
+}
+
+func (iv *invitationValidator) maxUsesNotNegative(inv *Invitation) error {
+	if inv.MaxUses < 0 {
+		return ErrMaxUsesInvalid
+	}
+	return nil
+}
+
+func (iv *invitationValidator) defaultToken(inv *Invitation) error {
+	if inv.Token != "" {
+		return nil
+	}
+	token, err := rand.RememberToken()
+	if err != nil {
+		return err
+	}
+	inv.Token = token
+	return nil
+}
+
+func (iv *invitationValidator) hashToken(inv *Invitation) error {
+	if inv.Token == "" {
+		return nil
+	}
+	inv.TokenHash = iv.hmac.Hash(inv.Token)
+	return nil
+}
+
+var _ InvitationDB = &invitationGorm{}
+
+type invitationGorm struct {
+	db *gorm.DB
+}
+
+func (ig *invitationGorm) ByID(id uint) (*Invitation, error) {
+	var inv Invitation
+	err := First(ig.db.Where("id = ?", id), &inv)
+	return &inv, err
+}
+
+func (ig *invitationGorm) ByToken(tokenHash string) (*Invitation, error) {
+	var inv Invitation
+	err := First(ig.db.Where("token_hash = ?", tokenHash), &inv)
+	if err != nil {
+		return nil, err
+	}
+	return &inv, nil
+}
+
+func (ig *invitationGorm) ByInviterID(inviterID uint) ([]Invitation, error) {
+	var invs []Invitation
+	err := ig.db.Where("inviter_id = ?", inviterID).Order("created_at desc").Find(&invs).Error
+	if err != nil {
+		return nil, err
+	}
+	return invs, nil
+}
+
+func (ig *invitationGorm) Create(inv *Invitation) error {
+	return ig.db.Create(inv).Error
+}
+
+func (ig *invitationGorm) Update(inv *Invitation) error {
+	return ig.db.Save(inv).Error
+}
+
+func (ig *invitationGorm) Delete(id uint) error {
+	inv := Invitation{Model: gorm.Model{ID: id}}
+	return ig.db.Unscoped().Delete(&inv).Error
+}
@@ -0,0 +1,362 @@
+package models
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The in-memory stores below keep everything in maps. They are meant for
+// tests and throwaway local setups, nothing survives a restart.
+
+// WithMemoryUser is like WithUser but keeps users, password resets and
+// email changes in memory
+func WithMemoryUser(keys Keys, policy PasswordPolicy) ServicesConfig {
+	return func(services *Services) error {
+		services.User = newUserService(NewMemoryUserDB(), &memPasswordResetDB{},
+			&memEmailChangeDB{}, keys, policy)
+		return nil
+	}
+}
+
+// WithMemoryGallery is like WithGallery but keeps galleries in memory
+func WithMemoryGallery() ServicesConfig {
+	return func(services *Services) error {
+		services.Gallery = &galleryService{
+			GalleryDB: &galleryValidator{NewMemoryGalleryDB()},
+		}
+		return nil
+	}
+}
+
+// WithMemoryOAuth is like WithOAuth but keeps connections in memory
+func WithMemoryOAuth() ServicesConfig {
+	return func(services *Services) error {
+		services.OAuth = &oauthService{
+			OAuthDB: &oauthValidator{NewMemoryOAuthDB()},
+		}
+		return nil
+	}
+}
+
+// memModel sets the fields gorm would set when a row is created or saved
+func memModel(id uint, createdAt time.Time) (uint, time.Time, time.Time) {
+	now := time.Now()
+	if createdAt.IsZero() {
+		createdAt = now
+	}
+	return id, createdAt, now
+}
+
+func memPage(n int, p Pagination) (int, int) {
+	start := p.Offset()
+	if start > n {
+		start = n
+	}
+	end := start + p.Limit()
+	if end > n {
+		end = n
+	}
+	return start, end
+}
+
+var _ UserDB = &memUserDB{}
+
+func NewMemoryUserDB() UserDB {
+	return &memUserDB{users: map[uint]User{}}
+}
+
+type memUserDB struct {
+	mu     sync.Mutex
+	users  map[uint]User
+	nextID uint
+}
+
+func (mu *memUserDB) find(match func(user *User) bool) (*User, error) {
+	mu.mu.Lock()
+	defer mu.mu.Unlock()
+	for _, user := range mu.users {
+		if match(&user) {
+			return &user, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (mu *memUserDB) ByID(id uint) (*User, error) {
+	return mu.find(func(user *User) bool { return user.ID == id })
+}
+
+func (mu *memUserDB) ByEmail(email string) (*User, error) {
+	return mu.find(func(user *User) bool { return user.Email == email })
+}
+
+func (mu *memUserDB) ByUsername(username string) (*User, error) {
+	return mu.find(func(user *User) bool { return strings.EqualFold(user.Username, username) })
+}
+
+func (mu *memUserDB) ByRememberToken(hashedToken string) (*User, error) {
+	return mu.find(func(user *User) bool { return user.RememberTokenHash == hashedToken })
+}
+
+func (mu *memUserDB) Search(query string, p Pagination) ([]User, int, error) {
+	mu.mu.Lock()
+	defer mu.mu.Unlock()
+	query = strings.ToLower(query)
+	var users []User
+	for _, user := range mu.users {
+		if strings.Contains(strings.ToLower(user.Name), query) ||
+			strings.Contains(strings.ToLower(user.Username), query) ||
+			strings.Contains(strings.ToLower(user.Email), query) {
+			users = append(users, user)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	start, end := memPage(len(users), p)
+	return users[start:end], len(users), nil
+}
+
+func (mu *memUserDB) Create(user *User) error {
+	mu.mu.Lock()
+	defer mu.mu.Unlock()
+	mu.nextID++
+	user.ID, user.CreatedAt, user.UpdatedAt = memModel(mu.nextID, user.CreatedAt)
+	mu.users[user.ID] = *user
+	return nil
+}
+
+func (mu *memUserDB) Update(user *User) error {
+	mu.mu.Lock()
+	defer mu.mu.Unlock()
+	user.ID, user.CreatedAt, user.UpdatedAt = memModel(user.ID, user.CreatedAt)
+	mu.users[user.ID] = *user
+	return nil
+}
+
+func (mu *memUserDB) Delete(id uint) error {
+	mu.mu.Lock()
+	defer mu.mu.Unlock()
+	delete(mu.users, id)
+	return nil
+}
+
+var _ GalleryDB = &memGalleryDB{}
+
+func NewMemoryGalleryDB() GalleryDB {
+	return &memGalleryDB{galleries: map[uint]Gallery{}}
+}
+
+type memGalleryDB struct {
+	mu        sync.Mutex
+	galleries map[uint]Gallery
+	nextID    uint
+}
+
+// filter returns the matching galleries ordered by id
+func (mg *memGalleryDB) filter(match func(gallery *Gallery) bool) []Gallery {
+	mg.mu.Lock()
+	defer mg.mu.Unlock()
+	var galleries []Gallery
+	for _, gallery := range mg.galleries {
+		if match(&gallery) {
+			galleries = append(galleries, gallery)
+		}
+	}
+	sort.Slice(galleries, func(i, j int) bool { return galleries[i].ID < galleries[j].ID })
+	return galleries
+}
+
+func (mg *memGalleryDB) ByUserID(userID uint) ([]Gallery, error) {
+	return mg.filter(func(gallery *Gallery) bool { return gallery.UserID == userID }), nil
+}
+
+func (mg *memGalleryDB) PageByUserID(userID uint, p Pagination) ([]Gallery, int, error) {
+	galleries, _ := mg.ByUserID(userID)
+	start, end := memPage(len(galleries), p)
+	return galleries[start:end], len(galleries), nil
+}
+
+func (mg *memGalleryDB) Search(query string, p Pagination) ([]Gallery, int, error) {
+	query = strings.ToLower(query)
+	galleries := mg.filter(func(gallery *Gallery) bool {
+		return strings.Contains(strings.ToLower(gallery.Title), query)
+	})
+	start, end := memPage(len(galleries), p)
+	return galleries[start:end], len(galleries), nil
+}
+
+func (mg *memGalleryDB) ByID(id uint) (*Gallery, error) {
+	mg.mu.Lock()
+	defer mg.mu.Unlock()
+	gallery, ok := mg.galleries[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &gallery, nil
+}
+
+func (mg *memGalleryDB) Create(gallery *Gallery) error {
+	mg.mu.Lock()
+	defer mg.mu.Unlock()
+	mg.nextID++
+	gallery.ID, gallery.CreatedAt, gallery.UpdatedAt = memModel(mg.nextID, gallery.CreatedAt)
+	mg.galleries[gallery.ID] = *gallery
+	return nil
+}
+
+func (mg *memGalleryDB) Update(gallery *Gallery) error {
+	mg.mu.Lock()
+	defer mg.mu.Unlock()
+	gallery.ID, gallery.CreatedAt, gallery.UpdatedAt = memModel(gallery.ID, gallery.CreatedAt)
+	mg.galleries[gallery.ID] = *gallery
+	return nil
+}
+
+func (mg *memGalleryDB) Delete(id uint) error {
+	mg.mu.Lock()
+	defer mg.mu.Unlock()
+	delete(mg.galleries, id)
+	return nil
+}
+
+var _ OAuthDB = &memOAuthDB{}
+
+func NewMemoryOAuthDB() OAuthDB {
+	return &memOAuthDB{oauths: map[uint]OAuth{}}
+}
+
+type memOAuthDB struct {
+	mu     sync.Mutex
+	oauths map[uint]OAuth
+	nextID uint
+}
+
+func (mo *memOAuthDB) Find(userID uint, provider string) (*OAuth, error) {
+	mo.mu.Lock()
+	defer mo.mu.Unlock()
+	for _, oauth := range mo.oauths {
+		if oauth.UserID == userID && oauth.Provider == provider {
+			return &oauth, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (mo *memOAuthDB) ByUserID(userID uint) ([]OAuth, error) {
+	mo.mu.Lock()
+	defer mo.mu.Unlock()
+	var oauths []OAuth
+	for _, oauth := range mo.oauths {
+		if oauth.UserID == userID {
+			oauths = append(oauths, oauth)
+		}
+	}
+	sort.Slice(oauths, func(i, j int) bool { return oauths[i].ID < oauths[j].ID })
+	return oauths, nil
+}
+
+func (mo *memOAuthDB) Create(oauth *OAuth) error {
+	mo.mu.Lock()
+	defer mo.mu.Unlock()
+	mo.nextID++
+	oauth.ID, oauth.CreatedAt, oauth.UpdatedAt = memModel(mo.nextID, oauth.CreatedAt)
+	mo.oauths[oauth.ID] = *oauth
+	return nil
+}
+
+func (mo *memOAuthDB) Delete(id uint) error {
+	mo.mu.Lock()
+	defer mo.mu.Unlock()
+	delete(mo.oauths, id)
+	return nil
+}
+
+var _ passwordResetDB = &memPasswordResetDB{}
+
+type memPasswordResetDB struct {
+	mu     sync.Mutex
+	resets []passwordReset
+	nextID uint
+}
+
+func (mpr *memPasswordResetDB) ByToken(tokenHash string) (*passwordReset, error) {
+	mpr.mu.Lock()
+	defer mpr.mu.Unlock()
+	for _, pwr := range mpr.resets {
+		if pwr.TokenHash == tokenHash {
+			return &pwr, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (mpr *memPasswordResetDB) Create(pwr *passwordReset) error {
+	mpr.mu.Lock()
+	defer mpr.mu.Unlock()
+	mpr.nextID++
+	pwr.ID, pwr.CreatedAt, pwr.UpdatedAt = memModel(mpr.nextID, pwr.CreatedAt)
+	mpr.resets = append(mpr.resets, *pwr)
+	return nil
+}
+
+func (mpr *memPasswordResetDB) Delete(id uint) error {
+	mpr.mu.Lock()
+	defer mpr.mu.Unlock()
+	for i, pwr := range mpr.resets {
+		if pwr.ID == id {
+			mpr.resets = append(mpr.resets[:i], mpr.resets[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+var _ emailChangeDB = &memEmailChangeDB{}
+
+type memEmailChangeDB struct {
+	mu      sync.Mutex
+	changes []emailChange
+	nextID  uint
+}
+
+func (mec *memEmailChangeDB) ByToken(tokenHash string) (*emailChange, error) {
+	mec.mu.Lock()
+	defer mec.mu.Unlock()
+	for _, ec := range mec.changes {
+		if ec.TokenHash == tokenHash {
+			return &ec, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (mec *memEmailChangeDB) Create(ec *emailChange) error {
+	mec.mu.Lock()
+	defer mec.mu.Unlock()
+	mec.nextID++
+	ec.ID, ec.CreatedAt, ec.UpdatedAt = memModel(mec.nextID, ec.CreatedAt)
+	mec.changes = append(mec.changes, *ec)
+	return nil
+}
+
+func (mec *memEmailChangeDB) Delete(id uint) error {
+	return mec.deleteWhere(func(ec *emailChange) bool { return ec.ID == id })
+}
+
+func (mec *memEmailChangeDB) DeleteByUserID(userID uint) error {
+	return mec.deleteWhere(func(ec *emailChange) bool { return ec.UserID == userID })
+}
+
+func (mec *memEmailChangeDB) deleteWhere(match func(ec *emailChange) bool) error {
+	mec.mu.Lock()
+	defer mec.mu.Unlock()
+	kept := mec.changes[:0]
+	for _, ec := range mec.changes {
+		if !match(&ec) {
+			kept = append(kept, ec)
+		}
+	}
+	mec.changes = kept
+	return nil
+}
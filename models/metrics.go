@@ -0,0 +1,94 @@
+package models
+
+import (
+	"context"
+	"gallerio/utils/metrics"
+	"github.com/jinzhu/gorm"
+	"io"
+	"time"
+)
+
+var (
+	queryDuration = metrics.NewHistogram("gallerio_db_query_duration_seconds",
+		"Time taken by database queries, by operation.",
+		metrics.DefaultBuckets, "operation")
+	uploads = metrics.NewCounter("gallerio_uploads_total",
+		"Images uploaded, by result.", "result")
+	uploadBytes = metrics.NewCounter("gallerio_upload_bytes_total",
+		"Bytes of the images stored.")
+	imageProcessing = metrics.NewHistogram("gallerio_image_processing_duration_seconds",
+		"Time taken to process and store an uploaded image.",
+		metrics.DefaultBuckets)
+)
+
+const queryStartKey = "metrics:query_start"
+
+// WithMetrics needs the database and the image service to be configured
+// first. It times the queries and wraps the image service to count uploads.
+func WithMetrics() ServicesConfig {
+	return func(services *Services) error {
+		// gorm logs every callback registered, which is just noise here
+		quiet := services.db.New()
+		quiet.SetLogger(nopLogger{})
+		callbacks := quiet.Callback()
+		callbacks.Create().Before("gorm:create").Register("metrics:before_create", startQuery)
+		callbacks.Create().After("gorm:create").Register("metrics:after_create", endQuery("create"))
+		callbacks.Query().Before("gorm:query").Register("metrics:before_query", startQuery)
+		callbacks.Query().After("gorm:query").Register("metrics:after_query", endQuery("query"))
+		callbacks.RowQuery().Before("gorm:row_query").Register("metrics:before_row_query", startQuery)
+		callbacks.RowQuery().After("gorm:row_query").Register("metrics:after_row_query", endQuery("row_query"))
+		callbacks.Update().Before("gorm:update").Register("metrics:before_update", startQuery)
+		callbacks.Update().After("gorm:update").Register("metrics:after_update", endQuery("update"))
+		callbacks.Delete().Before("gorm:delete").Register("metrics:before_delete", startQuery)
+		callbacks.Delete().After("gorm:delete").Register("metrics:after_delete", endQuery("delete"))
+		
+		services.Image = &imageMetrics{services.Image}
+		return nil
+	}
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Print(v ...interface{}) {}
+
+func startQuery(scope *gorm.Scope) {
+	scope.InstanceSet(queryStartKey, time.Now())
+}
+
+func endQuery(operation string) func(scope *gorm.Scope) {
+	return func(scope *gorm.Scope) {
+		if start, ok := scope.InstanceGet(queryStartKey); ok {
+			queryDuration.Since(start.(time.Time), operation)
+		}
+	}
+}
+
+// imageMetrics counts the uploads and the bytes they take up, and times
+// storing them
+type imageMetrics struct {
+	ImageService
+}
+
+func (im *imageMetrics) Create(ctx context.Context, galleryID uint, filename string, reader io.ReadCloser) error {
+	start := time.Now()
+	counter := &countingReader{ReadCloser: reader}
+	if err := im.ImageService.Create(ctx, galleryID, filename, counter); err != nil {
+		uploads.Inc("failure")
+		return err
+	}
+	imageProcessing.Since(start)
+	uploads.Inc("success")
+	uploadBytes.Add(float64(counter.n))
+	return nil
+}
+
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	return n, err
+}
@@ -3,6 +3,7 @@ package models
 import (
 	"github.com/jinzhu/gorm"
 	"golang.org/x/oauth2"
+	"time"
 )
 
 const (
@@ -13,11 +14,43 @@ type OAuth struct {
 	gorm.Model
 	UserID uint `gorm:"not null;unique_index:user_id_provider"`
 	Provider string `gorm:"not null;unique_index:user_id_provider"`
-	oauth2.Token
+	// The access and refresh tokens are never sent to clients
+	AccessToken  string `json:"-"`
+	TokenType    string `json:"-"`
+	RefreshToken string `json:"-"`
+	// Expiry is nil for tokens which don't expire. A zero time.Time can't
+	// be stored by MySQL in strict mode.
+	Expiry *time.Time `json:"-"`
+}
+
+// SetToken stores the token of the provider
+func (o *OAuth) SetToken(token *oauth2.Token) {
+	o.AccessToken = token.AccessToken
+	o.TokenType = token.TokenType
+	o.RefreshToken = token.RefreshToken
+	o.Expiry = nil
+	if !token.Expiry.IsZero() {
+		expiry := token.Expiry
+		o.Expiry = &expiry
+	}
+}
+
+// Token returns the stored token to make requests to the provider with
+func (o *OAuth) Token() *oauth2.Token {
+	token := &oauth2.Token{
+		AccessToken:  o.AccessToken,
+		TokenType:    o.TokenType,
+		RefreshToken: o.RefreshToken,
+	}
+	if o.Expiry != nil {
+		token.Expiry = *o.Expiry
+	}
+	return token
 }
 
 type OAuthDB interface {
 	Find(userID uint, provider string) (*OAuth, error)
+	ByUserID(userID uint) ([]OAuth, error)
 	Create(oauth *OAuth) error
 	Delete(id uint) error
 }
@@ -97,6 +130,15 @@ func (og *oauthGorm) Find(userID uint, provider string) (*OAuth, error) {
 	return &oauth, nil
 }
 
+func (og *oauthGorm) ByUserID(userID uint) ([]OAuth, error) {
+	var oauths []OAuth
+	err := og.db.Where("user_id = ?", userID).Find(&oauths).Error
+	if err != nil {
+		return nil, err
+	}
+	return oauths, nil
+}
+
 func (og *oauthGorm) Create(oauth *OAuth) error {
 	return og.db.Create(oauth).Error
 }
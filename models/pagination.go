@@ -0,0 +1,41 @@
+package models
+
+const (
+	DefaultPerPage = 25
+	MaxPerPage     = 100
+)
+
+// Pagination selects a page of a listing. Pages are numbered from 1.
+type Pagination struct {
+	Page    int
+	PerPage int
+}
+
+func NewPagination(page, perPage int) Pagination {
+	if page < 1 {
+		page = 1
+	}
+	if perPage < 1 {
+		perPage = DefaultPerPage
+	}
+	if perPage > MaxPerPage {
+		perPage = MaxPerPage
+	}
+	return Pagination{Page: page, PerPage: perPage}
+}
+
+func (p Pagination) Offset() int {
+	return (p.Page - 1) * p.PerPage
+}
+
+func (p Pagination) Limit() int {
+	return p.PerPage
+}
+
+// TotalPages returns the number of pages needed to list total items
+func (p Pagination) TotalPages(total int) int {
+	if total == 0 {
+		return 1
+	}
+	return (total + p.PerPage - 1) / p.PerPage
+}
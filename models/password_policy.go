@@ -0,0 +1,192 @@
+package models
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// PasswordPolicy decides whether a password is acceptable for the user it
+// is being set for. Signup, password resets and password changes all go
+// through the policy of the user service.
+type PasswordPolicy interface {
+	Check(password string, user *User) error
+}
+
+// PasswordRule is a single check of a policy. It returns a public error
+// describing why the password was rejected.
+type PasswordRule func(password string, user *User) error
+
+func NewPasswordPolicy(rules ...PasswordRule) PasswordPolicy {
+	return passwordRules(rules)
+}
+
+// DefaultPasswordPolicy is used when no policy is configured
+func DefaultPasswordPolicy() PasswordPolicy {
+	return NewPasswordPolicy(
+		MinLength(8),
+		MaxLength(72),
+		NoPersonalInfo(),
+		MinStrength(30),
+	)
+}
+
+type passwordRules []PasswordRule
+
+func (pr passwordRules) Check(password string, user *User) error {
+	for _, rule := range pr {
+		if err := rule(password, user); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func MinLength(n int) PasswordRule {
+	return func(password string, user *User) error {
+		if utf8.RuneCountInString(password) < n {
+			return modelError(fmt.Sprintf("models: password must be at least %d characters", n))
+		}
+		return nil
+	}
+}
+
+// MaxLength counts bytes as bcrypt ignores everything after the 72nd byte
+func MaxLength(n int) PasswordRule {
+	return func(password string, user *User) error {
+		if len(password) > n {
+			return modelError(fmt.Sprintf("models: password must be at most %d bytes", n))
+		}
+		return nil
+	}
+}
+
+// NoPersonalInfo rejects passwords containing the username, the email
+// address or the part of the email address before the @.
+func NoPersonalInfo() PasswordRule {
+	return func(password string, user *User) error {
+		if user == nil {
+			return nil
+		}
+		password = strings.ToLower(password)
+		local := strings.Split(user.Email, "@")[0]
+		for _, info := range []string{user.Username, user.Email, local} {
+			info = strings.ToLower(info)
+			if len(info) >= 3 && strings.Contains(password, info) {
+				return ErrPasswordPersonal
+			}
+		}
+		return nil
+	}
+}
+
+// MinStrength rejects passwords whose estimated entropy is below bits
+func MinStrength(bits float64) PasswordRule {
+	return func(password string, user *User) error {
+		if PasswordEntropy(password) < bits {
+			return ErrPasswordTooWeak
+		}
+		return nil
+	}
+}
+
+// NotBreached rejects passwords found in the breached password list
+func NotBreached(list *BreachedList) PasswordRule {
+	return func(password string, user *User) error {
+		if list.Contains(password) {
+			return ErrPasswordBreached
+		}
+		return nil
+	}
+}
+
+// PasswordEntropy estimates the entropy of a password in bits from the
+// character classes it uses. Characters repeating the previous one or
+// continuing a sequence (abc, 321) don't count towards its length.
+func PasswordEntropy(password string) float64 {
+	var lower, upper, digit, symbol bool
+	var prev rune
+	var step rune
+	length := 0
+	for i, r := range []rune(password) {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			symbol = true
+		}
+		diff := r - prev
+		if i == 0 || (diff != 0 && !(i > 1 && diff == step && (diff == 1 || diff == -1))) {
+			length++
+		}
+		step = diff
+		prev = r
+	}
+	
+	pool := 0
+	if lower {
+		pool += 26
+	}
+	if upper {
+		pool += 26
+	}
+	if digit {
+		pool += 10
+	}
+	if symbol {
+		pool += 33
+	}
+	if pool == 0 {
+		return 0
+	}
+	return float64(length) * math.Log2(float64(pool))
+}
+
+// BreachedList holds the SHA-1 hashes of passwords known from data breaches
+type BreachedList struct {
+	hashes map[string]struct{}
+}
+
+// LoadBreachedList reads a file with one upper or lower case hex SHA-1 hash
+// per line. Anything after a colon is ignored, so files in the format of
+// the Pwned Passwords downloads (HASH:COUNT) can be used as they are.
+func LoadBreachedList(path string) (*BreachedList, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	
+	list := &BreachedList{hashes: make(map[string]struct{})}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if i := strings.IndexByte(line, ':'); i >= 0 {
+			line = line[:i]
+		}
+		if len(line) != sha1.Size*2 {
+			continue
+		}
+		list.hashes[strings.ToUpper(line)] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+func (bl *BreachedList) Contains(password string) bool {
+	sum := sha1.Sum([]byte(password))
+	_, ok := bl.hashes[strings.ToUpper(hex.EncodeToString(sum[:]))]
+	return ok
+}
@@ -9,8 +9,8 @@ import (
 type passwordReset struct {
 	gorm.Model
 	UserID    uint   `gorm:"user_id"`
-	Token     string `gorm:"-"`
-	TokenHash string `gorm:"not null;unique_index"`
+	Token     string `gorm:"-" json:"-"`
+	TokenHash string `gorm:"not null;unique_index" json:"-"`
 }
 
 type passwordResetDB interface {
@@ -31,7 +31,7 @@ func runPasswordResetValFuncs(pwr *passwordReset, fns ...passwordResetValFunc) e
 	return nil
 }
 
-func newPasswordResetValidator(db passwordResetDB, hmac hash.HMAC) *passwordResetValidator {
+func newPasswordResetValidator(db passwordResetDB, hmac hash.Keyring) *passwordResetValidator {
 	return &passwordResetValidator{
 		passwordResetDB: db,
 		hmac:            hmac,
@@ -40,16 +40,18 @@ func newPasswordResetValidator(db passwordResetDB, hmac hash.HMAC) *passwordRese
 
 type passwordResetValidator struct {
 	passwordResetDB
-	hmac hash.HMAC
+	hmac hash.Keyring
 }
 
+// ByToken also finds tokens hashed with a previous HMAC key
 func (pwrv *passwordResetValidator) ByToken(token string) (*passwordReset, error) {
-	pwr := &passwordReset{Token: token}
-	err := runPasswordResetValFuncs(pwr, pwrv.hashToken)
-	if err != nil {
-		return nil, err
+	for _, tokenHash := range pwrv.hmac.Hashes(token) {
+		pwr, err := pwrv.passwordResetDB.ByToken(tokenHash)
+		if err != ErrNotFound {
+			return pwr, err
+		}
 	}
-	return pwrv.passwordResetDB.ByToken(pwr.TokenHash)
+	return nil, ErrNotFound
 }
 
 func (pwrv *passwordResetValidator) Create(pwr *passwordReset) error {
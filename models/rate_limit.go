@@ -0,0 +1,90 @@
+package models
+
+import (
+	"gallerio/utils/ratelimit"
+	"github.com/jinzhu/gorm"
+	"time"
+)
+
+const (
+	RateLimitStoreMemory   = "memory"
+	RateLimitStoreDatabase = "database"
+)
+
+type rateLimit struct {
+	gorm.Model
+	Bucket      string `gorm:"not null;unique_index"`
+	Failures    int
+	// Zero times are stored as NULL, MySQL in strict mode can't store them
+	LastFailure *time.Time
+	LockedUntil *time.Time
+}
+
+// NewRateLimitStore returns a ratelimit.Store backed by the database so that
+// multiple instances share the same counters.
+func NewRateLimitStore(db *gorm.DB) ratelimit.Store {
+	return &rateLimitGorm{db}
+}
+
+var _ ratelimit.Store = &rateLimitGorm{}
+
+type rateLimitGorm struct {
+	db *gorm.DB
+}
+
+func (rlg *rateLimitGorm) Get(bucket string) (*ratelimit.Entry, error) {
+	var rl rateLimit
+	err := First(rlg.db.Where("bucket = ?", bucket), &rl)
+	switch err {
+	case nil:
+		return &ratelimit.Entry{
+			Bucket:      rl.Bucket,
+			Failures:    rl.Failures,
+			LastFailure: timeValue(rl.LastFailure),
+			LockedUntil: timeValue(rl.LockedUntil),
+		}, nil
+	case ErrNotFound:
+		return nil, nil
+	default:
+		return nil, err
+	}
+}
+
+func (rlg *rateLimitGorm) Save(entry *ratelimit.Entry) error {
+	var rl rateLimit
+	err := First(rlg.db.Where("bucket = ?", entry.Bucket), &rl)
+	if err != nil && err != ErrNotFound {
+		return err
+	}
+	rl.Bucket = entry.Bucket
+	rl.Failures = entry.Failures
+	rl.LastFailure = timePtr(entry.LastFailure)
+	rl.LockedUntil = timePtr(entry.LockedUntil)
+	return rlg.db.Save(&rl).Error
+}
+
+func (rlg *rateLimitGorm) Delete(bucket string) error {
+	return rlg.db.Unscoped().Where("bucket = ?", bucket).Delete(&rateLimit{}).Error
+}
+
+func (rlg *rateLimitGorm) DeleteBefore(t time.Time) error {
+	return rlg.db.Unscoped().
+		Where("(last_failure IS NULL OR last_failure < ?) AND (locked_until IS NULL OR locked_until < ?)", t, t).
+		Delete(&rateLimit{}).Error
+}
+
+// timePtr returns nil for the zero time
+func timePtr(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// timeValue returns the zero time for nil
+func timeValue(t *time.Time) time.Time {
+	if t == nil {
+		return time.Time{}
+	}
+	return *t
+}
@@ -0,0 +1,37 @@
+package models
+
+import (
+	"gallerio/utils/ratelimit"
+	"testing"
+	"time"
+)
+
+func TestRateLimitStoreZeroTimes(t *testing.T) {
+	services := newTestServices(t)
+	store := NewRateLimitStore(services.DB())
+	
+	now := time.Now().Truncate(time.Second)
+	if err := store.Save(&ratelimit.Entry{Bucket: "unlocked", Failures: 1, LastFailure: now}); err != nil {
+		t.Fatal(err)
+	}
+	entry, err := store.Get("unlocked")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !entry.LockedUntil.IsZero() || !entry.LastFailure.Equal(now) {
+		t.Fatalf("expected the entry to round trip, got %+v", entry)
+	}
+	var nulls int
+	services.DB().Table("rate_limits").Where("locked_until IS NULL").Count(&nulls)
+	if nulls != 1 {
+		t.Fatal("expected the zero time to be stored as NULL")
+	}
+	
+	// Entries which were never locked are pruned as well
+	if err := store.DeleteBefore(now.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if entry, err := store.Get("unlocked"); err != nil || entry != nil {
+		t.Fatalf("expected the entry to be pruned, got %+v, %v", entry, err)
+	}
+}
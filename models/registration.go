@@ -0,0 +1,124 @@
+package models
+
+import (
+	"github.com/jinzhu/gorm"
+	"strings"
+)
+
+const (
+	RegistrationOpen   = "open"
+	RegistrationInvite = "invite"
+	RegistrationDomain = "domain"
+)
+
+// RegistrationService decides who may sign up
+type RegistrationService interface {
+	Mode() string
+	// Invitation looks up a usable invitation by its token
+	Invitation(token string) (*Invitation, error)
+	// Check returns the invitation used to sign up, if any, or a public
+	// error when the email address may not sign up.
+	Check(email, inviteToken string) (*Invitation, error)
+	// SignUp creates the user and counts the use of the invitation they
+	// signed up with, if any, in one transaction. It fails with
+	// ErrInviteInvalid when the invitation was used up in the meantime.
+	SignUp(user *User, inv *Invitation) error
+	// CanInvite reports whether the user may create invitations
+	CanInvite(user *User) bool
+}
+
+// NewRegistrationService returns a service for the mode. In domain mode
+// only email addresses of the allowed domains can sign up, unless they were
+// invited. Unknown modes fall back to open registration. With adminInvites
+// only admins can invite people, otherwise every user can.
+func NewRegistrationService(db *gorm.DB, mode string, domains []string, adminInvites bool,
+	us UserService, is InvitationService) RegistrationService {
+	allowed := make(map[string]bool, len(domains))
+	for _, domain := range domains {
+		allowed[strings.ToLower(strings.TrimSpace(domain))] = true
+	}
+	switch mode {
+	case RegistrationInvite, RegistrationDomain:
+	default:
+		mode = RegistrationOpen
+	}
+	return &registrationService{
+		db:           db,
+		mode:         mode,
+		domains:      allowed,
+		adminInvites: adminInvites,
+		us:           us,
+		is:           is,
+	}
+}
+
+type registrationService struct {
+	db           *gorm.DB
+	mode         string
+	domains      map[string]bool
+	adminInvites bool
+	us           UserService
+	is           InvitationService
+}
+
+func (rs *registrationService) Mode() string {
+	return rs.mode
+}
+
+func (rs *registrationService) Invitation(token string) (*Invitation, error) {
+	inv, err := rs.is.ByToken(token)
+	if err != nil || !inv.Usable() {
+		return nil, ErrInviteInvalid
+	}
+	return inv, nil
+}
+
+func (rs *registrationService) Check(email, inviteToken string) (*Invitation, error) {
+	email = strings.ToLower(strings.TrimSpace(email))
+	var inv *Invitation
+	if inviteToken != "" {
+		found, err := rs.Invitation(inviteToken)
+		if err != nil {
+			return nil, err
+		}
+		if found.Email != "" && found.Email != email {
+			return nil, ErrInviteEmail
+		}
+		inv = found
+	}
+	
+	switch rs.mode {
+	case RegistrationInvite:
+		if inv == nil {
+			return nil, ErrInviteOnly
+		}
+	case RegistrationDomain:
+		parts := strings.Split(email, "@")
+		if inv == nil && !rs.domains[parts[len(parts)-1]] {
+			return nil, ErrDomainNotAllowed
+		}
+	}
+	return inv, nil
+}
+
+func (rs *registrationService) SignUp(user *User, inv *Invitation) error {
+	if inv == nil {
+		return rs.us.Create(user)
+	}
+	return rs.db.Transaction(func(tx *gorm.DB) error {
+		if err := rs.is.Redeem(tx, inv); err != nil {
+			return err
+		}
+		if us, ok := rs.us.(txUserCreator); ok {
+			return us.createTx(tx, user)
+		}
+		return rs.us.Create(user)
+	})
+}
+
+func (rs *registrationService) CanInvite(user *User) bool {
+	if user == nil {
+		return false
+	}
+	return !rs.adminInvites || user.HasRole(RoleAdmin)
+}
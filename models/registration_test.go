@@ -0,0 +1,50 @@
+package models
+
+import (
+	"testing"
+)
+
+func TestSignUpRedeemsInvitationOnce(t *testing.T) {
+	services := newTestServices(t)
+	alice := createTestUser(t, services.User, "alice")
+	invite := &Invitation{InviterID: alice.ID, MaxUses: 1}
+	if err := services.Invitation.Create(invite); err != nil {
+		t.Fatal(err)
+	}
+	
+	// Both sign ups checked the invitation before either used it
+	first, err := services.Registration.Check("bob@example.com", invite.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := services.Registration.Check("carol@example.com", invite.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	
+	// A failed sign up doesn't use the invitation
+	taken := &User{Username: "alice", Email: "bob@example.com", Password: "correct horse battery staple"}
+	if err := services.Registration.SignUp(taken, first); err != ErrUsernameTaken {
+		t.Fatalf("expected ErrUsernameTaken, got %v", err)
+	}
+	
+	bob := &User{Username: "bob", Email: "bob@example.com", Password: "correct horse battery staple"}
+	if err := services.Registration.SignUp(bob, first); err != nil {
+		t.Fatal(err)
+	}
+	carol := &User{Username: "carol", Email: "carol@example.com", Password: "correct horse battery staple"}
+	if err := services.Registration.SignUp(carol, second); err != ErrInviteInvalid {
+		t.Fatalf("expected ErrInviteInvalid, got %v", err)
+	}
+	if _, err := services.User.ByUsername("carol"); err != ErrNotFound {
+		t.Fatalf("expected carol not to be created, got %v", err)
+	}
+	
+	stored, err := services.Invitation.ByID(invite.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Uses != 1 {
+		t.Fatalf("expected the invitation to be used once, got %d", stored.Uses)
+	}
+}
@@ -1,18 +1,42 @@
 package models
 
 import (
+	"context"
+	"fmt"
+	"gallerio/migrations"
+	"gallerio/utils/ratelimit"
 	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/mysql"
 	_ "github.com/jinzhu/gorm/dialects/postgres"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	"time"
+)
+
+const (
+	DialectPostgres = "postgres"
+	DialectMySQL    = "mysql"
+	DialectSQLite   = "sqlite3"
 )
 
 type ServicesConfig func(*Services) error
 
+// WithGorm connects to a Postgres, MySQL or SQLite database
 func WithGorm(dialect, connectionInfo string) ServicesConfig {
 	return func(services *Services) error {
+		switch dialect {
+		case DialectPostgres, DialectMySQL, DialectSQLite:
+		default:
+			return fmt.Errorf("models: unsupported database dialect %q", dialect)
+		}
 		db, err := gorm.Open(dialect, connectionInfo)
 		if err != nil {
 			return err
 		}
+		if dialect == DialectSQLite {
+			// Every connection to ":memory:" gets a database of its own,
+			// and SQLite only allows one writer at a time anyway
+			db.DB().SetMaxOpenConns(1)
+		}
 		services.db = db
 		return nil
 	}
@@ -25,9 +49,9 @@ func WithLogMode(logMode bool) ServicesConfig {
 	}
 }
 
-func WithUser(pepper, hmacKey string) ServicesConfig {
+func WithUser(keys Keys, policy PasswordPolicy) ServicesConfig {
 	return func(services *Services) error {
-		services.User = NewUserService(services.db, pepper, hmacKey)
+		services.User = NewUserService(services.db, keys, policy)
 		return nil
 	}
 }
@@ -46,6 +70,24 @@ func WithImage() ServicesConfig {
 	}
 }
 
+// WithWebhook needs the gallery and image services to be configured first.
+// It wraps both so their changes are sent to webhooks.
+func WithWebhook() ServicesConfig {
+	return func(services *Services) error {
+		services.Webhook = NewWebhookService(services.db)
+		services.Gallery = &galleryEvents{
+			GalleryService: services.Gallery,
+			ws:             services.Webhook,
+		}
+		services.Image = &imageEvents{
+			ImageService: services.Image,
+			gs:           services.Gallery,
+			ws:           services.Webhook,
+		}
+		return nil
+	}
+}
+
 func WithOAuth() ServicesConfig {
 	return func(services *Services) error {
 		services.OAuth = NewOAuthService(services.db)
@@ -53,6 +95,69 @@ func WithOAuth() ServicesConfig {
 	}
 }
 
+func WithAuditLog() ServicesConfig {
+	return func(services *Services) error {
+		services.AuditLog = NewAuditLogService(services.db)
+		return nil
+	}
+}
+
+// WithAccountDeletion needs the user, image and audit log services to be
+// configured first.
+func WithAccountDeletion(grace time.Duration) ServicesConfig {
+	return func(services *Services) error {
+		services.AccountDeletion = NewAccountDeletionService(
+			services.db, services.User, services.Image, services.AuditLog, grace)
+		return nil
+	}
+}
+
+// WithDataExport needs the user, gallery, image and oauth services to be
+// configured first.
+func WithDataExport(keys Keys) ServicesConfig {
+	return func(services *Services) error {
+		services.DataExport = NewDataExportService(services.db, keys,
+			services.User, services.Gallery, services.Image, services.OAuth)
+		return nil
+	}
+}
+
+func WithInvitation(keys Keys) ServicesConfig {
+	return func(services *Services) error {
+		services.Invitation = NewInvitationService(services.db, keys)
+		return nil
+	}
+}
+
+// WithRegistration needs the user and invitation services to be configured
+// first
+func WithRegistration(mode string, domains []string, adminInvites bool) ServicesConfig {
+	return func(services *Services) error {
+		services.Registration = NewRegistrationService(services.db, mode, domains, adminInvites,
+			services.User, services.Invitation)
+		return nil
+	}
+}
+
+func WithAPIToken(keys Keys) ServicesConfig {
+	return func(services *Services) error {
+		services.APIToken = NewAPITokenService(services.db, keys)
+		return nil
+	}
+}
+
+func WithRateLimitStore(store string) ServicesConfig {
+	return func(services *Services) error {
+		switch store {
+		case RateLimitStoreDatabase:
+			services.RateLimit = NewRateLimitStore(services.db)
+		default:
+			services.RateLimit = ratelimit.NewMemoryStore()
+		}
+		return nil
+	}
+}
+
 func NewServices(cfgs ...ServicesConfig) (*Services, error) {
 	var services Services
 	for _, cfg := range cfgs {
@@ -64,25 +169,62 @@ func NewServices(cfgs ...ServicesConfig) (*Services, error) {
 }
 
 type Services struct {
-	User    UserService
-	Gallery GalleryService
-	Image   ImageService
-	OAuth   OAuthService
-	db      *gorm.DB
+	User            UserService
+	Gallery         GalleryService
+	Image           ImageService
+	OAuth           OAuthService
+	RateLimit       ratelimit.Store
+	AuditLog        AuditLogService
+	AccountDeletion AccountDeletionService
+	DataExport      DataExportService
+	Invitation      InvitationService
+	Registration    RegistrationService
+	APIToken        APITokenService
+	Webhook         WebhookService
+	db              *gorm.DB
 }
 
 func (s *Services) Close() error {
 	return s.db.Close()
 }
 
+// Ping checks that the database can be reached
+func (s *Services) Ping(ctx context.Context) error {
+	return s.db.DB().PingContext(ctx)
+}
+
+// DB is the connection used by the services, e.g. for migrations
+func (s *Services) DB() *gorm.DB {
+	return s.db
+}
+
+// DestructiveReset drops every table and migrates the empty database
 func (s *Services) DestructiveReset() error {
-	err := s.db.DropTableIfExists(&User{}, &Gallery{}, &passwordReset{}, &OAuth{}).Error
+	err := s.db.DropTableIfExists(allModels()...).Error
+	if err != nil {
+		return err
+	}
+	err = s.db.DropTableIfExists("schema_migrations", "schema_migrations_lock").Error
 	if err != nil {
 		return err
 	}
-	return s.AutoMigrate()
+	_, err = migrations.New(s.db).Up()
+	return err
 }
 
-func (s *Services) AutoMigrate() error {
-	return s.db.AutoMigrate(&User{}, &Gallery{}, &passwordReset{}, &OAuth{}).Error
+func allModels() []interface{} {
+	return []interface{}{
+		&User{},
+		&Gallery{},
+		&passwordReset{},
+		&OAuth{},
+		&rateLimit{},
+		&emailChange{},
+		&AuditLog{},
+		&DataExport{},
+		&Invitation{},
+		&APIToken{},
+		&Webhook{},
+		&WebhookDelivery{},
+	}
 }
@@ -0,0 +1,73 @@
+package models
+
+import (
+	"gallerio/migrations"
+	"golang.org/x/crypto/bcrypt"
+	"testing"
+)
+
+var testKeys = Keys{
+	Peppers:    []string{"test-pepper"},
+	HMACKeys:   []string{"test-hmac-key"},
+	BcryptCost: bcrypt.MinCost,
+}
+
+// newTestServices returns services backed by an in-memory SQLite database
+// with every migration applied
+func newTestServices(t *testing.T) *Services {
+	t.Helper()
+	services, err := NewServices(
+		WithGorm(DialectSQLite, ":memory:"),
+		WithLogMode(false),
+		WithUser(testKeys, NewPasswordPolicy(MinLength(8))),
+		WithGallery(),
+		WithImage(),
+		WithWebhook(),
+		WithOAuth(),
+		WithAuditLog(),
+		WithAPIToken(testKeys),
+		WithDataExport(testKeys),
+		WithInvitation(testKeys),
+		WithRegistration(RegistrationInvite, nil, false),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { services.Close() })
+	if _, err := migrations.New(services.DB()).Up(); err != nil {
+		t.Fatal(err)
+	}
+	return services
+}
+
+func createTestUser(t *testing.T, us UserService, username string) *User {
+	t.Helper()
+	user := User{
+		Name:     "Test User",
+		Username: username,
+		Email:    username + "@example.com",
+		Password: "correct horse battery staple",
+	}
+	if err := us.Create(&user); err != nil {
+		t.Fatal(err)
+	}
+	return &user
+}
+
+func TestWithGormRejectsUnknownDialect(t *testing.T) {
+	if _, err := NewServices(WithGorm("oracle", "")); err == nil {
+		t.Fatal("expected an error for an unsupported dialect")
+	}
+}
+
+func TestDestructiveReset(t *testing.T) {
+	services := newTestServices(t)
+	createTestUser(t, services.User, "alice")
+	if err := services.DestructiveReset(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := services.User.ByEmail("alice@example.com"); err != ErrNotFound {
+		t.Fatalf("expected the user to be gone, got %v", err)
+	}
+	createTestUser(t, services.User, "alice")
+}
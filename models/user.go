@@ -1,17 +1,46 @@
 package models
 
 import (
+	"context"
 	"gallerio/utils/hash"
 	"gallerio/utils/rand"
 	"github.com/jinzhu/gorm"
 	"golang.org/x/crypto/bcrypt"
+	"log/slog"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 )
 
+const (
+	RoleUser      = "user"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
 var (
 	EmailRegex = regexp.MustCompile(`^[a-z0-9._%+\-]+@[a-z0-9.\-]+\.[a-z]{2,16}$`)
+	// Usernames are 3 to 30 characters long, start and end with a letter or
+	// a number and may contain dots, dashes and underscores in between.
+	UsernameRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9._\-]{1,28}[a-z0-9]$`)
+	
+	roleRanks = map[string]int{
+		RoleUser:      0,
+		RoleModerator: 1,
+		RoleAdmin:     2,
+	}
+	
+	// ReservedUsernames can't be registered as they clash with routes or
+	// could be used to impersonate staff.
+	ReservedUsernames = map[string]bool{
+		"about": true, "account": true, "admin": true, "administrator": true,
+		"api": true, "contact": true, "forgot": true, "galleries": true,
+		"gallery": true, "gallerio": true, "help": true, "media": true,
+		"moderator": true, "oauth": true, "reset": true, "root": true,
+		"settings": true, "signin": true, "signout": true, "signup": true,
+		"static": true, "staff": true, "support": true, "system": true,
+	}
 )
 
 type User struct {
@@ -19,18 +48,61 @@ type User struct {
 	Name              string
 	Username          string `gorm:"not null;unique_index"`
 	Email             string `gorm:"not null;unique_index"`
-	Password          string `gorm:"-"`
-	PasswordHash      string `gorm:"not null"`
-	RememberToken     string `gorm:"-"`
-	RememberTokenHash string `gorm:"not null;unique_index"`
+	Password          string `gorm:"-" json:"-"`
+	PasswordHash      string `gorm:"not null" json:"-"`
+	RememberToken     string `gorm:"-" json:"-"`
+	RememberTokenHash string `gorm:"not null;unique_index" json:"-"`
+	// DeleteAfter is set while the account is scheduled for deletion
+	DeleteAfter *time.Time `gorm:"index"`
+	Role        string     `gorm:"not null;default:'user'"`
+	SuspendedAt *time.Time
+}
+
+// PublicUser holds the fields of a user which are safe to send to clients
+type PublicUser struct {
+	ID        uint      `json:"id"`
+	Name      string    `json:"name"`
+	Username  string    `json:"username"`
+	Email     string    `json:"email"`
+	Role      string    `json:"role"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (u *User) Public() PublicUser {
+	return PublicUser{
+		ID:        u.ID,
+		Name:      u.Name,
+		Username:  u.Username,
+		Email:     u.Email,
+		Role:      u.Role,
+		CreatedAt: u.CreatedAt,
+	}
+}
+
+// HasRole reports whether the user has the role or one ranking above it
+func (u *User) HasRole(role string) bool {
+	rank, ok := roleRanks[role]
+	if !ok {
+		return false
+	}
+	return roleRanks[u.Role] >= rank
+}
+
+func (u *User) Suspended() bool {
+	return u.SuspendedAt != nil
 }
 
 type UserDB interface {
 	// Methods for single user queries
 	ByID(id uint) (*User, error)
 	ByEmail(email string) (*User, error)
+	ByUsername(username string) (*User, error)
 	ByRememberToken(token string) (*User, error)
 	
+	// Search matches the query against name, username and email and also
+	// returns the total number of matches
+	Search(query string, p Pagination) ([]User, int, error)
+	
 	// Methods for modifying user
 	Create(user *User) error
 	Update(user *User) error
@@ -38,49 +110,286 @@ type UserDB interface {
 }
 
 type UserService interface {
-	Authenticate(email, password string) (*User, error)
+	// ByLogin looks the user up by username or, when the login contains
+	// an @, by email address
+	ByLogin(login string) (*User, error)
+	// Authenticate accepts either the username or the email address as login.
+	// ctx tags the log line of failing to upgrade the password hash.
+	Authenticate(ctx context.Context, login, password string) (*User, error)
 	InitiateReset(email string) (string, error)
 	CompleteReset(token, newPw string) (*User, error)
+	VerifyPassword(user *User, password string) error
+	
+	// ChangePassword sets a new password once the current one is confirmed
+	// and rotates the remember token, signing out every other session.
+	ChangePassword(user *User, currentPw, newPw string) error
+	// InitiateEmailChange returns a token which has to be sent to the new
+	// email address. The address is only changed by CompleteEmailChange.
+	InitiateEmailChange(user *User, password, newEmail string) (string, error)
+	// CompleteEmailChange returns the updated user along with the email
+	// address the account used before the change.
+	CompleteEmailChange(token string) (*User, string, error)
+	
+	// ForceReset replaces the password with a random one, signs out every
+	// session and returns a password reset token for the user.
+	ForceReset(user *User) (string, error)
 	UserDB
 }
 
-func NewUserService(db *gorm.DB, pepper, hmacKey string) UserService {
-	ug := &userGorm{db}
-	hmac := hash.NewHMAC(hmacKey)
-	uv := newUserValidator(ug, hmac, pepper)
+// Keys are the secrets used to pepper passwords and to hash tokens. The
+// first pepper and HMAC key are the current ones, the others are only
+// accepted while the keys are being rotated.
+type Keys struct {
+	Peppers    []string
+	HMACKeys   []string
+	BcryptCost int
+}
+
+func (k Keys) Pepper() string {
+	if len(k.Peppers) == 0 {
+		return ""
+	}
+	return k.Peppers[0]
+}
+
+func (k Keys) Keyring() hash.Keyring {
+	if len(k.HMACKeys) == 0 {
+		return hash.NewKeyring("")
+	}
+	return hash.NewKeyring(k.HMACKeys[0], k.HMACKeys[1:]...)
+}
+
+func (k Keys) Cost() int {
+	if k.BcryptCost < bcrypt.MinCost {
+		return bcrypt.DefaultCost
+	}
+	return k.BcryptCost
+}
+
+func NewUserService(db *gorm.DB, keys Keys, policy PasswordPolicy) UserService {
+	return newUserService(&userGorm{db}, &passwordResetGorm{db}, &emailChangeGorm{db}, keys, policy)
+}
+
+func newUserService(udb UserDB, prdb passwordResetDB, ecdb emailChangeDB, keys Keys, policy PasswordPolicy) UserService {
+	hmac := keys.Keyring()
+	uv := newUserValidator(udb, hmac, keys.Pepper(), keys.Cost(), policy)
 	
+	peppers := keys.Peppers
+	if len(peppers) == 0 {
+		peppers = []string{""}
+	}
 	return &userService{
 		UserDB:          uv,
-		passwordResetDB: newPasswordResetValidator(&passwordResetGorm{db}, hmac),
-		pepper:          pepper,
+		uv:              uv,
+		passwordResetDB: newPasswordResetValidator(prdb, hmac),
+		emailChangeDB:   newEmailChangeValidator(ecdb, hmac),
+		peppers:         peppers,
+		bcryptCost:      keys.Cost(),
 	}
 }
 
 type userService struct {
 	UserDB
+	uv              *userValidator
 	passwordResetDB passwordResetDB
-	pepper          string
+	emailChangeDB   emailChangeDB
+	peppers         []string
+	bcryptCost      int
+	
+	dummyOnce sync.Once
+	dummyHash []byte
+}
+
+// txUserCreator creates users within a transaction, which the in-memory
+// store can't take part in
+type txUserCreator interface {
+	createTx(tx *gorm.DB, user *User) error
+}
+
+func (us *userService) createTx(tx *gorm.DB, user *User) error {
+	uv := *us.uv
+	if _, ok := uv.UserDB.(*userGorm); ok {
+		uv.UserDB = &userGorm{tx}
+	}
+	return uv.Create(user)
 }
 
-func (us *userService) Authenticate(email, password string) (*User, error) {
-	foundUser, err := us.ByEmail(email)
+func (us *userService) ByLogin(login string) (*User, error) {
+	if strings.Contains(login, "@") {
+		return us.ByEmail(login)
+	}
+	return us.ByUsername(login)
+}
+
+func (us *userService) Authenticate(ctx context.Context, login, password string) (*User, error) {
+	foundUser, err := us.ByLogin(login)
+	if err == ErrNotFound {
+		// Take as long as a wrong password would, so the response time
+		// doesn't tell which accounts exist
+		us.matchPepper(&User{PasswordHash: string(us.dummyPasswordHash())}, password)
+		return nil, err
+	}
 	if err != nil {
 		return nil, err
 	}
-	
-	err = bcrypt.CompareHashAndPassword([]byte(foundUser.PasswordHash),
-		[]byte(password+us.pepper),
-	)
+	pepper, err := us.matchPepper(foundUser, password)
 	if err != nil {
+		return nil, err
+	}
+	if foundUser.Suspended() {
+		return nil, ErrAccountSuspended
+	}
+	
+	// Re-hash while the plain password is at hand if it was hashed with
+	// an old pepper or cost. A failure here must not prevent signing in.
+	cost, err := bcrypt.Cost([]byte(foundUser.PasswordHash))
+	if err == nil && (pepper != us.peppers[0] || cost != us.bcryptCost) {
+		if err := us.rehashPassword(foundUser, password); err != nil {
+			slog.WarnContext(ctx, "models: could not upgrade password hash", "user_id", foundUser.ID, "err", err)
+		}
+	}
+	return foundUser, nil
+}
+
+// rehashPassword skips the validators other than hashing, which may have
+// become stricter since the password was set.
+func (us *userService) rehashPassword(user *User, password string) error {
+	user.Password = password
+	if err := runUserValFuncs(user, us.uv.passwordBcrypt); err != nil {
+		return err
+	}
+	return us.uv.UserDB.Update(user)
+}
+
+func (us *userService) VerifyPassword(user *User, password string) error {
+	_, err := us.matchPepper(user, password)
+	return err
+}
+
+// matchPepper returns the pepper the password hash was created with
+// dummyPasswordHash is a hash at the configured cost which no password
+// matches, to check passwords of unknown users against
+func (us *userService) dummyPasswordHash() []byte {
+	us.dummyOnce.Do(func() {
+		password, err := rand.Bytes(32)
+		if err != nil {
+			return
+		}
+		us.dummyHash, _ = bcrypt.GenerateFromPassword(password, us.bcryptCost)
+	})
+	return us.dummyHash
+}
+
+func (us *userService) matchPepper(user *User, password string) (string, error) {
+	for _, pepper := range us.peppers {
+		err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash),
+			[]byte(password+pepper),
+		)
 		switch err {
+		case nil:
+			return pepper, nil
 		case bcrypt.ErrMismatchedHashAndPassword:
-			return nil, ErrPasswordIncorrect
+			continue
 		default:
-			return nil, err
+			return "", err
+		}
+	}
+	return "", ErrPasswordIncorrect
+}
+
+func (us *userService) ChangePassword(user *User, currentPw, newPw string) error {
+	if err := us.VerifyPassword(user, currentPw); err != nil {
+		return err
+	}
+	if newPw == "" {
+		return ErrPasswordRequired
+	}
+	token, err := rand.RememberToken()
+	if err != nil {
+		return err
+	}
+	user.Password = newPw
+	user.RememberToken = token
+	return us.Update(user)
+}
+
+func (us *userService) ForceReset(user *User) (string, error) {
+	password, err := rand.String(32)
+	if err != nil {
+		return "", err
+	}
+	token, err := rand.RememberToken()
+	if err != nil {
+		return "", err
+	}
+	user.Password = password
+	user.RememberToken = token
+	err = runUserValFuncs(user, us.uv.passwordBcrypt, us.uv.hashRememberToken)
+	if err != nil {
+		return "", err
+	}
+	if err := us.uv.UserDB.Update(user); err != nil {
+		return "", err
+	}
+	pwr := &passwordReset{UserID: user.ID}
+	if err := us.passwordResetDB.Create(pwr); err != nil {
+		return "", err
+	}
+	return pwr.Token, nil
+}
+
+func (us *userService) InitiateEmailChange(user *User, password, newEmail string) (string, error) {
+	if err := us.VerifyPassword(user, password); err != nil {
+		return "", err
+	}
+	normalized := &User{Email: newEmail}
+	normalizeEmail(normalized)
+	ec := &emailChange{UserID: user.ID, Email: normalized.Email}
+	if ec.Email == user.Email {
+		return "", ErrEmailUnchanged
+	}
+	existing, err := us.ByEmail(newEmail)
+	switch err {
+	case ErrNotFound:
+		// pass
+	case nil:
+		if existing.ID != user.ID {
+			return "", ErrEmailTaken
 		}
+		return "", ErrEmailUnchanged
+	default:
+		return "", err
 	}
 	
-	return foundUser, nil
+	// Only the most recently requested address can be confirmed
+	if err := us.emailChangeDB.DeleteByUserID(user.ID); err != nil {
+		return "", err
+	}
+	if err := us.emailChangeDB.Create(ec); err != nil {
+		return "", err
+	}
+	return ec.Token, nil
+}
+
+func (us *userService) CompleteEmailChange(token string) (*User, string, error) {
+	ec, err := us.emailChangeDB.ByToken(token)
+	if err != nil {
+		return nil, "", ErrTokenInvalid
+	}
+	if time.Now().Sub(ec.CreatedAt) > (24 * time.Hour) {
+		return nil, "", ErrTokenInvalid
+	}
+	user, err := us.ByID(ec.UserID)
+	if err != nil {
+		return nil, "", err
+	}
+	oldEmail := user.Email
+	user.Email = ec.Email
+	if err := us.Update(user); err != nil {
+		return nil, "", err
+	}
+	us.emailChangeDB.Delete(ec.ID)
+	return user, oldEmail, nil
 }
 
 func (us *userService) InitiateReset(email string) (string, error) {
@@ -104,10 +413,10 @@ func (us *userService) CompleteReset(token, newPw string) (*User, error) {
 	if time.Now().Sub(pwr.CreatedAt) > (12 * time.Hour) {
 		return nil, ErrTokenInvalid
 	}
-	if len(newPw) < 8 {
-		return nil, ErrPasswordTooShort
+	if newPw == "" {
+		return nil, ErrPasswordRequired
 	}
-	user, err := us.ByID(pwr.ID)
+	user, err := us.ByID(pwr.UserID)
 	if err != nil {
 		return nil, err
 	}
@@ -131,20 +440,27 @@ func runUserValFuncs(user *User, fns ...userValFunc) error {
 	return nil
 }
 
-func newUserValidator(udb UserDB, hmac hash.HMAC, pepper string) *userValidator {
+func newUserValidator(udb UserDB, hmac hash.Keyring, pepper string, bcryptCost int, policy PasswordPolicy) *userValidator {
+	if policy == nil {
+		policy = DefaultPasswordPolicy()
+	}
 	return &userValidator{
 		UserDB:     udb,
 		hmac:       hmac,
 		pepper:     pepper,
+		bcryptCost: bcryptCost,
+		policy:     policy,
 		emailRegex: EmailRegex,
 	}
 }
 
 type userValidator struct {
 	UserDB
-	hmac       hash.HMAC
+	hmac       hash.Keyring
 	emailRegex *regexp.Regexp
 	pepper     string
+	bcryptCost int
+	policy     PasswordPolicy
 }
 
 func (uv *userValidator) ByEmail(email string) (*User, error) {
@@ -159,30 +475,59 @@ func (uv *userValidator) ByEmail(email string) (*User, error) {
 	return uv.UserDB.ByEmail(user.Email)
 }
 
-func (uv *userValidator) ByRememberToken(token string) (*User, error) {
-	user := &User{
-		RememberToken: token,
-	}
-	if err := runUserValFuncs(user, uv.hashRememberToken); err != nil {
+// ByUsername only normalizes the username, accounts created before the
+// format was enforced have to be found as well
+func (uv *userValidator) ByUsername(username string) (*User, error) {
+	user := &User{Username: username}
+	if err := runUserValFuncs(user, uv.usernameNormalize); err != nil {
 		return nil, err
 	}
-	return uv.UserDB.ByRememberToken(user.RememberTokenHash)
+	return uv.UserDB.ByUsername(user.Username)
+}
+
+// ByRememberToken also finds tokens hashed with a previous HMAC key and
+// re-hashes them with the current one.
+func (uv *userValidator) ByRememberToken(token string) (*User, error) {
+	for i, tokenHash := range uv.hmac.Hashes(token) {
+		user, err := uv.UserDB.ByRememberToken(tokenHash)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if i > 0 {
+			user.RememberTokenHash = uv.hmac.Hash(token)
+			if err := uv.UserDB.Update(user); err != nil {
+				return nil, err
+			}
+		}
+		return user, nil
+	}
+	return nil, ErrNotFound
 }
 
 func (uv *userValidator) Create(user *User) error {
 	err := runUserValFuncs(user,
+		uv.emailNormalize,
+		uv.emailRequired,
+		uv.emailFormat,
+		uv.emailAvailable,
+		uv.usernameNormalize,
+		uv.usernameRequired,
+		uv.usernameFormat,
+		uv.usernameNotReserved,
+		uv.usernameAvailable,
+		uv.roleDefault,
+		uv.roleValid,
 		uv.passwordRequired,
-		uv.passwordMinLength,
+		uv.passwordPolicy,
 		uv.passwordBcrypt,
 		uv.passwordHashRequired,
 		uv.defaultRememberToken,
 		uv.rememberTokenMinBytes,
 		uv.hashRememberToken,
 		uv.rememberTokenHashRequired,
-		uv.emailNormalize,
-		uv.emailRequired,
-		uv.emailFormat,
-		uv.emailAvailable,
 	)
 	if err != nil {
 		return err
@@ -192,17 +537,26 @@ func (uv *userValidator) Create(user *User) error {
 
 func (uv *userValidator) Update(user *User) error {
 	err := runUserValFuncs(user,
-		uv.passwordMinLength,
+		uv.emailNormalize,
+		uv.emailRequired,
+		uv.emailFormat,
+		uv.emailAvailable,
+		uv.usernameChanged(
+			uv.usernameNormalize,
+			uv.usernameRequired,
+			uv.usernameFormat,
+			uv.usernameNotReserved,
+			uv.usernameAvailable,
+		),
+		uv.roleDefault,
+		uv.roleValid,
+		uv.passwordPolicy,
 		uv.passwordBcrypt,
 		uv.passwordHashRequired,
 		uv.hashRememberToken,
 		uv.rememberTokenMinBytes,
 		uv.hashRememberToken,
 		uv.rememberTokenHashRequired,
-		uv.emailNormalize,
-		uv.emailRequired,
-		uv.emailFormat,
-		uv.emailAvailable,
 	)
 	if err != nil {
 		return err
@@ -225,7 +579,7 @@ func (uv *userValidator) passwordBcrypt(user *User) error {
 		return nil
 	}
 	passwordBytes := []byte(user.Password + uv.pepper)
-	hashedBytes, err := bcrypt.GenerateFromPassword(passwordBytes, bcrypt.DefaultCost)
+	hashedBytes, err := bcrypt.GenerateFromPassword(passwordBytes, uv.bcryptCost)
 	if err != nil {
 		return err
 	}
@@ -264,9 +618,13 @@ func (uv *userValidator) idGreaterThan(n uint) userValFunc {
 }
 
 func (uv *userValidator) emailNormalize(user *User) error {
+	normalizeEmail(user)
+	return nil
+}
+
+func normalizeEmail(user *User) {
 	user.Email = strings.ToLower(user.Email)
 	user.Email = strings.TrimSpace(user.Email)
-	return nil
 }
 
 func (uv *userValidator) emailRequired(user *User) error {
@@ -297,6 +655,77 @@ func (uv *userValidator) emailAvailable(user *User) error {
 	return nil
 }
 
+// usernameChanged only runs fns when the username differs from the stored
+// one. Accounts from before usernames were validated can still be saved,
+// e.g. when signing in, with a username the rules reject today.
+func (uv *userValidator) usernameChanged(fns ...userValFunc) userValFunc {
+	return func(user *User) error {
+		stored, err := uv.UserDB.ByID(user.ID)
+		if err != nil {
+			return err
+		}
+		if stored.Username == user.Username {
+			return nil
+		}
+		return runUserValFuncs(user, fns...)
+	}
+}
+
+func (uv *userValidator) usernameNormalize(user *User) error {
+	user.Username = strings.ToLower(user.Username)
+	user.Username = strings.TrimSpace(user.Username)
+	return nil
+}
+
+func (uv *userValidator) usernameRequired(user *User) error {
+	if user.Username == "" {
+		return ErrUsernameRequired
+	}
+	return nil
+}
+
+func (uv *userValidator) usernameFormat(user *User) error {
+	if !UsernameRegex.MatchString(user.Username) {
+		return ErrUsernameInvalid
+	}
+	return nil
+}
+
+func (uv *userValidator) usernameNotReserved(user *User) error {
+	if ReservedUsernames[user.Username] {
+		return ErrUsernameReserved
+	}
+	return nil
+}
+
+func (uv *userValidator) usernameAvailable(user *User) error {
+	existing, err := uv.ByUsername(user.Username)
+	if err == ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if existing.ID != user.ID {
+		return ErrUsernameTaken
+	}
+	return nil
+}
+
+func (uv *userValidator) roleDefault(user *User) error {
+	if user.Role == "" {
+		user.Role = RoleUser
+	}
+	return nil
+}
+
+func (uv *userValidator) roleValid(user *User) error {
+	if _, ok := roleRanks[user.Role]; !ok {
+		return ErrRoleInvalid
+	}
+	return nil
+}
+
 func (uv *userValidator) passwordRequired(user *User) error {
 	if user.Password == "" {
 		return ErrPasswordRequired
@@ -311,14 +740,11 @@ func (uv *userValidator) passwordHashRequired(user *User) error {
 	return nil
 }
 
-func (uv *userValidator) passwordMinLength(user *User) error {
+func (uv *userValidator) passwordPolicy(user *User) error {
 	if user.Password == "" {
 		return nil
 	}
-	if len(user.Password) < 8 {
-		return ErrPasswordTooShort
-	}
-	return nil
+	return uv.policy.Check(user.Password, user)
 }
 
 func (uv *userValidator) rememberTokenMinBytes(user *User) error {
@@ -360,6 +786,15 @@ func (ug *userGorm) ByEmail(email string) (*User, error) {
 	return &user, err
 }
 
+// ByUsername compares case-insensitively so accounts created before
+// usernames were normalized are still found.
+func (ug *userGorm) ByUsername(username string) (*User, error) {
+	var user User
+	db := ug.db.Where("LOWER(username) = ?", strings.ToLower(username))
+	err := First(db, &user)
+	return &user, err
+}
+
 func (ug *userGorm) ByRememberToken(hashedToken string) (*User, error) {
 	var user User
 	err := First(ug.db.Where("remember_token_hash = ?", hashedToken), &user)
@@ -369,6 +804,25 @@ func (ug *userGorm) ByRememberToken(hashedToken string) (*User, error) {
 	return &user, err
 }
 
+func (ug *userGorm) Search(query string, p Pagination) ([]User, int, error) {
+	db := ug.db.Model(&User{})
+	if query != "" {
+		like := "%" + strings.ToLower(query) + "%"
+		db = db.Where("LOWER(name) LIKE ? OR LOWER(username) LIKE ? OR LOWER(email) LIKE ?",
+			like, like, like)
+	}
+	var total int
+	if err := db.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	var users []User
+	err := db.Order("id").Offset(p.Offset()).Limit(p.Limit()).Find(&users).Error
+	if err != nil {
+		return nil, 0, err
+	}
+	return users, total, nil
+}
+
 func (ug *userGorm) Create(user *User) error {
 	return ug.db.Create(user).Error
 }
@@ -0,0 +1,155 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"gallerio/utils/rand"
+	"golang.org/x/crypto/bcrypt"
+	"testing"
+)
+
+func TestUserQueries(t *testing.T) {
+	services := newTestServices(t)
+	us := services.User
+	alice := createTestUser(t, us, "alice")
+	createTestUser(t, us, "bob")
+	
+	if alice.RememberToken == "" || alice.RememberTokenHash == "" {
+		t.Fatal("expected a remember token to be set")
+	}
+	found, err := us.ByRememberToken(alice.RememberToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.ID != alice.ID {
+		t.Fatalf("expected user %d, got %d", alice.ID, found.ID)
+	}
+	if _, err := us.ByRememberToken("not-a-remember-token-of-anyone-at-all"); err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	
+	if found, err := us.ByEmail("ALICE@example.com"); err != nil || found.ID != alice.ID {
+		t.Fatalf("expected to find alice by email, got %v", err)
+	}
+	if found, err := us.ByUsername("Alice"); err != nil || found.ID != alice.ID {
+		t.Fatalf("expected to find alice by username, got %v", err)
+	}
+	if _, err := us.Authenticate(context.Background(), "alice", "correct horse battery staple"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := us.Authenticate(context.Background(), "alice@example.com", "wrong password"); err != ErrPasswordIncorrect {
+		t.Fatalf("expected ErrPasswordIncorrect, got %v", err)
+	}
+	
+	duplicate := User{Username: "alice2", Email: "alice@example.com", Password: "correct horse battery staple"}
+	if err := us.Create(&duplicate); err != ErrEmailTaken {
+		t.Fatalf("expected ErrEmailTaken, got %v", err)
+	}
+}
+
+func TestAuthenticateUnknownLogin(t *testing.T) {
+	services := newTestServices(t)
+	us := services.User.(*userService)
+	if _, err := us.Authenticate(context.Background(), "nobody", "correct horse battery staple"); err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	// The password was checked against a hash as costly as a real one
+	cost, err := bcrypt.Cost(us.dummyPasswordHash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cost != us.bcryptCost {
+		t.Fatalf("expected the dummy hash to have cost %d, got %d", us.bcryptCost, cost)
+	}
+}
+
+func TestUserSearch(t *testing.T) {
+	services := newTestServices(t)
+	for _, username := range []string{"alice", "alina", "bob"} {
+		createTestUser(t, services.User, username)
+	}
+	
+	users, total, err := services.User.Search("ALI", NewPagination(1, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 2 || len(users) != 1 {
+		t.Fatalf("expected 1 of 2 matches, got %d of %d", len(users), total)
+	}
+	users, total, err = services.User.Search("", NewPagination(2, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 3 || len(users) != 1 {
+		t.Fatalf("expected the second page to hold 1 of 3 users, got %d of %d", len(users), total)
+	}
+}
+
+func TestLegacyUsernames(t *testing.T) {
+	services := newTestServices(t)
+	us := services.User
+	for i, legacy := range []string{"John Doe", "Jo", "admin"} {
+		user := createTestUser(t, us, fmt.Sprintf("legacy%d", i))
+		// Saved before usernames were validated
+		err := services.DB().Model(&User{}).Where("id = ?", user.ID).
+			Update("username", legacy).Error
+		if err != nil {
+			t.Fatal(err)
+		}
+		
+		// Signing in saves a new remember token
+		found, err := us.Authenticate(context.Background(), user.Email, "correct horse battery staple")
+		if err != nil {
+			t.Fatalf("%s: %v", legacy, err)
+		}
+		found.RememberToken, err = rand.RememberToken()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := us.Update(found); err != nil {
+			t.Fatalf("%s: expected to sign in, got %v", legacy, err)
+		}
+		if found.Username != legacy {
+			t.Fatalf("expected the username to stay %q, got %q", legacy, found.Username)
+		}
+		if _, err := us.Authenticate(context.Background(), legacy, "correct horse battery staple"); err != nil {
+			t.Fatalf("%s: expected to sign in by username, got %v", legacy, err)
+		}
+		
+		// A new username has to follow the rules
+		found.Username = "no spaces"
+		if err := us.Update(found); err != ErrUsernameInvalid {
+			t.Fatalf("%s: expected ErrUsernameInvalid, got %v", legacy, err)
+		}
+		found.Username = fmt.Sprintf("John_Doe%d", i)
+		if err := us.Update(found); err != nil {
+			t.Fatalf("%s: %v", legacy, err)
+		}
+	}
+}
+
+func TestCompleteResetChangesTheRightUser(t *testing.T) {
+	services := newTestServices(t)
+	us := services.User
+	createTestUser(t, us, "alice")
+	bob := createTestUser(t, us, "bob")
+	
+	// Bob's is the first reset, so its ID is the same as Alice's
+	token, err := us.InitiateReset(bob.Email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := us.CompleteReset(token, "a brand new password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.ID != bob.ID {
+		t.Fatalf("expected bob's password to be reset, got user %d", user.ID)
+	}
+	if _, err := us.Authenticate(context.Background(), "bob", "a brand new password"); err != nil {
+		t.Fatalf("expected bob to sign in with the new password, got %v", err)
+	}
+	if _, err := us.Authenticate(context.Background(), "alice", "correct horse battery staple"); err != nil {
+		t.Fatalf("expected alice's password to be unchanged, got %v", err)
+	}
+}
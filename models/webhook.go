@@ -0,0 +1,680 @@
+package models
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"gallerio/utils/rand"
+	"github.com/jinzhu/gorm"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	EventGalleryCreated = "gallery.created"
+	EventGalleryUpdated = "gallery.updated"
+	EventGalleryDeleted = "gallery.deleted"
+	EventImageUploaded  = "image.uploaded"
+	EventImageDeleted   = "image.deleted"
+	// EventShareLinkViewed is sent when someone other than the owner opens
+	// the public page of a gallery
+	EventShareLinkViewed = "share_link.viewed"
+	
+	WebhookDeliveryPending   = "pending"
+	WebhookDeliveryDelivered = "delivered"
+	WebhookDeliveryFailed    = "failed"
+	
+	WebhookEventHeader    = "X-Gallerio-Event"
+	WebhookDeliveryHeader = "X-Gallerio-Delivery"
+	// WebhookSignatureHeader holds "sha256=" followed by the hex encoded
+	// HMAC-SHA256 of the request body, keyed with the webhook secret
+	WebhookSignatureHeader = "X-Gallerio-Signature"
+)
+
+// Events lists every event a webhook can subscribe to
+var Events = []string{
+	EventGalleryCreated,
+	EventGalleryUpdated,
+	EventGalleryDeleted,
+	EventImageUploaded,
+	EventImageDeleted,
+	EventShareLinkViewed,
+}
+
+var (
+	// webhookMaxAttempts is how often a delivery is tried before it is
+	// marked as failed
+	webhookMaxAttempts = 8
+	// webhookBackoff is the delay before the first retry, it doubles with
+	// every further attempt up to webhookMaxBackoff
+	webhookBackoff    = 30 * time.Second
+	webhookMaxBackoff = 6 * time.Hour
+	webhookTimeout    = 10 * time.Second
+	// webhookClaimTimeout is how long a delivery claimed by a worker is
+	// left to it before another worker may pick it up again, so deliveries
+	// of a worker which stopped midway aren't lost
+	webhookClaimTimeout = 5 * time.Minute
+	// webhookBatchSize limits how many deliveries one run of the worker sends
+	webhookBatchSize = 50
+	// webhookRetention is how long the delivery log is kept
+	webhookRetention = 30 * 24 * time.Hour
+)
+
+// Webhook is an endpoint of a user which is notified about events. Events
+// are stored space separated. The secret has to be kept in plain text as
+// it signs every delivery.
+type Webhook struct {
+	gorm.Model
+	UserID uint   `gorm:"not null;index"`
+	URL    string `gorm:"not null"`
+	Events string `gorm:"not null"`
+	Secret string `gorm:"not null"`
+}
+
+// PublicWebhook holds the fields of a webhook which are safe to send to
+// its owner. The secret is left out so it's only shown where it's asked
+// for.
+type PublicWebhook struct {
+	ID        uint      `json:"id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (wh Webhook) Public() PublicWebhook {
+	return PublicWebhook{
+		ID:        wh.ID,
+		URL:       wh.URL,
+		Events:    wh.EventList(),
+		CreatedAt: wh.CreatedAt,
+	}
+}
+
+func (wh Webhook) EventList() []string {
+	return strings.Fields(wh.Events)
+}
+
+func (wh Webhook) Subscribed(event string) bool {
+	for _, e := range wh.EventList() {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookDelivery is a single event sent to a webhook along with the
+// outcome of its latest attempt
+type WebhookDelivery struct {
+	gorm.Model
+	WebhookID      uint   `gorm:"not null;index"`
+	Event          string `gorm:"not null"`
+	Payload        string `gorm:"type:text"`
+	Status         string `gorm:"not null;index"`
+	Attempts       int
+	NextAttemptAt  *time.Time `gorm:"index"`
+	ResponseStatus int
+	Error          string `gorm:"type:text"`
+	DeliveredAt    *time.Time
+}
+
+// PublicWebhookDelivery holds the fields of a delivery which are safe to
+// send to the owner of the webhook
+type PublicWebhookDelivery struct {
+	ID             uint       `json:"id"`
+	Event          string     `json:"event"`
+	Payload        string     `json:"payload"`
+	Status         string     `json:"status"`
+	Attempts       int        `json:"attempts"`
+	NextAttemptAt  *time.Time `json:"next_attempt_at"`
+	ResponseStatus int        `json:"response_status"`
+	Error          string     `json:"error"`
+	DeliveredAt    *time.Time `json:"delivered_at"`
+	CreatedAt      time.Time  `json:"created_at"`
+}
+
+func (wd WebhookDelivery) Public() PublicWebhookDelivery {
+	return PublicWebhookDelivery{
+		ID:             wd.ID,
+		Event:          wd.Event,
+		Payload:        wd.Payload,
+		Status:         wd.Status,
+		Attempts:       wd.Attempts,
+		NextAttemptAt:  wd.NextAttemptAt,
+		ResponseStatus: wd.ResponseStatus,
+		Error:          wd.Error,
+		DeliveredAt:    wd.DeliveredAt,
+		CreatedAt:      wd.CreatedAt,
+	}
+}
+
+// WebhookPayload is the JSON body of every delivery
+type WebhookPayload struct {
+	Event     string      `json:"event"`
+	CreatedAt time.Time   `json:"created_at"`
+	Data      interface{} `json:"data"`
+}
+
+type WebhookGallery struct {
+	ID        uint      `json:"id"`
+	Title     string    `json:"title"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func NewWebhookGallery(gallery *Gallery) WebhookGallery {
+	return WebhookGallery{
+		ID:        gallery.ID,
+		Title:     gallery.Title,
+		CreatedAt: gallery.CreatedAt,
+		UpdatedAt: gallery.UpdatedAt,
+	}
+}
+
+type WebhookImage struct {
+	GalleryID uint   `json:"gallery_id"`
+	Filename  string `json:"filename"`
+	URL       string `json:"url"`
+}
+
+func NewWebhookImage(img *Image) WebhookImage {
+	return WebhookImage{
+		GalleryID: img.GalleryID,
+		Filename:  img.Filename,
+		URL:       img.Path(),
+	}
+}
+
+// SignWebhook returns the value of WebhookSignatureHeader for body.
+// Receivers should compare it to their own with hmac.Equal.
+func SignWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+type WebhookDB interface {
+	// Methods for single webhook queries
+	ByID(id uint) (*Webhook, error)
+	
+	// Methods for multiple webhook queries
+	ByUserID(userID uint) ([]Webhook, error)
+	
+	// Methods for modifying webhook
+	Create(hook *Webhook) error
+	Update(hook *Webhook) error
+	Delete(id uint) error
+}
+
+type WebhookDeliveryDB interface {
+	// ByWebhookID returns the newest deliveries first along with the total
+	// number of deliveries of the webhook
+	ByWebhookID(webhookID uint, p Pagination) ([]WebhookDelivery, int, error)
+	// Due returns up to limit pending deliveries which should be attempted
+	// at or before t, the longest waiting first
+	Due(t time.Time, limit int) ([]WebhookDelivery, error)
+	// Claim moves the next attempt of the pending delivery to until unless
+	// it isn't due at t anymore, meaning another worker claimed it first.
+	// It reports whether the delivery was claimed.
+	Claim(id uint, t, until time.Time) (bool, error)
+	
+	Create(delivery *WebhookDelivery) error
+	Update(delivery *WebhookDelivery) error
+	DeleteByWebhookID(webhookID uint) error
+	DeleteBefore(t time.Time) (int64, error)
+}
+
+type WebhookService interface {
+	// Dispatch queues the event for every webhook of the user which is
+	// subscribed to it. Data is sent as the data field of WebhookPayload.
+	Dispatch(userID uint, event string, data interface{}) error
+	// Deliveries returns the delivery log of the webhook, newest first
+	Deliveries(webhookID uint, p Pagination) ([]WebhookDelivery, int, error)
+	// DeliverDue sends the pending deliveries which are due and returns how
+	// many were attempted. Failed attempts are retried with exponential
+	// backoff. Each delivery is claimed before it's sent, so several
+	// instances may run DeliverDue at the same time.
+	DeliverDue(ctx context.Context) (int, error)
+	// Prune removes deliveries which are older than the retention period
+	Prune() (int64, error)
+	WebhookDB
+}
+
+func NewWebhookService(db *gorm.DB) WebhookService {
+	return &webhookService{
+		WebhookDB:  &webhookValidator{WebhookDB: &webhookGorm{db}, ipAllowed: webhookIPAllowed},
+		deliveries: &webhookDeliveryGorm{db},
+		client:     newWebhookClient(webhookIPAllowed),
+		now:        time.Now,
+	}
+}
+
+// sharedAddressSpace is the carrier-grade NAT range of RFC 6598, which
+// net.IP.IsPrivate doesn't cover
+var sharedAddressSpace = &net.IPNet{
+	IP:   net.IPv4(100, 64, 0, 0),
+	Mask: net.CIDRMask(10, 32),
+}
+
+// webhookIPAllowed tells whether webhooks may be sent to ip. Loopback,
+// private, shared, link-local, multicast and unspecified addresses are
+// refused so a webhook can't reach the server itself or the network it
+// runs in.
+func webhookIPAllowed(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsMulticast() ||
+		sharedAddressSpace.Contains(ip))
+}
+
+// newWebhookClient returns a client which only connects to addresses
+// allowed by ipAllowed. The address is checked when dialing, after the
+// host name was resolved, so a name can't be pointed at a refused address
+// once the webhook was saved. Redirects are dialed the same way.
+func newWebhookClient(ipAllowed func(ip net.IP) bool) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: webhookTimeout,
+		Control: func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !ipAllowed(ip) {
+				return ErrWebhookURLPrivate
+			}
+			return nil
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// A proxy would be dialed instead of the webhook, skipping the check
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Timeout: webhookTimeout, Transport: transport}
+}
+
+type webhookService struct {
+	WebhookDB
+	deliveries WebhookDeliveryDB
+	client     *http.Client
+	now        func() time.Time
+}
+
+func (ws *webhookService) Dispatch(userID uint, event string, data interface{}) error {
+	hooks, err := ws.ByUserID(userID)
+	if err != nil {
+		return err
+	}
+	var payload []byte
+	for _, hook := range hooks {
+		if !hook.Subscribed(event) {
+			continue
+		}
+		now := ws.now()
+		if payload == nil {
+			payload, err = json.Marshal(WebhookPayload{
+				Event:     event,
+				CreatedAt: now.UTC(),
+				Data:      data,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		delivery := WebhookDelivery{
+			WebhookID:     hook.ID,
+			Event:         event,
+			Payload:       string(payload),
+			Status:        WebhookDeliveryPending,
+			NextAttemptAt: &now,
+		}
+		if err := ws.deliveries.Create(&delivery); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ws *webhookService) Deliveries(webhookID uint, p Pagination) ([]WebhookDelivery, int, error) {
+	return ws.deliveries.ByWebhookID(webhookID, p)
+}
+
+func (ws *webhookService) DeliverDue(ctx context.Context) (int, error) {
+	deliveries, err := ws.deliveries.Due(ws.now(), webhookBatchSize)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for i := range deliveries {
+		// Whatever is left is picked up again after a restart
+		if ctx.Err() != nil {
+			return n, nil
+		}
+		now := ws.now()
+		until := now.Add(webhookClaimTimeout)
+		claimed, err := ws.deliveries.Claim(deliveries[i].ID, now, until)
+		if err != nil {
+			return n, err
+		}
+		if !claimed {
+			continue
+		}
+		deliveries[i].NextAttemptAt = &until
+		n++
+		if err := ws.deliver(ctx, &deliveries[i]); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (ws *webhookService) Prune() (int64, error) {
+	return ws.deliveries.DeleteBefore(ws.now().Add(-webhookRetention))
+}
+
+// Delete also removes the delivery log of the webhook
+func (ws *webhookService) Delete(id uint) error {
+	if err := ws.WebhookDB.Delete(id); err != nil {
+		return err
+	}
+	return ws.deliveries.DeleteByWebhookID(id)
+}
+
+// deliver makes one attempt and records its outcome on the delivery
+func (ws *webhookService) deliver(ctx context.Context, delivery *WebhookDelivery) error {
+	hook, err := ws.ByID(delivery.WebhookID)
+	switch err {
+	case nil:
+		delivery.Attempts++
+		delivery.ResponseStatus, err = ws.send(ctx, hook, delivery)
+	case ErrNotFound:
+		// The webhook was deleted after the event was queued
+		delivery.Attempts = webhookMaxAttempts
+	default:
+		return err
+	}
+	
+	now := ws.now()
+	switch {
+	case err == nil:
+		delivery.Status = WebhookDeliveryDelivered
+		delivery.Error = ""
+		delivery.NextAttemptAt = nil
+		delivery.DeliveredAt = &now
+	case delivery.Attempts >= webhookMaxAttempts:
+		delivery.Status = WebhookDeliveryFailed
+		delivery.Error = err.Error()
+		delivery.NextAttemptAt = nil
+	default:
+		delivery.Error = err.Error()
+		next := now.Add(webhookRetryDelay(delivery.Attempts))
+		delivery.NextAttemptAt = &next
+	}
+	return ws.deliveries.Update(delivery)
+}
+
+// send posts the payload to the webhook and returns the response status.
+// Any status other than 2xx counts as a failure.
+func (ws *webhookService) send(ctx context.Context, hook *Webhook, delivery *WebhookDelivery) (int, error) {
+	body := []byte(delivery.Payload)
+	req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Gallerio-Webhooks")
+	req.Header.Set(WebhookEventHeader, delivery.Event)
+	req.Header.Set(WebhookDeliveryHeader, strconv.FormatUint(uint64(delivery.ID), 10))
+	req.Header.Set(WebhookSignatureHeader, SignWebhook(hook.Secret, body))
+	
+	resp, err := ws.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	// Drain a bit of the body so the connection can be reused
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("endpoint responded with %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// webhookRetryDelay is the wait after the given number of failed attempts
+func webhookRetryDelay(attempts int) time.Duration {
+	delay := webhookBackoff
+	for i := 1; i < attempts; i++ {
+		delay *= 2
+		if delay >= webhookMaxBackoff {
+			return webhookMaxBackoff
+		}
+	}
+	return delay
+}
+
+type webhookValFunc func(hook *Webhook) error
+
+func runWebhookValFuncs(hook *Webhook, fns ...webhookValFunc) error {
+	for _, fn := range fns {
+		if err := fn(hook); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type webhookValidator struct {
+	WebhookDB
+	ipAllowed func(ip net.IP) bool
+}
+
+func (wv *webhookValidator) Create(hook *Webhook) error {
+	err := runWebhookValFuncs(hook,
+		wv.userIDRequired,
+		wv.urlValid,
+		wv.urlPublic,
+		wv.eventsNormalize,
+		wv.eventsRequired,
+		wv.defaultSecret,
+	)
+	if err != nil {
+		return err
+	}
+	return wv.WebhookDB.Create(hook)
+}
+
+func (wv *webhookValidator) Update(hook *Webhook) error {
+	err := runWebhookValFuncs(hook,
+		wv.userIDRequired,
+		wv.urlValid,
+		wv.urlPublic,
+		wv.eventsNormalize,
+		wv.eventsRequired,
+		wv.defaultSecret,
+	)
+	if err != nil {
+		return err
+	}
+	return wv.WebhookDB.Update(hook)
+}
+
+func (wv *webhookValidator) Delete(id uint) error {
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+	return wv.WebhookDB.Delete(id)
+}
+
+func (wv *webhookValidator) userIDRequired(hook *Webhook) error {
+	if hook.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+	return nil
+}
+
+func (wv *webhookValidator) urlValid(hook *Webhook) error {
+	hook.URL = strings.TrimSpace(hook.URL)
+	u, err := url.Parse(hook.URL)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return ErrWebhookURLInvalid
+	}
+	return nil
+}
+
+// urlPublic refuses hosts which are refused when dialing anyway, to tell
+// the user right away. Other host names are only checked when dialing.
+func (wv *webhookValidator) urlPublic(hook *Webhook) error {
+	u, err := url.Parse(hook.URL)
+	if err != nil {
+		return ErrWebhookURLInvalid
+	}
+	host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return ErrWebhookURLPrivate
+	}
+	if ip := net.ParseIP(host); ip != nil && !wv.ipAllowed(ip) {
+		return ErrWebhookURLPrivate
+	}
+	return nil
+}
+
+// eventsNormalize sorts events in the order of Events and drops duplicates
+func (wv *webhookValidator) eventsNormalize(hook *Webhook) error {
+	requested := map[string]bool{}
+	for _, event := range hook.EventList() {
+		requested[event] = true
+	}
+	var events []string
+	for _, event := range Events {
+		if requested[event] {
+			events = append(events, event)
+			delete(requested, event)
+		}
+	}
+	if len(requested) > 0 {
+		return ErrEventInvalid
+	}
+	hook.Events = strings.Join(events, " ")
+	return nil
+}
+
+func (wv *webhookValidator) eventsRequired(hook *Webhook) error {
+	if hook.Events == "" {
+		return ErrEventsRequired
+	}
+	return nil
+}
+
+func (wv *webhookValidator) defaultSecret(hook *Webhook) error {
+	if hook.Secret != "" {
+		return nil
+	}
+	secret, err := rand.String(32)
+	if err != nil {
+		return err
+	}
+	hook.Secret = secret
+	return nil
+}
+
+var _ WebhookDB = &webhookGorm{}
+
+type webhookGorm struct {
+	db *gorm.DB
+}
+
+func (wg *webhookGorm) ByID(id uint) (*Webhook, error) {
+	var hook Webhook
+	err := First(wg.db.Where("id = ?", id), &hook)
+	if err != nil {
+		return nil, err
+	}
+	return &hook, nil
+}
+
+func (wg *webhookGorm) ByUserID(userID uint) ([]Webhook, error) {
+	var hooks []Webhook
+	err := wg.db.Where("user_id = ?", userID).Order("created_at").Find(&hooks).Error
+	if err != nil {
+		return nil, err
+	}
+	return hooks, nil
+}
+
+func (wg *webhookGorm) Create(hook *Webhook) error {
+	return wg.db.Create(hook).Error
+}
+
+func (wg *webhookGorm) Update(hook *Webhook) error {
+	return wg.db.Save(hook).Error
+}
+
+func (wg *webhookGorm) Delete(id uint) error {
+	hook := Webhook{Model: gorm.Model{ID: id}}
+	return wg.db.Unscoped().Delete(&hook).Error
+}
+
+var _ WebhookDeliveryDB = &webhookDeliveryGorm{}
+
+type webhookDeliveryGorm struct {
+	db *gorm.DB
+}
+
+func (wdg *webhookDeliveryGorm) ByWebhookID(webhookID uint, p Pagination) ([]WebhookDelivery, int, error) {
+	db := wdg.db.Model(&WebhookDelivery{}).Where("webhook_id = ?", webhookID)
+	var total int
+	if err := db.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	var deliveries []WebhookDelivery
+	err := db.Order("created_at desc, id desc").
+		Offset(p.Offset()).Limit(p.Limit()).Find(&deliveries).Error
+	if err != nil {
+		return nil, 0, err
+	}
+	return deliveries, total, nil
+}
+
+func (wdg *webhookDeliveryGorm) Due(t time.Time, limit int) ([]WebhookDelivery, error) {
+	var deliveries []WebhookDelivery
+	err := wdg.db.Where("status = ? AND next_attempt_at <= ?", WebhookDeliveryPending, t).
+		Order("next_attempt_at, id").Limit(limit).Find(&deliveries).Error
+	if err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+func (wdg *webhookDeliveryGorm) Claim(id uint, t, until time.Time) (bool, error) {
+	db := wdg.db.Model(&WebhookDelivery{}).
+		Where("id = ? AND status = ? AND next_attempt_at <= ?", id, WebhookDeliveryPending, t).
+		UpdateColumn("next_attempt_at", until)
+	return db.RowsAffected == 1, db.Error
+}
+
+func (wdg *webhookDeliveryGorm) Create(delivery *WebhookDelivery) error {
+	return wdg.db.Create(delivery).Error
+}
+
+func (wdg *webhookDeliveryGorm) Update(delivery *WebhookDelivery) error {
+	return wdg.db.Save(delivery).Error
+}
+
+func (wdg *webhookDeliveryGorm) DeleteByWebhookID(webhookID uint) error {
+	return wdg.db.Unscoped().Where("webhook_id = ?", webhookID).Delete(&WebhookDelivery{}).Error
+}
+
+func (wdg *webhookDeliveryGorm) DeleteBefore(t time.Time) (int64, error) {
+	db := wdg.db.Unscoped().Where("created_at < ?", t).Delete(&WebhookDelivery{})
+	return db.RowsAffected, db.Error
+}
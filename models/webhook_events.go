@@ -0,0 +1,81 @@
+package models
+
+import (
+	"context"
+	"io"
+	"log/slog"
+)
+
+// galleryEvents dispatches webhook events for changes made through the
+// gallery service. Failing to queue an event doesn't fail the change.
+type galleryEvents struct {
+	GalleryService
+	ws WebhookService
+}
+
+func (ge *galleryEvents) Create(ctx context.Context, gallery *Gallery) error {
+	if err := ge.GalleryService.Create(ctx, gallery); err != nil {
+		return err
+	}
+	dispatchEvent(ctx, ge.ws, gallery.UserID, EventGalleryCreated, NewWebhookGallery(gallery))
+	return nil
+}
+
+func (ge *galleryEvents) Update(ctx context.Context, gallery *Gallery) error {
+	if err := ge.GalleryService.Update(ctx, gallery); err != nil {
+		return err
+	}
+	dispatchEvent(ctx, ge.ws, gallery.UserID, EventGalleryUpdated, NewWebhookGallery(gallery))
+	return nil
+}
+
+func (ge *galleryEvents) Delete(ctx context.Context, id uint) error {
+	gallery, err := ge.GalleryService.ByID(id)
+	if err != nil {
+		return err
+	}
+	if err := ge.GalleryService.Delete(ctx, id); err != nil {
+		return err
+	}
+	dispatchEvent(ctx, ge.ws, gallery.UserID, EventGalleryDeleted, NewWebhookGallery(gallery))
+	return nil
+}
+
+// imageEvents dispatches webhook events for images uploaded or deleted
+// through the image service. The gallery service finds the owner.
+type imageEvents struct {
+	ImageService
+	gs GalleryService
+	ws WebhookService
+}
+
+func (ie *imageEvents) Create(ctx context.Context, galleryID uint, filename string, reader io.ReadCloser) error {
+	if err := ie.ImageService.Create(ctx, galleryID, filename, reader); err != nil {
+		return err
+	}
+	ie.dispatch(ctx, &Image{GalleryID: galleryID, Filename: filename}, EventImageUploaded)
+	return nil
+}
+
+func (ie *imageEvents) Delete(ctx context.Context, img *Image) error {
+	if err := ie.ImageService.Delete(ctx, img); err != nil {
+		return err
+	}
+	ie.dispatch(ctx, img, EventImageDeleted)
+	return nil
+}
+
+func (ie *imageEvents) dispatch(ctx context.Context, img *Image, event string) {
+	gallery, err := ie.gs.ByID(img.GalleryID)
+	if err != nil {
+		slog.ErrorContext(ctx, "webhooks: couldn't find gallery", "gallery_id", img.GalleryID, "err", err)
+		return
+	}
+	dispatchEvent(ctx, ie.ws, gallery.UserID, event, NewWebhookImage(img))
+}
+
+func dispatchEvent(ctx context.Context, ws WebhookService, userID uint, event string, data interface{}) {
+	if err := ws.Dispatch(userID, event, data); err != nil {
+		slog.ErrorContext(ctx, "webhooks: couldn't queue event", "event", event, "user_id", userID, "err", err)
+	}
+}
@@ -0,0 +1,617 @@
+package models
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"encoding/json"
+	"gallerio/utils/logging"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type memWebhookDB struct {
+	hooks  map[uint]*Webhook
+	nextID uint
+}
+
+func (db *memWebhookDB) ByID(id uint) (*Webhook, error) {
+	hook, ok := db.hooks[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	copied := *hook
+	return &copied, nil
+}
+
+func (db *memWebhookDB) ByUserID(userID uint) ([]Webhook, error) {
+	var hooks []Webhook
+	for _, hook := range db.hooks {
+		if hook.UserID == userID {
+			hooks = append(hooks, *hook)
+		}
+	}
+	sort.Slice(hooks, func(i, j int) bool { return hooks[i].ID < hooks[j].ID })
+	return hooks, nil
+}
+
+func (db *memWebhookDB) Create(hook *Webhook) error {
+	db.nextID++
+	hook.ID = db.nextID
+	return db.Update(hook)
+}
+
+func (db *memWebhookDB) Update(hook *Webhook) error {
+	copied := *hook
+	db.hooks[hook.ID] = &copied
+	return nil
+}
+
+func (db *memWebhookDB) Delete(id uint) error {
+	delete(db.hooks, id)
+	return nil
+}
+
+type memWebhookDeliveryDB struct {
+	deliveries map[uint]*WebhookDelivery
+	nextID     uint
+}
+
+func (db *memWebhookDeliveryDB) all() []WebhookDelivery {
+	var deliveries []WebhookDelivery
+	for _, delivery := range db.deliveries {
+		deliveries = append(deliveries, *delivery)
+	}
+	sort.Slice(deliveries, func(i, j int) bool { return deliveries[i].ID < deliveries[j].ID })
+	return deliveries
+}
+
+func (db *memWebhookDeliveryDB) ByWebhookID(webhookID uint, p Pagination) ([]WebhookDelivery, int, error) {
+	var deliveries []WebhookDelivery
+	for _, delivery := range db.all() {
+		if delivery.WebhookID == webhookID {
+			deliveries = append(deliveries, delivery)
+		}
+	}
+	return deliveries, len(deliveries), nil
+}
+
+func (db *memWebhookDeliveryDB) Due(t time.Time, limit int) ([]WebhookDelivery, error) {
+	var deliveries []WebhookDelivery
+	for _, delivery := range db.all() {
+		if delivery.Status == WebhookDeliveryPending && !delivery.NextAttemptAt.After(t) {
+			deliveries = append(deliveries, delivery)
+		}
+	}
+	if len(deliveries) > limit {
+		deliveries = deliveries[:limit]
+	}
+	return deliveries, nil
+}
+
+func (db *memWebhookDeliveryDB) Claim(id uint, t, until time.Time) (bool, error) {
+	delivery, ok := db.deliveries[id]
+	if !ok || delivery.Status != WebhookDeliveryPending || delivery.NextAttemptAt.After(t) {
+		return false, nil
+	}
+	delivery.NextAttemptAt = &until
+	return true, nil
+}
+
+func (db *memWebhookDeliveryDB) Create(delivery *WebhookDelivery) error {
+	db.nextID++
+	delivery.ID = db.nextID
+	return db.Update(delivery)
+}
+
+func (db *memWebhookDeliveryDB) Update(delivery *WebhookDelivery) error {
+	copied := *delivery
+	db.deliveries[delivery.ID] = &copied
+	return nil
+}
+
+func (db *memWebhookDeliveryDB) DeleteByWebhookID(webhookID uint) error {
+	for id, delivery := range db.deliveries {
+		if delivery.WebhookID == webhookID {
+			delete(db.deliveries, id)
+		}
+	}
+	return nil
+}
+
+func (db *memWebhookDeliveryDB) DeleteBefore(t time.Time) (int64, error) {
+	var n int64
+	for id, delivery := range db.deliveries {
+		if delivery.CreatedAt.Before(t) {
+			delete(db.deliveries, id)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// receivedWebhook is a request as seen by the test receiver
+type receivedWebhook struct {
+	Header http.Header
+	Body   []byte
+}
+
+// webhookReceiver is a local endpoint which answers with the queued
+// statuses, and 200 once they are used up
+type webhookReceiver struct {
+	*httptest.Server
+	mu       sync.Mutex
+	statuses []int
+	received []receivedWebhook
+}
+
+func newWebhookReceiver(t *testing.T, statuses ...int) *webhookReceiver {
+	r := &webhookReceiver{statuses: statuses}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.received = append(r.received, receivedWebhook{Header: req.Header, Body: body})
+		status := http.StatusOK
+		if len(r.statuses) > 0 {
+			status, r.statuses = r.statuses[0], r.statuses[1:]
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func (r *webhookReceiver) requests() []receivedWebhook {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]receivedWebhook(nil), r.received...)
+}
+
+type testClock struct {
+	t time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	return c.t
+}
+
+// allowLoopback lets the tests deliver to httptest servers
+func allowLoopback(ip net.IP) bool {
+	return ip.IsLoopback() || webhookIPAllowed(ip)
+}
+
+func newTestWebhookService(client *http.Client) (*webhookService, *memWebhookDeliveryDB, *testClock) {
+	clock := &testClock{t: time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)}
+	deliveries := &memWebhookDeliveryDB{deliveries: map[uint]*WebhookDelivery{}}
+	ws := &webhookService{
+		WebhookDB: &webhookValidator{
+			WebhookDB: &memWebhookDB{hooks: map[uint]*Webhook{}},
+			ipAllowed: allowLoopback,
+		},
+		deliveries: deliveries,
+		client:     client,
+		now:        clock.Now,
+	}
+	return ws, deliveries, clock
+}
+
+func TestWebhookDeliveryIsSigned(t *testing.T) {
+	receiver := newWebhookReceiver(t)
+	ws, deliveries, _ := newTestWebhookService(receiver.Client())
+	
+	hook := Webhook{UserID: 1, URL: receiver.URL + "/hooks", Events: EventGalleryCreated}
+	if err := ws.Create(&hook); err != nil {
+		t.Fatal(err)
+	}
+	if hook.Secret == "" {
+		t.Fatal("expected a secret to be generated")
+	}
+	other := Webhook{UserID: 1, URL: receiver.URL + "/other", Events: EventImageDeleted}
+	if err := ws.Create(&other); err != nil {
+		t.Fatal(err)
+	}
+	
+	gallery := &Gallery{Title: "Holidays"}
+	gallery.ID = 7
+	if err := ws.Dispatch(1, EventGalleryCreated, NewWebhookGallery(gallery)); err != nil {
+		t.Fatal(err)
+	}
+	if err := ws.Dispatch(2, EventGalleryCreated, NewWebhookGallery(gallery)); err != nil {
+		t.Fatal(err)
+	}
+	n, err := ws.DeliverDue(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("expected 1 delivery, got %d", n)
+	}
+	
+	requests := receiver.requests()
+	if len(requests) != 1 {
+		t.Fatalf("expected the receiver to get 1 request, got %d", len(requests))
+	}
+	got := requests[0]
+	want := SignWebhook(hook.Secret, got.Body)
+	if !hmac.Equal([]byte(got.Header.Get(WebhookSignatureHeader)), []byte(want)) {
+		t.Errorf("signature %q doesn't match %q", got.Header.Get(WebhookSignatureHeader), want)
+	}
+	if !strings.HasPrefix(want, "sha256=") {
+		t.Errorf("expected a sha256= signature, got %q", want)
+	}
+	if event := got.Header.Get(WebhookEventHeader); event != EventGalleryCreated {
+		t.Errorf("expected event header %q, got %q", EventGalleryCreated, event)
+	}
+	if got.Header.Get(WebhookDeliveryHeader) != "1" {
+		t.Errorf("expected delivery header 1, got %q", got.Header.Get(WebhookDeliveryHeader))
+	}
+	
+	var payload struct {
+		Event string         `json:"event"`
+		Data  WebhookGallery `json:"data"`
+	}
+	if err := json.Unmarshal(got.Body, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.Event != EventGalleryCreated || payload.Data.ID != 7 || payload.Data.Title != "Holidays" {
+		t.Errorf("unexpected payload %s", got.Body)
+	}
+	
+	delivery := deliveries.all()[0]
+	if delivery.Status != WebhookDeliveryDelivered || delivery.ResponseStatus != http.StatusOK ||
+		delivery.Attempts != 1 || delivery.DeliveredAt == nil || delivery.NextAttemptAt != nil {
+		t.Errorf("unexpected delivery %+v", delivery)
+	}
+}
+
+func TestWebhookDeliveryRetriesWithBackoff(t *testing.T) {
+	receiver := newWebhookReceiver(t, http.StatusInternalServerError, http.StatusServiceUnavailable)
+	ws, deliveries, clock := newTestWebhookService(receiver.Client())
+	hook := Webhook{UserID: 1, URL: receiver.URL, Events: EventImageUploaded}
+	if err := ws.Create(&hook); err != nil {
+		t.Fatal(err)
+	}
+	img := &Image{GalleryID: 3, Filename: "beach.jpg"}
+	if err := ws.Dispatch(1, EventImageUploaded, NewWebhookImage(img)); err != nil {
+		t.Fatal(err)
+	}
+	
+	deliver := func(expected int) WebhookDelivery {
+		t.Helper()
+		n, err := ws.DeliverDue(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != expected {
+			t.Fatalf("expected %d attempts, got %d", expected, n)
+		}
+		return deliveries.all()[0]
+	}
+	
+	delivery := deliver(1)
+	if delivery.Status != WebhookDeliveryPending || delivery.ResponseStatus != 500 || delivery.Error == "" {
+		t.Fatalf("unexpected delivery after a failure %+v", delivery)
+	}
+	if want := clock.t.Add(webhookBackoff); !delivery.NextAttemptAt.Equal(want) {
+		t.Fatalf("expected next attempt at %v, got %v", want, delivery.NextAttemptAt)
+	}
+	
+	// Nothing is due before the backoff has passed
+	clock.t = clock.t.Add(webhookBackoff - time.Second)
+	deliver(0)
+	
+	clock.t = clock.t.Add(time.Second)
+	delivery = deliver(1)
+	if delivery.Attempts != 2 || delivery.ResponseStatus != 503 {
+		t.Fatalf("unexpected delivery after the second failure %+v", delivery)
+	}
+	if want := clock.t.Add(2 * webhookBackoff); !delivery.NextAttemptAt.Equal(want) {
+		t.Fatalf("expected the backoff to double to %v, got %v", want, delivery.NextAttemptAt)
+	}
+	
+	clock.t = clock.t.Add(2 * webhookBackoff)
+	delivery = deliver(1)
+	if delivery.Status != WebhookDeliveryDelivered || delivery.Attempts != 3 || delivery.Error != "" {
+		t.Fatalf("expected the third attempt to succeed, got %+v", delivery)
+	}
+	if n := len(receiver.requests()); n != 3 {
+		t.Fatalf("expected 3 requests, got %d", n)
+	}
+}
+
+func TestWebhookDeliveryGivesUp(t *testing.T) {
+	statuses := make([]int, webhookMaxAttempts)
+	for i := range statuses {
+		statuses[i] = http.StatusBadGateway
+	}
+	receiver := newWebhookReceiver(t, statuses...)
+	ws, deliveries, clock := newTestWebhookService(receiver.Client())
+	hook := Webhook{UserID: 1, URL: receiver.URL, Events: EventGalleryDeleted}
+	if err := ws.Create(&hook); err != nil {
+		t.Fatal(err)
+	}
+	if err := ws.Dispatch(1, EventGalleryDeleted, WebhookGallery{ID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	
+	for i := 0; i < webhookMaxAttempts; i++ {
+		if _, err := ws.DeliverDue(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		clock.t = clock.t.Add(webhookMaxBackoff)
+	}
+	delivery := deliveries.all()[0]
+	if delivery.Status != WebhookDeliveryFailed || delivery.Attempts != webhookMaxAttempts || delivery.NextAttemptAt != nil {
+		t.Fatalf("expected the delivery to fail for good, got %+v", delivery)
+	}
+	if n, _ := ws.DeliverDue(context.Background()); n != 0 {
+		t.Fatalf("expected no more attempts, got %d", n)
+	}
+}
+
+func TestWebhookDeleteRemovesDeliveries(t *testing.T) {
+	ws, deliveries, _ := newTestWebhookService(http.DefaultClient)
+	hook := Webhook{UserID: 1, URL: "https://example.com/hook", Events: EventGalleryUpdated}
+	if err := ws.Create(&hook); err != nil {
+		t.Fatal(err)
+	}
+	if err := ws.Dispatch(1, EventGalleryUpdated, WebhookGallery{ID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ws.Delete(hook.ID); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(deliveries.all()); n != 0 {
+		t.Fatalf("expected deliveries to be removed, %d left", n)
+	}
+}
+
+func TestWebhookValidation(t *testing.T) {
+	ws, _, _ := newTestWebhookService(http.DefaultClient)
+	cases := []struct {
+		hook Webhook
+		err  error
+	}{
+		{Webhook{UserID: 1, URL: "example.com/hook", Events: EventGalleryCreated}, ErrWebhookURLInvalid},
+		{Webhook{UserID: 1, URL: "ftp://example.com/hook", Events: EventGalleryCreated}, ErrWebhookURLInvalid},
+		{Webhook{UserID: 1, URL: "http://10.0.0.1/hook", Events: EventGalleryCreated}, ErrWebhookURLPrivate},
+		{Webhook{UserID: 1, URL: "http://169.254.169.254/latest", Events: EventGalleryCreated}, ErrWebhookURLPrivate},
+		{Webhook{UserID: 1, URL: "http://[fd00::1]:8080/hook", Events: EventGalleryCreated}, ErrWebhookURLPrivate},
+		{Webhook{UserID: 1, URL: "http://0.0.0.0/hook", Events: EventGalleryCreated}, ErrWebhookURLPrivate},
+		{Webhook{UserID: 1, URL: "http://localhost./hook", Events: EventGalleryCreated}, ErrWebhookURLPrivate},
+		{Webhook{UserID: 1, URL: "https://example.com/hook"}, ErrEventsRequired},
+		{Webhook{UserID: 1, URL: "https://example.com/hook", Events: "gallery.renamed"}, ErrEventInvalid},
+		{Webhook{URL: "https://example.com/hook", Events: EventGalleryCreated}, ErrUserIDRequired},
+	}
+	for _, c := range cases {
+		if err := ws.Create(&c.hook); err != c.err {
+			t.Errorf("%+v: expected %v, got %v", c.hook, c.err, err)
+		}
+	}
+	
+	hook := Webhook{
+		UserID: 1,
+		URL:    " https://example.com/hook ",
+		Events: "image.deleted gallery.created image.deleted",
+	}
+	if err := ws.Create(&hook); err != nil {
+		t.Fatal(err)
+	}
+	if hook.URL != "https://example.com/hook" || hook.Events != "gallery.created image.deleted" {
+		t.Errorf("expected the webhook to be normalized, got %+v", hook)
+	}
+}
+
+// staleDueDB hands out the deliveries which were due when it was created,
+// like a worker which read them right before another one sent them
+type staleDueDB struct {
+	*memWebhookDeliveryDB
+	due []WebhookDelivery
+}
+
+func (db *staleDueDB) Due(t time.Time, limit int) ([]WebhookDelivery, error) {
+	return db.due, nil
+}
+
+func TestWebhookDeliveryIsSentOnce(t *testing.T) {
+	receiver := newWebhookReceiver(t)
+	ws, deliveries, clock := newTestWebhookService(receiver.Client())
+	hook := Webhook{UserID: 1, URL: receiver.URL, Events: EventGalleryCreated}
+	if err := ws.Create(&hook); err != nil {
+		t.Fatal(err)
+	}
+	if err := ws.Dispatch(1, EventGalleryCreated, WebhookGallery{ID: 7}); err != nil {
+		t.Fatal(err)
+	}
+	due, err := deliveries.Due(clock.Now(), webhookBatchSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := *ws
+	other.deliveries = &staleDueDB{memWebhookDeliveryDB: deliveries, due: due}
+	
+	if n, err := ws.DeliverDue(context.Background()); err != nil || n != 1 {
+		t.Fatalf("expected 1 delivery, got %d (%v)", n, err)
+	}
+	if n, err := other.DeliverDue(context.Background()); err != nil || n != 0 {
+		t.Fatalf("expected the delivery to be claimed already, got %d (%v)", n, err)
+	}
+	if requests := receiver.requests(); len(requests) != 1 {
+		t.Fatalf("expected the receiver to get 1 request, got %d", len(requests))
+	}
+}
+
+func TestWebhookIPAllowed(t *testing.T) {
+	cases := map[string]bool{
+		"93.184.216.34":    true,
+		"2606:4700::1111":  true,
+		"127.0.0.1":        false,
+		"::1":              false,
+		"10.1.2.3":         false,
+		"172.16.0.1":       false,
+		"192.168.1.1":      false,
+		"169.254.169.254":  false,
+		"fe80::1":          false,
+		"fd12:3456::1":     false,
+		"0.0.0.0":          false,
+		"::":               false,
+		"::ffff:127.0.0.1": false,
+		"100.64.0.1":       false,
+		"100.127.255.254":  false,
+		"100.128.0.1":      true,
+		"224.0.0.1":        false,
+		"239.255.255.250":  false,
+		"ff02::1":          false,
+		"ff0e::1":          false,
+	}
+	for addr, expected := range cases {
+		if allowed := webhookIPAllowed(net.ParseIP(addr)); allowed != expected {
+			t.Errorf("%s: expected allowed to be %t", addr, expected)
+		}
+	}
+}
+
+func TestWebhookClientRefusesLocalAddresses(t *testing.T) {
+	receiver := newWebhookReceiver(t)
+	
+	// The receiver listens on loopback, which is what a host name rebound
+	// to 127.0.0.1 after the webhook was saved would resolve to
+	_, err := newWebhookClient(webhookIPAllowed).Post(receiver.URL, "application/json", nil)
+	if err == nil || !strings.Contains(err.Error(), ErrWebhookURLPrivate.Error()) {
+		t.Fatalf("expected dialing loopback to be refused, got %v", err)
+	}
+	if len(receiver.requests()) != 0 {
+		t.Fatal("expected no request to reach the receiver")
+	}
+	
+	resp, err := newWebhookClient(allowLoopback).Post(receiver.URL, "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if len(receiver.requests()) != 1 {
+		t.Fatal("expected the request to reach the receiver")
+	}
+}
+
+func TestWebhookEventLogsRequestID(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := logging.New(&buf, logging.FormatJSON, "debug")
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := slog.Default()
+	slog.SetDefault(logger)
+	defer slog.SetDefault(previous)
+	
+	ws, _, _ := newTestWebhookService(http.DefaultClient)
+	ie := &imageEvents{
+		ImageService: NewImageService(),
+		gs:           &galleryService{GalleryDB: NewMemoryGalleryDB()},
+		ws:           ws,
+	}
+	ctx := logging.WithRequestID(context.Background(), "request-1")
+	ie.dispatch(ctx, &Image{GalleryID: 42, Filename: "a.jpg"}, EventImageDeleted)
+	
+	var record map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatal(err)
+	}
+	if record["request_id"] != "request-1" {
+		t.Fatalf("expected the log line of the missing gallery to have the request ID, got %v", record)
+	}
+}
+
+func TestWebhookRetryDelay(t *testing.T) {
+	if d := webhookRetryDelay(1); d != webhookBackoff {
+		t.Errorf("expected %v after the first attempt, got %v", webhookBackoff, d)
+	}
+	if d := webhookRetryDelay(3); d != 4*webhookBackoff {
+		t.Errorf("expected %v after the third attempt, got %v", 4*webhookBackoff, d)
+	}
+	if d := webhookRetryDelay(100); d != webhookMaxBackoff {
+		t.Errorf("expected the delay to be capped at %v, got %v", webhookMaxBackoff, d)
+	}
+}
+
+func TestWebhookDeliveryGormDue(t *testing.T) {
+	services := newTestServices(t)
+	alice := createTestUser(t, services.User, "alice")
+	hook := Webhook{UserID: alice.ID, URL: "https://example.com/hook", Events: EventGalleryCreated}
+	if err := services.Webhook.Create(&hook); err != nil {
+		t.Fatal(err)
+	}
+	
+	wdg := &webhookDeliveryGorm{services.DB()}
+	now := time.Now().UTC().Truncate(time.Second)
+	past, future := now.Add(-time.Minute), now.Add(time.Minute)
+	for _, delivery := range []WebhookDelivery{
+		{WebhookID: hook.ID, Event: EventGalleryCreated, Status: WebhookDeliveryPending, NextAttemptAt: &past},
+		{WebhookID: hook.ID, Event: EventGalleryCreated, Status: WebhookDeliveryPending, NextAttemptAt: &future},
+		{WebhookID: hook.ID, Event: EventGalleryCreated, Status: WebhookDeliveryDelivered, NextAttemptAt: &past},
+	} {
+		if err := wdg.Create(&delivery); err != nil {
+			t.Fatal(err)
+		}
+	}
+	
+	due, err := wdg.Due(now, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(due) != 1 || !due[0].NextAttemptAt.Equal(past) {
+		t.Fatalf("expected only the overdue pending delivery, got %+v", due)
+	}
+	deliveries, total, err := wdg.ByWebhookID(hook.ID, NewPagination(1, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 3 || len(deliveries) != 2 {
+		t.Fatalf("expected 2 of 3 deliveries, got %d of %d", len(deliveries), total)
+	}
+}
+
+func TestWebhookDeliveryGormClaim(t *testing.T) {
+	services := newTestServices(t)
+	alice := createTestUser(t, services.User, "alice")
+	hook := Webhook{UserID: alice.ID, URL: "https://example.com/hook", Events: EventGalleryCreated}
+	if err := services.Webhook.Create(&hook); err != nil {
+		t.Fatal(err)
+	}
+	
+	wdg := &webhookDeliveryGorm{services.DB()}
+	now := time.Now().UTC().Truncate(time.Second)
+	past := now.Add(-time.Minute)
+	delivery := WebhookDelivery{WebhookID: hook.ID, Event: EventGalleryCreated,
+		Status: WebhookDeliveryPending, NextAttemptAt: &past}
+	if err := wdg.Create(&delivery); err != nil {
+		t.Fatal(err)
+	}
+	
+	until := now.Add(webhookClaimTimeout)
+	for i, expected := range []bool{true, false} {
+		claimed, err := wdg.Claim(delivery.ID, now, until)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if claimed != expected {
+			t.Fatalf("claim %d: expected claimed to be %t", i+1, expected)
+		}
+	}
+	if due, _ := wdg.Due(now, 10); len(due) != 0 {
+		t.Fatalf("expected the claimed delivery not to be due, got %+v", due)
+	}
+	// A worker which stopped midway leaves the delivery to the others
+	if claimed, err := wdg.Claim(delivery.ID, until, until.Add(webhookClaimTimeout)); err != nil || !claimed {
+		t.Fatalf("expected the expired claim to be taken over, got %t (%v)", claimed, err)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"gallerio/configs"
+	"gallerio/models"
+)
+
+const roleUsage = `usage: gallerio role <email or username> <role>
+
+Gives an existing user a role: user, moderator or admin. Meant to make the
+first admin, every other role change can be made from the admin panel.`
+
+// runRole implements "gallerio role"
+func runRole(cfg configs.Config, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf(roleUsage)
+	}
+	
+	dbCfg := cfg.Database
+	keys := models.Keys{Peppers: cfg.Peppers(), HMACKeys: cfg.HMACKeys()}
+	services, err := models.NewServices(
+		models.WithGorm(dbCfg.Dialect(), dbCfg.ConnectionInfo()),
+		models.WithLogMode(false),
+		models.WithUser(keys, nil),
+		models.WithAuditLog(),
+	)
+	if err != nil {
+		return err
+	}
+	defer services.Close()
+	
+	user, err := services.User.ByLogin(args[0])
+	if err != nil {
+		return err
+	}
+	previous := user.Role
+	user.Role = args[1]
+	if err := services.User.Update(user); err != nil {
+		return err
+	}
+	services.AuditLog.Record(user.ID, models.AuditAdminRoleChanged,
+		fmt.Sprintf("role changed from %s to %s from the command line", previous, user.Role))
+	fmt.Printf("%s is now %s\n", user.Email, user.Role)
+	return nil
+}
@@ -1,55 +1,242 @@
 package tests
 
-// func testingUserService() (models.UserService, error) {
-// 	const (
-// 		dbHost = "localhost"
-// 		dbPort = 5432
-// 		dbUser = "robert"
-// 		dbPassword = "password"
-// 		dbName = "gallerio_test"
-// 	)
-// 	psqlInfo := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable",
-// 		dbHost, dbPort, dbUser, dbPassword, dbName,
-// 	)
-//
-// 	services, err := models.NewServices(psqlInfo)
-// 	if err != nil {
-// 		return nil, err
-// 	}
-// 	// services.DB.LogMode(false)
-// 	services.DestructiveReset()
-// 	return services.User, nil
-// }
-
-// func TestCreateUser(t *testing.T) {
-// 	us, err := testingUserService()
-// 	if err != nil {
-// 		t.Fatal(err)
-// 	}
-//
-// 	user := models.User{
-// 		Name: "Amanur Rahman",
-// 		Email: "aaman007.liilab@gmail.com",
-// 	}
-// 	err = us.Create(&user)
-// 	if err != nil {
-// 		t.Fatal(err)
-// 	}
-//
-// 	if user.ID <= 0 {
-// 		t.Errorf("Expected ID to be > 0; Received %d", user.ID)
-// 	}
-// 	if time.Since(user.CreatedAt) > 5 * time.Second {
-// 		// Fatalf will terminate, so we are using Errorf
-// 		t.Errorf("Expected CreatedAt to be recent; Received %s", user.CreatedAt)
-// 	}
-// 	if time.Since(user.UpdatedAt) > 5 * time.Second {
-// 		t.Errorf("Expected UpdatedAt to be recent; Received %s", user.UpdatedAt)
-// 	}
-// }
-
-// go test go-web-dev-2/tests/
-// test file name should start with what we are testing followed by _test.go
-// eg, accounts_test.go, order_test.go etc
-//
-// Function name also needs to in specific format
\ No newline at end of file
+import (
+	"gallerio/models"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var resetTokenRegexp = regexp.MustCompile(`token=([^\s&"]+)`)
+
+func TestSignUp(t *testing.T) {
+	app := newTestApp(t)
+	c := app.newClient(t)
+	
+	user := c.signUp("alice")
+	if user.Email != "alice@example.com" {
+		t.Errorf("expected the email to be stored, got %q", user.Email)
+	}
+	if resp := c.get("/account"); resp.Path != "/account" || !strings.Contains(resp.Body, "alice") {
+		t.Fatalf("expected to be signed in after signing up, ended up at %s", resp.Path)
+	}
+	
+	// The username is taken now
+	other := app.newClient(t)
+	resp := other.post("/signup", "/signup", url.Values{
+		"username": {"Alice"},
+		"email":    {"someone@example.com"},
+		"password": {testPassword},
+	})
+	if resp.Path != "/signup" || !strings.Contains(resp.Body, "Username is taken") {
+		t.Fatalf("expected the sign up form with an error, got %s", resp.Path)
+	}
+}
+
+func TestSignInAndOut(t *testing.T) {
+	app := newTestApp(t)
+	c := app.newClient(t)
+	c.signUp("alice")
+	c.signOut()
+	
+	if resp := c.get("/account"); resp.Path != "/signin" {
+		t.Fatalf("expected to be sent to sign in after signing out, ended up at %s", resp.Path)
+	}
+	resp := c.signIn("alice", "not the password")
+	if resp.Path != "/signin" || c.get("/account").Path != "/signin" {
+		t.Fatal("expected signing in with the wrong password to fail")
+	}
+	c.signIn("alice@example.com", testPassword)
+	if resp := c.get("/account"); resp.Path != "/account" {
+		t.Fatalf("expected to be signed in, ended up at %s", resp.Path)
+	}
+}
+
+func TestPasswordReset(t *testing.T) {
+	app := newTestApp(t)
+	c := app.newClient(t)
+	c.signUp("alice")
+	c.signOut()
+	
+	// Unknown addresses get the same response without an email
+	unknown := c.post("/forgot", "/forgot", url.Values{"email": {"nobody@example.com"}})
+	known := c.post("/forgot", "/forgot", url.Values{"email": {"alice@example.com"}})
+	for _, resp := range []*testResponse{unknown, known} {
+		if resp.Path != "/reset" || !strings.Contains(resp.Body, "If an account exists") {
+			t.Fatalf("expected the same response for every address, ended up at %s", resp.Path)
+		}
+	}
+	var token string
+	for _, msg := range app.waitForEmails(t, "alice@example.com", 2) {
+		if match := resetTokenRegexp.FindStringSubmatch(msg.Text); match != nil {
+			token, _ = url.QueryUnescape(match[1])
+		}
+	}
+	if token == "" {
+		t.Fatal("expected a password reset email")
+	}
+	if msgs := app.Emails.Messages("nobody@example.com"); len(msgs) != 0 {
+		t.Fatalf("expected no email for an unknown address, got %d", len(msgs))
+	}
+	
+	resp := c.post("/reset?token="+url.QueryEscape(token), "/reset", url.Values{
+		"token":    {token},
+		"password": {"a brand new password"},
+	})
+	if resp.Path != "/galleries" {
+		t.Fatalf("expected to be signed in after resetting, ended up at %s", resp.Path)
+	}
+	c.signOut()
+	
+	if resp := c.signIn("alice", testPassword); resp.Path != "/signin" {
+		t.Fatal("expected the old password to stop working")
+	}
+	c.signIn("alice", "a brand new password")
+	if resp := c.get("/account"); resp.Path != "/account" {
+		t.Fatalf("expected to sign in with the new password, ended up at %s", resp.Path)
+	}
+	
+	// Tokens only work once
+	c.signOut()
+	resp = c.post("/reset", "/reset", url.Values{
+		"token":    {token},
+		"password": {"yet another password"},
+	})
+	if resp.Path != "/reset" || !strings.Contains(resp.Body, "Token is invalid") {
+		t.Fatal("expected the used token to be rejected")
+	}
+}
+
+func TestDeletionRevokesAPITokens(t *testing.T) {
+	app := newTestApp(t)
+	c := app.newClient(t)
+	alice := c.signUp("alice")
+	token := models.APIToken{UserID: alice.ID, Name: "cms", Scopes: models.ScopeGalleriesRead}
+	if err := app.Services.APIToken.Create(&token); err != nil {
+		t.Fatal(err)
+	}
+	listGalleries := func() int {
+		req, err := http.NewRequest("GET", app.URL+"/api/v1/galleries", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token.Token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := listGalleries(); status != http.StatusOK {
+		t.Fatalf("expected the token to work, got status %d", status)
+	}
+	
+	c.post("/account", "/account/delete", url.Values{"password": {testPassword}})
+	if status := listGalleries(); status != http.StatusUnauthorized {
+		t.Fatalf("expected the token to be revoked, got status %d", status)
+	}
+}
+
+func TestPasswordResetCancelsDeletion(t *testing.T) {
+	app := newTestApp(t)
+	c := app.newClient(t)
+	c.signUp("alice")
+	resp := c.post("/account", "/account/delete", url.Values{"password": {testPassword}})
+	if !strings.Contains(resp.Body, "will be deleted") {
+		t.Fatal("expected the account to be scheduled for deletion")
+	}
+	
+	c.post("/forgot", "/forgot", url.Values{"email": {"alice@example.com"}})
+	var token string
+	for _, msg := range app.waitForEmails(t, "alice@example.com", 2) {
+		if match := resetTokenRegexp.FindStringSubmatch(msg.Text); match != nil {
+			token, _ = url.QueryUnescape(match[1])
+		}
+	}
+	resp = c.post("/reset?token="+url.QueryEscape(token), "/reset", url.Values{
+		"token":    {token},
+		"password": {"a brand new password"},
+	})
+	if resp.Path != "/galleries" || !strings.Contains(resp.Body, "no longer scheduled for deletion") {
+		t.Fatalf("expected to be told the deletion was cancelled, ended up at %s", resp.Path)
+	}
+	user, err := app.Services.User.ByUsername("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.DeleteAfter != nil {
+		t.Fatalf("expected the deletion to be cancelled, still due %s", user.DeleteAfter)
+	}
+}
+
+func TestCSRFProtection(t *testing.T) {
+	app := newTestApp(t)
+	c := app.newClient(t)
+	c.signUp("alice")
+	
+	resp := c.postWithoutToken("/galleries", url.Values{"title": {"Forged"}})
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected a post without a CSRF token to be forbidden, got %d", resp.StatusCode)
+	}
+	
+	// A token from another session doesn't count either
+	token := app.newClient(t).csrfToken("/signin")
+	resp = c.postWithoutToken("/galleries", url.Values{
+		"title":              {"Forged"},
+		"gorilla.csrf.Token": {token},
+	})
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected a post with another session's token to be forbidden, got %d", resp.StatusCode)
+	}
+	user, _ := app.Services.User.ByUsername("alice")
+	if galleries, _ := app.Services.Gallery.ByUserID(user.ID); len(galleries) != 0 {
+		t.Fatalf("expected no gallery to be created, got %d", len(galleries))
+	}
+}
+
+func TestCSRFKeySurvivesRestart(t *testing.T) {
+	before := newTestApp(t)
+	c := before.newClient(t)
+	token := c.csrfToken("/signin")
+	
+	// Another instance with the same key accepts the form
+	after := newTestApp(t)
+	c.app = after
+	resp := c.postWithoutToken("/signin", url.Values{
+		"login":              {"alice"},
+		"password":           {testPassword},
+		"gorilla.csrf.Token": {token},
+	})
+	if resp.StatusCode == http.StatusForbidden {
+		t.Fatal("expected the form to be accepted after a restart")
+	}
+}
+
+func TestSignInRateLimit(t *testing.T) {
+	app := newTestApp(t)
+	c := app.newClient(t)
+	c.signUp("alice")
+	c.signOut()
+	
+	for i := 0; i < 5; i++ {
+		if resp := c.signIn("alice", "not the password"); resp.StatusCode != http.StatusOK {
+			t.Fatalf("attempt %d: expected status 200, got %d", i+1, resp.StatusCode)
+		}
+	}
+	resp := c.signIn("alice", testPassword)
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected status 429 once locked out, got %d", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		t.Errorf("expected the page to be sent as HTML, got %q", ct)
+	}
+	if resp.Header.Get("Retry-After") == "" {
+		t.Error("expected a Retry-After header")
+	}
+	if !strings.Contains(resp.Body, "Too many attempts") {
+		t.Error("expected the page to explain the lockout")
+	}
+}
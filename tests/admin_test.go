@@ -0,0 +1,39 @@
+package tests
+
+import (
+	"gallerio/models"
+	"strings"
+	"testing"
+)
+
+func TestAuditLogIsAdminOnly(t *testing.T) {
+	app := newTestApp(t)
+	c := app.newClient(t)
+	alice := c.signUp("alice")
+	alice.Role = models.RoleModerator
+	if err := app.Services.User.Update(alice); err != nil {
+		t.Fatal(err)
+	}
+	
+	resp := c.get("/admin/users")
+	if resp.StatusCode != 200 {
+		t.Fatalf("expected moderators to see the users, got status %d", resp.StatusCode)
+	}
+	if strings.Contains(resp.Body, `href="/admin/audit"`) {
+		t.Error("expected the audit log to be hidden from moderators")
+	}
+	if resp := c.get("/admin/audit"); resp.StatusCode != 404 {
+		t.Fatalf("expected moderators to be refused the audit log, got status %d", resp.StatusCode)
+	}
+	
+	alice.Role = models.RoleAdmin
+	if err := app.Services.User.Update(alice); err != nil {
+		t.Fatal(err)
+	}
+	if resp := c.get("/admin/galleries"); !strings.Contains(resp.Body, `href="/admin/audit"`) {
+		t.Error("expected admins to be linked to the audit log")
+	}
+	if resp := c.get("/admin/audit"); resp.StatusCode != 200 {
+		t.Fatalf("expected admins to see the audit log, got status %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,147 @@
+package tests
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"gallerio/models"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGalleryCRUD(t *testing.T) {
+	app := newTestApp(t)
+	c := app.newClient(t)
+	alice := c.signUp("alice")
+	
+	resp := c.post("/galleries/new", "/galleries", url.Values{"title": {"Summer Trip"}})
+	galleries, _ := app.Services.Gallery.ByUserID(alice.ID)
+	if len(galleries) != 1 {
+		t.Fatalf("expected 1 gallery, got %d", len(galleries))
+	}
+	gallery := galleries[0]
+	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	if resp.Path != editPath {
+		t.Fatalf("expected to be sent to %s, ended up at %s", editPath, resp.Path)
+	}
+	if resp := c.post("/galleries/new", "/galleries", url.Values{"title": {""}}); !strings.Contains(resp.Body, "Title is required") {
+		t.Fatal("expected a gallery without a title to be rejected")
+	}
+	
+	if resp := c.get("/galleries"); !strings.Contains(resp.Body, "Summer Trip") {
+		t.Fatal("expected the gallery to be listed")
+	}
+	c.post(editPath, fmt.Sprintf("/galleries/%d/update", gallery.ID), url.Values{"title": {"Winter Trip"}})
+	if resp := c.get(fmt.Sprintf("/galleries/%d", gallery.ID)); !strings.Contains(resp.Body, "Winter Trip") {
+		t.Fatal("expected the gallery to be renamed")
+	}
+	
+	// Other users can look at the gallery but not change it
+	bob := app.newClient(t)
+	bob.signUp("bob")
+	if resp := bob.get(fmt.Sprintf("/galleries/%d", gallery.ID)); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected anyone to see the gallery, got %d", resp.StatusCode)
+	}
+	if resp := bob.get(editPath); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected another user's edit page to be not found, got %d", resp.StatusCode)
+	}
+	resp = bob.post("/galleries/new", fmt.Sprintf("/galleries/%d/delete", gallery.ID), nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected deleting another user's gallery to fail, got %d", resp.StatusCode)
+	}
+	
+	resp = c.post(editPath, fmt.Sprintf("/galleries/%d/delete", gallery.ID), nil)
+	if resp.Path != "/galleries" {
+		t.Fatalf("expected to be sent to /galleries, ended up at %s", resp.Path)
+	}
+	if resp := c.get(fmt.Sprintf("/galleries/%d", gallery.ID)); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected the deleted gallery to be not found, got %d", resp.StatusCode)
+	}
+}
+
+func TestShareLinkViewedIsThrottled(t *testing.T) {
+	app := newTestApp(t)
+	c := app.newClient(t)
+	alice := c.signUp("alice")
+	c.post("/galleries/new", "/galleries", url.Values{"title": {"Summer Trip"}})
+	galleries, _ := app.Services.Gallery.ByUserID(alice.ID)
+	if len(galleries) != 1 {
+		t.Fatalf("expected 1 gallery, got %d", len(galleries))
+	}
+	hook := models.Webhook{UserID: alice.ID, URL: "https://example.com/hook", Events: models.EventShareLinkViewed}
+	if err := app.Services.Webhook.Create(&hook); err != nil {
+		t.Fatal(err)
+	}
+	
+	showPath := fmt.Sprintf("/galleries/%d", galleries[0].ID)
+	c.get(showPath)
+	anonymous := app.newClient(t)
+	for i := 0; i < 3; i++ {
+		anonymous.get(showPath)
+	}
+	bob := app.newClient(t)
+	bob.signUp("bob")
+	bob.get(showPath)
+	bob.get(showPath)
+	
+	// Only the first view of the anonymous visitor and of bob are sent
+	_, total, err := app.Services.Webhook.Deliveries(hook.ID, models.NewPagination(1, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 2 {
+		t.Fatalf("expected 2 deliveries, got %d", total)
+	}
+}
+
+func TestImageUpload(t *testing.T) {
+	app := newTestApp(t)
+	c := app.newClient(t)
+	alice := c.signUp("alice")
+	c.post("/galleries/new", "/galleries", url.Values{"title": {"Summer Trip"}})
+	galleries, _ := app.Services.Gallery.ByUserID(alice.ID)
+	if len(galleries) != 1 {
+		t.Fatalf("expected 1 gallery, got %d", len(galleries))
+	}
+	id := galleries[0].ID
+	editPath := fmt.Sprintf("/galleries/%d/edit", id)
+	
+	resp := c.upload(editPath, fmt.Sprintf("/galleries/%d/images", id), "images", map[string][]byte{
+		"beach.jpg":  []byte("not really a jpeg"),
+		"sunset.png": []byte("not really a png"),
+	})
+	if resp.Path != editPath {
+		t.Fatalf("expected to be sent back to %s, ended up at %s", editPath, resp.Path)
+	}
+	stored, err := ioutil.ReadFile(filepath.Join(app.Dir, "media", "galleries", fmt.Sprint(id), "beach.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(stored) != "not really a jpeg" {
+		t.Fatalf("expected the uploaded content, got %q", stored)
+	}
+	images, _ := app.Services.Image.ByGalleryID(id)
+	if len(images) != 2 {
+		t.Fatalf("expected 2 images, got %d", len(images))
+	}
+	if resp := c.get(fmt.Sprintf("/galleries/%d", id)); !strings.Contains(resp.Body, "sunset.png") {
+		t.Fatal("expected the gallery to show the image")
+	}
+	
+	// Only the owner can upload
+	bob := app.newClient(t)
+	bob.signUp("bob")
+	resp = bob.upload("/galleries/new", fmt.Sprintf("/galleries/%d/images", id), "images", map[string][]byte{
+		"intruder.jpg": []byte("nope"),
+	})
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected uploading to another user's gallery to fail, got %d", resp.StatusCode)
+	}
+	
+	c.post(editPath, fmt.Sprintf("/galleries/%d/images/beach.jpg/delete", id), nil)
+	if images, _ := app.Services.Image.ByGalleryID(id); len(images) != 1 {
+		t.Fatalf("expected 1 image after deleting one, got %d", len(images))
+	}
+}
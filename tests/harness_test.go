@@ -0,0 +1,283 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"gallerio/app"
+	"gallerio/configs"
+	"gallerio/migrations"
+	"gallerio/models"
+	"gallerio/utils/email"
+	"gallerio/utils/jobs"
+	"golang.org/x/crypto/bcrypt"
+	"html"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testPassword = "correct horse battery staple"
+	testCSRFKey  = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+)
+
+// repoRoot is captured before any test changes the working directory
+var repoRoot, _ = filepath.Abs("..")
+
+var csrfFieldRegexp = regexp.MustCompile(`name="gorilla\.csrf\.Token" value="([^"]+)"`)
+
+// testApp is the full router served by an httptest.Server. Users,
+// galleries, oauth connections and password resets live in memory, the
+// other services use an in-memory SQLite database and sent emails are kept
+// in Emails.
+type testApp struct {
+	*httptest.Server
+	Services *models.Services
+	Emails   *email.Recorder
+	// Dir is the working directory of the app, uploaded images end up in
+	// its media directory
+	Dir string
+}
+
+func newTestApp(t *testing.T) *testApp {
+	t.Helper()
+	root := repoRoot
+	dir, err := os.MkdirTemp("", "gallerio-tests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Templates are loaded relative to the working directory
+	if err := os.Symlink(filepath.Join(root, "views"), filepath.Join(dir, "views")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.Chdir(filepath.Join(root, "tests"))
+		os.RemoveAll(dir)
+	})
+	
+	cfg := configs.DefaultConfig()
+	cfg.CSRFKey = testCSRFKey
+	// Serve the metrics from the router, to admins
+	cfg.Metrics.Port = 0
+	keys := models.Keys{
+		Peppers:    []string{"test-pepper"},
+		HMACKeys:   []string{"test-hmac-key"},
+		BcryptCost: bcrypt.MinCost,
+	}
+	services, err := models.NewServices(
+		models.WithGorm(models.DialectSQLite, ":memory:"),
+		models.WithLogMode(false),
+		models.WithMemoryUser(keys, models.NewPasswordPolicy(models.MinLength(8))),
+		models.WithMemoryGallery(),
+		models.WithImage(),
+		models.WithWebhook(),
+		models.WithMemoryOAuth(),
+		models.WithRateLimitStore(cfg.RateLimit.Store),
+		models.WithAuditLog(),
+		models.WithAccountDeletion(cfg.DeletionGracePeriod()),
+		models.WithDataExport(keys),
+		models.WithInvitation(keys),
+		models.WithRegistration(cfg.Registration.Mode, cfg.Registration.AllowedDomains,
+			cfg.Registration.AdminInvitesOnly),
+		models.WithAPIToken(keys),
+		models.WithMetrics(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { services.Close() })
+	if _, err := migrations.New(services.DB()).Up(); err != nil {
+		t.Fatal(err)
+	}
+	
+	emails := &email.Recorder{}
+	runner := jobs.NewRunner()
+	t.Cleanup(func() { runner.Stop(context.Background()) })
+	
+	handler := app.NewRouter(cfg, services, email.NewClient(email.WithTransport(emails)), runner, nil)
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return &testApp{
+		Server:   server,
+		Services: services,
+		Emails:   emails,
+		Dir:      dir,
+	}
+}
+
+// waitForEmails returns the messages sent to the address once there are at
+// least n of them. Most emails are sent in the background.
+func (a *testApp) waitForEmails(t *testing.T, to string, n int) []email.Message {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		messages := a.Emails.Messages(to)
+		if len(messages) >= n {
+			return messages
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d email(s) to %s, got %d", n, to, len(messages))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// testClient is a browser session, it keeps cookies and follows redirects
+type testClient struct {
+	t      *testing.T
+	app    *testApp
+	client *http.Client
+}
+
+func (a *testApp) newClient(t *testing.T) *testClient {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testClient{
+		t:      t,
+		app:    a,
+		client: &http.Client{Jar: jar},
+	}
+}
+
+// testResponse is a response with its body read. Path is where the
+// redirects ended.
+type testResponse struct {
+	StatusCode int
+	Path       string
+	Header     http.Header
+	Body       string
+}
+
+func (c *testClient) do(req *http.Request) *testResponse {
+	c.t.Helper()
+	resp, err := c.client.Do(req)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return &testResponse{
+		StatusCode: resp.StatusCode,
+		Path:       resp.Request.URL.Path,
+		Header:     resp.Header,
+		Body:       string(body),
+	}
+}
+
+func (c *testClient) get(path string) *testResponse {
+	c.t.Helper()
+	req, err := http.NewRequest(http.MethodGet, c.app.URL+path, nil)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return c.do(req)
+}
+
+// csrfToken loads the page and returns the CSRF token of its forms
+func (c *testClient) csrfToken(page string) string {
+	c.t.Helper()
+	resp := c.get(page)
+	match := csrfFieldRegexp.FindStringSubmatch(resp.Body)
+	if match == nil {
+		c.t.Fatalf("GET %s: no CSRF token in the page", page)
+	}
+	return html.UnescapeString(match[1])
+}
+
+// post submits the form the way a browser would after loading page
+func (c *testClient) post(page, path string, values url.Values) *testResponse {
+	c.t.Helper()
+	if values == nil {
+		values = url.Values{}
+	}
+	values.Set("gorilla.csrf.Token", c.csrfToken(page))
+	return c.postWithoutToken(path, values)
+}
+
+func (c *testClient) postWithoutToken(path string, values url.Values) *testResponse {
+	c.t.Helper()
+	req, err := http.NewRequest(http.MethodPost, c.app.URL+path, strings.NewReader(values.Encode()))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return c.do(req)
+}
+
+// upload submits files as the multipart field of a form on page
+func (c *testClient) upload(page, path, field string, files map[string][]byte) *testResponse {
+	c.t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	if err := mw.WriteField("gorilla.csrf.Token", c.csrfToken(page)); err != nil {
+		c.t.Fatal(err)
+	}
+	for filename, content := range files {
+		fw, err := mw.CreateFormFile(field, filename)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		fw.Write(content)
+	}
+	if err := mw.Close(); err != nil {
+		c.t.Fatal(err)
+	}
+	req, err := http.NewRequest(http.MethodPost, c.app.URL+path, &body)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return c.do(req)
+}
+
+// signUp creates an account and leaves the client signed in to it
+func (c *testClient) signUp(username string) *models.User {
+	c.t.Helper()
+	resp := c.post("/signup", "/signup", url.Values{
+		"name":     {"Test User"},
+		"username": {username},
+		"email":    {username + "@example.com"},
+		"password": {testPassword},
+	})
+	if resp.StatusCode != http.StatusOK {
+		c.t.Fatalf("sign up: expected status 200, got %d", resp.StatusCode)
+	}
+	user, err := c.app.Services.User.ByUsername(username)
+	if err != nil {
+		c.t.Fatalf("sign up: %v", err)
+	}
+	return user
+}
+
+func (c *testClient) signIn(login, password string) *testResponse {
+	c.t.Helper()
+	return c.post("/signin", "/signin", url.Values{
+		"login":    {login},
+		"password": {password},
+	})
+}
+
+func (c *testClient) signOut() {
+	c.t.Helper()
+	resp := c.post("/", "/signout", nil)
+	if resp.StatusCode != http.StatusOK {
+		c.t.Fatalf("sign out: expected status 200, got %d", resp.StatusCode)
+	}
+}
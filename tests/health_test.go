@@ -0,0 +1,69 @@
+package tests
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestHealthz(t *testing.T) {
+	app := newTestApp(t)
+	c := app.newClient(t)
+
+	resp := c.get("/healthz")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", resp.StatusCode)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	app := newTestApp(t)
+	c := app.newClient(t)
+
+	resp := c.get("/readyz")
+	var ready struct {
+		Status string
+		Checks map[string]string
+	}
+	if err := json.Unmarshal([]byte(resp.Body), &ready); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || ready.Status != "ok" {
+		t.Fatalf("expected to be ready, got status %d and %+v", resp.StatusCode, ready)
+	}
+	for _, check := range []string{"database", "media", "email"} {
+		if ready.Checks[check] != "ok" {
+			t.Errorf("expected the %s check to pass, got %q", check, ready.Checks[check])
+		}
+	}
+
+	app.Services.Close()
+	resp = c.get("/readyz")
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected status 503 without a database, got %d", resp.StatusCode)
+	}
+	// The cause is logged, the probe is public
+	if err := json.Unmarshal([]byte(resp.Body), &ready); err != nil {
+		t.Fatal(err)
+	}
+	if ready.Checks["database"] != "failed" {
+		t.Errorf("expected the database check to report only its failure, got %q", ready.Checks["database"])
+	}
+}
+
+func TestVersion(t *testing.T) {
+	app := newTestApp(t)
+	c := app.newClient(t)
+
+	resp := c.get("/version")
+	var version struct {
+		Version string
+		Commit  string
+	}
+	if err := json.Unmarshal([]byte(resp.Body), &version); err != nil {
+		t.Fatal(err)
+	}
+	if version.Version != "dev" || version.Commit == "" {
+		t.Fatalf("expected the version of a development build, got %+v", version)
+	}
+}
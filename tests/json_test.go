@@ -0,0 +1,74 @@
+package tests
+
+import (
+	"encoding/json"
+	"fmt"
+	"gallerio/models"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// getJSON loads the page as JSON and returns its content
+func (c *testClient) getJSON(path string) interface{} {
+	c.t.Helper()
+	req, err := http.NewRequest(http.MethodGet, c.app.URL+path, nil)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	req.Header.Set("Accept", "application/json")
+	resp := c.do(req)
+	if resp.StatusCode != 200 {
+		c.t.Fatalf("GET %s: expected status 200, got %d", path, resp.StatusCode)
+	}
+	var page struct {
+		Content interface{} `json:"content"`
+	}
+	if err := json.Unmarshal([]byte(resp.Body), &page); err != nil {
+		c.t.Fatalf("GET %s: invalid JSON: %v", path, err)
+	}
+	return page.Content
+}
+
+func keys(v interface{}) string {
+	obj, _ := v.(map[string]interface{})
+	var keys []string
+	for key := range obj {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, " ")
+}
+
+func TestJSONPagesOnlyExposePublicFields(t *testing.T) {
+	app := newTestApp(t)
+	c := app.newClient(t)
+	alice := c.signUp("alice")
+	c.post("/galleries/new", "/galleries", url.Values{"title": {"Summer Trip"}})
+	galleries, _ := app.Services.Gallery.ByUserID(alice.ID)
+	if len(galleries) != 1 {
+		t.Fatalf("expected 1 gallery, got %d", len(galleries))
+	}
+	hook := models.Webhook{UserID: alice.ID, URL: "https://example.com/hook", Events: models.EventGalleryCreated}
+	if err := app.Services.Webhook.Create(&hook); err != nil {
+		t.Fatal(err)
+	}
+	
+	if got, want := keys(c.getJSON("/account")), "created_at email id name role username"; got != want {
+		t.Errorf("account: expected %q, got %q", want, got)
+	}
+	gallery := c.getJSON(fmt.Sprintf("/galleries/%d", galleries[0].ID))
+	if got, want := keys(gallery), "created_at id images title updated_at"; got != want {
+		t.Errorf("gallery: expected %q, got %q", want, got)
+	}
+	webhooks := c.getJSON("/account/webhooks").(map[string]interface{})["webhooks"].([]interface{})
+	if got, want := keys(webhooks[0]), "created_at events id url"; got != want {
+		t.Errorf("webhooks: expected %q, got %q", want, got)
+	}
+	show := c.getJSON(fmt.Sprintf("/account/webhooks/%d", hook.ID)).(map[string]interface{})
+	if secret := show["webhook"].(map[string]interface{})["secret"]; secret != hook.Secret {
+		t.Errorf("expected the webhook page to show the secret, got %v", secret)
+	}
+}
@@ -0,0 +1,111 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"gallerio/utils/logging"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// lockedBuffer is written to by the server's goroutines while the test
+// reads it
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// records decodes the JSON log lines
+func (b *lockedBuffer) records(t *testing.T) []map[string]interface{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var records []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(b.buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var record map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("log line %q isn't JSON: %v", line, err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func captureLogs(t *testing.T) *lockedBuffer {
+	var buf lockedBuffer
+	logger, err := logging.New(&buf, logging.FormatJSON, "debug")
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := slog.Default()
+	slog.SetDefault(logger)
+	t.Cleanup(func() {
+		slog.SetDefault(previous)
+	})
+	return &buf
+}
+
+func TestRequestLogging(t *testing.T) {
+	app := newTestApp(t)
+	logs := captureLogs(t)
+	c := app.newClient(t)
+	user := c.signUp("alice")
+	
+	resp := c.get("/account")
+	requestID := resp.Header.Get("X-Request-ID")
+	if requestID == "" {
+		t.Fatal("expected the response to carry a request ID")
+	}
+	
+	var found map[string]interface{}
+	for _, record := range logs.records(t) {
+		if record["msg"] == "request" && record["request_id"] == requestID {
+			found = record
+		}
+	}
+	if found == nil {
+		t.Fatalf("expected an access log line with request ID %s", requestID)
+	}
+	expected := map[string]string{
+		"method":  "GET",
+		"path":    "/account",
+		"status":  "200",
+		"user_id": fmt.Sprint(user.ID),
+	}
+	for key, value := range expected {
+		if got := fmt.Sprint(found[key]); got != value {
+			t.Errorf("expected %s to be %s, got %s", key, value, got)
+		}
+	}
+	if _, ok := found["bytes"]; !ok {
+		t.Error("expected the access log to record the size of the body")
+	}
+	if _, ok := found["latency"]; !ok {
+		t.Error("expected the access log to record the latency")
+	}
+}
+
+func TestRequestIDsAreUnique(t *testing.T) {
+	app := newTestApp(t)
+	c := app.newClient(t)
+	
+	seen := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		id := c.get("/").Header.Get("X-Request-ID")
+		if id == "" || seen[id] {
+			t.Fatalf("expected a new request ID, got %q", id)
+		}
+		seen[id] = true
+	}
+}
@@ -0,0 +1,59 @@
+package tests
+
+import (
+	"fmt"
+	"gallerio/models"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	app := newTestApp(t)
+	c := app.newClient(t)
+	alice := c.signUp("alice")
+	c.post("/galleries/new", "/galleries", url.Values{"title": {"Summer Trip"}})
+	galleries, _ := app.Services.Gallery.ByUserID(alice.ID)
+	if len(galleries) != 1 {
+		t.Fatalf("expected 1 gallery, got %d", len(galleries))
+	}
+	id := galleries[0].ID
+	c.upload(fmt.Sprintf("/galleries/%d/edit", id), fmt.Sprintf("/galleries/%d/images", id), "images",
+		map[string][]byte{"beach.jpg": []byte("not really a jpeg")})
+	c.get(fmt.Sprintf("/galleries/%d", id))
+	
+	// The site's port is public, only admins may read the metrics there
+	if resp := c.get("/metrics"); resp.StatusCode != 404 {
+		t.Fatalf("expected the metrics to be hidden from users, got status %d", resp.StatusCode)
+	}
+	anonymous := app.newClient(t)
+	if resp := anonymous.get("/metrics"); resp.Path != "/signin" {
+		t.Fatalf("expected to be sent to /signin, ended up at %s", resp.Path)
+	}
+	alice.Role = models.RoleAdmin
+	if err := app.Services.User.Update(alice); err != nil {
+		t.Fatal(err)
+	}
+	
+	// Metrics are shared by every app of the tests, so only their presence
+	// can be checked
+	resp := c.get("/metrics")
+	if resp.StatusCode != 200 {
+		t.Fatalf("expected the metrics, got status %d", resp.StatusCode)
+	}
+	expected := []string{
+		`gallerio_http_requests_total{route="show_gallery",method="GET",status="200"}`,
+		`gallerio_http_request_duration_seconds_bucket{route="/signup",method="POST",le="+Inf"}`,
+		`gallerio_db_query_duration_seconds_count{operation="create"}`,
+		`gallerio_uploads_total{result="success"}`,
+		`gallerio_upload_bytes_total`,
+		`gallerio_image_processing_duration_seconds_count`,
+		`gallerio_emails_total{result="success"}`,
+		`gallerio_active_sessions`,
+	}
+	for _, line := range expected {
+		if !strings.Contains(resp.Body, "\n"+line+" ") {
+			t.Errorf("expected the metrics to include %s", line)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package tests
+
+import (
+	"html"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var nonceRegexp = regexp.MustCompile(`<script nonce="([^"]+)"`)
+
+func TestSecurityHeaders(t *testing.T) {
+	app := newTestApp(t)
+	c := app.newClient(t)
+	
+	resp := c.get("/")
+	csp := resp.Header.Get("Content-Security-Policy")
+	match := nonceRegexp.FindStringSubmatch(resp.Body)
+	if match == nil {
+		t.Fatal("expected the page's script to carry a nonce")
+	}
+	// The template escapes the + of base64 in the attribute
+	nonce := html.UnescapeString(match[1])
+	if !strings.Contains(csp, "script-src 'self' https://cdn.jsdelivr.net 'nonce-"+nonce+"'") {
+		t.Errorf("expected the CSP to allow the page's nonce, got %q", csp)
+	}
+	if resp.Header.Get("X-Frame-Options") != "DENY" {
+		t.Error("expected framing to be forbidden")
+	}
+	if resp.Header.Get("X-Content-Type-Options") != "nosniff" {
+		t.Error("expected content sniffing to be disabled")
+	}
+	if resp.Header.Get("Strict-Transport-Security") != "" {
+		t.Error("expected no HSTS outside production")
+	}
+	
+	next := nonceRegexp.FindStringSubmatch(c.get("/").Body)
+	if next == nil || next[1] == match[1] {
+		t.Error("expected a new nonce for every response")
+	}
+}
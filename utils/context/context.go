@@ -3,15 +3,30 @@ package context
 import (
 	"context"
 	"gallerio/models"
+	"gallerio/utils/cookie"
+	"gallerio/utils/logging"
+	"gallerio/utils/security"
 )
 
 var (
-	userKey privateKey = "user"
+	userKey     privateKey = "user"
+	apiTokenKey privateKey = "api_token"
+	nonceKey    privateKey = "csp_nonce"
+	policyKey   privateKey = "security_policy"
+	cookiesKey  privateKey = "cookie_policy"
 )
 
 type privateKey string
 
+// Context lets packages which import this package as context refer to the
+// standard context type.
+type Context = context.Context
+
+// WithUser also tags the log lines of the request with the user's ID
 func WithUser(ctx context.Context, user *models.User) context.Context {
+	if user != nil {
+		logging.SetUserID(ctx, user.ID)
+	}
 	return context.WithValue(ctx, userKey, user)
 }
 
@@ -24,6 +39,57 @@ func User(ctx context.Context) *models.User {
 	return nil
 }
 
+// WithAPIToken marks the request as authenticated by a personal API token
+func WithAPIToken(ctx context.Context, token *models.APIToken) context.Context {
+	return context.WithValue(ctx, apiTokenKey, token)
+}
+
+func APIToken(ctx context.Context) *models.APIToken {
+	if temp := ctx.Value(apiTokenKey); temp != nil {
+		if token, ok := temp.(*models.APIToken); ok {
+			return token
+		}
+	}
+	return nil
+}
+
+// WithCSPNonce sets the nonce which lets the scripts and styles of the
+// response run under its Content-Security-Policy
+func WithCSPNonce(ctx context.Context, nonce string) context.Context {
+	return context.WithValue(ctx, nonceKey, nonce)
+}
+
+func CSPNonce(ctx context.Context) string {
+	if nonce, ok := ctx.Value(nonceKey).(string); ok {
+		return nonce
+	}
+	return ""
+}
+
+// WithSecurityPolicy keeps the policy the security headers were set from,
+// so it can be changed for a single route
+func WithSecurityPolicy(ctx context.Context, policy security.Policy) context.Context {
+	return context.WithValue(ctx, policyKey, policy)
+}
+
+func SecurityPolicy(ctx context.Context) (security.Policy, bool) {
+	policy, ok := ctx.Value(policyKey).(security.Policy)
+	return policy, ok
+}
+
+// WithCookiePolicy sets the policy which the views create cookies with
+func WithCookiePolicy(ctx context.Context, policy cookie.Policy) context.Context {
+	return context.WithValue(ctx, cookiesKey, policy)
+}
+
+// CookiePolicy returns cookie.DefaultPolicy when none was set
+func CookiePolicy(ctx context.Context) cookie.Policy {
+	if policy, ok := ctx.Value(cookiesKey).(cookie.Policy); ok {
+		return policy
+	}
+	return cookie.DefaultPolicy()
+}
+
 func TODO() context.Context {
 	return context.TODO()
 }
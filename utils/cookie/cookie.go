@@ -0,0 +1,70 @@
+// Package cookie creates every cookie of the site from a Policy so they all
+// get the same security attributes.
+package cookie
+
+import (
+	"github.com/gorilla/csrf"
+	"net/http"
+	"time"
+)
+
+// Policy holds the attributes applied to every cookie
+type Policy struct {
+	// Domain is left empty to limit cookies to the exact host
+	Domain   string
+	Secure   bool
+	SameSite http.SameSite
+}
+
+// DefaultPolicy sends cookies over plain HTTP too, for development
+func DefaultPolicy() Policy {
+	return Policy{
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// New returns a cookie readable only by the server with the policy
+// applied. A zero expires makes it a session cookie.
+func (policy Policy) New(name, value string, expires time.Time) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		Domain:   policy.Domain,
+		Expires:  expires,
+		Secure:   policy.Secure,
+		HttpOnly: true,
+		SameSite: policy.SameSite,
+	}
+}
+
+// Set adds the cookie to the response
+func (policy Policy) Set(w http.ResponseWriter, name, value string, expires time.Time) {
+	http.SetCookie(w, policy.New(name, value, expires))
+}
+
+// Clear tells the browser to delete the cookie
+func (policy Policy) Clear(w http.ResponseWriter, name string) {
+	c := policy.New(name, "", time.Unix(0, 0))
+	c.MaxAge = -1
+	http.SetCookie(w, c)
+}
+
+// CSRFOptions applies the policy to the cookie set by gorilla/csrf, which
+// can't use New
+func (policy Policy) CSRFOptions() []csrf.Option {
+	sameSite := csrf.SameSiteLaxMode
+	switch policy.SameSite {
+	case http.SameSiteStrictMode:
+		sameSite = csrf.SameSiteStrictMode
+	case http.SameSiteNoneMode:
+		sameSite = csrf.SameSiteNoneMode
+	}
+	return []csrf.Option{
+		csrf.Path("/"),
+		csrf.Domain(policy.Domain),
+		csrf.Secure(policy.Secure),
+		csrf.HttpOnly(true),
+		csrf.SameSite(sameSite),
+	}
+}
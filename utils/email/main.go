@@ -2,15 +2,24 @@ package email
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"gallerio/utils/metrics"
 	"github.com/mailgun/mailgun-go/v4"
-	"log"
+	"log/slog"
 	"net/url"
 	"time"
 )
 
 var (
-	baseResetURL = "http://localhost:8000/reset"
+	sent = metrics.NewCounter("gallerio_emails_total", "Emails the client tried to send, by result.", "result")
+	
+	errNoTransport = errors.New("email: no transport configured")
+	
+	baseResetURL        = "http://localhost:8000/reset"
+	baseConfirmEmailURL = "http://localhost:8000/account/email/confirm"
+	baseExportURL       = "http://localhost:8000/account/export/download"
+	baseSignUpURL       = "http://localhost:8000/signup"
 	
 	welcomeSubject = "Welcome to Gallerio"
 	welcomeText    = "Greeting. Its a pleasure to have you here. Cheers"
@@ -35,13 +44,65 @@ var (
 	You can also use the code below<br/>
 	%s<br/>
 	If you didn't requested this, then ignore this message<br/>`
+	
+	confirmEmailSubject = "Confirm your new email address"
+	confirmEmailText    = `
+	It appears you have requested to change the email address of your Gallerio account to this one.
+	Use the following link to confirm the change
+	%s
+	If you didn't requested this, then ignore this message`
+	confirmEmailHtml = `
+	It appears you have requested to change the email address of your Gallerio account to this one.<br/>
+	Use the following link to confirm the change<br/>
+	<a href="%s">%s</a><br/>
+	If you didn't requested this, then ignore this message<br/>`
+	
+	exportReadySubject = "Your Gallerio data export is ready"
+	exportReadyText    = `
+	Hello %s,
+	The copy of your Gallerio data you requested is ready.
+	Use the following link to download it. The link works until %s
+	%s`
+	exportReadyHtml = `
+	Hello %s,<br/>
+	The copy of your Gallerio data you requested is ready.<br/>
+	Use the following link to download it. The link works until %s<br/>
+	<a href="%s">Download your data</a><br/>`
+	
+	inviteSubject = "You have been invited to Gallerio"
+	inviteText    = `
+	Hello,
+	%s has invited you to join Gallerio.
+	Use the following link to create your account
+	%s`
+	inviteHtml = `
+	Hello,<br/>
+	%s has invited you to join Gallerio.<br/>
+	Use the following link to create your account<br/>
+	<a href="%s">%s</a><br/>`
+	
+	emailChangedSubject = "Your email address was changed"
+	emailChangedText    = `
+	The email address of your Gallerio account was changed to %s.
+	If you didn't make this change, please contact our support right away`
+	emailChangedHtml = `
+	The email address of your Gallerio account was changed to %s.<br/>
+	If you didn't make this change, please contact our support right away<br/>`
 )
 
 type ClientConfig func(*Client)
 
 func WithMailgun(domain, apiKey string) ClientConfig {
 	return func(client *Client) {
-		client.mg = mailgun.NewMailgun(domain, apiKey)
+		client.transport = &mailgunTransport{mailgun.NewMailgun(domain, apiKey)}
+	}
+}
+
+// WithTransport sends the emails through t instead of Mailgun, e.g. a
+// Recorder in tests
+func WithTransport(t Transport) ClientConfig {
+	return func(client *Client) {
+		client.transport = t
 	}
 }
 
@@ -62,34 +123,114 @@ func NewClient(opts ...ClientConfig) Client {
 }
 
 type Client struct {
-	from string
-	mg   mailgun.Mailgun
+	from      string
+	transport Transport
 }
 
-func (c *Client) Welcome(name, email string) error {
-	message := c.mg.NewMessage(c.from, welcomeSubject, welcomeText, buildEmail(name, email))
-	message.SetHtml(welcomeHtml)
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
-	defer cancel()
-	
-	_, _, err := c.mg.Send(ctx, message)
-	log.Println(err)
-	return err
+func (c *Client) Welcome(ctx context.Context, name, email string) error {
+	return c.send(ctx, Message{
+		To:      buildEmail(name, email),
+		Subject: welcomeSubject,
+		Text:    welcomeText,
+		HTML:    welcomeHtml,
+	})
 }
 
-func (c *Client) ResetPassword(email, token string) error {
+func (c *Client) ResetPassword(ctx context.Context, email, token string) error {
 	v := url.Values{}
 	v.Set("token", token)
 	resetUrl := baseResetURL + "?" + v.Encode()
-	resetPasswordText = fmt.Sprintf(resetPasswordText, resetUrl, token)
-	message := c.mg.NewMessage(c.from, resetPasswordSubject, resetPasswordText, email)
-	resetPasswordHtml = fmt.Sprintf(resetPasswordHtml, resetUrl, resetUrl, token)
-	message.SetHtml(resetPasswordHtml)
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	return c.send(ctx, Message{
+		To:      email,
+		Subject: resetPasswordSubject,
+		Text:    fmt.Sprintf(resetPasswordText, resetUrl, token),
+		HTML:    fmt.Sprintf(resetPasswordHtml, resetUrl, resetUrl, token),
+	})
+}
+
+func (c *Client) ConfirmEmailChange(ctx context.Context, email, token string) error {
+	v := url.Values{}
+	v.Set("token", token)
+	confirmUrl := baseConfirmEmailURL + "?" + v.Encode()
+	return c.send(ctx, Message{
+		To:      email,
+		Subject: confirmEmailSubject,
+		Text:    fmt.Sprintf(confirmEmailText, confirmUrl),
+		HTML:    fmt.Sprintf(confirmEmailHtml, confirmUrl, confirmUrl),
+	})
+}
+
+func (c *Client) EmailChanged(ctx context.Context, oldEmail, newEmail string) error {
+	return c.send(ctx, Message{
+		To:      oldEmail,
+		Subject: emailChangedSubject,
+		Text:    fmt.Sprintf(emailChangedText, newEmail),
+		HTML:    fmt.Sprintf(emailChangedHtml, newEmail),
+	})
+}
+
+func (c *Client) DataExportReady(ctx context.Context, name, email, token string, expiresAt time.Time) error {
+	v := url.Values{}
+	v.Set("token", token)
+	downloadUrl := baseExportURL + "?" + v.Encode()
+	expires := expiresAt.Format("January 2, 2006 15:04 MST")
+	return c.send(ctx, Message{
+		To:      buildEmail(name, email),
+		Subject: exportReadySubject,
+		Text:    fmt.Sprintf(exportReadyText, name, expires, downloadUrl),
+		HTML:    fmt.Sprintf(exportReadyHtml, name, expires, downloadUrl),
+	})
+}
+
+func (c *Client) Invite(ctx context.Context, inviterName, email, token string) error {
+	inviteUrl := InviteURL(token)
+	return c.send(ctx, Message{
+		To:      email,
+		Subject: inviteSubject,
+		Text:    fmt.Sprintf(inviteText, inviterName, inviteUrl),
+		HTML:    fmt.Sprintf(inviteHtml, inviterName, inviteUrl, inviteUrl),
+	})
+}
+
+// Check tells whether emails can be sent, as far as it's possible to know
+// without sending one
+func (c *Client) Check() error {
+	if c.transport == nil {
+		return errNoTransport
+	}
+	if t, ok := c.transport.(checker); ok {
+		return t.Check()
+	}
+	return nil
+}
+
+// send logs the outcome with ctx, which is usually the request's. The email
+// isn't cancelled along with ctx, e.g. when the request is done.
+func (c *Client) send(ctx context.Context, msg Message) error {
+	if c.transport == nil {
+		slog.ErrorContext(ctx, "sending email failed", "subject", msg.Subject, "err", errNoTransport)
+		sent.Inc("failure")
+		return errNoTransport
+	}
+	msg.From = c.from
+	sendCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Second*10)
 	defer cancel()
 	
-	_, _, err := c.mg.Send(ctx, message)
-	return err
+	if err := c.transport.Send(sendCtx, msg); err != nil {
+		slog.ErrorContext(ctx, "sending email failed", "subject", msg.Subject, "err", err)
+		sent.Inc("failure")
+		return err
+	}
+	slog.InfoContext(ctx, "email sent", "subject", msg.Subject)
+	sent.Inc("success")
+	return nil
+}
+
+// InviteURL is the sign up link for an invitation token
+func InviteURL(token string) string {
+	v := url.Values{}
+	v.Set("invite", token)
+	return baseSignUpURL + "?" + v.Encode()
 }
 
 func buildEmail(name, email string) string {
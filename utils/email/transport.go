@@ -0,0 +1,74 @@
+package email
+
+import (
+	"context"
+	"errors"
+	"github.com/mailgun/mailgun-go/v4"
+	"strings"
+	"sync"
+)
+
+// Message is a single email, From is set by the Client
+type Message struct {
+	From    string
+	To      string
+	Subject string
+	Text    string
+	HTML    string
+}
+
+// Transport delivers messages
+type Transport interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// checker is implemented by transports which can tell whether they are
+// configured without sending anything
+type checker interface {
+	Check() error
+}
+
+type mailgunTransport struct {
+	mg mailgun.Mailgun
+}
+
+func (t *mailgunTransport) Send(ctx context.Context, msg Message) error {
+	message := t.mg.NewMessage(msg.From, msg.Subject, msg.Text, msg.To)
+	message.SetHtml(msg.HTML)
+	_, _, err := t.mg.Send(ctx, message)
+	return err
+}
+
+func (t *mailgunTransport) Check() error {
+	if t.mg.Domain() == "" || t.mg.APIKey() == "" {
+		return errors.New("email: mailgun domain or API key is missing")
+	}
+	return nil
+}
+
+// Recorder is a Transport which keeps messages instead of sending them
+type Recorder struct {
+	mu       sync.Mutex
+	messages []Message
+}
+
+func (r *Recorder) Send(ctx context.Context, msg Message) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.messages = append(r.messages, msg)
+	return nil
+}
+
+// Messages returns the messages sent to the address, with or without a
+// name, oldest first
+func (r *Recorder) Messages(to string) []Message {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var messages []Message
+	for _, msg := range r.messages {
+		if msg.To == to || strings.HasSuffix(msg.To, "<"+to+">") {
+			messages = append(messages, msg)
+		}
+	}
+	return messages
+}
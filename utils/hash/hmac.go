@@ -4,23 +4,55 @@ import (
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/base64"
-	"hash"
 )
 
 func NewHMAC(key string) HMAC {
-	h := hmac.New(sha256.New, []byte(key))
 	return HMAC{
-		hmac: h,
+		key: []byte(key),
 	}
 }
 
+// HMAC creates a new hash.Hash on every call, so it is safe to share
+// between goroutines.
 type HMAC struct {
-	hmac hash.Hash
+	key []byte
 }
 
 func (h HMAC) Hash(input string) string {
-	h.hmac.Reset()
-	h.hmac.Write([]byte(input))
-	b := h.hmac.Sum(nil)
+	mac := hmac.New(sha256.New, h.key)
+	mac.Write([]byte(input))
+	b := mac.Sum(nil)
 	return base64.URLEncoding.EncodeToString(b)
 }
+
+// NewKeyring returns a Keyring which hashes with the current key while still
+// recognizing values hashed with any of the previous keys.
+func NewKeyring(current string, previous ...string) Keyring {
+	keyring := Keyring{current: NewHMAC(current)}
+	for _, key := range previous {
+		if key == "" || key == current {
+			continue
+		}
+		keyring.previous = append(keyring.previous, NewHMAC(key))
+	}
+	return keyring
+}
+
+type Keyring struct {
+	current  HMAC
+	previous []HMAC
+}
+
+// Hash hashes the input with the current key
+func (k Keyring) Hash(input string) string {
+	return k.current.Hash(input)
+}
+
+// Hashes returns the input hashed with every key, the current one first
+func (k Keyring) Hashes(input string) []string {
+	hashes := []string{k.current.Hash(input)}
+	for _, h := range k.previous {
+		hashes = append(hashes, h.Hash(input))
+	}
+	return hashes
+}
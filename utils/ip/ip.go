@@ -0,0 +1,35 @@
+package ip
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// TrustProxy makes FromRequest honor the X-Forwarded-For and X-Real-IP
+// headers. Only enable it when the app runs behind a single proxy that sets
+// them.
+var TrustProxy = false
+
+// FromRequest returns the IP address of the client that made the request.
+// Behind a proxy it's the rightmost X-Forwarded-For entry, the one the
+// proxy appended. The entries left of it are sent by the client and can't
+// be trusted.
+func FromRequest(req *http.Request) string {
+	if TrustProxy {
+		if fwd := req.Header.Values("X-Forwarded-For"); len(fwd) > 0 {
+			entries := strings.Split(fwd[len(fwd)-1], ",")
+			if last := strings.TrimSpace(entries[len(entries)-1]); last != "" {
+				return last
+			}
+		}
+		if real := req.Header.Get("X-Real-IP"); real != "" {
+			return strings.TrimSpace(real)
+		}
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,40 @@
+package ip
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFromRequest(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.0.0.2:41234"
+	req.Header.Set("X-Forwarded-For", "1.2.3.4")
+	if got := FromRequest(req); got != "10.0.0.2" {
+		t.Fatalf("expected the headers to be ignored without a proxy, got %s", got)
+	}
+	
+	TrustProxy = true
+	defer func() { TrustProxy = false }()
+	cases := []struct {
+		forwarded []string
+		expected  string
+	}{
+		{[]string{"203.0.113.7"}, "203.0.113.7"},
+		// The client sent a made up address which the proxy appended to
+		{[]string{"1.2.3.4, 203.0.113.7"}, "203.0.113.7"},
+		{[]string{"1.2.3.4", "5.6.7.8, 203.0.113.7"}, "203.0.113.7"},
+		{[]string{"1.2.3.4,"}, "192.0.2.1"},
+		{nil, "192.0.2.1"},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "10.0.0.2:41234"
+		req.Header.Set("X-Real-IP", "192.0.2.1")
+		for _, value := range c.forwarded {
+			req.Header.Add("X-Forwarded-For", value)
+		}
+		if got := FromRequest(req); got != c.expected {
+			t.Errorf("%q: expected %s, got %s", c.forwarded, c.expected, got)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package jobs
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// NewRunner returns a Runner for background work that has to be waited on
+// before the application exits.
+func NewRunner() *Runner {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Runner{
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+type Runner struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// Go runs fn in its own goroutine. The context passed to fn is cancelled
+// when the runner is stopped.
+func (r *Runner) Go(fn func(ctx context.Context)) {
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		defer recoverPanic()
+		fn(r.ctx)
+	}()
+}
+
+// Every runs fn right away and then once per interval until the runner is
+// stopped. Runs never overlap.
+func (r *Runner) Every(interval time.Duration, fn func(ctx context.Context)) {
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			func() {
+				defer recoverPanic()
+				fn(r.ctx)
+			}()
+			select {
+			case <-r.ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Stop cancels all jobs and waits for them to return, or for ctx to be done.
+func (r *Runner) Stop(ctx context.Context) error {
+	r.cancel()
+	done := make(chan struct{})
+	go func() {
+		r.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func recoverPanic() {
+	if r := recover(); r != nil {
+		slog.Error("jobs: recovered from panic", "panic", r)
+	}
+}
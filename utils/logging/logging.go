@@ -0,0 +1,141 @@
+// Package logging builds the structured logger of the site. Records logged
+// with the context of a request carry its request ID and, once known, the
+// ID of the signed in user.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+)
+
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// New returns a logger writing records of at least level to w. Format is
+// "text" or "json" and level is "debug", "info", "warn" or "error".
+func New(w io.Writer, format, level string) (*slog.Logger, error) {
+	lvl, err := ParseLevel(level)
+	if err != nil {
+		return nil, err
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case "", FormatText:
+		handler = slog.NewTextHandler(w, opts)
+	case FormatJSON:
+		handler = slog.NewJSONHandler(w, opts)
+	default:
+		return nil, fmt.Errorf("logging: unknown format %q", format)
+	}
+	return slog.New(contextHandler{handler}), nil
+}
+
+// ParseLevel parses the name of a level, the empty string being info
+func ParseLevel(level string) (slog.Level, error) {
+	switch strings.ToLower(level) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("logging: unknown level %q", level)
+}
+
+var requestKey privateKey = "request"
+
+type privateKey string
+
+// request is shared by every context derived from the one the request ID
+// middleware created, so the user assigned deep in the handler chain is
+// seen by the access log written on the way out.
+type request struct {
+	id string
+	
+	mu     sync.Mutex
+	userID uint
+}
+
+// WithRequestID starts tagging records logged with the context with id
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestKey, &request{id: id})
+}
+
+func RequestID(ctx context.Context) string {
+	if r := requestFrom(ctx); r != nil {
+		return r.id
+	}
+	return ""
+}
+
+// SetUserID tags records logged for the rest of the request with the user.
+// It does nothing for contexts without a request ID.
+func SetUserID(ctx context.Context, userID uint) {
+	if r := requestFrom(ctx); r != nil {
+		r.mu.Lock()
+		r.userID = userID
+		r.mu.Unlock()
+	}
+}
+
+func UserID(ctx context.Context) uint {
+	if r := requestFrom(ctx); r != nil {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		return r.userID
+	}
+	return 0
+}
+
+// Inherit returns ctx tagged like the records of the request from, e.g. for
+// jobs started by the request which outlive it.
+func Inherit(ctx, from context.Context) context.Context {
+	if r := requestFrom(from); r != nil {
+		return context.WithValue(ctx, requestKey, r)
+	}
+	return ctx
+}
+
+func requestFrom(ctx context.Context) *request {
+	if ctx == nil {
+		return nil
+	}
+	if r, ok := ctx.Value(requestKey).(*request); ok {
+		return r
+	}
+	return nil
+}
+
+// contextHandler adds the request and user IDs found in the context to
+// every record
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if r := requestFrom(ctx); r != nil {
+		record.AddAttrs(slog.String("request_id", r.id))
+		if userID := UserID(ctx); userID != 0 {
+			record.AddAttrs(slog.Uint64("user_id", uint64(userID)))
+		}
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
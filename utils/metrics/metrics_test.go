@@ -0,0 +1,73 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestWrite(t *testing.T) {
+	r := NewRegistry()
+	requests := r.NewCounter("requests_total", "Requests served.", "route", "status")
+	requests.Inc("/", "200")
+	requests.Add(2, "/", "200")
+	requests.Inc(`/say "hi"`, "404")
+	r.NewCounter("errors_total", "Errors.")
+	durations := r.NewHistogram("duration_seconds", "Durations.", []float64{0.1, 1})
+	durations.Observe(0.05)
+	durations.Observe(0.5)
+	durations.Observe(3)
+	r.NewGaugeFunc("sessions", "Sessions\nopen.", func() float64 { return 4 })
+	
+	var buf bytes.Buffer
+	if err := r.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	expected := `# HELP duration_seconds Durations.
+# TYPE duration_seconds histogram
+duration_seconds_bucket{le="0.1"} 1
+duration_seconds_bucket{le="1"} 2
+duration_seconds_bucket{le="+Inf"} 3
+duration_seconds_sum 3.55
+duration_seconds_count 3
+# HELP errors_total Errors.
+# TYPE errors_total counter
+errors_total 0
+# HELP requests_total Requests served.
+# TYPE requests_total counter
+requests_total{route="/",status="200"} 3
+requests_total{route="/say \"hi\"",status="404"} 1
+# HELP sessions Sessions\nopen.
+# TYPE sessions gauge
+sessions 4
+`
+	if buf.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, buf.String())
+	}
+}
+
+func TestRegisterTwicePanics(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("requests_total", "Requests served.")
+	defer func() {
+		if recover() == nil {
+			t.Error("expected registering the same name twice to panic")
+		}
+	}()
+	r.NewCounter("requests_total", "Requests served.")
+}
+
+func TestActive(t *testing.T) {
+	r := NewRegistry()
+	active := r.NewActive("active", "Active.", time.Hour)
+	active.Touch("1")
+	active.Touch("2")
+	active.Touch("1")
+	if n := active.Count(); n != 2 {
+		t.Errorf("expected 2 active keys, got %d", n)
+	}
+	active.seen["3"] = time.Now().Add(-2 * time.Hour)
+	if n := active.Count(); n != 2 {
+		t.Errorf("expected keys outside the window to be forgotten, got %d", n)
+	}
+}
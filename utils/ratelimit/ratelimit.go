@@ -0,0 +1,193 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Entry tracks the attempts made against a single bucket, eg. an IP address
+// or an account.
+type Entry struct {
+	Bucket      string
+	Failures    int
+	LastFailure time.Time
+	LockedUntil time.Time
+}
+
+// Store persists entries so limits can be shared across instances.
+// Get must return (nil, nil) when the bucket is unknown.
+type Store interface {
+	Get(bucket string) (*Entry, error)
+	Save(entry *Entry) error
+	Delete(bucket string) error
+	DeleteBefore(t time.Time) error
+}
+
+// Policy describes how many attempts are allowed before a bucket gets locked
+// and how the lockout grows with every additional failure.
+type Policy struct {
+	MaxAttempts int
+	Window      time.Duration
+	Lockout     time.Duration
+	MaxLockout  time.Duration
+}
+
+func DefaultPolicy() Policy {
+	return Policy{
+		MaxAttempts: 5,
+		Window:      15 * time.Minute,
+		Lockout:     time.Minute,
+		MaxLockout:  time.Hour,
+	}
+}
+
+// pruneEvery is the number of recorded attempts between two sweeps of stale
+// entries from the store.
+const pruneEvery = 100
+
+func NewLimiter(store Store, policy Policy) *Limiter {
+	return &Limiter{
+		store:  store,
+		policy: policy,
+		now:    time.Now,
+	}
+}
+
+type Limiter struct {
+	store  Store
+	policy Policy
+	now    func() time.Time
+
+	mu   sync.Mutex
+	hits int
+}
+
+// Check returns how long the caller has to wait before trying again.
+// A zero duration means every bucket is allowed.
+func (l *Limiter) Check(buckets ...string) (time.Duration, error) {
+	now := l.now()
+	var wait time.Duration
+	for _, bucket := range buckets {
+		entry, err := l.store.Get(bucket)
+		if err != nil {
+			return 0, err
+		}
+		if entry == nil || !entry.LockedUntil.After(now) {
+			continue
+		}
+		if d := entry.LockedUntil.Sub(now); d > wait {
+			wait = d
+		}
+	}
+	return wait, nil
+}
+
+// Fail records a failed (or, for endpoints limited by volume, any) attempt
+// against every bucket. Once a bucket reaches MaxAttempts failures it is
+// locked, and the lockout doubles for each further failure up to MaxLockout.
+func (l *Limiter) Fail(buckets ...string) error {
+	now := l.now()
+	for _, bucket := range buckets {
+		entry, err := l.store.Get(bucket)
+		if err != nil {
+			return err
+		}
+		if entry == nil || l.expired(entry, now) {
+			entry = &Entry{Bucket: bucket}
+		}
+		entry.Failures++
+		entry.LastFailure = now
+		if entry.Failures >= l.policy.MaxAttempts {
+			entry.LockedUntil = now.Add(l.lockout(entry.Failures))
+		}
+		if err := l.store.Save(entry); err != nil {
+			return err
+		}
+	}
+	return l.maybePrune(now)
+}
+
+// Reset forgets every recorded attempt for the buckets.
+func (l *Limiter) Reset(buckets ...string) error {
+	for _, bucket := range buckets {
+		if err := l.store.Delete(bucket); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *Limiter) expired(entry *Entry, now time.Time) bool {
+	last := entry.LastFailure
+	if entry.LockedUntil.After(last) {
+		last = entry.LockedUntil
+	}
+	return now.After(last.Add(l.policy.Window))
+}
+
+func (l *Limiter) lockout(failures int) time.Duration {
+	exp := failures - l.policy.MaxAttempts
+	d := time.Duration(float64(l.policy.Lockout) * math.Pow(2, float64(exp)))
+	if d <= 0 || d > l.policy.MaxLockout {
+		return l.policy.MaxLockout
+	}
+	return d
+}
+
+func (l *Limiter) maybePrune(now time.Time) error {
+	l.mu.Lock()
+	l.hits++
+	prune := l.hits%pruneEvery == 0
+	l.mu.Unlock()
+	if !prune {
+		return nil
+	}
+	return l.store.DeleteBefore(now.Add(-l.policy.Window - l.policy.MaxLockout))
+}
+
+func NewMemoryStore() Store {
+	return &memoryStore{
+		entries: make(map[string]Entry),
+	}
+}
+
+type memoryStore struct {
+	mu      sync.Mutex
+	entries map[string]Entry
+}
+
+func (ms *memoryStore) Get(bucket string) (*Entry, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	entry, ok := ms.entries[bucket]
+	if !ok {
+		return nil, nil
+	}
+	return &entry, nil
+}
+
+func (ms *memoryStore) Save(entry *Entry) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.entries[entry.Bucket] = *entry
+	return nil
+}
+
+func (ms *memoryStore) Delete(bucket string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	delete(ms.entries, bucket)
+	return nil
+}
+
+func (ms *memoryStore) DeleteBefore(t time.Time) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	for bucket, entry := range ms.entries {
+		if entry.LastFailure.Before(t) && entry.LockedUntil.Before(t) {
+			delete(ms.entries, bucket)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+// testLimiter returns a limiter whose clock is moved with the returned func
+func testLimiter() (*Limiter, func(d time.Duration)) {
+	now := time.Date(2021, 4, 1, 12, 0, 0, 0, time.UTC)
+	l := NewLimiter(NewMemoryStore(), Policy{
+		MaxAttempts: 3,
+		Window:      15 * time.Minute,
+		Lockout:     time.Minute,
+		MaxLockout:  5 * time.Minute,
+	})
+	l.now = func() time.Time { return now }
+	return l, func(d time.Duration) { now = now.Add(d) }
+}
+
+func checkWait(t *testing.T, l *Limiter, expected time.Duration, buckets ...string) {
+	t.Helper()
+	wait, err := l.Check(buckets...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wait != expected {
+		t.Fatalf("expected to wait %s, got %s", expected, wait)
+	}
+}
+
+func TestLockoutAtMaxAttempts(t *testing.T) {
+	l, _ := testLimiter()
+	for i := 0; i < 2; i++ {
+		if err := l.Fail("ip"); err != nil {
+			t.Fatal(err)
+		}
+		checkWait(t, l, 0, "ip")
+	}
+	
+	// The third failure reaches MaxAttempts
+	if err := l.Fail("ip"); err != nil {
+		t.Fatal(err)
+	}
+	checkWait(t, l, time.Minute, "ip")
+	checkWait(t, l, 0, "other")
+	checkWait(t, l, time.Minute, "other", "ip")
+}
+
+func TestLockoutBackoff(t *testing.T) {
+	l, advance := testLimiter()
+	expected := []time.Duration{
+		time.Minute,
+		2 * time.Minute,
+		4 * time.Minute,
+		// Capped by MaxLockout
+		5 * time.Minute,
+		5 * time.Minute,
+	}
+	l.Fail("ip")
+	l.Fail("ip")
+	for _, lockout := range expected {
+		if err := l.Fail("ip"); err != nil {
+			t.Fatal(err)
+		}
+		checkWait(t, l, lockout, "ip")
+		advance(lockout)
+		checkWait(t, l, 0, "ip")
+	}
+}
+
+func TestWindowExpires(t *testing.T) {
+	l, advance := testLimiter()
+	l.Fail("ip")
+	l.Fail("ip")
+	advance(16 * time.Minute)
+	
+	// The earlier failures are forgotten, so this one doesn't lock
+	l.Fail("ip")
+	checkWait(t, l, 0, "ip")
+	
+	// Failures after a lockout count from its end
+	l.Fail("ip")
+	l.Fail("ip")
+	checkWait(t, l, time.Minute, "ip")
+	advance(10 * time.Minute)
+	l.Fail("ip")
+	checkWait(t, l, 2*time.Minute, "ip")
+}
+
+func TestReset(t *testing.T) {
+	l, _ := testLimiter()
+	for i := 0; i < 3; i++ {
+		l.Fail("account", "ip")
+	}
+	if err := l.Reset("account"); err != nil {
+		t.Fatal(err)
+	}
+	checkWait(t, l, 0, "account")
+	checkWait(t, l, time.Minute, "ip")
+}
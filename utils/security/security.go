@@ -0,0 +1,125 @@
+// Package security builds the security headers sent with every response,
+// the Content-Security-Policy among them.
+package security
+
+import (
+	"encoding/base64"
+	"fmt"
+	"gallerio/utils/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Policy holds the security headers. Empty values leave their header out.
+type Policy struct {
+	// CSP maps each directive to its sources. The nonce of the request is
+	// added to script-src and style-src.
+	CSP map[string][]string
+	// CSPReportOnly sends the CSP without enforcing it, to find out what a
+	// stricter policy would break
+	CSPReportOnly     bool
+	FrameOptions      string
+	ReferrerPolicy    string
+	PermissionsPolicy string
+	// HSTSMaxAge sends Strict-Transport-Security with requests made over
+	// TLS when it's not zero
+	HSTSMaxAge time.Duration
+}
+
+// DefaultPolicy allows the site's own resources and Bootstrap from its CDN,
+// and forbids framing the site
+func DefaultPolicy() Policy {
+	return Policy{
+		CSP: map[string][]string{
+			"default-src":     {"'self'"},
+			"script-src":      {"'self'", "https://cdn.jsdelivr.net"},
+			"style-src":       {"'self'", "https://cdn.jsdelivr.net"},
+			"img-src":         {"'self'", "data:"},
+			"object-src":      {"'none'"},
+			"base-uri":        {"'self'"},
+			"form-action":     {"'self'"},
+			"frame-ancestors": {"'none'"},
+		},
+		FrameOptions:      "DENY",
+		ReferrerPolicy:    "strict-origin-when-cross-origin",
+		PermissionsPolicy: "camera=(), microphone=(), geolocation=(), payment=()",
+	}
+}
+
+// Clone returns a copy whose CSP can be changed without changing p's
+func (p Policy) Clone() Policy {
+	csp := make(map[string][]string, len(p.CSP))
+	for directive, sources := range p.CSP {
+		csp[directive] = append([]string(nil), sources...)
+	}
+	p.CSP = csp
+	return p
+}
+
+// SetHeaders sets the headers of the policy on h, replacing the ones set
+// before. HSTS is only sent when tls is true.
+func (p Policy) SetHeaders(h http.Header, nonce string, tls bool) {
+	cspHeader := "Content-Security-Policy"
+	if p.CSPReportOnly {
+		cspHeader = "Content-Security-Policy-Report-Only"
+	}
+	h.Del("Content-Security-Policy")
+	h.Del("Content-Security-Policy-Report-Only")
+	if csp := p.BuildCSP(nonce); csp != "" {
+		h.Set(cspHeader, csp)
+	}
+	
+	set := func(name, value string) {
+		if value == "" {
+			h.Del(name)
+			return
+		}
+		h.Set(name, value)
+	}
+	// Uploaded images must never be run as something else
+	h.Set("X-Content-Type-Options", "nosniff")
+	set("X-Frame-Options", p.FrameOptions)
+	set("Referrer-Policy", p.ReferrerPolicy)
+	set("Permissions-Policy", p.PermissionsPolicy)
+	if tls && p.HSTSMaxAge > 0 {
+		h.Set("Strict-Transport-Security",
+			fmt.Sprintf("max-age=%d; includeSubDomains", int(p.HSTSMaxAge.Seconds())))
+	} else {
+		h.Del("Strict-Transport-Security")
+	}
+}
+
+// BuildCSP formats the directives sorted by name, with the nonce allowed to
+// run scripts and styles
+func (p Policy) BuildCSP(nonce string) string {
+	directives := make([]string, 0, len(p.CSP))
+	for directive := range p.CSP {
+		directives = append(directives, directive)
+	}
+	sort.Strings(directives)
+	
+	var parts []string
+	for _, directive := range directives {
+		sources := p.CSP[directive]
+		if nonce != "" && (directive == "script-src" || directive == "style-src") {
+			sources = append(append([]string(nil), sources...), "'nonce-"+nonce+"'")
+		}
+		if len(sources) == 0 {
+			parts = append(parts, directive)
+			continue
+		}
+		parts = append(parts, directive+" "+strings.Join(sources, " "))
+	}
+	return strings.Join(parts, "; ")
+}
+
+// NewNonce returns a random nonce for a single response
+func NewNonce() (string, error) {
+	b, err := rand.Bytes(16)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
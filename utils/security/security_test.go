@@ -0,0 +1,68 @@
+package security
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuildCSP(t *testing.T) {
+	p := Policy{CSP: map[string][]string{
+		"default-src":               {"'self'"},
+		"script-src":                {"'self'"},
+		"upgrade-insecure-requests": {},
+	}}
+	expected := "default-src 'self'; script-src 'self' 'nonce-abc'; upgrade-insecure-requests"
+	if csp := p.BuildCSP("abc"); csp != expected {
+		t.Errorf("expected %q, got %q", expected, csp)
+	}
+	if csp := p.BuildCSP(""); strings.Contains(csp, "nonce") {
+		t.Errorf("expected no nonce without one, got %q", csp)
+	}
+	if len(p.CSP["script-src"]) != 1 {
+		t.Error("expected building the CSP to leave the policy unchanged")
+	}
+}
+
+func TestSetHeaders(t *testing.T) {
+	p := DefaultPolicy()
+	p.HSTSMaxAge = time.Hour
+	
+	h := http.Header{}
+	p.SetHeaders(h, "abc", false)
+	if h.Get("Strict-Transport-Security") != "" {
+		t.Error("expected no HSTS without TLS")
+	}
+	for _, name := range []string{"Content-Security-Policy", "X-Frame-Options", "Referrer-Policy",
+		"Permissions-Policy", "X-Content-Type-Options"} {
+		if h.Get(name) == "" {
+			t.Errorf("expected the %s header", name)
+		}
+	}
+	
+	p.SetHeaders(h, "abc", true)
+	if got := h.Get("Strict-Transport-Security"); got != "max-age=3600; includeSubDomains" {
+		t.Errorf("expected HSTS over TLS, got %q", got)
+	}
+	
+	p.FrameOptions = ""
+	p.CSPReportOnly = true
+	p.SetHeaders(h, "abc", true)
+	if h.Get("X-Frame-Options") != "" {
+		t.Error("expected an empty value to remove the header")
+	}
+	if h.Get("Content-Security-Policy") != "" || h.Get("Content-Security-Policy-Report-Only") == "" {
+		t.Error("expected the CSP to only be reported")
+	}
+}
+
+func TestClone(t *testing.T) {
+	p := DefaultPolicy()
+	clone := p.Clone()
+	clone.CSP["frame-ancestors"] = []string{"*"}
+	clone.CSP["img-src"][0] = "https:"
+	if p.CSP["frame-ancestors"][0] != "'none'" || p.CSP["img-src"][0] != "'self'" {
+		t.Error("expected changing the clone to leave the policy unchanged")
+	}
+}
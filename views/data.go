@@ -1,7 +1,8 @@
 package views
 
 import (
-	"log"
+	"gallerio/utils/context"
+	"log/slog"
 	"net/http"
 	"time"
 )
@@ -16,24 +17,30 @@ var (
 )
 
 type Alert struct {
-	Level   string
-	Message string
+	Level   string `json:"level"`
+	Message string `json:"message"`
 }
 
 type Data struct {
 	Alert   *Alert
 	User    interface{}
 	Content interface{}
+	// Status replaces 200 OK, or for JSON the status derived from Alert
+	Status int
 }
 
-func (d *Data) SetAlert(err error) {
+// SetAlert shows the message of public errors and a generic one for the
+// others. Both are logged with ctx, public ones only at debug level as they
+// are usually caused by the user.
+func (d *Data) SetAlert(ctx context.Context, err error) {
 	if pErr, ok := err.(PublicError); ok {
+		slog.DebugContext(ctx, "showing error", "err", err)
 		d.Alert = &Alert{
 			Level:   AlertLevelError,
 			Message: pErr.Public(),
 		}
 	} else {
-		log.Println(err)
+		slog.ErrorContext(ctx, "showing generic error", "err", err)
 		d.Alert = &Alert{
 			Level:   AlertLevelError,
 			Message: AlertMessageGeneric,
@@ -74,20 +81,17 @@ type PublicError interface {
 	Public() string
 }
 
-func persistAlert(w http.ResponseWriter, alert Alert) {
-	lvl, msg := getCookiesForAlert(alert, time.Now().Add(5 * time.Minute))
-	http.SetCookie(w, lvl)
-	http.SetCookie(w, msg)
+func persistAlert(w http.ResponseWriter, req *http.Request, alert Alert) {
+	expires := time.Now().Add(5 * time.Minute)
+	cookies := context.CookiePolicy(req.Context())
+	cookies.Set(w, "alert_level", alert.Level, expires)
+	cookies.Set(w, "alert_message", alert.Message, expires)
 }
 
-func clearAlert(w http.ResponseWriter) {
-	alert := Alert{
-		Level: "",
-		Message: "",
-	}
-	lvl, msg := getCookiesForAlert(alert, time.Now())
-	http.SetCookie(w, lvl)
-	http.SetCookie(w, msg)
+func clearAlert(w http.ResponseWriter, req *http.Request) {
+	cookies := context.CookiePolicy(req.Context())
+	cookies.Clear(w, "alert_level")
+	cookies.Clear(w, "alert_message")
 }
 
 func getAlert(req *http.Request) *Alert {
@@ -107,23 +111,16 @@ func getAlert(req *http.Request) *Alert {
 	return alert
 }
 
+// RedirectAlert shows the alert on the page it redirects to. Clients asking
+// for JSON get the alert and the location in the body instead.
 func RedirectAlert(w http.ResponseWriter, req *http.Request, urlStr string, code int, alert Alert) {
-	persistAlert(w, alert)
-	http.Redirect(w, req, urlStr, code)
-}
-
-func getCookiesForAlert(alert Alert, expires time.Time) (*http.Cookie, *http.Cookie) {
-	lvl := &http.Cookie{
-		Name: "alert_level",
-		Value: alert.Level,
-		Expires: expires,
-		HttpOnly: true,
-	}
-	msg := &http.Cookie{
-		Name: "alert_message",
-		Value: alert.Message,
-		Expires: expires,
-		HttpOnly: true,
+	if WantsJSON(req) {
+		RenderJSON(w, alertStatus(&alert), Redirect{
+			Alert:    &alert,
+			Location: urlStr,
+		})
+		return
 	}
-	return lvl, msg
+	persistAlert(w, req, alert)
+	http.Redirect(w, req, urlStr, code)
 }
@@ -0,0 +1,143 @@
+package views
+
+import (
+	"encoding/json"
+	"gallerio/models"
+	"github.com/gorilla/csrf"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// ErrorResponse is the body of every JSON error response
+type ErrorResponse struct {
+	Error ErrorBody `json:"error"`
+}
+
+type ErrorBody struct {
+	Status  int    `json:"status"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Page is what View.Render sends to clients asking for JSON. User only
+// holds the public fields of the signed in user. CSRFToken has to be sent
+// back in the X-CSRF-Token header of unsafe requests.
+type Page struct {
+	Alert     *Alert             `json:"alert"`
+	User      *models.PublicUser `json:"user"`
+	Content   interface{}        `json:"content"`
+	CSRFToken string             `json:"csrf_token,omitempty"`
+}
+
+// JSONContent is implemented by page contents which hold models. JSON pages
+// send what JSONContent returns instead of the content, so the database
+// fields of the models aren't exposed.
+type JSONContent interface {
+	JSONContent() interface{}
+}
+
+// Redirect is what RedirectAlert sends to clients asking for JSON
+type Redirect struct {
+	Alert    *Alert `json:"alert"`
+	Location string `json:"location"`
+}
+
+// WantsJSON reports whether the response to the request should be JSON,
+// which is the case for the API and for clients asking for it.
+func WantsJSON(req *http.Request) bool {
+	return strings.HasPrefix(req.URL.Path, "/api/") ||
+		strings.Contains(req.Header.Get("Accept"), "application/json")
+}
+
+func RenderJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	if v == nil {
+		return
+	}
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("encoding JSON response failed", "err", err)
+	}
+}
+
+func RenderJSONError(w http.ResponseWriter, status int, code, message string) {
+	RenderJSON(w, status, ErrorResponse{
+		Error: ErrorBody{
+			Status:  status,
+			Code:    code,
+			Message: message,
+		},
+	})
+}
+
+// Error replies with the message and status code, as a JSON error for
+// clients asking for JSON and as plain text otherwise.
+func Error(w http.ResponseWriter, req *http.Request, message string, status int) {
+	if WantsJSON(req) {
+		RenderJSONError(w, status, errorCode(status), message)
+		return
+	}
+	http.Error(w, message, status)
+}
+
+func renderPage(w http.ResponseWriter, req *http.Request, data Data) {
+	page := Page{
+		Alert:     data.Alert,
+		Content:   jsonContent(data.Content),
+		CSRFToken: csrf.Token(req),
+	}
+	if user, ok := data.User.(*models.User); ok && user != nil {
+		public := user.Public()
+		page.User = &public
+	}
+	status := data.Status
+	if status == 0 {
+		status = alertStatus(data.Alert)
+	}
+	RenderJSON(w, status, page)
+}
+
+// jsonContent converts the models pages are rendered with directly to
+// their public fields
+func jsonContent(content interface{}) interface{} {
+	switch c := content.(type) {
+	case JSONContent:
+		return c.JSONContent()
+	case *models.User:
+		if c == nil {
+			return nil
+		}
+		return c.Public()
+	case *models.Gallery:
+		if c == nil {
+			return nil
+		}
+		return c.Public()
+	case []models.Gallery:
+		galleries := make([]models.PublicGallery, len(c))
+		for i := range c {
+			galleries[i] = c[i].Public()
+		}
+		return galleries
+	}
+	return content
+}
+
+// alertStatus is the status of a JSON page with the alert. Pages report
+// invalid input with an error alert; the generic message hides a failure
+// on our side.
+func alertStatus(alert *Alert) int {
+	if alert == nil || alert.Level != AlertLevelError {
+		return http.StatusOK
+	}
+	if alert.Message == AlertMessageGeneric {
+		return http.StatusInternalServerError
+	}
+	return http.StatusUnprocessableEntity
+}
+
+// errorCode turns a status into a code such as "not_found"
+func errorCode(status int) string {
+	return strings.ReplaceAll(strings.ToLower(http.StatusText(status)), " ", "_")
+}
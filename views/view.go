@@ -7,7 +7,7 @@ import (
 	"github.com/gorilla/csrf"
 	"html/template"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"path/filepath"
 )
@@ -26,6 +26,9 @@ func NewView(layout string, files ...string) *View {
 		"csrfField": func() (template.HTML, error) {
 			return "", errors.New("csrfField is not implemented properly")
 		},
+		"cspNonce": func() (string, error) {
+			return "", errors.New("cspNonce is not implemented properly")
+		},
 	}).ParseFiles(files...)
 	if err != nil {
 		panic(err)
@@ -58,22 +61,38 @@ func (v *View) Render(w http.ResponseWriter, req *http.Request, data interface{}
 
 	if alert := getAlert(req); alert != nil {
 		_data.Alert = alert
-		clearAlert(w)
+		clearAlert(w, req)
 	}
 	_data.User = context.User(req.Context())
+	// The same URL serves HTML and JSON
+	w.Header().Add("Vary", "Accept")
+	if WantsJSON(req) {
+		renderPage(w, req, _data)
+		return
+	}
 	csrfField := csrf.TemplateField(req)
+	// Inline scripts and styles need the nonce to run under the CSP
+	nonce := context.CSPNonce(req.Context())
 	tpl := v.Template.Funcs(template.FuncMap{
 		"csrfField": func() template.HTML {
 			return csrfField
 		},
+		"cspNonce": func() string {
+			return nonce
+		},
 	})
 	
 	var buff bytes.Buffer
 	if err := tpl.ExecuteTemplate(&buff, v.Layout, _data); err != nil {
-		log.Println(err)
-		http.Error(w, AlertMessageGeneric, http.StatusInternalServerError)
+		slog.ErrorContext(req.Context(), "rendering template failed", "layout", v.Layout, "err", err)
+		Error(w, req, AlertMessageGeneric, http.StatusInternalServerError)
 		return
 	}
+	if _data.Status != 0 {
+		// The content type can't be sniffed once the header is written
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(_data.Status)
+	}
 	io.Copy(w, &buff)
 }
 